@@ -11,9 +11,11 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -71,35 +73,62 @@ type pseudoOpData struct {
 const hiBitTerm = 1 << 16
 
 var pseudoOps = map[string]pseudoOpData{
-	".ar":      {fn: (*assembler).parseArch},
-	".arch":    {fn: (*assembler).parseArch},
-	"arch":     {fn: (*assembler).parseArch},
-	".bin":     {fn: (*assembler).parseBinaryInclude},
-	".binary":  {fn: (*assembler).parseBinaryInclude},
-	".eq":      {fn: (*assembler).parseEquate},
-	".equ":     {fn: (*assembler).parseEquate},
-	"equ":      {fn: (*assembler).parseEquate},
-	"=":        {fn: (*assembler).parseEquate},
-	".or":      {fn: (*assembler).parseOrigin},
-	".org":     {fn: (*assembler).parseOrigin},
-	"org":      {fn: (*assembler).parseOrigin},
-	".db":      {fn: (*assembler).parseData, param: 1},
-	".byte":    {fn: (*assembler).parseData, param: 1},
-	".dw":      {fn: (*assembler).parseData, param: 2},
-	".word":    {fn: (*assembler).parseData, param: 2},
-	".dd":      {fn: (*assembler).parseData, param: 4},
-	".dword":   {fn: (*assembler).parseData, param: 4},
-	".dh":      {fn: (*assembler).parseHexString},
-	".hex":     {fn: (*assembler).parseHexString},
-	"hex":      {fn: (*assembler).parseHexString},
-	".ds":      {fn: (*assembler).parseData, param: 1 | hiBitTerm},
-	".tstring": {fn: (*assembler).parseData, param: 1 | hiBitTerm},
-	".al":      {fn: (*assembler).parseAlign},
-	".align":   {fn: (*assembler).parseAlign},
-	".pad":     {fn: (*assembler).parsePadding},
-	".ex":      {fn: (*assembler).parseExport},
-	".export":  {fn: (*assembler).parseExport},
-	"exp":      {fn: (*assembler).parseExport},
+	".ar":        {fn: (*assembler).parseArch},
+	".arch":      {fn: (*assembler).parseArch},
+	"arch":       {fn: (*assembler).parseArch},
+	".bin":       {fn: (*assembler).parseBinaryInclude},
+	".binary":    {fn: (*assembler).parseBinaryInclude},
+	".eq":        {fn: (*assembler).parseEquate},
+	".equ":       {fn: (*assembler).parseEquate},
+	"equ":        {fn: (*assembler).parseEquate},
+	"=":          {fn: (*assembler).parseEquate},
+	".entry":     {fn: (*assembler).parseEntry},
+	".text":      {fn: (*assembler).parseSection, param: SectionText},
+	".data":      {fn: (*assembler).parseSection, param: SectionData},
+	".bss":       {fn: (*assembler).parseSection, param: SectionBSS},
+	".global":    {fn: (*assembler).parseLinkage, param: false},
+	".globl":     {fn: (*assembler).parseLinkage, param: false},
+	".extern":    {fn: (*assembler).parseLinkage, param: true},
+	".or":        {fn: (*assembler).parseOrigin},
+	".org":       {fn: (*assembler).parseOrigin},
+	"org":        {fn: (*assembler).parseOrigin},
+	".db":        {fn: (*assembler).parseData, param: 1},
+	".byte":      {fn: (*assembler).parseData, param: 1},
+	".dw":        {fn: (*assembler).parseData, param: 2},
+	".word":      {fn: (*assembler).parseData, param: 2},
+	".dd":        {fn: (*assembler).parseData, param: 4},
+	".dword":     {fn: (*assembler).parseData, param: 4},
+	".dh":        {fn: (*assembler).parseHexString},
+	".hex":       {fn: (*assembler).parseHexString},
+	"hex":        {fn: (*assembler).parseHexString},
+	".ds":        {fn: (*assembler).parseData, param: 1 | hiBitTerm},
+	".tstring":   {fn: (*assembler).parseData, param: 1 | hiBitTerm},
+	".al":        {fn: (*assembler).parseAlign},
+	".align":     {fn: (*assembler).parseAlign},
+	".pad":       {fn: (*assembler).parsePadding},
+	".ex":        {fn: (*assembler).parseExport},
+	".export":    {fn: (*assembler).parseExport},
+	"exp":        {fn: (*assembler).parseExport},
+	".endm":      {fn: (*assembler).parseEndMacro},
+	".endmacro":  {fn: (*assembler).parseEndMacro},
+	"endm":       {fn: (*assembler).parseEndMacro},
+	".if":        {fn: (*assembler).parseIf, param: "if"},
+	".ifdef":     {fn: (*assembler).parseIf, param: "ifdef"},
+	".ifndef":    {fn: (*assembler).parseIf, param: "ifndef"},
+	".elseif":    {fn: (*assembler).parseElseIf},
+	".elif":      {fn: (*assembler).parseElseIf},
+	".else":      {fn: (*assembler).parseElse},
+	".endif":     {fn: (*assembler).parseEndIf},
+	".endstruct": {fn: (*assembler).parseEndLayout, param: ".struct"},
+	".ends":      {fn: (*assembler).parseEndLayout, param: ".struct"},
+	".endenum":   {fn: (*assembler).parseEndLayout, param: ".enum"},
+	".ende":      {fn: (*assembler).parseEndLayout, param: ".enum"},
+	".fill":      {fn: (*assembler).parseFill},
+	".endr":      {fn: (*assembler).parseEndRepeat},
+	".endrepeat": {fn: (*assembler).parseEndRepeat},
+	".once":      {fn: (*assembler).parseOnce},
+	".test":      {fn: (*assembler).parseTest},
+	".expect":    {fn: (*assembler).parseExpect},
 }
 
 func init() {
@@ -108,6 +137,16 @@ func init() {
 	pseudoOps[".in"] = pseudoOpData{fn: (*assembler).parseInclude}
 	pseudoOps[".include"] = pseudoOpData{fn: (*assembler).parseInclude}
 	pseudoOps["include"] = pseudoOpData{fn: (*assembler).parseInclude}
+
+	// Likewise .macro, which checks macro names against the pseudo-ops.
+	pseudoOps[".macro"] = pseudoOpData{fn: (*assembler).parseMacro}
+	pseudoOps["macro"] = pseudoOpData{fn: (*assembler).parseMacro}
+
+	// And the block pseudo-ops, whose bodies are parsed as they are read.
+	pseudoOps[".struct"] = pseudoOpData{fn: (*assembler).parseLayout, param: false}
+	pseudoOps[".enum"] = pseudoOpData{fn: (*assembler).parseLayout, param: true}
+	pseudoOps[".repeat"] = pseudoOpData{fn: (*assembler).parseRepeat}
+	pseudoOps[".rept"] = pseudoOpData{fn: (*assembler).parseRepeat}
 }
 
 // A segment is a small chunk of machine code that may represent a single
@@ -125,6 +164,8 @@ type instruction struct {
 	opcode    fstring          // opcode string
 	inst      *cpu.Instruction // selected instruction data for the opcode
 	operand   operand          // parameter data for the instruction
+	reg       int              // register or line number selecting the opcode, or -1
+	code      []byte           // generated machine code
 }
 
 func (i *instruction) address() int {
@@ -159,7 +200,14 @@ func (i *instruction) operandString() string {
 		n = fmt.Sprintf("%04X", number)
 	}
 
-	return fmt.Sprintf(modeFormat[i.inst.Mode], n)
+	s := fmt.Sprintf(modeFormat[i.inst.Mode], n)
+	switch {
+	case i.reg >= 0 && i.inst.Operands == cpu.RegOpcode:
+		s = strings.TrimSuffix(fmt.Sprintf("R%d, %s", i.reg, s), ", ")
+	case i.reg >= 0:
+		s = strings.TrimSuffix(fmt.Sprintf("%d, %s", i.reg, s), ", ")
+	}
+	return s
 }
 
 // An operand represents the parameter(s) of an assembly instruction.
@@ -205,6 +253,7 @@ type data struct {
 	unit      int     // unit size (1 or 2 bytes)
 	hiBitTerm bool    // terminate last char of string by setting hi bit
 	exprs     []*expr // all expressions in the data segment
+	line      fstring // the data directive
 }
 
 func (d *data) address() int {
@@ -227,6 +276,7 @@ func (d *data) bytes() int {
 type bytedata struct {
 	addr int
 	b    []byte
+	line fstring // the directive, or empty for the end of the file
 }
 
 func (b *bytedata) address() int {
@@ -238,6 +288,7 @@ type alignment struct {
 	addr  int
 	align int
 	pad   int
+	line  fstring // the .align directive
 }
 
 func (a *alignment) address() int {
@@ -251,12 +302,45 @@ type padding struct {
 	value   byte
 	valExpr *expr
 	lenExpr *expr
+	line    fstring // the padding directive
 }
 
 func (p *padding) address() int {
 	return p.addr
 }
 
+// An origin segment starts a new block of code at the address given by an
+// ".org" directive.
+type origin struct {
+	addr   int
+	flags  byte    // SegmentROM, SegmentRAM and SegmentExec
+	line   fstring // the .org directive
+	beyond fstring // the line whose code first passes $FFFF, if any
+}
+
+func (o *origin) address() int {
+	return o.addr
+}
+
+// Return the line that produced a segment.
+func segmentLine(s segment) fstring {
+	switch ss := s.(type) {
+	case *instruction:
+		return ss.opcode
+	case *data:
+		return ss.line
+	case *bytedata:
+		return ss.line
+	case *alignment:
+		return ss.line
+	case *padding:
+		return ss.line
+	case *origin:
+		return ss.line
+	}
+	return fstring{}
+}
+
 // An export segment contains an exported address.
 type export struct {
 	addr int
@@ -267,11 +351,12 @@ func (e *export) address() int {
 	return e.addr
 }
 
-// An asmerror is used to keep track of errors encountered
+// An asmerror is used to keep track of errors and warnings encountered
 // during assembly.
 type asmerror struct {
 	line fstring // line causing the error
 	msg  string  // error message
+	code string  // diagnostic code, such as a warning ID
 }
 
 // An unevaluated expression
@@ -283,24 +368,55 @@ type uneval struct {
 // The assembler is a state object used during the assembly of
 // machine code from assembly code.
 type assembler struct {
-	arch        cpu.Architecture    // requested architecture
-	instSet     *cpu.InstructionSet // instructions on current arch
-	origin      int                 // requested origin
-	pc          int                 // the program counter
-	code        []byte              // generated machine code
-	r           io.Reader           // the reader passed to Assemble
-	scopeLabel  fstring             // label currently in scope
-	constants   map[string]*expr    // constant -> expression
-	labels      map[string]int      // label -> segment index
-	exports     []Export            // exported addresses
-	sourceLines []SourceLine        // source code line mappings
-	files       []string            // processed files
-	segments    []segment           // segment of machine code
-	unevaluated []uneval            // expressions requiring evaluation
-	out         io.Writer           // output used for verbose output
-	verbose     bool                // verbose output
-	exprParser  exprParser          // used to parse math expressions
-	errors      []asmerror          // errors encountered during assembly
+	arch         cpu.Architecture        // requested architecture
+	instSet      *cpu.InstructionSet     // instructions on current arch
+	origin       int                     // requested origin
+	pc           int                     // the program counter
+	code         []byte                  // generated machine code
+	r            io.Reader               // the reader passed to Assemble
+	scopeLabel   fstring                 // label currently in scope
+	constants    map[string]*expr        // constant -> expression
+	labels       map[string]int          // label -> segment index
+	exports      []Export                // exported addresses
+	sourceLines  []SourceLine            // source code line mappings
+	files        []string                // processed files
+	segments     []segment               // segment of machine code
+	unevaluated  []uneval                // expressions requiring evaluation
+	out          io.Writer               // output used for verbose output
+	verbose      bool                    // verbose output
+	exprParser   exprParser              // used to parse math expressions
+	errors       []asmerror              // errors encountered during assembly
+	tests        []*testcase             // unit tests declared with .test
+	macros       map[string]*macro       // macro name -> definition
+	defining     *macro                  // macro whose body is being collected
+	expansions   int                     // number of macro expansions so far
+	repeating    *repeat                 // .repeat block whose body is being collected
+	layout       *layout                 // .struct or .enum block being parsed
+	structs      map[string]*structDef   // structure name -> declaration
+	declared     map[string]bool         // constants declared by .struct and .enum
+	conds        []cond                  // open conditional assembly blocks
+	list         bool                    // produce a listing
+	listing      []listEntry             // lines recorded for the listing
+	includeDepth int                     // nesting depth of included files
+	includeDirs  []string                // directories searched for included files
+	fsys         fs.FS                   // file system holding the source, or nil for the OS
+	includeStack []string                // absolute paths of the files being parsed
+	once         map[string]bool         // absolute paths of files marked with .once
+	deps         []string                // files included with .include or .bin
+	symbolDefs   map[string]fstring      // symbol -> line defining it
+	entry        *expr                   // entry point set by .entry
+	entryAddr    int                     // resolved entry point
+	blocks       []Block                 // contiguous blocks of generated code
+	object       bool                    // assembling a relocatable object
+	sectionCode  [][]byte                // code of each object section
+	globals      []fstring               // symbols declared with .global
+	externs      []fstring               // symbols declared with .extern
+	relocs       []Relocation            // relocations for the object
+	obj          *Object                 // the assembled object
+	warnLevels   map[string]WarningLevel // warning ID -> level
+	warnings     []asmerror              // warnings reported during assembly
+	errorCode    string                  // diagnostic code for errors in the current step
+	failed       map[string]bool         // symbols whose definitions had errors
 }
 
 // An Export describes an exported address.
@@ -312,8 +428,17 @@ type Export struct {
 // Assembly contains the assembled machine code and other data associated with
 // the machine code.
 type Assembly struct {
-	Code   []byte   // Assembled machine code
-	Errors []string // Errors encountered during assembly
+	Origin      uint16       // Address of the first byte of machine code
+	Code        []byte       // Assembled machine code, with gaps between blocks zero-filled
+	Blocks      []Block      // Blocks of machine code, one per .org directive
+	Entry       uint16       // Entry point address
+	Object      *Object      // Relocatable object, with the Relocatable option
+	Errors      []string     // Errors encountered during assembly
+	Warnings    []string     // Warnings reported during assembly
+	Diagnostics []Diagnostic // Errors and warnings, with their positions, for tools
+	Tests       []TestCase   // Unit tests declared in the source
+	Listing     []byte       // Assembly listing, if requested with the Listing option
+	Includes    []string     // Files included with .include or .bin, in the order first seen
 }
 
 // ReadFrom reads machine code from a binary input source.
@@ -338,119 +463,287 @@ type Option uint
 
 // Options for the Assemble function.
 const (
-	Verbose Option = 1 << iota // verbose output during assembly
+	Verbose         Option = 1 << iota // verbose output during assembly
+	Listing                            // produce an assembly listing
+	IntelHex                           // also write an Intel HEX (.hex) file
+	SRecord                            // also write a Motorola S-record (.s19) file
+	WriteExecutable                    // also write a CPU1 executable (.cx1) file
+	Relocatable                        // produce a relocatable object (.obj) instead of code
+	DiagnosticsJSON                    // report errors and warnings as JSON instead of text
+	Dependencies                       // also write a Makefile dependency (.d) file
 )
 
+// A Setting adjusts the assembler before assembly begins. Define and
+// WarningFlag are settings.
+type Setting interface {
+	apply(a *assembler)
+}
+
 const defaultOrigin = 0x1000
 
 // AssembleFile reads a file containing 6502 assembly code, assembles it,
-// and produces a binary output file and a source map file.
-func AssembleFile(path string, options Option, out io.Writer) error {
+// and produces a binary output file and a source map file. Any defines in
+// the settings are visible to the source as constants.
+func AssembleFile(path string, options Option, out io.Writer, settings ...Setting) error {
+	_, err := BuildFile(path, options, out, settings...)
+	return err
+}
+
+// BuildFile is AssembleFile, also returning the assembly, whose Includes
+// list the files the source depends on.
+func BuildFile(path string, options Option, out io.Writer, settings ...Setting) (*Assembly, error) {
 	inFile, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer inFile.Close()
 
-	assembly, sourceMap, err := Assemble(inFile, path, defaultOrigin, out, options)
+	// JSON diagnostics are the only output, so that tools can parse it.
+	diagOut := out
+	if options&DiagnosticsJSON != 0 {
+		out = io.Discard
+	}
+
+	assembly, sourceMap, err := Assemble(inFile, path, defaultOrigin, out, options, settings...)
+	if options&DiagnosticsJSON != 0 {
+		if jerr := WriteDiagnosticsJSON(diagOut, assembly.Diagnostics); jerr != nil {
+			return assembly, jerr
+		}
+	}
+	for _, w := range assembly.Warnings {
+		fmt.Fprintln(out, w)
+	}
 	if err != nil {
 		for _, e := range assembly.Errors {
 			fmt.Fprintln(out, e)
 		}
-		return err
+		return assembly, err
 	}
 
 	ext := filepath.Ext(path)
 	prefix := path[:len(path)-len(ext)]
+	var outputs []string // files written, for the dependency file
+
+	if assembly.Listing != nil {
+		lstPath := prefix + ".lst"
+		err = os.WriteFile(lstPath, assembly.Listing, 0600)
+		if err != nil {
+			return assembly, err
+		}
+		fmt.Fprintf(out, "Wrote listing to '%s'.\n", filepath.Base(lstPath))
+		outputs = append(outputs, lstPath)
+	}
+
+	if assembly.Object != nil {
+		objPath := prefix + ".obj"
+		err = writeImageFile(objPath, func(w io.Writer) error {
+			_, err := assembly.Object.WriteTo(w)
+			return err
+		})
+		if err != nil {
+			return assembly, err
+		}
+		outputs = append(outputs, objPath)
+		if err := writeDependencyFile(prefix, path, outputs, assembly, options, out); err != nil {
+			return assembly, err
+		}
+		fmt.Fprintf(out, "Assembled '%s' to produce '%s'.\n", filepath.Base(path), filepath.Base(objPath))
+		return assembly, nil
+	}
+
 	binPath := prefix + ".bin"
 	binFile, err := os.OpenFile(binPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return err
+		return assembly, err
 	}
 	defer binFile.Close()
 
 	_, err = assembly.WriteTo(binFile)
 	if err != nil {
-		return err
+		return assembly, err
+	}
+	outputs = append(outputs, binPath)
+
+	if options&WriteExecutable != 0 {
+		exePath := prefix + ".cx1"
+		err = writeImageFile(exePath, func(w io.Writer) error {
+			_, err := assembly.Executable(sourceMap.Exports).WriteTo(w)
+			return err
+		})
+		if err != nil {
+			return assembly, err
+		}
+		fmt.Fprintf(out, "Wrote executable to '%s'.\n", filepath.Base(exePath))
+		outputs = append(outputs, exePath)
+	}
+
+	if options&IntelHex != 0 {
+		hexPath := prefix + ".hex"
+		err = writeImageFile(hexPath, func(w io.Writer) error {
+			return WriteIntelHex(w, assembly.Image())
+		})
+		if err != nil {
+			return assembly, err
+		}
+		fmt.Fprintf(out, "Wrote Intel HEX to '%s'.\n", filepath.Base(hexPath))
+		outputs = append(outputs, hexPath)
+	}
+
+	if options&SRecord != 0 {
+		srecPath := prefix + ".s19"
+		err = writeImageFile(srecPath, func(w io.Writer) error {
+			return WriteSRecord(w, assembly.Image(), filepath.Base(prefix))
+		})
+		if err != nil {
+			return assembly, err
+		}
+		fmt.Fprintf(out, "Wrote S-records to '%s'.\n", filepath.Base(srecPath))
+		outputs = append(outputs, srecPath)
 	}
 
 	mapPath := prefix + ".map"
 	mapFile, err := os.OpenFile(mapPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return err
+		return assembly, err
 	}
 	defer mapFile.Close()
 
 	_, err = sourceMap.WriteTo(mapFile)
 	if err != nil {
-		return err
+		return assembly, err
+	}
+	outputs = append(outputs, mapPath)
+
+	if err := writeDependencyFile(prefix, path, outputs, assembly, options, out); err != nil {
+		return assembly, err
 	}
 
 	fmt.Fprintf(out, "Assembled '%s' to produce '%s' and '%s'.\n",
 		filepath.Base(path),
 		filepath.Base(binPath),
 		filepath.Base(mapPath))
-	return nil
+	return assembly, nil
 }
 
 // Assemble reads data from the provided stream and attempts to assemble it
-// into CPU1 byte code.
-func Assemble(r io.Reader, filename string, origin uint16, out io.Writer, options Option) (*Assembly, *SourceMap, error) {
+// into CPU1 byte code. Any defines in the settings are visible to the
+// source as constants, and warning flags set the level of each warning.
+func Assemble(r io.Reader, filename string, origin uint16, out io.Writer, options Option, settings ...Setting) (*Assembly, *SourceMap, error) {
+	return newAssembler(r, filename, origin, out, options, settings...).run()
+}
+
+// Create an assembler for a source stream.
+func newAssembler(r io.Reader, filename string, origin uint16, out io.Writer, options Option, settings ...Setting) *assembler {
 	if out == nil {
 		out = os.Stdout
 	}
 
 	a := &assembler{
-		arch:      cpu.NMOS,
-		instSet:   cpu.GetInstructionSet(cpu.NMOS),
-		origin:    int(origin),
-		pc:        -1,
-		r:         r,
-		constants: make(map[string]*expr),
-		labels:    make(map[string]int),
-		files:     []string{filename},
-		exports:   make([]Export, 0),
-		segments:  make([]segment, 0, 32),
-		out:       out,
+		arch:       cpu.NMOS,
+		instSet:    cpu.GetInstructionSet(cpu.NMOS),
+		origin:     int(origin),
+		pc:         -1,
+		r:          r,
+		constants:  make(map[string]*expr),
+		labels:     make(map[string]int),
+		macros:     make(map[string]*macro),
+		structs:    make(map[string]*structDef),
+		declared:   make(map[string]bool),
+		symbolDefs: make(map[string]fstring),
+		warnLevels: make(map[string]WarningLevel),
+		failed:     make(map[string]bool),
+		once:       make(map[string]bool),
+		list:       (options & Listing) != 0,
+		object:     (options & Relocatable) != 0,
+		files:      []string{filename},
+		exports:    make([]Export, 0),
+		segments:   make([]segment, 0, 32),
+		out:        out,
 		//verbose:   (options & Verbose) != 0,	// restore after debugging
 		verbose: true, // remove after debugging
 	}
-
-	// Assembly consists of the following steps
-	steps := []func(a *assembler) error{
-		(*assembler).parse,                        // Parse the assembly code
-		(*assembler).evaluateExpressions,          // Evaluate operand & constant expressions
-		(*assembler).assignAddresses,              // Assign addresses to instructions
-		(*assembler).resolveLabels,                // Resolve labels to addresses
-		(*assembler).evaluateExpressions,          // Do another evaluation pass with resolved labels
-		(*assembler).handleUnevaluatedExpressions, // Cause error if there are unevaluated expressions
-		(*assembler).generateCode,                 // Generate the machine code
-	}
-
-	// Execute assembler steps, breaking if an error is encountered
-	// in any one of them.
+	a.exprParser.sizeOf = a.labelSize
+	a.exprParser.defined = a.symbolDefined
+	for id, level := range defaultWarningLevels {
+		a.warnLevels[id] = level
+	}
+	for _, setting := range settings {
+		setting.apply(a)
+	}
+	if a.object {
+		a.origin = sectionBase(SectionText)
+		a.sectionCode = make([][]byte, len(SectionNames))
+	}
+	return a
+}
+
+// Run each step of the assembly.
+func (a *assembler) run() (*Assembly, *SourceMap, error) {
+	// Assembly consists of the following steps. Errors found by the steps
+	// up to the resolution of expressions don't stop assembly, so that one
+	// run reports every independent error. Code is only generated for a
+	// program without errors.
+	steps := []struct {
+		fn      func(a *assembler) error
+		code    string // diagnostic code of errors found by the step
+		recover bool   // continue with the next step after errors
+	}{
+		{(*assembler).parse, "syntax", true},                             // Parse the assembly code
+		{(*assembler).evaluateExpressions, "expression", true},           // Evaluate operand & constant expressions
+		{(*assembler).assignAddresses, "address", true},                  // Assign addresses to instructions
+		{(*assembler).resolveLabels, "label", true},                      // Resolve labels to addresses
+		{(*assembler).evaluateExpressions, "expression", true},           // Do another evaluation pass with resolved labels
+		{(*assembler).handleUnevaluatedExpressions, "unresolved", false}, // Cause error if there are unevaluated expressions
+		{(*assembler).generateCode, "code", false},                       // Generate the machine code
+		{(*assembler).lint, "lint", false},                               // Check for likely mistakes
+		{(*assembler).generateTests, "test", false},                      // Finish unit test declarations
+	}
+
+	// Execute assembler steps, breaking if an error is encountered in
+	// any one of them that can't recover.
 	var err error
 	for _, step := range steps {
-		err = step(a)
-		if err != nil {
+		a.errorCode = step.code
+		err = step.fn(a)
+		if err != nil && (err != errParse || !step.recover) {
 			break
 		}
-		if len(a.errors) > 0 {
+		if len(a.errors) > 0 && !step.recover {
 			err = errParse
 			break
 		}
 	}
 
+	var diags []Diagnostic
 	errors := make([]string, 0, len(a.errors))
 	for _, e := range a.errors {
-		filename := a.files[e.line.fileIndex]
-		s := fmt.Sprintf("Syntax error in '%s' line %d, col %d: %s", filename, e.line.row, e.line.column+1, e.msg)
-		errors = append(errors, s)
+		d := a.diagnostic(e, SeverityError)
+		diags = append(diags, d)
+		errors = append(errors, d.String())
+	}
+	warnings := make([]string, 0, len(a.warnings))
+	for _, w := range a.warnings {
+		d := a.diagnostic(w, SeverityWarning)
+		diags = append(diags, d)
+		warnings = append(warnings, d.String())
 	}
 
 	assembly := &Assembly{
-		Code:   a.code,
-		Errors: errors,
+		Origin:      uint16(a.origin),
+		Code:        a.code,
+		Blocks:      a.blocks,
+		Entry:       uint16(a.entryAddr),
+		Object:      a.obj,
+		Errors:      errors,
+		Warnings:    warnings,
+		Diagnostics: diags,
+		Includes:    a.deps,
+	}
+	for _, t := range a.tests {
+		assembly.Tests = append(assembly.Tests, t.TestCase)
+	}
+	if a.list && err == nil {
+		assembly.Listing = a.listingBytes()
 	}
 
 	sourceMap := &SourceMap{
@@ -460,22 +753,58 @@ func Assemble(r io.Reader, filename string, origin uint16, out io.Writer, option
 		Files:   a.files,
 		Lines:   a.sourceLines,
 		Exports: a.exports,
+		Labels:  a.addressLabels(),
 	}
 
 	return assembly, sourceMap, err
 }
 
+// Return every label with a known address, sorted by address, for the
+// source map. Local labels are qualified by their scope, as in "LOOP.next".
+func (a *assembler) addressLabels() []Export {
+	labels := []Export{}
+	if a.object {
+		return labels
+	}
+	for name, seg := range a.labels {
+		if addr := a.segaddr(seg); addr >= 0 {
+			labels = append(labels, Export{Label: strings.TrimPrefix(name, "~"), Address: uint16(addr)})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Address != labels[j].Address {
+			return labels[i].Address < labels[j].Address
+		}
+		return labels[i].Label < labels[j].Label
+	})
+	return labels
+}
+
 // Read the assembly code and perform the initial parsing. Build up
 // machine code segments, the constants table, the label table, and a
 // list of unevaluated expression trees.
 func (a *assembler) parse() error {
 	a.logSection("Parsing assembly code")
 
+	a.includeStack = append(a.includeStack, a.canonicalPath(a.files[0]))
 	err := a.parseFile(bufio.NewScanner(a.r), 0)
 	if err != nil {
 		return err
 	}
 
+	if a.defining != nil {
+		a.addError(a.defining.def, "macro '%s' is missing .endm", a.defining.name)
+	}
+	if a.repeating != nil {
+		a.addError(a.repeating.block.def, ".repeat is missing .endr")
+	}
+	if a.layout != nil {
+		a.addError(a.layout.def, "'%s' is missing its end", a.layout.name)
+	}
+	if len(a.conds) > 0 {
+		a.addError(a.conds[len(a.conds)-1].line, ".if is missing .endif")
+	}
+
 	// Add an empty byte-data segment to the end of the file, just so the
 	// end of the file can be assigned an address and any labels attached
 	// to the end of the file will be valid.
@@ -487,14 +816,15 @@ func (a *assembler) parse() error {
 
 // Parse a single file. This may be called to parse the original file
 // passed to the assembler, or it may be called in response to including
-// a file.
+// a file. A line with a syntax error is skipped after the error is
+// recorded, so that the rest of the file is still checked.
 func (a *assembler) parseFile(scanner *bufio.Scanner, fileIndex int) error {
 	row := 1
 	for scanner.Scan() {
 		text := scanner.Text()
 		line := newFstring(fileIndex, row, text)
 		err := a.parseLine(line.stripTrailingComment())
-		if err != nil {
+		if err != nil && err != errParse {
 			return err
 		}
 		row++
@@ -541,6 +871,14 @@ func (a *assembler) evaluateExpressions() error {
 func (a *assembler) assignAddresses() error {
 	a.logSection("Assigning addresses")
 	a.pc = a.origin
+
+	// Each object section has its own program counter.
+	pcs := make([]int, len(SectionNames))
+	for i := range pcs {
+		pcs[i] = sectionBase(i)
+	}
+	cur := SectionText
+
 	for _, s := range a.segments {
 		switch ss := s.(type) {
 		case *instruction:
@@ -548,7 +886,10 @@ func (a *assembler) assignAddresses() error {
 			ss.inst = a.findMatchingInstruction(ss.opcode, ss.operand)
 			if ss.inst == nil {
 				a.addError(ss.opcode, "invalid addressing mode for opcode '%s'", ss.opcode.str)
-				return errParse
+				continue
+			}
+			if ss.reg >= 0 {
+				ss.inst = a.instSet.Lookup(ss.inst.Opcode&^7 | byte(ss.reg))
 			}
 
 			l := SourceLine{
@@ -587,11 +928,11 @@ func (a *assembler) assignAddresses() error {
 				a.evaluateExpressions()
 				if !ss.valExpr.evaluated {
 					a.addError(ss.valExpr.line, "padding value expression could not be evaluated")
-					return errParse
+					continue
 				}
 				if !ss.lenExpr.evaluated {
 					a.addError(ss.lenExpr.line, "padding length expression could not be evaluated")
-					return errParse
+					continue
 				}
 			}
 			ss.value = byte(ss.valExpr.value)
@@ -601,6 +942,16 @@ func (a *assembler) assignAddresses() error {
 
 		case *export:
 			ss.addr = a.pc
+
+		case *origin:
+			a.pc = ss.addr
+			a.log("%04X  .ORG", ss.addr)
+
+		case *section:
+			ss.addr = a.pc
+			pcs[cur], cur = a.pc, ss.index
+			a.pc = pcs[cur]
+			a.log("%04X  %s", a.pc, SectionNames[cur])
 		}
 	}
 
@@ -624,24 +975,47 @@ func (a *assembler) resolveLabels() error {
 	return nil
 }
 
-// Cause an error if there are any unevaluated expressions.
+// Cause an error if there are any unevaluated expressions. Expressions
+// that depend on a symbol whose definition had an error are skipped, since
+// that error has already been reported.
 func (a *assembler) handleUnevaluatedExpressions() error {
-	if len(a.unevaluated) > 0 {
-		for _, u := range a.unevaluated {
+	// Constants defined in terms of failed symbols fail too.
+	for changed := true; changed; {
+		changed = false
+		for name, e := range a.constants {
+			if !e.evaluated && !a.failed[name] && e.uses(a.failed) {
+				a.failed[name] = true
+				changed = true
+			}
+		}
+	}
+
+	for _, u := range a.unevaluated {
+		if !u.expr.uses(a.failed) {
 			a.addError(u.expr.line, "unresolved expression")
 		}
+	}
+	if len(a.unevaluated) > 0 {
 		return errParse
 	}
-
 	return nil
 }
 
 // Generate machine code.
 func (a *assembler) generateCode() error {
 	a.logSection("Generating code")
+
+	// Each origin starts a new block. Track where each block's code starts.
+	origins := []*origin{{addr: a.origin, flags: defaultSegmentFlags}}
+	starts := []int{0}
+
+	// In an object, code goes to the current section.
+	cur := SectionText
+
 	for _, s := range a.segments {
 		switch ss := s.(type) {
 		case *instruction:
+			start := len(a.code)
 			a.code = append(a.code, ss.inst.Opcode)
 			switch {
 			case ss.inst.Length == 1:
@@ -654,14 +1028,17 @@ func (a *assembler) generateCode() error {
 				a.code = append(a.code, offset)
 				a.log("%04X-   %-8s    %s   %s", ss.addr, ss.codeString(), ss.opcode.str, ss.operandString())
 			case ss.inst.Length == 2:
+				a.checkRelocation(ss.opcode, ss.operand.expr, cur, len(a.code), 1)
 				a.code = append(a.code, byte(ss.operand.getValue()))
 				a.log("%04X-   %-8s    %s   %s", ss.addr, ss.codeString(), ss.opcode.str, ss.operandString())
 			case ss.inst.Length == 3:
+				a.checkRelocation(ss.opcode, ss.operand.expr, cur, len(a.code), 2)
 				a.code = append(a.code, toBytes(2, ss.operand.getValue())...)
 				a.log("%04X-   %-8s    %s   %s", ss.addr, ss.codeString(), ss.opcode.str, ss.operandString())
 			default:
 				panic("invalid operand")
 			}
+			ss.code = append([]byte(nil), a.code[start:]...)
 
 		case *data:
 			start := len(a.code)
@@ -674,6 +1051,7 @@ func (a *assembler) generateCode() error {
 					}
 					a.code = append(a.code, s...)
 				default:
+					a.checkRelocation(e.line, e, cur, len(a.code), ss.unit)
 					a.code = append(a.code, toBytes(ss.unit, e.value)...)
 				}
 			}
@@ -705,14 +1083,56 @@ func (a *assembler) generateCode() error {
 				Address: uint16(ss.expr.value),
 			}
 			a.exports = append(a.exports, export)
+
+		case *origin:
+			origins = append(origins, ss)
+			starts = append(starts, len(a.code))
+
+		case *section:
+			a.sectionCode[cur], cur = a.code, ss.index
+			a.code = a.sectionCode[cur]
+		}
+
+		// Remember the line whose code first runs past $FFFF, so the
+		// error points at it rather than at the start of the block.
+		o := origins[len(origins)-1]
+		if o.beyond.isEmpty() && o.addr+len(a.code)-starts[len(starts)-1] > 0x10000 {
+			o.beyond = segmentLine(s)
 		}
 	}
 
-	return nil
+	if a.object {
+		a.sectionCode[cur], a.code = a.code, nil
+		return a.finishObject()
+	}
+
+	return a.finishBlocks(origins, starts)
 }
 
 // Parse a single line of assembly code.
 func (a *assembler) parseLine(line fstring) error {
+	a.listLine(line)
+
+	// Lines inside a macro definition are stored, not parsed.
+	if a.defining != nil {
+		return a.collectMacroLine(line)
+	}
+
+	// Lines inside a .repeat block are stored until the block ends.
+	if a.repeating != nil {
+		return a.collectRepeatLine(line)
+	}
+
+	// Lines inside a .struct or .enum block declare its fields.
+	if a.layout != nil {
+		return a.parseLayoutLine(line)
+	}
+
+	// Lines inside a false conditional block are skipped.
+	if a.skipping() {
+		return a.skipLine(line)
+	}
+
 	// Skip empty (or comment-only) lines
 	if line.isEmpty() || line.startsWithChar('*') {
 		return nil
@@ -736,6 +1156,11 @@ func (a *assembler) parseUnlabeledLine(line fstring) error {
 		return op.fn(a, line.consumeWhitespace(), fstring{}, op.param)
 	}
 
+	// Is it a macro invocation?
+	if m, ok := a.macros[strings.ToLower(word.str)]; ok {
+		return a.expandMacro(m, word, line)
+	}
+
 	return a.parseInstruction(word, line)
 }
 
@@ -752,7 +1177,11 @@ func (a *assembler) parseLabeledLine(line fstring) error {
 	// Is the next word a pseudo-op, rather than an opcode?
 	word, line := line.consumeWhile(wordChar)
 	if op, ok := pseudoOps[strings.ToLower(word.str)]; ok {
-		return op.fn(a, line.consumeWhitespace(), label, op.param)
+		err := op.fn(a, line.consumeWhitespace(), label, op.param)
+		if err != nil {
+			a.failDefinition(label)
+		}
+		return err
 	}
 
 	// Store the label.
@@ -761,6 +1190,11 @@ func (a *assembler) parseLabeledLine(line fstring) error {
 		return err
 	}
 
+	// Expand any macro following the label
+	if m, ok := a.macros[strings.ToLower(word.str)]; ok {
+		return a.expandMacro(m, word, line)
+	}
+
 	// Parse any instruction following the label
 	if !word.isEmpty() {
 		return a.parseInstruction(word, line)
@@ -768,6 +1202,21 @@ func (a *assembler) parseLabeledLine(line fstring) error {
 	return nil
 }
 
+// Remember that a symbol's definition had an error, unless the symbol was
+// defined anyway. Expressions using it are not reported as unresolved,
+// since the error has already been reported.
+func (a *assembler) failDefinition(label fstring) {
+	name := label.str
+	if label.startsWithChar('.') || label.startsWithChar('@') {
+		name = "~" + a.scopeLabel.str + name
+	}
+	_, isConst := a.constants[name]
+	_, isLabel := a.labels[name]
+	if !isConst && !isLabel {
+		a.failed[name] = true
+	}
+}
+
 // Store a label into the assembler's label list.
 func (a *assembler) storeLabel(label fstring) error {
 	// If the label starts with '.' or '@', it is a local label. So append it
@@ -786,6 +1235,7 @@ func (a *assembler) storeLabel(label fstring) error {
 	// Associate the label with its segment number.
 	segno := len(a.segments)
 	a.labels[label.str] = segno
+	a.symbolDefs[label.str] = label
 	a.logLine(label, "label=%s", label.str)
 	a.logLine(label, "seg=%d", segno)
 	return nil
@@ -869,19 +1319,27 @@ func (a *assembler) parseEquate(line, label fstring, param any) error {
 
 	// Track the constants for later substitution.
 	a.constants[label.str] = e
+	a.symbolDefs[label.str] = label
 	return nil
 }
 
 // Parse an ".ORG" origin definition
 func (a *assembler) parseOrigin(line, label fstring, param any) error {
-	if len(a.segments) > 0 {
-		a.addError(line, "origin directive must appear before first instruction")
+	a.logLine(line, "origin=")
+
+	if a.object {
+		a.addError(line, "object files are placed by the linker and can't use .org")
 		return errParse
 	}
 
-	a.logLine(line, "origin=")
+	// The address may be followed by flags: ".org $F000, ROM"
+	fields := a.splitFields(line)
+	if len(fields) == 0 {
+		a.addError(line, "origin requires an address")
+		return errParse
+	}
 
-	e, _, err := a.exprParser.parse(line, a.scopeLabel, allowParentheses)
+	e, _, err := a.exprParser.parse(fields[0], a.scopeLabel, allowParentheses)
 	if err != nil {
 		a.addExprErrors()
 		return errParse
@@ -895,7 +1353,62 @@ func (a *assembler) parseOrigin(line, label fstring, param any) error {
 	a.logLine(line, "expr=%s", e.String())
 	a.logLine(line, "val=$%04X", e.value)
 
-	a.origin = e.value
+	if e.value < 0 || e.value > 0xffff {
+		a.addError(line, "origin $%X is out of range", e.value)
+		return errParse
+	}
+
+	// Optional flags describe the memory the block is loaded into.
+	var flags byte
+	for _, f := range fields[1:] {
+		switch strings.ToUpper(f.str) {
+		case "ROM":
+			flags |= SegmentROM
+		case "RAM":
+			flags |= SegmentRAM
+		case "EXEC":
+			flags |= SegmentExec
+		default:
+			a.addError(f, "unknown segment flag '%s'", f.str)
+			return errParse
+		}
+	}
+	if flags == 0 {
+		flags = defaultSegmentFlags
+	}
+
+	// The first origin sets the address of the first block. Later ones
+	// start new blocks.
+	if len(a.segments) == 0 {
+		a.origin = e.value
+	}
+	a.segments = append(a.segments, &origin{addr: e.value, flags: flags, line: line})
+	return nil
+}
+
+// Parse an ".entry" directive, which sets the program's entry point.
+func (a *assembler) parseEntry(line, label fstring, param any) error {
+	a.logLine(line, "entry=")
+
+	if a.object {
+		a.addError(line, "the entry point of linked programs is set by the link layout")
+		return errParse
+	}
+
+	if a.entry != nil {
+		a.addError(line, "entry point defined more than once")
+		return errParse
+	}
+
+	e, _, err := a.exprParser.parse(line, a.scopeLabel, allowParentheses)
+	if err != nil {
+		a.addExprErrors()
+		return err
+	}
+	if !e.eval(-1, a.constants, a.labels) {
+		a.pushUnevaluated(e)
+	}
+	a.entry = e
 	return nil
 }
 
@@ -907,6 +1420,7 @@ func (a *assembler) parseData(line, label fstring, param any) error {
 		unit:      param.(int) & 7,
 		hiBitTerm: (param.(int) & hiBitTerm) != 0,
 		addr:      -1,
+		line:      line,
 	}
 
 	remain := line
@@ -957,7 +1471,7 @@ func (a *assembler) parseHexString(line, label fstring, param any) error {
 		return errParse
 	}
 
-	seg := &bytedata{addr: -1}
+	seg := &bytedata{addr: -1, line: line}
 
 	for i := 0; i < len(s.str); i += 2 {
 		v := hexToByte(s.str[i:])
@@ -991,7 +1505,7 @@ func (a *assembler) parseAlign(line, label fstring, param any) error {
 		return errParse
 	}
 
-	seg := &alignment{addr: -1, align: int(v)}
+	seg := &alignment{addr: -1, align: int(v), line: line}
 
 	a.segments = append(a.segments, seg)
 	return nil
@@ -1046,7 +1560,14 @@ func (a *assembler) parsePadding(line, label fstring, param any) error {
 		a.logLine(line, "len=(uneval)")
 	}
 
-	seg := &padding{addr: -1, valExpr: valExpr, lenExpr: lenExpr}
+	if !label.isEmpty() {
+		err := a.storeLabel(label)
+		if err != nil {
+			return err
+		}
+	}
+
+	seg := &padding{addr: -1, valExpr: valExpr, lenExpr: lenExpr, line: line}
 	a.segments = append(a.segments, seg)
 	return nil
 }
@@ -1080,7 +1601,9 @@ func (a *assembler) parseExport(line, label fstring, param any) error {
 	return nil
 }
 
-// Parse an include pseudo-op
+// Parse an include pseudo-op. The file is searched for in the current
+// directory, the directory of the including file and the include
+// directories, in that order.
 func (a *assembler) parseInclude(line, label fstring, param any) error {
 	a.logLine(line, "include")
 
@@ -1090,20 +1613,42 @@ func (a *assembler) parseInclude(line, label fstring, param any) error {
 		return errParse
 	}
 
-	file, err := os.Open(filename.str)
+	path, ok := a.findInclude(line, filename)
+	if !ok {
+		a.addError(filename, "unable to find '%s'", filename.str)
+		return errParse
+	}
+	canonical := a.canonicalPath(path)
+	if a.once[canonical] {
+		a.logLine(line, "skip=%s", path)
+		return nil
+	}
+	if !a.checkIncludeCycle(filename, canonical) {
+		return errParse
+	}
+
+	file, err := a.openFile(path)
 	if err != nil {
 		a.addError(filename, "unable to open '%s'", filename.str)
-		return err
+		return errParse
 	}
 	defer file.Close()
 
 	fileIndex := len(a.files)
-	a.files = append(a.files, filename.str)
-
+	a.files = append(a.files, path)
+	a.addDependency(path)
+
+	a.includeDepth++
+	a.includeStack = append(a.includeStack, canonical)
+	defer func() {
+		a.includeDepth--
+		a.includeStack = a.includeStack[:len(a.includeStack)-1]
+	}()
 	return a.parseFile(bufio.NewScanner(file), fileIndex)
 }
 
-// Parse a binary include pseudo-op
+// Parse a binary include pseudo-op. The file is searched for in the same
+// places as an included source file.
 func (a *assembler) parseBinaryInclude(line, label fstring, param any) error {
 	a.logLine(line, "binary_include")
 
@@ -1113,19 +1658,26 @@ func (a *assembler) parseBinaryInclude(line, label fstring, param any) error {
 		return errParse
 	}
 
-	file, err := os.Open(filename.str)
+	path, ok := a.findInclude(line, filename)
+	if !ok {
+		a.addError(filename, "unable to find '%s'", filename.str)
+		return errParse
+	}
+
+	file, err := a.openFile(path)
 	if err != nil {
 		a.addError(filename, "unable to open '%s'", filename.str)
-		return err
+		return errParse
 	}
 	defer file.Close()
+	a.addDependency(path)
 
-	seg := &bytedata{addr: -1}
+	seg := &bytedata{addr: -1, line: line}
 
 	data, err := ioutil.ReadAll(file)
 	if err != nil {
 		a.addError(filename, "unable to read '%s'", filename.str)
-		return err
+		return errParse
 	}
 
 	seg.b = data
@@ -1159,19 +1711,33 @@ func (a *assembler) parseInstruction(opcode, remain fstring) error {
 	remain = remain.consumeWhitespace()
 	a.logLine(remain, "op=%s", opcode.str)
 
-	// Parse the operand, if any.
-	operand, remain, err := a.parseOperand(remain)
+	// Parse any register or line number written in native syntax.
+	reg, pair, remain, err := a.parseRegisterOperand(opcode, instructions, remain)
 	if err != nil {
 		return err
 	}
 
-	// Create a code segment for the instruction
+	// Parse the operand, if any.
+	var operand operand
+	if pair != nil {
+		operand = *pair
+	} else {
+		operand, remain, err = a.parseOperand(remain)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create a code segment for the instruction. Instructions produced by
+	// a macro map to the line that invoked it.
+	fileIndex, row := remain.origin()
 	seg := &instruction{
 		addr:      -1,
-		fileIndex: remain.fileIndex,
-		line:      remain.row,
+		fileIndex: fileIndex,
+		line:      row,
 		opcode:    opcode,
 		operand:   operand,
+		reg:       reg,
 	}
 	a.segments = append(a.segments, seg)
 	return nil
@@ -1251,11 +1817,16 @@ func (a *assembler) parseOperand(line fstring) (o operand, remain fstring, err e
 
 // Append an error message to the assembler's error state.
 func (a *assembler) addError(l fstring, format string, args ...any) {
+	a.addErrorCode(a.errorCode, l, format, args...)
+}
+
+// Add an error with a particular diagnostic code.
+func (a *assembler) addErrorCode(code string, l fstring, format string, args ...any) {
 	msg := fmt.Sprintf(format, args...)
-	a.errors = append(a.errors, asmerror{l, msg})
+	a.errors = append(a.errors, asmerror{l, msg, code})
 	if a.verbose {
 		filename := a.files[l.fileIndex]
-		fmt.Fprintf(a.out, "Syntax error in '%s' line %d, col %d: %s\n", filename, l.row, l.column+1, msg)
+		fmt.Fprintf(a.out, "Syntax error in '%s' line %d, col %d: %s%s\n", filename, l.row, l.column+1, msg, a.expansionString(l))
 		fmt.Fprintln(a.out, l.full)
 		for i := 0; i < l.column; i++ {
 			fmt.Fprintf(a.out, "-")
@@ -1401,7 +1972,7 @@ func (l fstring) consumeIndirect() (mode cpu.Mode, expr fstring, remain fstring,
 // addressing mode substring is reached. Guess the addressing mode,
 // and return the expression substring.
 func (l fstring) consumeAbsolute() (mode cpu.Mode, expr fstring, remain fstring, err error) {
-	expr, remain = l.consumeUntilChar(',')
+	expr, remain = l.consumeUntilUnquotedChar(',')
 
 	switch {
 	case remain.startsWithString(",X") || remain.startsWithString(",x"):
@@ -6,7 +6,11 @@ package asm
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -227,6 +231,15 @@ func TestDataDwords(t *testing.T) {
 		"60504030A000000FFFFFFFF7FFFFFFF5500000055550000")
 }
 
+func TestDataBCD(t *testing.T) {
+	asm := `
+	.DB !59, !00, !99
+	.DW !1234
+	.DB !0100 >> 8`
+
+	checkASM(t, asm, "5900993412"+"01")
+}
+
 func TestDataHexStrings(t *testing.T) {
 	asm := `
 	.DH 0102030405060708
@@ -337,3 +350,870 @@ var asm65c02 = `	PHX
 		checkASMError(t, prefix+line, "parse error")
 	}
 } */
+
+func TestTestDirectives(t *testing.T) {
+	asm := `
+	.ORG $1000
+	.test "add", ADD2, R0=5, [BUF]=$10
+	.expect R0=8, CYCLES<=20
+	.expect UART="OK"
+ADD2	ADR #$01
+	RET
+BUF	.DB 0`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assembly.Tests) != 1 {
+		t.Fatalf("expected 1 test, got %d", len(assembly.Tests))
+	}
+
+	tc := assembly.Tests[0]
+	if tc.Name != "add" || tc.Target != 0x1000 || tc.Line != 3 {
+		t.Errorf("test header incorrect: %+v", tc)
+	}
+	if len(tc.Setup) != 2 || tc.Setup[1].Name != "MEM" || tc.Setup[1].Address != 0x1003 || tc.Setup[1].Value != 0x10 {
+		t.Errorf("test setup incorrect: %+v", tc.Setup)
+	}
+	if len(tc.Expect) != 3 || tc.Expect[1].Op != "<=" || string(tc.Expect[2].Bytes) != "OK" {
+		t.Errorf("test expectations incorrect: %+v", tc.Expect)
+	}
+}
+
+func TestTestDirectiveErrors(t *testing.T) {
+	checkASMError(t, "\t.expect R0=1", "parse error")
+	checkASMError(t, "\t.test \"x\", $1000, PC=1", "parse error")
+	checkASMError(t, "\t.test \"x\", $1000\n\t.expect R9=1", "parse error")
+}
+
+func TestMacros(t *testing.T) {
+	asm := `
+	.ORG $1000
+	.macro WAIT n
+	LDI0 #\n
+@loop	DEC
+	LBR @loop
+	.endm
+PAIR	.macro a, b
+	WAIT \a
+	WAIT \b
+	.endm
+START	WAIT 3
+	PAIR $10, 1`
+
+	checkASM(t, asm, "E00330180210"+"E01030180810"+"E00130180E10")
+
+	r := bytes.NewReader([]byte(asm))
+	_, sourceMap, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, line := range map[int]int{0x1000: 12, 0x1002: 12, 0x1006: 13, 0x100C: 13} {
+		if _, l, err := sourceMap.Find(addr); err != nil || l != line {
+			t.Errorf("address $%04X: expected line %d, got %d (%v)", addr, line, l, err)
+		}
+	}
+
+	// Expanded instructions are placed at the outermost invocation, with
+	// their position in the macro body kept separately.
+	res, err := AssembleResult(strings.NewReader(asm), "test", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inst := range res.Instructions {
+		if inst.Address != 0x100C {
+			continue
+		}
+		if inst.Mnemonic != "LDI" || inst.Source.File != "test" || inst.Source.Line != 13 ||
+			inst.Body.File != "test" || inst.Body.Line != 4 {
+			t.Errorf("unexpected instruction %+v", inst)
+		}
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	checkASMError(t, "\t.macro M a\n\tLDI0 #\\a\n\t.endm\n\tM", "parse error")
+	checkASMError(t, "\t.macro M\n\tLDI0 #1", "parse error")
+	checkASMError(t, "\t.macro M\n\tM\n\t.endm\n\tM", "parse error")
+	checkASMError(t, "\t.macro LDI0\n\t.endm", "parse error")
+	checkASMError(t, "\t.endm", "parse error")
+
+	asm := "\t.macro M\n\tBOGUS\n\t.endm\n\tM"
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err == nil || len(assembly.Errors) != 1 {
+		t.Fatalf("expected one error, got %v", err)
+	}
+	exp := "Syntax error in 'test' line 2, col 9: invalid opcode 'BOGUS'\n    in macro 'M' invoked from 'test' line 4"
+	if assembly.Errors[0] != exp {
+		t.Errorf("expected %q, got %q", exp, assembly.Errors[0])
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	asm := `
+DEBUG	= 1
+LEVEL	= 2
+	.if DEBUG
+	.db 1
+	.if LEVEL - 2
+	.db 2
+	.elseif LEVEL
+	.db 3
+	.else
+	.db 4
+	.endif
+	.else
+	.db 5
+	.if 1
+	.db 6
+	.endif
+	.endif
+	.ifdef LEVEL
+	.db 7
+	.endif
+	.ifndef RELEASE
+	.db 8
+	.endif`
+
+	checkASM(t, asm, "01030708")
+}
+
+func TestDefines(t *testing.T) {
+	asm := `
+	.ifdef RELEASE
+	.db RELEASE
+	.else
+	.db 0
+	.endif`
+
+	d, err := ParseDefine("RELEASE=$2A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembly.Code, []byte{0x2a}) {
+		t.Errorf("expected $2A, got %X", assembly.Code)
+	}
+
+	if d, err := ParseDefine("DEBUG"); err != nil || d.Value != 1 {
+		t.Errorf("expected DEBUG=1, got %v (%v)", d, err)
+	}
+	values := map[string]int{"N=010": 10, "N=0x1F": 31, "N=$1f": 31, "N=-5": -5}
+	for s, v := range values {
+		if d, err := ParseDefine(s); err != nil || d.Value != v {
+			t.Errorf("%s: got %v (%v), expected %d", s, d, err, v)
+		}
+	}
+	for _, s := range []string{"N=0b101", "N=0o17", "N=1_000", "N=$"} {
+		if _, err := ParseDefine(s); err == nil {
+			t.Errorf("%s: expected an invalid value error", s)
+		}
+	}
+	if _, err := ParseDefine("1X=2"); err == nil {
+		t.Error("expected error for invalid symbol name")
+	}
+}
+
+func TestConditionalErrors(t *testing.T) {
+	checkASMError(t, "\t.if 1\n\t.db 1", "parse error")
+	checkASMError(t, "\t.endif", "parse error")
+	checkASMError(t, "\t.else", "parse error")
+	checkASMError(t, "\t.if 1\n\t.else\n\t.else\n\t.endif", "parse error")
+	checkASMError(t, "\t.if LATER\n\t.endif\nLATER\t.db 1", "parse error")
+}
+
+func TestListing(t *testing.T) {
+	asm := `
+	.ORG $1000
+COUNT	= 3
+START	LDI0 #COUNT
+	.db "Hello", 0
+	LBR START`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, Listing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		"1000  E0 03       2     4     START\tLDI0 #COUNT",
+		"1002  48 65 6C          5     \t.db \"Hello\", 0",
+		"1005  6C 6F 00",
+		"1008  18 00 10    4     6     \tLBR START",
+		"COUNT                $0003     constant  test:3          test:4",
+		"START                $1000     label     test:4          test:6",
+	} {
+		if !bytes.Contains(assembly.Listing, []byte(s)) {
+			t.Errorf("listing missing %q", s)
+		}
+	}
+}
+
+func TestIntelHex(t *testing.T) {
+	img := &Image{
+		Blocks: []Block{
+			{Address: 0x0200, Data: []byte{0xe0, 0x01, 0x00}},
+			{Address: 0xfffe, Data: []byte{0x00, 0x02}},
+		},
+		Entry: 0x0200,
+	}
+
+	var b bytes.Buffer
+	if err := WriteIntelHex(&b, img); err != nil {
+		t.Fatal(err)
+	}
+	exp := ":03020000E001001A\n:02FFFE000002FF\n:0400000500000200F5\n:00000001FF\n"
+	if b.String() != exp {
+		t.Errorf("expected:\n%sgot:\n%s", exp, b.String())
+	}
+
+	img2, err := ReadIntelHex(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img2.Blocks) != 2 || img2.Entry != 0x0200 || img2.Blocks[1].Address != 0xfffe ||
+		!bytes.Equal(img2.Blocks[0].Data, img.Blocks[0].Data) {
+		t.Errorf("image doesn't match: %+v", img2)
+	}
+
+	_, err = ReadIntelHex(bytes.NewReader([]byte(":03020000E001001B\n:00000001FF\n:0102")))
+	errs, ok := err.(RecordErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 1 {
+		t.Errorf("expected a checksum error on line 1, got %v", err)
+	}
+}
+
+func TestSRecord(t *testing.T) {
+	img := &Image{
+		Blocks: []Block{{Address: 0x1000, Data: []byte("Hi")}},
+		Entry:  0x1000,
+	}
+
+	var b bytes.Buffer
+	if err := WriteSRecord(&b, img, "t"); err != nil {
+		t.Fatal(err)
+	}
+	exp := "S00400007487\nS1051000486939\nS5030001FB\nS9031000EC\n"
+	if b.String() != exp {
+		t.Errorf("expected:\n%sgot:\n%s", exp, b.String())
+	}
+	if DetectFormat("rom.dat", b.Bytes()) != FormatSRecord {
+		t.Error("S-record content not detected")
+	}
+
+	img2, err := ReadSRecord(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img2.Blocks) != 1 || img2.Entry != 0x1000 || string(img2.Blocks[0].Data) != "Hi" {
+		t.Errorf("image doesn't match: %+v", img2)
+	}
+
+	_, err = ReadSRecord(bytes.NewReader([]byte("S105100048693A\nS1051002486938\n")))
+	if errs, ok := err.(RecordErrors); !ok || len(errs) != 2 || errs[1].Line != 2 {
+		t.Errorf("expected checksum errors on lines 1 and 2, got %v", err)
+	}
+}
+
+func TestMultipleOrigins(t *testing.T) {
+	asm := `
+	.ORG $0200
+	.entry START
+	.db 1
+START	LBR START
+	.ORG $0210, ROM
+	.dw START`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assembly.Origin != 0x0200 || len(assembly.Code) != 0x12 || assembly.Entry != 0x0201 {
+		t.Errorf("origin $%04X, length %d, entry $%04X", assembly.Origin, len(assembly.Code), assembly.Entry)
+	}
+	if len(assembly.Blocks) != 2 || assembly.Blocks[1].Address != 0x0210 || assembly.Blocks[1].Flags != SegmentROM ||
+		!bytes.Equal(assembly.Blocks[1].Data, []byte{0x01, 0x02}) {
+		t.Errorf("blocks incorrect: %+v", assembly.Blocks)
+	}
+
+	var b bytes.Buffer
+	exports := []Export{{Label: "START", Address: 0x0201}}
+	if _, err := assembly.Executable(exports).WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 12+5+4+5+2+2+6 {
+		t.Errorf("executable size %d", b.Len())
+	}
+
+	exe := &Executable{}
+	if _, err := exe.ReadFrom(&b); err != nil {
+		t.Fatal(err)
+	}
+	if exe.Entry != 0x0201 || len(exe.Segments) != 2 || exe.Segments[0].Flags != defaultSegmentFlags ||
+		len(exe.Symbols) != 1 || exe.Symbols[0] != exports[0] {
+		t.Errorf("executable incorrect: %+v", exe)
+	}
+	if origin, code := exe.Flatten(); origin != 0x0200 || !bytes.Equal(code, assembly.Code) {
+		t.Errorf("flattened executable incorrect")
+	}
+
+	checkASMError(t, "\t.ORG $0200\n\t.db 1, 2\n\t.ORG $0201\n\t.db 3", "parse error")
+	checkASMError(t, "\t.ORG $FFFF\n\t.dw 1", "parse error")
+	checkASMError(t, "\t.ORG $0200, FLASH", "parse error")
+
+	// Code that runs past $FFFF is reported at the line that crosses it,
+	// even when the block has no .org.
+	cases := []struct {
+		asm string
+		exp string
+	}{
+		{"\tHALT\n\t.fill 70000\n\tHALT", "Syntax error in 'test' line 2, col 15: code at $1000 extends beyond $FFFF"},
+		{"\t.ORG $FFFE\n\tNOP\n\tNOP\n\t.dw 1", "Syntax error in 'test' line 4, col 13: code at $FFFE extends beyond $FFFF"},
+	}
+	for _, c := range cases {
+		assembly, _, err := Assemble(strings.NewReader(c.asm), "test", 0x1000, io.Discard, 0)
+		if err == nil || len(assembly.Errors) != 1 || assembly.Errors[0] != c.exp {
+			t.Errorf("%q: expected %q, got %q", c.asm, c.exp, assembly.Errors)
+		}
+	}
+}
+
+func TestObject(t *testing.T) {
+	asm := `
+	.global START, BUF
+	.extern PRINT
+START	CALL PRINT
+	LBR START
+	.data
+MSG	.dw MSG+1, PRINT
+	.bss
+BUF	.pad 0, 4`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, Relocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := assembly.Object
+	if obj == nil {
+		t.Fatal("no object produced")
+	}
+
+	var b bytes.Buffer
+	if _, err := obj.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	obj = &Object{}
+	if _, err := obj.ReadFrom(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(obj.Sections) != 3 || !bytes.Equal(obj.Sections[SectionText].Data, []byte{0x02, 0, 0, 0x18, 0, 0}) ||
+		!bytes.Equal(obj.Sections[SectionData].Data, []byte{1, 0, 0, 0}) ||
+		obj.Sections[SectionBSS].Size != 4 || obj.Sections[SectionBSS].Data != nil {
+		t.Errorf("sections incorrect: %+v", obj.Sections)
+	}
+	symbols := []Symbol{{"START", SectionText, 0}, {"BUF", SectionBSS, 0}}
+	if len(obj.Symbols) != 2 || obj.Symbols[0] != symbols[0] || obj.Symbols[1] != symbols[1] {
+		t.Errorf("symbols incorrect: %+v", obj.Symbols)
+	}
+	if len(obj.Externs) != 1 || obj.Externs[0] != "PRINT" {
+		t.Errorf("externs incorrect: %+v", obj.Externs)
+	}
+	relocs := []Relocation{
+		{Section: SectionText, Offset: 1, Extern: true, Target: 0},
+		{Section: SectionText, Offset: 4, Target: SectionText},
+		{Section: SectionData, Offset: 0, Target: SectionData, Addend: 1},
+		{Section: SectionData, Offset: 2, Extern: true, Target: 0},
+	}
+	if len(obj.Relocations) != len(relocs) {
+		t.Fatalf("relocations incorrect: %+v", obj.Relocations)
+	}
+	for i, r := range relocs {
+		if obj.Relocations[i] != r {
+			t.Errorf("relocation %d: got %+v, expected %+v", i, obj.Relocations[i], r)
+		}
+	}
+
+	errs := []string{
+		"\t.extern X\n\tLDI0 #X",
+		"\t.global X",
+		"\t.org $0200",
+		"\t.bss\n\t.db 1",
+	}
+	for _, s := range errs {
+		_, _, err := Assemble(bytes.NewReader([]byte(s)), "test", 0x1000, os.Stdout, Relocatable)
+		if err == nil {
+			t.Errorf("expected an error assembling %q", s)
+		}
+	}
+	checkASMError(t, "\t.text", "parse error")
+}
+
+func TestRegisterSyntax(t *testing.T) {
+	asm := `
+	LDI R3, #$10
+	ADR R1, R2
+	PUSH R5
+	SETQ 2
+	LDM R2, $2000
+	LBRQ 2, $1000
+	LDI3 #$10
+	ADR #$12`
+
+	checkASM(t, asm, "E3108012453AF20020B20010E3108012")
+
+	errors := []string{
+		"\tLDI #1",
+		"\tLDI3 R2, #1",
+		"\tADR R1",
+		"\tSETQ 9",
+		"\tPUSH R5 R6",
+	}
+	for _, line := range errors {
+		checkASMError(t, line, "parse error")
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	check := func(asm, id string, settings ...Setting) {
+		t.Helper()
+		r := bytes.NewReader([]byte(asm))
+		assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0, settings...)
+		if err != nil {
+			t.Errorf("unexpected error on %s: %v", asm, err)
+			return
+		}
+		var ids []string
+		for _, w := range assembly.Warnings {
+			ids = append(ids, w[strings.LastIndex(w, "[")+1:len(w)-1])
+		}
+		if got := strings.Join(ids, ","); got != id {
+			t.Errorf("expected warnings '%s' on %s, got '%s'", id, asm, got)
+		}
+	}
+
+	check("\tADI R1, #200\n\tADI R1, #-5\n\tANI R1, #200", WarnSignedRange)
+	check("START\tHALT\nX\tHALT\nY = 3", WarnUnused+","+WarnUnused)
+	check("\tLDI R1, #1\n\t.db 1, 2", WarnFallthrough)
+	check("\tHALT\n\t.db 1, 2", "")
+	check("\tSTI R1, $0180\n\tSTI R1, $0280", WarnStackWrite)
+	check("\tCALL $2000\n\tCALL SUB\nSUB\tRET", WarnCallAddress)
+	check("\tADR R1, R1\n\tADR R1, R2", WarnSameRegister)
+	check("\tLBR L\n\tHALT\n\tHALT\nL\tHALT", WarnUnreachable)
+	check("\t.org $1000\n\t.db 1, 2\n\t.org $1001\n\t.db 3", WarnOrgOverlap, WarningFlag{WarnOrgOverlap, WarnOn})
+	check("\tADI R1, #200\n\tADR R1, R1", "", WarningFlag{Level: WarnOff})
+	check("\tADI R1, #200\n\tADR R1, R1", WarnSameRegister, WarningFlag{WarnSignedRange, WarnOff})
+
+	checkASMError(t, "\t.org $1000\n\t.db 1, 2\n\t.org $1001\n\t.db 3", "parse error")
+	r := bytes.NewReader([]byte("\tADI R1, #200"))
+	_, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0, WarningFlag{Level: WarnError})
+	if err == nil {
+		t.Error("expected warning to be an error")
+	}
+
+	if w, err := ParseWarningFlag("unused=off"); err != nil || w != (WarningFlag{WarnUnused, WarnOff}) {
+		t.Errorf("ParseWarningFlag: got %v, %v", w, err)
+	}
+	if w, err := ParseWarningFlag("error"); err != nil || w != (WarningFlag{"", WarnError}) {
+		t.Errorf("ParseWarningFlag: got %v, %v", w, err)
+	}
+	if _, err := ParseWarningFlag("bogus=on"); err == nil {
+		t.Error("expected error for unknown warning")
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	asm := `
+X = BOGUS(
+Y = X+1
+	LDI R1, #Y
+	LDQ R2
+	.macro M
+	LDI R9, #1
+	.endm
+	M
+	LBR NOWHERE`
+
+	r := bytes.NewReader([]byte(asm))
+	assembly, _, err := Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+
+	expected := []Diagnostic{
+		{SeverityError, "test", 2, 5, 10, "syntax", "unknown function 'BOGUS'", nil},
+		{SeverityError, "test", 5, 9, 12, "syntax", "invalid opcode 'LDQ'", nil},
+		{SeverityError, "test", 7, 13, 15, "syntax", "'LDI' needs a register operand", []string{"in macro 'M' invoked from 'test' line 9"}},
+		{SeverityError, "test", 10, 13, 20, "unresolved", "unresolved expression", nil},
+	}
+	if len(assembly.Diagnostics) != len(expected) {
+		t.Fatalf("expected %d diagnostics, got %v", len(expected), assembly.Diagnostics)
+	}
+	for i, d := range assembly.Diagnostics {
+		if d.String() != expected[i].String() || d.EndColumn != expected[i].EndColumn || d.Code != expected[i].Code {
+			t.Errorf("diagnostic %d: expected %+v, got %+v", i, expected[i], d)
+		}
+		if d.String() != assembly.Errors[i] {
+			t.Errorf("error %d: expected '%s', got '%s'", i, d.String(), assembly.Errors[i])
+		}
+	}
+
+	r = bytes.NewReader([]byte("\tADR R1, R1"))
+	assembly, _, err = Assemble(r, "test", 0x1000, os.Stdout, 0)
+	if err != nil || len(assembly.Diagnostics) != 1 || assembly.Diagnostics[0].Severity != SeverityWarning {
+		t.Fatalf("expected one warning, got %v (%v)", assembly.Diagnostics, err)
+	}
+
+	var b bytes.Buffer
+	if err := WriteDiagnosticsJSON(&b, assembly.Diagnostics); err != nil {
+		t.Fatal(err)
+	}
+	var diags []Diagnostic
+	if err := json.Unmarshal(b.Bytes(), &diags); err != nil || len(diags) != 1 || diags[0].Code != WarnSameRegister {
+		t.Errorf("JSON round trip failed: %v %v", diags, err)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	asm := `
+	.org $1000
+PTR = $1234
+	LDI R1, #lo(PTR)
+	LDI R2, #HI(PTR)
+	LDI R3, #strlen("hello")
+	LDI R4, #sizeof(MSG)
+	LDI R5, #min(3, 1, 2)
+	LDI R6, #max(3, PTR >> 8, 2)
+	LDI R7, #abs(-5)
+	LBR * + 3
+	LBR $
+	.if defined(PTR)
+	.db 1
+	.endif
+	.if defined(NOPE)
+	.db 2
+	.endif
+	.db defined(LATER), defined(END)
+MSG	.db "hello", 0
+END	.db lo(MSG), hi(END), max(1, 2, 3), defined(LATER), defined(MSG)
+LATER = 4`
+
+	checkASM(t, asm, "E134E212E305E406E501E612E705"+"181110181110"+"01"+"0000"+"68656C6C6F00"+"1710030001")
+
+	errors := []string{
+		"\tLDI R1, #lo(1, 2)",
+		"\tLDI R1, #min(1)",
+		"\tLDI R1, #strlen(5)",
+		"\tLDI R1, #abs(\"x\")",
+		"\tLDI R1, #defined(1)",
+		"\tLDI R1, #foo(1)",
+		"\tLDI R1, #lo(1",
+		"\tLDI R1, #max(1,)",
+	}
+	for _, line := range errors {
+		checkASMError(t, line, "parse error")
+	}
+}
+
+func TestStructuredData(t *testing.T) {
+	asm := `
+POINT	.struct
+x	.db
+y	.db
+	.endstruct
+NODE	.struct
+next	.dw
+pos	POINT
+name	.fill 4
+	.endstruct
+	.enum COLOR, 1
+RED, GREEN
+BLUE = 8
+CYAN
+	.endenum
+	.org $1000
+	LDI R0, #NODE.pos.y
+	LDI R1, #sizeof(NODE)
+	LDI R2, #NODE
+	LDI R3, #COLOR.GREEN
+	LDI R4, #COLOR.CYAN
+	.repeat 3, I
+	.db I * 2, 'I'
+	.endr
+	.repeat 2
+@x	.dw @x
+	.endr
+	.fill 3, $FF
+	.fill 2`
+
+	checkASM(t, asm, "E003E108E208E302E409"+"004902490449"+"10101210"+"FFFFFF0000")
+
+	errors := []string{
+		"\t.struct",
+		"S\t.struct\nS\t.struct\n\t.endstruct\n\t.endstruct",
+		"S\t.struct\nx\t.zz\n\t.endstruct",
+		"S\t.struct\nx\t.db\nx\t.db\n\t.endstruct",
+		"S\t.struct\nx\t.db\n\t.endenum",
+		"\t.endstruct",
+		"\t.enum\nA = X\n\t.endenum",
+		"\t.repeat 2\n\t.db 1",
+		"\t.repeat X\n\t.endr",
+		"\t.endr",
+		"\t.fill",
+	}
+	for _, line := range errors {
+		checkASMError(t, line, "parse error")
+	}
+}
+
+func TestIncludePaths(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	files := map[string]string{
+		"lib/util.asm": "\t.once\nUTIL\tRET\n",
+		"lib/a.asm":    "\t.include b.asm\n",
+		"lib/b.asm":    "\t.include a.asm\n",
+		"data.bin":     "\x12\x34",
+		"main.asm": "\t.org $1000\n\tCALL UTIL\n\tHALT\n" +
+			"\t.include util.asm\n\t.include util.asm\n\t.bin data.bin\n",
+	}
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	main := filepath.Join(dir, "main.asm")
+	if err := AssembleFile(main, Dependencies, io.Discard, IncludeDir(lib)); err != nil {
+		t.Fatal(err)
+	}
+	code, err := os.ReadFile(filepath.Join(dir, "main.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, exp := strings.ToUpper(hexString(code)), "02041001031234"; got != exp {
+		t.Errorf("code: got %s, exp %s", got, exp)
+	}
+
+	deps, err := os.ReadFile(filepath.Join(dir, "main.d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{main, filepath.Join(lib, "util.asm"), filepath.Join(dir, "data.bin"), filepath.Join(dir, "main.bin") + " "} {
+		if !strings.Contains(string(deps), want) {
+			t.Errorf("dependency file doesn't mention %s:\n%s", want, deps)
+		}
+	}
+
+	// Without the include directory, util.asm can't be found.
+	r := strings.NewReader(files["main.asm"])
+	if _, _, err := Assemble(r, main, 0x1000, io.Discard, 0); err == nil {
+		t.Error("expected an error without the include directory")
+	}
+
+	// An include cycle is reported rather than followed.
+	r = strings.NewReader("\t.include a.asm\n")
+	assembly, _, err := Assemble(r, main, 0x1000, io.Discard, 0, IncludeDir(lib))
+	if err == nil || len(assembly.Errors) != 1 || !strings.Contains(assembly.Errors[0], "include cycle: a.asm -> b.asm -> a.asm") {
+		t.Errorf("expected an include cycle error, got %v", assembly.Errors)
+	}
+}
+
+func hexString(b []byte) string {
+	var sb strings.Builder
+	for _, v := range b {
+		sb.WriteByte(hex[v>>4])
+		sb.WriteByte(hex[v&0x0f])
+	}
+	return sb.String()
+}
+
+func TestResult(t *testing.T) {
+	files := MemFS{
+		"main.asm": "\t.org $1000\nCOUNT = 3\nSTART\tLDI R1, #COUNT\n.loop\tLBR .loop\n" +
+			"\t.include lib/data.asm\n",
+		"lib/data.asm": "TABLE\t.db 1, 2\n\t.fill 2, $FF\n",
+	}
+	res, err := AssembleFS(files, "main.asm", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syms := make(map[string]SymbolInfo)
+	for _, s := range res.Symbols {
+		syms[s.Name] = s
+	}
+	cases := []struct {
+		name  string
+		kind  string
+		value int
+		file  string
+		line  int
+		refs  int
+	}{
+		{"COUNT", SymbolConstant, 3, "main.asm", 2, 1},
+		{"START", SymbolLabel, 0x1000, "main.asm", 3, 0},
+		{"START.loop", SymbolLabel, 0x1002, "main.asm", 4, 1},
+		{"TABLE", SymbolLabel, 0x1005, "lib/data.asm", 1, 0},
+	}
+	for _, c := range cases {
+		s, ok := syms[c.name]
+		switch {
+		case !ok:
+			t.Errorf("symbol %s missing", c.name)
+		case s.Kind != c.kind || s.Value != c.value || !s.Evaluated:
+			t.Errorf("symbol %s: got %s $%04X, exp %s $%04X", c.name, s.Kind, s.Value, c.kind, c.value)
+		case s.Defined.File != c.file || s.Defined.Line != c.line || len(s.References) != c.refs:
+			t.Errorf("symbol %s: got %s:%d with %d references", c.name, s.Defined.File, s.Defined.Line, len(s.References))
+		}
+	}
+
+	segs := []Segment{{SegmentCode, 0x1000, 0x1005}, {SegmentData, 0x1005, 0x1007}, {SegmentPadding, 0x1007, 0x1009}}
+	if len(res.Segments) != len(segs) {
+		t.Fatalf("segments: got %v, exp %v", res.Segments, segs)
+	}
+	for i, s := range segs {
+		if res.Segments[i] != s {
+			t.Errorf("segment %d: got %v, exp %v", i, res.Segments[i], s)
+		}
+	}
+
+	if len(res.Instructions) != 2 {
+		t.Fatalf("got %d instructions, exp 2", len(res.Instructions))
+	}
+	inst := res.Instructions[1]
+	if inst.Address != 0x1002 || inst.Mnemonic != "LBR" || hexString(inst.Bytes) != "180210" ||
+		inst.Source.Line != 4 || inst.Body.File != "" || inst.Text != ".loop\tLBR .loop" {
+		t.Errorf("unexpected instruction %+v", inst)
+	}
+}
+
+func TestSourceMapAddresses(t *testing.T) {
+	files := MemFS{"main.asm": "\t.org $1000\nSTART\tLDI R1, #5\n\n\tCALL SUB\n\tHALT\nSUB\tRET\n"}
+	res, err := AssembleFS(files, "main.asm", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The map must survive being written and read back.
+	var buf bytes.Buffer
+	if _, err := res.SourceMap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var sm SourceMap
+	if _, err := sm.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		line int
+		addr int
+	}{
+		{1, 0x1000},
+		{2, 0x1000},
+		{3, 0x1002},
+		{4, 0x1002},
+		{6, 0x1006},
+	}
+	for _, c := range cases {
+		addr, err := sm.FindAddress("main.asm", c.line)
+		if err != nil || addr != c.addr {
+			t.Errorf("line %d: got $%04X (%v), exp $%04X", c.line, addr, err, c.addr)
+		}
+	}
+	if _, err := sm.FindAddress("main.asm", 7); err == nil {
+		t.Errorf("line 7: expected an error")
+	}
+}
+
+func TestSourceMapLabels(t *testing.T) {
+	src := "\t.org $1000\nSTART\tLDM R1, TABLE+3\n.loop\tLBR .loop\nTABLE\t.db 1, 2, 3, 4\n"
+	_, sm, err := Assemble(strings.NewReader(src), "test.asm", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := sm.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var sm2 SourceMap
+	if _, err := sm2.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		addr   uint16
+		label  string
+		offset int
+	}{
+		{0x1000, "START", 0},
+		{0x1003, "START.loop", 0},
+		{0x1006, "TABLE", 0},
+		{0x1009, "TABLE", 3},
+	}
+	for _, c := range cases {
+		label, offset, ok := sm2.LookupLabel(c.addr)
+		if !ok || label != c.label || offset != c.offset {
+			t.Errorf("$%04X: got %s+%d, exp %s+%d", c.addr, label, offset, c.label, c.offset)
+		}
+	}
+	if _, _, ok := sm2.LookupLabel(0x0FFF); ok {
+		t.Errorf("$0FFF: expected no label")
+	}
+
+	// Maps written before labels were recorded end after the exports,
+	// where the label count now follows.
+	sm.Labels = nil
+	buf.Reset()
+	if _, err := sm.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var sm3 SourceMap
+	if _, err := sm3.ReadFrom(bytes.NewReader(buf.Bytes()[:buf.Len()-4])); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm3.Labels) != 0 || len(sm3.Lines) != len(sm.Lines) {
+		t.Errorf("old map: got %d labels and %d lines", len(sm3.Labels), len(sm3.Lines))
+	}
+}
+
+func TestSourceMapLookupName(t *testing.T) {
+	src := "\t.org $1000\n" +
+		"\t.export SUB\n" +
+		"START\tCALL SUB\n" +
+		"\tHALT\n" +
+		"SUB\tRET\n"
+	_, sourceMap, err := Assemble(strings.NewReader(src), "test.asm", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		addr uint16
+		ok   bool
+	}{
+		{"SUB", 0x1004, true},
+		{"start", 0x1000, true},
+		{"MISSING", 0, false},
+	} {
+		addr, ok := sourceMap.LookupName(c.name)
+		if addr != c.addr || ok != c.ok {
+			t.Errorf("LookupName(%q) = $%04X, %v; expected $%04X, %v", c.name, addr, ok, c.addr, c.ok)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Define is a symbol defined outside the source code, such as with the
+// -D command line option. It is visible to the assembler as a constant.
+type Define struct {
+	Name  string
+	Value int
+}
+
+// ParseDefine parses a "NAME=value" or "NAME" definition. The value may be
+// decimal, or hexadecimal with a '$' or '0x' prefix, and defaults to 1.
+func ParseDefine(s string) (Define, error) {
+	name, value, found := strings.Cut(s, "=")
+	d := Define{Name: strings.TrimSpace(name), Value: 1}
+
+	l := newFstring(0, 0, d.Name)
+	if !l.startsWith(identifierStartChar) || l.scanWhile(labelChar) != len(d.Name) {
+		return d, fmt.Errorf("invalid symbol name '%s'", d.Name)
+	}
+
+	if found {
+		value = strings.TrimSpace(value)
+		v, base := value, 10
+		for _, prefix := range []string{"$", "0x", "0X"} {
+			if hex, ok := strings.CutPrefix(value, prefix); ok {
+				v, base = hex, 16
+				break
+			}
+		}
+		n, err := strconv.ParseInt(v, base, 32)
+		if err != nil {
+			return d, fmt.Errorf("invalid value '%s' for symbol '%s'", value, d.Name)
+		}
+		d.Value = int(n)
+	}
+	return d, nil
+}
+
+// Store a defined symbol as an evaluated constant.
+func (d Define) apply(a *assembler) {
+	a.constants[d.Name] = &expr{op: opNumber, value: d.Value, bytes: valueBytes(d.Value), evaluated: true}
+}
+
+// A cond tracks one level of an .if/.elseif/.else/.endif block.
+type cond struct {
+	line    fstring // the directive that opened the block
+	outer   bool    // true if the enclosing block is being assembled
+	active  bool    // true if the current branch is being assembled
+	taken   bool    // true if any branch has been assembled
+	hasElse bool    // true once .else has been seen
+}
+
+// Return true if lines are currently being skipped by a false condition.
+func (a *assembler) skipping() bool {
+	return len(a.conds) > 0 && !a.conds[len(a.conds)-1].active
+}
+
+// Handle a line inside a false conditional block. Only conditional
+// directives are processed; everything else is ignored.
+func (a *assembler) skipLine(line fstring) error {
+	word, remain := directiveWord(line)
+	switch strings.ToLower(word.str) {
+	case ".if", ".ifdef", ".ifndef", ".elseif", ".elif", ".else", ".endif":
+		op := pseudoOps[strings.ToLower(word.str)]
+		return op.fn(a, remain.consumeWhitespace(), fstring{}, op.param)
+	}
+	return nil
+}
+
+// Return the first word of a line, or the second if the line starts with a
+// label, along with the rest of the line. Labels that are themselves
+// directives are treated as the directive.
+func directiveWord(line fstring) (word, remain fstring) {
+	l := line.stripTrailingComment().consumeWhitespace()
+	word, remain = l.consumeWhile(wordChar)
+	if !line.startsWith(whitespace) {
+		if _, ok := pseudoOps[strings.ToLower(word.str)]; !ok {
+			remain = remain.consumeWhitespace()
+			word, remain = remain.consumeWhile(wordChar)
+		}
+	}
+	return word, remain
+}
+
+// Evaluate a condition expression. It must be computable from constants
+// and symbols defined before it.
+func (a *assembler) evalCondition(line fstring) (bool, error) {
+	e, _, err := a.exprParser.parse(line, a.scopeLabel, allowParentheses)
+	if err != nil {
+		a.addExprErrors()
+		return false, err
+	}
+	if !e.eval(-1, a.constants, a.labels) {
+		a.addError(line, "condition must use constants defined before it")
+		return false, errParse
+	}
+	return e.value != 0, nil
+}
+
+// Return true if a symbol is a known constant or label.
+func (a *assembler) defined(line fstring) (bool, error) {
+	name, remain := line.consumeWhile(labelChar)
+	remain = remain.consumeWhitespace()
+	if name.isEmpty() || !remain.isEmpty() {
+		a.addError(line, "expected a symbol name")
+		return false, errParse
+	}
+	key := name.str
+	if name.startsWithChar('.') || name.startsWithChar('@') {
+		key = "~" + a.scopeLabel.str + key
+	}
+	_, isConst := a.constants[key]
+	_, isLabel := a.labels[key]
+	return isConst || isLabel, nil
+}
+
+// Parse an ".if", ".ifdef" or ".ifndef" pseudo-op. The param selects the
+// kind of test.
+func (a *assembler) parseIf(line, label fstring, param any) error {
+	a.logLine(line, "if=")
+
+	c := cond{line: line, outer: !a.skipping()}
+	if c.outer {
+		var err error
+		switch param.(string) {
+		case "if":
+			c.active, err = a.evalCondition(line)
+		case "ifdef":
+			c.active, err = a.defined(line)
+		case "ifndef":
+			c.active, err = a.defined(line)
+			c.active = !c.active
+		}
+		if err != nil {
+			// Skip the whole block, so that assembly can continue
+			// without reporting errors from either branch.
+			c.active, c.taken = false, true
+			a.conds = append(a.conds, c)
+			return err
+		}
+		c.taken = c.active
+	}
+
+	a.conds = append(a.conds, c)
+	return nil
+}
+
+// Parse an ".elseif" pseudo-op.
+func (a *assembler) parseElseIf(line, label fstring, param any) error {
+	a.logLine(line, "elseif=")
+
+	if len(a.conds) == 0 {
+		a.addError(line, ".elseif without .if")
+		return errParse
+	}
+	c := &a.conds[len(a.conds)-1]
+	if c.hasElse {
+		a.addError(line, ".elseif after .else")
+		return errParse
+	}
+
+	c.active = false
+	if c.outer && !c.taken {
+		active, err := a.evalCondition(line)
+		if err != nil {
+			c.taken = true
+			return err
+		}
+		c.active, c.taken = active, active
+	}
+	return nil
+}
+
+// Parse an ".else" pseudo-op.
+func (a *assembler) parseElse(line, label fstring, param any) error {
+	a.logLine(line, "else")
+
+	if len(a.conds) == 0 {
+		a.addError(line, ".else without .if")
+		return errParse
+	}
+	c := &a.conds[len(a.conds)-1]
+	if c.hasElse {
+		a.addError(line, ".else used more than once")
+		return errParse
+	}
+
+	c.hasElse = true
+	c.active = c.outer && !c.taken
+	c.taken = true
+	return nil
+}
+
+// Parse an ".endif" pseudo-op.
+func (a *assembler) parseEndIf(line, label fstring, param any) error {
+	a.logLine(line, "endif")
+
+	if len(a.conds) == 0 {
+		a.addError(line, ".endif without .if")
+		return errParse
+	}
+	a.conds = a.conds[:len(a.conds)-1]
+	return nil
+}
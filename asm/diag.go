@@ -0,0 +1,79 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Diagnostic severities
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// A Diagnostic describes an error or warning found during assembly, in a
+// form that editors and other tools can use to mark the source.
+type Diagnostic struct {
+	Severity  string   `json:"severity"`        // SeverityError or SeverityWarning
+	File      string   `json:"file"`            // source file
+	Line      int      `json:"line"`            // line number, starting at 1
+	Column    int      `json:"column"`          // first column, starting at 1
+	EndColumn int      `json:"endColumn"`       // column just past the end of the span
+	Code      string   `json:"code"`            // kind of error, or the warning ID
+	Message   string   `json:"message"`         // description of the problem
+	Notes     []string `json:"notes,omitempty"` // further context, such as macro invocations
+}
+
+// String formats the diagnostic the way the assembler prints it.
+func (d *Diagnostic) String() string {
+	s := fmt.Sprintf("Syntax error in '%s' line %d, col %d: %s", d.File, d.Line, d.Column, d.Message)
+	if d.Severity == SeverityWarning {
+		s = fmt.Sprintf("Warning in '%s' line %d, col %d: %s [%s]", d.File, d.Line, d.Column, d.Message, d.Code)
+	}
+	for _, n := range d.Notes {
+		s += "\n    " + n
+	}
+	return s
+}
+
+// WriteDiagnosticsJSON writes a list of diagnostics as a JSON array.
+func WriteDiagnosticsJSON(w io.Writer, diags []Diagnostic) error {
+	if diags == nil {
+		diags = []Diagnostic{}
+	}
+	b, err := json.MarshalIndent(diags, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// Build the diagnostic for an error or warning.
+func (a *assembler) diagnostic(e asmerror, severity string) Diagnostic {
+	d := Diagnostic{
+		Severity:  severity,
+		File:      a.files[e.line.fileIndex],
+		Line:      e.line.row,
+		Column:    e.line.column + 1,
+		EndColumn: e.line.column + 1 + spanLength(e.line.str),
+		Code:      e.code,
+		Message:   e.msg,
+	}
+	d.Notes = a.expansionNotes(e.line)
+	return d
+}
+
+// Return the length of the token at the start of the text an error points
+// to, so that the whole token can be marked. The span is at least one
+// column wide.
+func spanLength(s string) int {
+	n := 0
+	for n < len(s) && !whitespace(s[n]) && s[n] != ',' {
+		n++
+	}
+	return max(n, 1)
+}
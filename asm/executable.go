@@ -0,0 +1,235 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// Segment flags describe the memory a block of code is loaded into.
+const (
+	SegmentROM  = 1 << iota // block belongs in read-only memory
+	SegmentRAM              // block belongs in read/write memory
+	SegmentExec             // block contains executable code
+)
+
+// defaultSegmentFlags apply to blocks whose .org directive has no flags.
+const defaultSegmentFlags = SegmentRAM | SegmentExec
+
+const (
+	executableSignature    = "CX1\x00"
+	executableVersionMajor = 1
+	executableVersionMinor = 0
+)
+
+// An Executable is a CPU1 executable file. It holds one or more segments of
+// code, each loaded at its own address, an entry point and, optionally, the
+// program's exported symbols.
+//
+// The file begins with a header:
+//
+//	signature   4 bytes  "CX1\0"
+//	version     2 bytes  major, minor
+//	entry       2 bytes  entry point address
+//	segments    2 bytes  number of segments
+//	symbols     2 bytes  number of symbols
+//
+// Each segment follows as a 2-byte load address, a 2-byte length, a flags
+// byte and the data. Each symbol follows as a 2-byte address and a
+// zero-terminated name. Multi-byte values are little-endian.
+type Executable struct {
+	Entry    uint16
+	Segments []Block
+	Symbols  []Export
+}
+
+// Executable returns the assembled code as an executable, including its
+// exported symbols.
+func (a *Assembly) Executable(exports []Export) *Executable {
+	return &Executable{Entry: a.Entry, Segments: a.Blocks, Symbols: exports}
+}
+
+// IsExecutable returns true if the data starts with an executable
+// signature.
+func IsExecutable(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(executableSignature))
+}
+
+// WriteTo writes the executable to w.
+func (e *Executable) WriteTo(w io.Writer) (n int64, err error) {
+	ww := bufio.NewWriter(w)
+
+	var b []byte
+	b = append(b, executableSignature...)
+	b = append(b, executableVersionMajor, executableVersionMinor)
+	b = binary.LittleEndian.AppendUint16(b, e.Entry)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(e.Segments)))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(e.Symbols)))
+
+	for _, s := range e.Segments {
+		b = binary.LittleEndian.AppendUint16(b, s.Address)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(s.Data)))
+		b = append(b, s.Flags)
+		b = append(b, s.Data...)
+	}
+	for _, s := range e.Symbols {
+		b = binary.LittleEndian.AppendUint16(b, s.Address)
+		b = append(b, s.Label...)
+		b = append(b, 0)
+	}
+
+	nn, err := ww.Write(b)
+	n = int64(nn)
+	if err != nil {
+		return n, err
+	}
+	return n, ww.Flush()
+}
+
+// ReadFrom reads an executable from r.
+func (e *Executable) ReadFrom(r io.Reader) (n int64, err error) {
+	rr := bufio.NewReader(r)
+	read := func(size int) ([]byte, error) {
+		b := make([]byte, size)
+		nn, err := io.ReadFull(rr, b)
+		n += int64(nn)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return b, err
+	}
+
+	h, err := read(12)
+	if err != nil {
+		return n, err
+	}
+	if !IsExecutable(h) {
+		return n, errors.New("invalid executable format")
+	}
+	if h[4] != executableVersionMajor {
+		return n, errors.New("unsupported executable version")
+	}
+	e.Entry = binary.LittleEndian.Uint16(h[6:8])
+	segments := int(binary.LittleEndian.Uint16(h[8:10]))
+	symbols := int(binary.LittleEndian.Uint16(h[10:12]))
+
+	e.Segments = make([]Block, 0, segments)
+	for i := 0; i < segments; i++ {
+		sh, err := read(5)
+		if err != nil {
+			return n, err
+		}
+		s := Block{
+			Address: binary.LittleEndian.Uint16(sh[0:2]),
+			Flags:   sh[4],
+		}
+		if s.Data, err = read(int(binary.LittleEndian.Uint16(sh[2:4]))); err != nil {
+			return n, err
+		}
+		if int(s.Address)+len(s.Data) > 0x10000 {
+			return n, errors.New("executable segment extends beyond $FFFF")
+		}
+		e.Segments = append(e.Segments, s)
+	}
+
+	e.Symbols = make([]Export, 0, symbols)
+	for i := 0; i < symbols; i++ {
+		a, err := read(2)
+		if err != nil {
+			return n, err
+		}
+		name, err := rr.ReadString(0)
+		n += int64(len(name))
+		if err != nil {
+			return n, io.ErrUnexpectedEOF
+		}
+		e.Symbols = append(e.Symbols, Export{Label: name[:len(name)-1], Address: binary.LittleEndian.Uint16(a)})
+	}
+	return n, nil
+}
+
+// Flatten returns the executable's segments as one contiguous block of
+// code, with any gaps between segments zero-filled.
+func (e *Executable) Flatten() (origin uint16, code []byte) {
+	return flatten(e.Segments)
+}
+
+func flatten(blocks []Block) (origin uint16, code []byte) {
+	if len(blocks) == 0 {
+		return 0, nil
+	}
+	start, end := 0x10000, 0
+	for _, b := range blocks {
+		start = min(start, int(b.Address))
+		end = max(end, int(b.Address)+len(b.Data))
+	}
+	code = make([]byte, end-start)
+	for _, b := range blocks {
+		copy(code[int(b.Address)-start:], b.Data)
+	}
+	return uint16(start), code
+}
+
+// Split the generated code into one block per origin, check that no blocks
+// overlap, and resolve the entry point. The assembly's code becomes the
+// flattened image of all the blocks.
+func (a *assembler) finishBlocks(origins []*origin, starts []int) error {
+	a.blocks = nil
+	var lines []fstring
+	for i, o := range origins {
+		end := len(a.code)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		if end == starts[i] {
+			continue
+		}
+		b := Block{Address: uint16(o.addr), Flags: o.flags, Data: a.code[starts[i]:end]}
+		if o.addr+len(b.Data) > 0x10000 {
+			line := o.beyond
+			if line.isEmpty() {
+				line = o.line
+			}
+			a.addError(line, "code at $%04X extends beyond $FFFF", o.addr)
+			return errParse
+		}
+		a.blocks = append(a.blocks, b)
+		lines = append(lines, o.line)
+	}
+
+	// Blocks should not overlap. If they are allowed to, later blocks
+	// overwrite earlier ones in the flattened image.
+	order := make([]int, len(a.blocks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return a.blocks[order[i]].Address < a.blocks[order[j]].Address })
+	for i := 1; i < len(order); i++ {
+		prev, cur := a.blocks[order[i-1]], a.blocks[order[i]]
+		if int(prev.Address)+len(prev.Data) > int(cur.Address) {
+			if a.addWarning(WarnOrgOverlap, lines[order[i]], "code at $%04X overlaps code at $%04X", cur.Address, prev.Address) {
+				return errParse
+			}
+		}
+	}
+
+	switch {
+	case a.entry != nil:
+		a.entryAddr = a.entry.value
+	case len(a.blocks) > 0:
+		a.entryAddr = int(a.blocks[0].Address)
+	default:
+		a.entryAddr = a.origin
+	}
+
+	if len(a.blocks) > 0 {
+		origin, code := flatten(a.blocks)
+		a.origin, a.code = int(origin), code
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ package asm
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 //
@@ -38,17 +39,24 @@ const (
 	// opBitwiseXOR
 	// opBitwiseOR
 
-	// value "operations" (16..19)
+	// value "operations" (16..20)
 	opNumber exprOp = iota + 16
 	opString
 	opIdentifier
 	opHere
+	opFunction
 
-	// pseudo-ops (20..21) (used only during parsing but not stored in expr's)
+	// pseudo-ops (21..22) (used only during parsing but not stored in expr's)
 	opLeftParen
 	opRightParen
 )
 
+// Unary operators used by the lo() and hi() functions.
+const (
+	opLowByte  exprOp = 2
+	opHighByte exprOp = 3
+)
+
 type opdata struct {
 	precedence      byte
 	children        int
@@ -92,6 +100,7 @@ var ops = []opdata{
 	{0, 0, false, "", nil}, // string literal
 	{0, 0, false, "", nil}, // identifier
 	{0, 0, false, "", nil}, // here
+	{0, 0, false, "", nil}, // function call
 
 	// pseudo-operations
 	{0, 0, false, "", nil}, // lparen
@@ -150,6 +159,25 @@ type expr struct {
 	scopeLabel    fstring // active scope label when parsing began
 	child0        *expr   // first child in expression tree
 	child1        *expr   // second child in expression tree (parent must be binary op)
+	fn            string  // if op == opFunction, the function name
+	args          []*expr // if op == opFunction, the arguments
+	sizeOf        func(name string) (int, bool)
+}
+
+// Return true if the expression refers to any of the named symbols.
+func (e *expr) uses(names map[string]bool) bool {
+	if e == nil || len(names) == 0 {
+		return false
+	}
+	if e.op == opIdentifier && names[refKey(e)] {
+		return true
+	}
+	for _, arg := range e.args {
+		if arg.uses(names) {
+			return true
+		}
+	}
+	return e.child0.uses(names) || e.child1.uses(names)
 }
 
 // Return the expression as a postfix notation string.
@@ -166,6 +194,12 @@ func (e *expr) String() string {
 		return e.identifier.str
 	case e.op == opHere:
 		return "$"
+	case e.op == opFunction:
+		args := make([]string, len(e.args))
+		for i, arg := range e.args {
+			args[i] = arg.String()
+		}
+		return fmt.Sprintf("%s(%s)", e.fn, strings.Join(args, ", "))
 	case e.op.isBinary():
 		return fmt.Sprintf("%s %s %s", e.child0.String(), e.child1.String(), e.op.symbol())
 	case !e.op.isBinary():
@@ -211,6 +245,9 @@ func (e *expr) eval(addr int, constants map[string]*expr, labels map[string]int)
 				e.value, e.bytes, e.address, e.evaluated = addr, 2, true, true
 			}
 
+		case e.op == opFunction:
+			e.evalFunction(addr, constants, labels)
+
 		case e.op.isBinary():
 			e.child0.eval(addr, constants, labels)
 			e.child1.eval(addr, constants, labels)
@@ -251,12 +288,13 @@ const (
 	tokenString
 	tokenIdentifier
 	tokenHere
+	tokenFunction
 	tokenLeftParen
 	tokenRightParen
 )
 
 func (tt tokentype) isValue() bool {
-	return tt == tokenNumber || tt == tokenIdentifier || tt == tokenHere
+	return tt == tokenNumber || tt == tokenIdentifier || tt == tokenHere || tt == tokenFunction
 }
 
 func (tt tokentype) canPrecedeUnaryOp() bool {
@@ -270,6 +308,7 @@ type token struct {
 	stringLiteral fstring
 	identifier    fstring
 	op            exprOp
+	call          *expr // if typ == tokenFunction, the parsed call
 }
 
 //
@@ -283,6 +322,9 @@ type exprParser struct {
 	flags         parseFlags
 	prevTokenType tokentype
 	errors        []asmerror
+	refs          []*expr                       // identifiers parsed, for the cross-reference
+	sizeOf        func(name string) (int, bool) // size of the data at a label, for sizeof()
+	defined       func(name string) bool        // whether a symbol is defined so far, for defined()
 }
 
 // Parse an expression from the line until it is exhausted.
@@ -298,7 +340,7 @@ func (p *exprParser) parse(line, scopeLabel fstring, flags parseFlags) (e *expr,
 
 		// Parse the next expression token
 		var token token
-		token, remain, err = p.parseToken(line)
+		token, remain, err = p.parseToken(line, scopeLabel)
 		if err != nil {
 			break
 		}
@@ -337,6 +379,7 @@ func (p *exprParser) parse(line, scopeLabel fstring, flags parseFlags) (e *expr,
 				scopeLabel: scopeLabel,
 			}
 			p.operandStack.push(e)
+			p.refs = append(p.refs, e)
 
 		case tokenHere:
 			e := &expr{
@@ -346,6 +389,9 @@ func (p *exprParser) parse(line, scopeLabel fstring, flags parseFlags) (e *expr,
 			}
 			p.operandStack.push(e)
 
+		case tokenFunction:
+			p.operandStack.push(token.call)
+
 		case tokenOp:
 			for err == nil && !p.operatorStack.empty() && token.op.collapses(p.operatorStack.peek()) {
 				err = collapse(&p.operandStack, p.operatorStack.pop())
@@ -431,7 +477,7 @@ func collapse(s *stack[*expr], op exprOp) error {
 }
 
 // Attempt to parse the next token from the line.
-func (p *exprParser) parseToken(line fstring) (t token, remain fstring, err error) {
+func (p *exprParser) parseToken(line, scopeLabel fstring) (t token, remain fstring, err error) {
 	if line.isEmpty() {
 		return token{typ: tokenNil}, line, nil
 	}
@@ -442,7 +488,7 @@ func (p *exprParser) parseToken(line fstring) (t token, remain fstring, err erro
 		t.typ = tokenHere
 		t.bytes = 2
 
-	case line.startsWith(decimal) || line.startsWithChar('$') || line.startsWithChar('%'):
+	case line.startsWith(decimal) || line.startsWithChar('$') || line.startsWithChar('%') || line.startsWithChar('!'):
 		t.value, t.bytes, remain, err = p.parseNumber(line)
 		t.typ = tokenNumber
 		if p.prevTokenType.isValue() || p.prevTokenType == tokenRightParen {
@@ -486,6 +532,16 @@ func (p *exprParser) parseToken(line fstring) (t token, remain fstring, err erro
 			p.addError(line, "invalid identifier")
 			err = errParse
 		}
+		if err == nil && remain.startsWithChar('(') {
+			t.typ = tokenFunction
+			t.call, remain, err = p.parseFunction(t.identifier, remain.consume(1), scopeLabel)
+		}
+
+	case line.startsWithChar('*') && p.prevTokenType.canPrecedeUnaryOp():
+		// Where a value is expected, '*' is the current address.
+		remain = line.consume(1)
+		t.typ = tokenHere
+		t.bytes = 2
 
 	default:
 		for i, o := range ops {
@@ -513,6 +569,7 @@ func (p *exprParser) parseToken(line fstring) (t token, remain fstring, err erro
 //	$[0-9a-fA-F]+    Hexadecimal number
 //	0x[0-9a-fA-F]+   Hexadecimal number
 //	0b[01]+          Binary number
+//	![0-9]+          Packed BCD number (two decimal digits per byte)
 //
 // The function returns the parsed value, the number of bytes used to
 // hold the value, the remainder of the line, and any parsing error
@@ -523,7 +580,8 @@ func (p *exprParser) parseToken(line fstring) (t token, remain fstring, err erro
 // string is used to determine how many bytes are required to hold the
 // value.  For example, if the parsed string is "0x0020", the number of bytes
 // required to hold the value is 2, while if the parse string is "0x20", the
-// number of bytes required is 1.
+// number of bytes required is 1. BCD values are sized the same way, so
+// "!59" is the byte $59 and "!0100" is the word $0100.
 //
 // If a decimal number if parsed, the length of the parsed string is ignored,
 // and the minimum number of bytes required to hold the value is returned.
@@ -548,6 +606,10 @@ func (p *exprParser) parseNumber(line fstring) (value, bytes int, remain fstring
 	case line.startsWithString("0b"):
 		line = line.consume(2)
 		base, fn, bitsPerChar = 2, binarynum, 1
+	case line.startsWithChar('!'):
+		// Decimal digits read as hexadecimal yield their packed BCD form.
+		line = line.consume(1)
+		base, fn, bitsPerChar = 16, decimal, 4
 	}
 
 	numstr, remain := line.consumeWhile(fn)
@@ -621,7 +683,7 @@ func (p *exprParser) parseCharLiteral(line fstring) (value int, remain fstring,
 }
 
 func (p *exprParser) addError(line fstring, msg string) {
-	p.errors = append(p.errors, asmerror{line, msg})
+	p.errors = append(p.errors, asmerror{line: line, msg: msg})
 }
 
 func (p *exprParser) reset() {
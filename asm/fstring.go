@@ -7,15 +7,16 @@ package asm
 // An fstring is a string that keeps track of its position within the
 // file from which it was read.
 type fstring struct {
-	fileIndex int    // index of file in the assembly
-	row       int    // 1-based line number of substring
-	column    int    // 0-based column of start of substring
-	str       string // the actual substring of interest
-	full      string // the full line as originally read from the file
+	fileIndex int        // index of file in the assembly
+	row       int        // 1-based line number of substring
+	column    int        // 0-based column of start of substring
+	str       string     // the actual substring of interest
+	full      string     // the full line as originally read from the file
+	exp       *expansion // macro expansion producing the line, if any
 }
 
 func newFstring(fileIndex, row int, str string) fstring {
-	return fstring{fileIndex, row, 0, str, str}
+	return fstring{fileIndex, row, 0, str, str, nil}
 }
 
 func (l *fstring) String() string {
@@ -36,11 +37,11 @@ func (l *fstring) advanceColumn(n int) int {
 
 func (l fstring) consume(n int) fstring {
 	col := l.advanceColumn(n)
-	return fstring{l.fileIndex, l.row, col, l.str[n:], l.full}
+	return fstring{l.fileIndex, l.row, col, l.str[n:], l.full, l.exp}
 }
 
 func (l fstring) trunc(n int) fstring {
-	return fstring{l.fileIndex, l.row, l.column, l.str[:n], l.full}
+	return fstring{l.fileIndex, l.row, l.column, l.str[:n], l.full, l.exp}
 }
 
 func (l *fstring) isEmpty() bool {
@@ -104,14 +105,20 @@ func (l *fstring) consumeUntilChar(c byte) (consumed, remain fstring) {
 
 func (l *fstring) consumeUntilUnquotedChar(c byte) (consumed, remain fstring) {
 	var quote byte
+	depth := 0
 	i := 0
 	for ; i < len(l.str); i++ {
 		if quote == 0 {
-			if l.str[i] == c {
+			if l.str[i] == c && depth == 0 {
 				break
 			}
-			if l.str[i] == '\'' || l.str[i] == '"' {
+			switch l.str[i] {
+			case '\'', '"':
 				quote = l.str[i]
+			case '(':
+				depth++
+			case ')':
+				depth = max(depth-1, 0)
 			}
 		} else {
 			if l.str[i] == quote {
@@ -0,0 +1,263 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A function describes a built-in expression function.
+type function struct {
+	minArgs int
+	maxArgs int  // -1 for any number
+	symbol  bool // the argument is a symbol name, which isn't evaluated
+	str     bool // the argument is a string literal
+}
+
+// Built-in expression functions, by name. The names are case-insensitive.
+var functions = map[string]function{
+	"lo":      {1, 1, false, false},  // low byte of a value
+	"hi":      {1, 1, false, false},  // high byte of a value
+	"defined": {1, 1, true, false},   // 1 if a symbol is defined on an earlier line
+	"sizeof":  {1, 1, true, false},   // bytes from a label to the next label, or a structure size
+	"strlen":  {1, 1, false, true},   // length of a string literal
+	"min":     {2, -1, false, false}, // smallest argument
+	"max":     {2, -1, false, false}, // largest argument
+	"abs":     {1, 1, false, false},  // absolute value
+}
+
+// Parse a call to a built-in function. The line starts just after the
+// opening parenthesis. Each argument is parsed as an expression of its
+// own.
+func (p *exprParser) parseFunction(name, line, scopeLabel fstring) (e *expr, remain fstring, err error) {
+	fname := strings.ToLower(name.str)
+	fn, ok := functions[fname]
+	if !ok {
+		p.addError(name, "unknown function '"+name.str+"'")
+		return nil, line, errParse
+	}
+
+	fields, remain, ok := splitArgs(line)
+	if !ok {
+		p.addError(name, "missing ')' after arguments to '"+fname+"'")
+		return nil, remain, errParse
+	}
+
+	switch n := len(fields); {
+	case fn.maxArgs < 0 && n < fn.minArgs:
+		p.addError(name, plural("'%s' expects at least %d argument%s, got %d", fname, fn.minArgs, n))
+		return nil, remain, errParse
+	case fn.maxArgs >= 0 && (n < fn.minArgs || n > fn.maxArgs):
+		p.addError(name, plural("'%s' expects %d argument%s, got %d", fname, fn.maxArgs, n))
+		return nil, remain, errParse
+	}
+
+	e = &expr{op: opFunction, fn: fname, sizeOf: p.sizeOf}
+	for _, f := range fields {
+		if f.isEmpty() {
+			p.addError(f, "missing argument to '"+fname+"'")
+			return nil, remain, errParse
+		}
+
+		sub := exprParser{sizeOf: p.sizeOf, defined: p.defined}
+		arg, _, err := sub.parse(f, scopeLabel, allowParentheses|allowStrings)
+		p.errors = append(p.errors, sub.errors...)
+		p.refs = append(p.refs, sub.refs...)
+		if err != nil {
+			return nil, remain, err
+		}
+
+		switch {
+		case fn.symbol && arg.op != opIdentifier:
+			p.addError(f, "'"+fname+"' expects a symbol name")
+			return nil, remain, errParse
+		case fn.str && !arg.isString:
+			p.addError(f, "'"+fname+"' expects a string")
+			return nil, remain, errParse
+		case !fn.str && arg.isString:
+			p.addError(f, "'"+fname+"' doesn't take a string")
+			return nil, remain, errParse
+		}
+		e.args = append(e.args, arg)
+	}
+
+	// lo() and hi() are the same as the '<' and '>' operators, and
+	// defined() depends only on the symbols seen before this line.
+	switch fname {
+	case "lo":
+		e = &expr{op: opLowByte, child0: e.args[0]}
+	case "hi":
+		e = &expr{op: opHighByte, child0: e.args[0]}
+	case "defined":
+		if p.defined != nil {
+			e.value, e.bytes, e.evaluated = 0, 1, true
+			if p.defined(refKey(e.args[0])) {
+				e.value = 1
+			}
+		}
+	}
+	return e, remain, nil
+}
+
+// Format an argument count error.
+func plural(format, fname string, want, got int) string {
+	s := "s"
+	if want == 1 {
+		s = ""
+	}
+	return fmt.Sprintf(format, fname, want, s, got)
+}
+
+// Split the arguments of a function call at the commas that aren't nested
+// in parentheses or quoted, up to the closing parenthesis. Returns false
+// if there is no closing parenthesis.
+func splitArgs(line fstring) (args []fstring, remain fstring, ok bool) {
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(line.str); i++ {
+		c := line.str[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == ')' || (c == ',' && depth == 0):
+			arg := line.consume(start).trunc(i - start)
+			arg = arg.consumeWhitespace()
+			arg = arg.trunc(len(strings.TrimRight(arg.str, " \t")))
+			if c == ')' && len(args) == 0 && arg.isEmpty() {
+				return nil, line.consume(i + 1), true
+			}
+			args = append(args, arg)
+			if c == ')' {
+				return args, line.consume(i + 1), true
+			}
+			start = i + 1
+		}
+	}
+	return nil, fstring{}, false
+}
+
+// Evaluate a call to a built-in function.
+func (e *expr) evalFunction(addr int, constants map[string]*expr, labels map[string]int) {
+	switch e.fn {
+	case "defined":
+		key := refKey(e.args[0])
+		_, isConst := constants[key]
+		_, isLabel := labels[key]
+		e.value = 0
+		if isConst || isLabel {
+			e.value = 1
+		}
+		e.evaluated = true
+
+	case "sizeof":
+		if e.sizeOf != nil {
+			e.value, e.evaluated = e.sizeOf(refKey(e.args[0]))
+		}
+
+	case "strlen":
+		e.value, e.evaluated = len(e.args[0].stringLiteral.str), true
+
+	default:
+		for _, arg := range e.args {
+			arg.eval(addr, constants, labels)
+			if arg.address {
+				e.address = true
+			}
+		}
+		for _, arg := range e.args {
+			if !arg.evaluated {
+				return
+			}
+		}
+		v := e.args[0].value
+		for _, arg := range e.args[1:] {
+			switch {
+			case e.fn == "min" && arg.value < v, e.fn == "max" && arg.value > v:
+				v = arg.value
+			}
+		}
+		if e.fn == "abs" && v < 0 {
+			v = -v
+		}
+		e.value, e.evaluated = v, true
+	}
+
+	if e.evaluated {
+		e.bytes = valueBytes(e.value)
+		if e.address {
+			e.bytes = 2
+		}
+	}
+}
+
+// Return the number of bytes needed to hold a value.
+func valueBytes(v int) int {
+	switch {
+	case v > 0xffff || v < -0x8000:
+		return 4
+	case v > 0xff || v < -0x80:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Return the number of bytes from a label to the next label, origin or
+// section, once addresses have been assigned up to there, or the size of a
+// structure.
+func (a *assembler) labelSize(name string) (int, bool) {
+	if s, ok := a.structs[name]; ok {
+		return s.size, true
+	}
+	start, ok := a.labels[name]
+	if !ok || a.segaddr(start) == -1 {
+		return 0, false
+	}
+	end := len(a.segments)
+	for _, seg := range a.labels {
+		if seg > start && seg < end {
+			end = seg
+		}
+	}
+
+	size := 0
+	for i := start; i < end; i++ {
+		switch ss := a.segments[i].(type) {
+		case *origin, *section:
+			return size, true
+		case *instruction:
+			if ss.addr == -1 || ss.inst == nil {
+				return 0, false
+			}
+			size += int(ss.inst.Length)
+		case *alignment:
+			if ss.addr == -1 {
+				return 0, false
+			}
+			size += ss.pad
+		default:
+			if ss.address() == -1 {
+				return 0, false
+			}
+			size += a.segmentSize(i)
+		}
+	}
+	return size, true
+}
+
+// Return true if a constant or label has been defined by the lines parsed
+// so far.
+func (a *assembler) symbolDefined(name string) bool {
+	_, isConst := a.constants[name]
+	_, isLabel := a.labels[name]
+	return isConst || isLabel
+}
@@ -0,0 +1,364 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"bufio"
+	"bytes"
+	hexenc "encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Supported memory image file formats.
+const (
+	FormatRaw     = "raw"     // raw binary data
+	FormatIntel   = "ihex"    // Intel HEX
+	FormatSRecord = "srecord" // Motorola S-record
+)
+
+// recordBytes is the number of data bytes written to each record.
+const recordBytes = 16
+
+// A Block is a run of bytes loaded at a memory address.
+type Block struct {
+	Address uint16
+	Flags   byte // SegmentROM, SegmentRAM and SegmentExec
+	Data    []byte
+}
+
+// An Image is a memory image made of one or more blocks, as stored in an
+// Intel HEX or S-record file.
+type Image struct {
+	Blocks []Block
+	Entry  int // entry point address, or -1 if none
+}
+
+// Image returns the assembled machine code as a memory image.
+func (a *Assembly) Image() *Image {
+	if a.Blocks == nil {
+		return &Image{
+			Blocks: []Block{{Address: a.Origin, Data: a.Code}},
+			Entry:  int(a.Origin),
+		}
+	}
+	return &Image{Blocks: a.Blocks, Entry: int(a.Entry)}
+}
+
+// A RecordError describes a malformed record in a HEX or S-record file.
+type RecordError struct {
+	Line int
+	Msg  string
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// RecordErrors is a list of record errors, returned when one or more
+// records of a file could not be read.
+type RecordErrors []*RecordError
+
+func (e RecordErrors) Error() string {
+	s := make([]string, len(e))
+	for i, r := range e {
+		s[i] = r.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// DetectFormat returns the format of a memory image file, judged first by
+// its extension and then by its content.
+func DetectFormat(filename string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".hex", ".ihx", ".ihex":
+		return FormatIntel
+	case ".s19", ".s28", ".s37", ".srec", ".mot":
+		return FormatSRecord
+	case ".bin":
+		return FormatRaw
+	}
+
+	s := bytes.TrimLeft(content, " \t\r\n")
+	switch {
+	case len(s) > 0 && s[0] == ':':
+		return FormatIntel
+	case len(s) > 1 && s[0] == 'S' && s[1] >= '0' && s[1] <= '9':
+		return FormatSRecord
+	}
+	return FormatRaw
+}
+
+// ReadImage reads an Intel HEX or S-record file in the given format.
+func ReadImage(r io.Reader, format string) (*Image, error) {
+	switch format {
+	case FormatIntel:
+		return ReadIntelHex(r)
+	case FormatSRecord:
+		return ReadSRecord(r)
+	}
+	return nil, fmt.Errorf("unsupported image format '%s'", format)
+}
+
+// Add data to an image, extending the previous block if it is contiguous.
+func (img *Image) add(addr uint16, data []byte) {
+	if n := len(img.Blocks); n > 0 {
+		b := &img.Blocks[n-1]
+		if int(b.Address)+len(b.Data) == int(addr) {
+			b.Data = append(b.Data, data...)
+			return
+		}
+	}
+	img.Blocks = append(img.Blocks, Block{Address: addr, Data: append([]byte(nil), data...)})
+}
+
+// Split each block of an image into chunks of at most recordBytes, and call
+// fn for each.
+func (img *Image) records(fn func(addr uint16, data []byte) error) error {
+	for _, b := range img.Blocks {
+		for i := 0; i < len(b.Data); i += recordBytes {
+			j := i + recordBytes
+			if j > len(b.Data) {
+				j = len(b.Data)
+			}
+			if err := fn(b.Address+uint16(i), b.Data[i:j]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return the two's complement checksum used by Intel HEX records.
+func intelChecksum(b []byte) byte {
+	var sum byte
+	for _, v := range b {
+		sum += v
+	}
+	return -sum
+}
+
+// Return the ones' complement checksum used by S-records.
+func srecChecksum(b []byte) byte {
+	var sum byte
+	for _, v := range b {
+		sum += v
+	}
+	return ^sum
+}
+
+// WriteIntelHex writes an image as Intel HEX records. The entry point, if
+// any, is written as a start linear address record.
+func WriteIntelHex(w io.Writer, img *Image) error {
+	write := func(typ byte, addr uint16, data []byte) error {
+		rec := append([]byte{byte(len(data)), byte(addr >> 8), byte(addr), typ}, data...)
+		rec = append(rec, intelChecksum(rec))
+		_, err := fmt.Fprintf(w, ":%s\n", strings.ToUpper(hexenc.EncodeToString(rec)))
+		return err
+	}
+
+	err := img.records(func(addr uint16, data []byte) error {
+		return write(0x00, addr, data)
+	})
+	if err != nil {
+		return err
+	}
+	if img.Entry >= 0 {
+		e := uint32(img.Entry)
+		if err := write(0x05, 0, []byte{byte(e >> 24), byte(e >> 16), byte(e >> 8), byte(e)}); err != nil {
+			return err
+		}
+	}
+	return write(0x01, 0, nil)
+}
+
+// ReadIntelHex reads an image from Intel HEX records. Malformed records and
+// checksum mismatches are collected and returned together as RecordErrors.
+func ReadIntelHex(r io.Reader) (*Image, error) {
+	img := &Image{Entry: -1}
+	var errs RecordErrors
+	var base uint32 // upper address bits from extended address records
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" {
+			continue
+		}
+		fail := func(format string, args ...any) {
+			errs = append(errs, &RecordError{line, fmt.Sprintf(format, args...)})
+		}
+
+		if s[0] != ':' {
+			fail("record does not start with ':'")
+			continue
+		}
+		rec, err := hexenc.DecodeString(s[1:])
+		if err != nil || len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			fail("malformed record")
+			continue
+		}
+		n := len(rec) - 1
+		if sum := intelChecksum(rec[:n]); sum != rec[n] {
+			fail("checksum error (expected $%02X, got $%02X)", sum, rec[n])
+			continue
+		}
+
+		addr := uint32(rec[1])<<8 | uint32(rec[2])
+		data := rec[4:n]
+		switch rec[3] {
+		case 0x00:
+			a := base + addr
+			if a+uint32(len(data)) > 0x10000 {
+				fail("data beyond $FFFF")
+				continue
+			}
+			img.add(uint16(a), data)
+		case 0x01:
+			if len(errs) > 0 {
+				return img, errs
+			}
+			return img, nil
+		case 0x02:
+			if len(data) == 2 {
+				base = (uint32(data[0])<<8 | uint32(data[1])) << 4
+			}
+		case 0x04:
+			if len(data) == 2 {
+				base = (uint32(data[0])<<8 | uint32(data[1])) << 16
+			}
+		case 0x03, 0x05:
+			if len(data) == 4 {
+				hi := uint32(data[0])<<8 | uint32(data[1])
+				lo := uint32(data[2])<<8 | uint32(data[3])
+				if rec[3] == 0x03 {
+					img.Entry = int((hi<<4 + lo) & 0xffff) // CS:IP
+				} else {
+					img.Entry = int((hi<<16 | lo) & 0xffff)
+				}
+			}
+		default:
+			fail("unknown record type $%02X", rec[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return img, err
+	}
+	if len(errs) > 0 {
+		return img, errs
+	}
+	return img, nil
+}
+
+// WriteSRecord writes an image as Motorola S-records: an S0 header with the
+// given name, S1 data records, an S5 record count and an S9 record holding
+// the entry point.
+func WriteSRecord(w io.Writer, img *Image, name string) error {
+	write := func(typ byte, addr uint16, data []byte) error {
+		rec := append([]byte{byte(len(data) + 3), byte(addr >> 8), byte(addr)}, data...)
+		rec = append(rec, srecChecksum(rec))
+		_, err := fmt.Fprintf(w, "S%c%s\n", typ, strings.ToUpper(hexenc.EncodeToString(rec)))
+		return err
+	}
+
+	if err := write('0', 0, []byte(name)); err != nil {
+		return err
+	}
+	count := 0
+	err := img.records(func(addr uint16, data []byte) error {
+		count++
+		return write('1', addr, data)
+	})
+	if err != nil {
+		return err
+	}
+	if count <= 0xffff {
+		if err := write('5', uint16(count), nil); err != nil {
+			return err
+		}
+	}
+	entry := 0
+	if img.Entry >= 0 {
+		entry = img.Entry
+	}
+	return write('9', uint16(entry), nil)
+}
+
+// ReadSRecord reads an image from Motorola S-records. Malformed records and
+// checksum mismatches are collected and returned together as RecordErrors.
+func ReadSRecord(r io.Reader) (*Image, error) {
+	img := &Image{Entry: -1}
+	var errs RecordErrors
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" {
+			continue
+		}
+		fail := func(format string, args ...any) {
+			errs = append(errs, &RecordError{line, fmt.Sprintf(format, args...)})
+		}
+
+		if len(s) < 2 || s[0] != 'S' || s[1] < '0' || s[1] > '9' {
+			fail("record does not start with 'S0'-'S9'")
+			continue
+		}
+		rec, err := hexenc.DecodeString(s[2:])
+		if err != nil || len(rec) < 3 || len(rec) != int(rec[0])+1 {
+			fail("malformed record")
+			continue
+		}
+		n := len(rec) - 1
+		if sum := srecChecksum(rec[:n]); sum != rec[n] {
+			fail("checksum error (expected $%02X, got $%02X)", sum, rec[n])
+			continue
+		}
+
+		// The address field is 2, 3 or 4 bytes long depending on the type.
+		size := map[byte]int{'0': 2, '1': 2, '2': 3, '3': 4, '5': 2, '6': 3, '7': 4, '8': 3, '9': 2}[s[1]]
+		if size == 0 || n < 1+size {
+			fail("unsupported record type S%c", s[1])
+			continue
+		}
+		var addr uint32
+		for _, b := range rec[1 : 1+size] {
+			addr = addr<<8 | uint32(b)
+		}
+		data := rec[1+size : n]
+
+		switch s[1] {
+		case '1', '2', '3':
+			if addr+uint32(len(data)) > 0x10000 {
+				fail("data beyond $FFFF")
+				continue
+			}
+			img.add(uint16(addr), data)
+		case '7', '8', '9':
+			img.Entry = int(addr & 0xffff)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return img, err
+	}
+	if len(errs) > 0 {
+		return img, errs
+	}
+	return img, nil
+}
+
+// Create a file and write an image to it with the function fn.
+func writeImageFile(path string, fn func(w io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
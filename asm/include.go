@@ -0,0 +1,192 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// An IncludeDir is a directory searched for files named by .include and
+// .bin, such as with the -I command line option. Directories are searched
+// in the order given, after the current directory and the directory of
+// the including file.
+type IncludeDir string
+
+func (d IncludeDir) apply(a *assembler) {
+	if d != "" {
+		a.includeDirs = append(a.includeDirs, string(d))
+	}
+}
+
+// SplitIncludePath splits a list of directories separated by the OS path
+// list separator, as in the ASMPATH environment variable, into IncludeDir
+// settings.
+func SplitIncludePath(path string) []Setting {
+	var dirs []Setting
+	for _, d := range filepath.SplitList(path) {
+		if d != "" {
+			dirs = append(dirs, IncludeDir(d))
+		}
+	}
+	return dirs
+}
+
+// Find a file named by an include directive. Returns false if it isn't in
+// any of the searched directories.
+func (a *assembler) findInclude(line, filename fstring) (string, bool) {
+	name := filename.str
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		if from := a.files[line.fileIndex]; from != "" {
+			candidates = append(candidates, a.joinPath(a.dirPath(from), name))
+		}
+		for _, dir := range a.includeDirs {
+			candidates = append(candidates, a.joinPath(dir, name))
+		}
+	}
+
+	for _, path := range candidates {
+		if a.isFile(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// Open a file named by the source. Files come from the file system given
+// to AssembleFS, or else from the operating system.
+func (a *assembler) openFile(path string) (io.ReadCloser, error) {
+	if a.fsys != nil {
+		return a.fsys.Open(path)
+	}
+	return os.Open(path)
+}
+
+// Return true if a path names a regular file.
+func (a *assembler) isFile(path string) bool {
+	var info fs.FileInfo
+	var err error
+	if a.fsys != nil {
+		info, err = fs.Stat(a.fsys, path)
+	} else {
+		info, err = os.Stat(path)
+	}
+	return err == nil && !info.IsDir()
+}
+
+// File system paths always use slashes.
+func (a *assembler) joinPath(dir, name string) string {
+	if a.fsys != nil {
+		return path.Join(dir, name)
+	}
+	return filepath.Join(dir, name)
+}
+
+func (a *assembler) dirPath(name string) string {
+	if a.fsys != nil {
+		return path.Dir(name)
+	}
+	return filepath.Dir(name)
+}
+
+// Return the canonical form of a path, used to recognize a file included
+// under different names.
+func (a *assembler) canonicalPath(name string) string {
+	if a.fsys != nil {
+		return path.Clean(name)
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
+// Record a file the assembly depends on, once.
+func (a *assembler) addDependency(path string) {
+	for _, d := range a.deps {
+		if d == path {
+			return
+		}
+	}
+	a.deps = append(a.deps, path)
+}
+
+// Check that including a file doesn't include a file that is already
+// being parsed. Returns false after reporting the cycle.
+func (a *assembler) checkIncludeCycle(filename fstring, canonical string) bool {
+	for i, f := range a.includeStack {
+		if f != canonical {
+			continue
+		}
+		var names []string
+		for _, g := range a.includeStack[i:] {
+			names = append(names, filepath.Base(g))
+		}
+		names = append(names, filepath.Base(canonical))
+		a.addError(filename, "include cycle: %s", strings.Join(names, " -> "))
+		return false
+	}
+	return true
+}
+
+// Parse a ".once" pseudo-op, which stops the file containing it from
+// being included again.
+func (a *assembler) parseOnce(line, label fstring, param any) error {
+	a.logLine(line, "once")
+	a.once[a.canonicalPath(a.files[line.fileIndex])] = true
+	return nil
+}
+
+// Write the dependency (.d) file for an assembled file, if the
+// Dependencies option asks for one.
+func writeDependencyFile(prefix, source string, outputs []string, assembly *Assembly, options Option, out io.Writer) error {
+	if options&Dependencies == 0 {
+		return nil
+	}
+	depPath := prefix + ".d"
+	err := writeImageFile(depPath, func(w io.Writer) error {
+		return writeDependencies(w, outputs, source, assembly.Includes)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Wrote dependencies to '%s'.\n", filepath.Base(depPath))
+	return nil
+}
+
+// Write a Makefile rule saying the targets depend on the source file and
+// everything it included. Each dependency also gets an empty rule, so make
+// doesn't fail when an included file is removed.
+func writeDependencies(w io.Writer, targets []string, source string, deps []string) error {
+	var escaped []string
+	for _, t := range targets {
+		escaped = append(escaped, makeEscape(t))
+	}
+	line := strings.Join(escaped, " ") + ":"
+	for _, d := range append([]string{source}, deps...) {
+		line += " \\\n  " + makeEscape(d)
+	}
+	if _, err := fmt.Fprintln(w, line); err != nil {
+		return err
+	}
+
+	for _, d := range deps {
+		if _, err := fmt.Fprintf(w, "\n%s:\n", makeEscape(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Escape the characters make treats specially in file names.
+func makeEscape(s string) string {
+	s = strings.ReplaceAll(s, "$", "$$")
+	s = strings.ReplaceAll(s, "#", "\\#")
+	return strings.ReplaceAll(s, " ", "\\ ")
+}
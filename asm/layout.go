@@ -0,0 +1,315 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"strings"
+)
+
+// A layout is a .struct or .enum block whose lines are being parsed.
+//
+//	NODE    .struct
+//	next    .dw
+//	value   .db
+//	        .endstruct
+//
+// Each field of a structure becomes a constant holding its offset, named
+// after the structure and the field (NODE.next), and the structure's name
+// is a constant holding its size. Each member of an enumeration is a
+// constant one greater than the member before it.
+type layout struct {
+	enum   bool
+	name   string
+	def    fstring // the .struct or .enum line
+	offset int     // offset of the next field, or value of the next member
+	fields []field
+}
+
+// A field of a structure.
+type field struct {
+	name   string
+	offset int
+}
+
+// A structure declared with .struct.
+type structDef struct {
+	size   int
+	fields []field
+}
+
+// Parse a ".struct" or ".enum" declaration. The name is either the label or
+// the first word following the pseudo-op. An enumeration may give the value
+// of its first member, which is otherwise 0.
+func (a *assembler) parseLayout(line, label fstring, param any) error {
+	enum := param.(bool)
+	a.logLine(line, "layout=")
+
+	def := line
+	name := label
+	if name.isEmpty() && line.startsWith(identifierStartChar) {
+		name, line = line.consumeWhile(labelChar)
+		line = line.consumeWhitespace()
+		if line.startsWithChar(',') {
+			line = line.consume(1).consumeWhitespace()
+		}
+	}
+
+	l := &layout{enum: enum, name: name.str, def: def}
+	switch {
+	case !enum && name.isEmpty():
+		a.addError(def, "structure requires a name")
+		return errParse
+	case name.startsWithChar('.') || name.startsWithChar('@'):
+		a.addError(name, "invalid name '%s'", name.str)
+		return errParse
+	case !enum && !line.isEmpty():
+		a.addError(line, "unexpected '%s' after structure name", line.str)
+		return errParse
+	case enum && !line.isEmpty():
+		v, ok := a.layoutValue(line)
+		if !ok {
+			return errParse
+		}
+		l.offset = v
+	}
+
+	a.layout = l
+	return nil
+}
+
+// Parse a line inside a .struct or .enum block. The block ends at
+// ".endstruct" or ".endenum".
+func (a *assembler) parseLayoutLine(line fstring) error {
+	word, _ := directiveWord(line)
+	switch strings.ToLower(word.str) {
+	case ".endstruct", ".ends":
+		if a.layout.enum {
+			a.addError(word, "'%s' ends an enumeration", word.str)
+			return errParse
+		}
+		return a.endLayout(word)
+	case ".endenum", ".ende":
+		if !a.layout.enum {
+			a.addError(word, "'%s' ends a structure", word.str)
+			return errParse
+		}
+		return a.endLayout(word)
+	case ".struct", ".enum":
+		a.addError(word, "structures and enumerations may not be nested")
+		return errParse
+	}
+
+	line = line.stripTrailingComment()
+	if line.isEmpty() || line.startsWithChar('*') {
+		return nil
+	}
+	if a.layout.enum {
+		return a.parseEnumLine(line.consumeWhitespace())
+	}
+	return a.parseFieldLine(line)
+}
+
+// Parse a structure field: an optional name followed by its type and an
+// optional count. The type is .db, .dw, .dd or the name of another
+// structure; ".fill n" reserves n bytes.
+func (a *assembler) parseFieldLine(line fstring) error {
+	var name fstring
+	if !line.startsWith(whitespace) {
+		var err error
+		name, line, err = a.parseLabel(line)
+		if err != nil {
+			return err
+		}
+	}
+	line = line.consumeWhitespace()
+
+	size, count := 0, 1
+	var nested *structDef
+	if !line.isEmpty() {
+		word, remain := line.consumeWhile(wordChar)
+		remain = remain.consumeWhitespace()
+		switch strings.ToLower(word.str) {
+		case ".db", ".byte":
+			size = 1
+		case ".dw", ".word":
+			size = 2
+		case ".dd", ".dword":
+			size = 4
+		case ".fill", ".res":
+			size = 1
+			if remain.isEmpty() {
+				a.addError(word, "'%s' requires a byte count", word.str)
+				return errParse
+			}
+		default:
+			s, ok := a.structs[word.str]
+			if !ok {
+				a.addError(word, "unknown field type '%s'", word.str)
+				return errParse
+			}
+			size, nested = s.size, s
+		}
+
+		if !remain.isEmpty() {
+			v, ok := a.layoutValue(remain)
+			if !ok {
+				return errParse
+			}
+			if v < 0 {
+				a.addError(remain, "field count %d is negative", v)
+				return errParse
+			}
+			count = v
+		}
+	}
+
+	l := a.layout
+	if !name.isEmpty() {
+		if err := a.defineLayoutSymbol(l.name+"."+name.str, l.offset, name); err != nil {
+			return err
+		}
+		l.fields = append(l.fields, field{name.str, l.offset})
+
+		// The fields of a nested structure are reached through this one.
+		if nested != nil {
+			for _, f := range nested.fields {
+				sub := name.str + "." + f.name
+				if err := a.defineLayoutSymbol(l.name+"."+sub, l.offset+f.offset, name); err != nil {
+					return err
+				}
+				l.fields = append(l.fields, field{sub, l.offset + f.offset})
+			}
+		}
+	}
+	l.offset += size * count
+	return nil
+}
+
+// Parse the members of an enumeration. A line holds one or more
+// comma-separated names, each optionally followed by "= value".
+func (a *assembler) parseEnumLine(line fstring) error {
+	l := a.layout
+	for _, f := range a.splitFields(line) {
+		name, remain := f.consumeWhile(labelChar)
+		remain = remain.consumeWhitespace()
+		if name.isEmpty() || !name.startsWith(identifierStartChar) {
+			a.addError(f, "invalid enumeration member '%s'", f.str)
+			return errParse
+		}
+		if remain.startsWithChar('=') {
+			v, ok := a.layoutValue(remain.consume(1).consumeWhitespace())
+			if !ok {
+				return errParse
+			}
+			l.offset = v
+		} else if !remain.isEmpty() {
+			a.addError(remain, "expected '=' after '%s'", name.str)
+			return errParse
+		}
+
+		key := name.str
+		if l.name != "" {
+			key = l.name + "." + name.str
+		}
+		if err := a.defineLayoutSymbol(key, l.offset, name); err != nil {
+			return err
+		}
+		l.offset++
+	}
+	return nil
+}
+
+// Finish a .struct or .enum block.
+func (a *assembler) endLayout(word fstring) error {
+	l := a.layout
+	a.layout = nil
+	a.logLine(word, "endlayout=%s", l.name)
+
+	if l.enum {
+		return nil
+	}
+	a.structs[l.name] = &structDef{size: l.offset, fields: l.fields}
+	return a.defineLayoutSymbol(l.name, l.offset, l.def)
+}
+
+// Evaluate an expression in a layout block. It may only use numbers and
+// symbols defined before it.
+func (a *assembler) layoutValue(line fstring) (int, bool) {
+	e, _, err := a.exprParser.parse(line, a.scopeLabel, allowParentheses)
+	if err != nil {
+		a.addExprErrors()
+		return 0, false
+	}
+	if !e.eval(-1, a.constants, a.labels) {
+		a.addError(line, "unable to evaluate '%s' here", line.str)
+		return 0, false
+	}
+	return e.value, true
+}
+
+// Define a constant declared by a .struct or .enum block. Such constants
+// aren't reported when unused, since a layout usually declares more than
+// any one program needs.
+func (a *assembler) defineLayoutSymbol(name string, v int, line fstring) error {
+	_, isConst := a.constants[name]
+	_, isLabel := a.labels[name]
+	if isConst || isLabel {
+		a.addError(line, "symbol '%s' defined more than once", name)
+		return errParse
+	}
+	a.constants[name] = &expr{op: opNumber, value: v, bytes: valueBytes(v), evaluated: true}
+	a.symbolDefs[name] = line
+	a.declared[name] = true
+	a.logLine(line, "const=%s val=$%X", name, v)
+	return nil
+}
+
+// Report an ".endstruct" or ".endenum" that has no matching declaration.
+func (a *assembler) parseEndLayout(line, label fstring, param any) error {
+	a.addError(line, "no %s to end", param.(string))
+	return errParse
+}
+
+// Parse a ".fill count[, value]" pseudo-op, which repeats a byte value
+// (0 if omitted) count times.
+func (a *assembler) parseFill(line, label fstring, param any) error {
+	a.logLine(line, "fill=")
+
+	fields := a.splitFields(line)
+	if len(fields) < 1 || len(fields) > 2 {
+		a.addError(line, "fill requires a count and an optional value")
+		return errParse
+	}
+
+	lenExpr, _, err := a.exprParser.parse(fields[0], a.scopeLabel, allowParentheses)
+	if err != nil {
+		a.addExprErrors()
+		return err
+	}
+	if !lenExpr.eval(-1, a.constants, a.labels) {
+		a.pushUnevaluated(lenExpr)
+	}
+
+	valExpr := &expr{op: opNumber, bytes: 1, evaluated: true}
+	if len(fields) == 2 {
+		valExpr, _, err = a.exprParser.parse(fields[1], a.scopeLabel, allowParentheses)
+		if err != nil {
+			a.addExprErrors()
+			return err
+		}
+		if !valExpr.eval(-1, a.constants, a.labels) {
+			a.pushUnevaluated(valExpr)
+		}
+	}
+
+	if !label.isEmpty() {
+		err := a.storeLabel(label)
+		if err != nil {
+			return err
+		}
+	}
+
+	seg := &padding{addr: -1, valExpr: valExpr, lenExpr: lenExpr, line: line}
+	a.segments = append(a.segments, seg)
+	return nil
+}
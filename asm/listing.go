@@ -0,0 +1,189 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A listEntry records one source line for the assembly listing, along with
+// the index of the first code segment it produced.
+type listEntry struct {
+	line    fstring // the line as passed to the parser
+	seg     int     // index of the first segment produced by the line
+	include int     // include nesting depth
+}
+
+// Record a line for the listing.
+func (a *assembler) listLine(line fstring) {
+	if a.list {
+		a.listing = append(a.listing, listEntry{line: line, seg: len(a.segments), include: a.includeDepth})
+	}
+}
+
+// Return a short "file:line" description of a line's location. Lines
+// produced by a macro expansion are attributed to the invocation.
+func (a *assembler) location(l fstring) string {
+	fileIndex, row := l.origin()
+	return fmt.Sprintf("%s:%d", filepath.Base(a.files[fileIndex]), row)
+}
+
+// Write the assembly listing. Each source line is shown with its address,
+// the bytes it produced and the cycles taken by its instruction. Lines from
+// included files are marked with '>' and lines from macro expansions with
+// '+', once per level of nesting. A symbol cross-reference follows the
+// code.
+func (a *assembler) writeListing(w io.Writer) {
+	fmt.Fprintf(w, "Listing of '%s'\n\n", a.files[0])
+	fmt.Fprintf(w, "%-4s  %-8s  %3s %5s %-3s %s\n", "ADDR", "BYTES", "CYC", "LINE", "", "SOURCE")
+
+	// Find the end address of each segment so that data segments can show
+	// the bytes they produced. A segment followed by an origin ends with
+	// its block.
+	ends := make([]int, len(a.segments))
+	for i, s := range a.segments {
+		ends[i] = a.blockEnd(s.address())
+		if i+1 < len(a.segments) {
+			if _, ok := a.segments[i+1].(*origin); !ok {
+				ends[i] = a.segments[i+1].address()
+			}
+		}
+	}
+
+	for i, e := range a.listing {
+		last := len(a.segments)
+		if i+1 < len(a.listing) {
+			last = a.listing[i+1].seg
+		}
+
+		nest := strings.Repeat(">", e.include)
+		if e.line.exp != nil {
+			nest += strings.Repeat("+", e.line.exp.depth)
+		}
+		source := fmt.Sprintf("%5d %-3s %s", e.line.row, nest, strings.TrimRight(e.line.full, " \t"))
+
+		var rows []string
+		for s := e.seg; s < last; s++ {
+			rows = append(rows, a.listSegment(a.segments[s], ends[s])...)
+		}
+		if len(rows) == 0 {
+			fmt.Fprintf(w, "%-19s %s\n", "", source)
+			continue
+		}
+		fmt.Fprintf(w, "%s %s\n", rows[0], source)
+		for _, r := range rows[1:] {
+			fmt.Fprintln(w, strings.TrimRight(r, " "))
+		}
+	}
+
+	a.writeSymbols(w)
+}
+
+// Return the end address of the block containing an address.
+func (a *assembler) blockEnd(addr int) int {
+	for _, b := range a.blocks {
+		end := int(b.Address) + len(b.Data)
+		if addr >= int(b.Address) && addr < end {
+			return end
+		}
+	}
+	return addr
+}
+
+// Format the address, bytes and cycles of a code segment as listing
+// columns, one row per 3 bytes.
+func (a *assembler) listSegment(s segment, end int) []string {
+	switch ss := s.(type) {
+	case *instruction:
+		return []string{fmt.Sprintf("%04X  %-8s  %3d", ss.addr&0xffff, ss.codeString(), ss.inst.Cycles)}
+	case *origin, *section:
+		return nil
+	}
+
+	addr := s.address()
+	b := a.codeRange(addr, end)
+
+	var rows []string
+	for i := 0; i < len(b); i += 3 {
+		j := i + 3
+		if j > len(b) {
+			j = len(b)
+		}
+		rows = append(rows, fmt.Sprintf("%04X  %-8s     ", (addr+i)&0xffff, byteString(b[i:j])))
+	}
+	return rows
+}
+
+// Write the symbol cross-reference table, listing each label and constant
+// with its value, where it was defined and the lines that refer to it.
+func (a *assembler) writeSymbols(w io.Writer) {
+	refs := make(map[string][]string)
+	for _, e := range a.exprParser.refs {
+		key := refKey(e)
+		loc := a.location(e.identifier)
+		if r := refs[key]; len(r) == 0 || r[len(r)-1] != loc {
+			refs[key] = append(r, loc)
+		}
+	}
+
+	exported := make(map[string]bool)
+	for _, e := range a.exports {
+		exported[e.Label] = true
+	}
+	global := make(map[string]bool)
+	for _, g := range a.globals {
+		global[g.str] = true
+	}
+	extern := make(map[string]bool)
+	for _, e := range a.externs {
+		extern[e.str] = true
+	}
+
+	names := make([]string, 0, len(a.constants))
+	for name := range a.constants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "\nSymbols\n\n")
+	fmt.Fprintf(w, "%-20s %-9s %-9s %-15s %s\n", "NAME", "VALUE", "KIND", "DEFINED", "REFERENCES")
+	for _, name := range names {
+		kind := "constant"
+		if _, ok := a.labels[name]; ok {
+			kind = "label"
+		}
+		if exported[name] {
+			kind += ",exp"
+		}
+		if global[name] {
+			kind += ",glb"
+		}
+
+		def := "command line"
+		if l, ok := a.symbolDefs[name]; ok {
+			def = a.location(l)
+		}
+
+		value := "?"
+		if e := a.constants[name]; extern[name] {
+			kind = "extern"
+		} else if e.evaluated {
+			value = fmt.Sprintf("$%04X", e.value&0xffff)
+		}
+
+		fmt.Fprintf(w, "%-20s %-9s %-9s %-15s %s\n",
+			strings.TrimPrefix(name, "~"), value, kind, def, strings.Join(refs[name], ", "))
+	}
+}
+
+// Produce the listing as a byte slice.
+func (a *assembler) listingBytes() []byte {
+	var b bytes.Buffer
+	a.writeListing(&b)
+	return b.Bytes()
+}
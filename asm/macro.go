@@ -0,0 +1,426 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxMacroDepth limits how deeply macro invocations may nest, which stops
+// runaway recursion.
+const maxMacroDepth = 16
+
+// maxRepeatCount limits the number of times a .repeat block may be
+// expanded.
+const maxRepeatCount = 65536
+
+// A macro is a named block of source lines declared with .macro and .endm.
+//
+//	.macro  ADD16 dst, src
+//	LDM     \src
+//	...
+//	.endm
+//
+// When the macro is invoked, each \param in the body is replaced by the
+// corresponding argument, and \@ is replaced by a number unique to the
+// expansion. Local labels starting with '@' are also made unique to each
+// expansion, so a macro can be invoked many times in the same scope.
+type macro struct {
+	name   string
+	params []string
+	def    fstring   // the .macro line
+	body   []fstring // lines between .macro and .endm
+}
+
+// An expansion records where a macro was invoked. Lines produced by an
+// expansion carry a pointer to it, so errors and source map entries can
+// refer to the invocation as well as the macro definition.
+type expansion struct {
+	macro     *macro
+	invoke    fstring    // the line that invoked the macro
+	parent    *expansion // enclosing expansion, for nested invocations
+	depth     int
+	iteration int // iteration of a .repeat block
+}
+
+// A repeat is a .repeat block whose body is being collected.
+//
+//	.repeat 4, I
+//	.db     I * 2
+//	.endr
+//
+// The body is expanded count times, like a macro with no parameters. Each
+// occurrence of the optional index symbol is replaced by the number of the
+// iteration, starting at 0.
+type repeat struct {
+	block *macro
+	count int
+	index string // loop index symbol, if any
+	depth int    // nesting of .repeat blocks within the body
+}
+
+// Return the file index and line number of the outermost invocation that
+// produced a line, or the line's own location if it isn't part of an
+// expansion.
+func (l *fstring) origin() (fileIndex, row int) {
+	if l.exp == nil {
+		return l.fileIndex, l.row
+	}
+	e := l.exp
+	for e.parent != nil {
+		e = e.parent
+	}
+	return e.invoke.fileIndex, e.invoke.row
+}
+
+// Parse a ".macro" definition. The macro name is either the label or the
+// first word following the pseudo-op; the remaining words name the
+// parameters.
+func (a *assembler) parseMacro(line, label fstring, param any) error {
+	a.logLine(line, "macro=")
+
+	def := line
+	name := label
+	if name.isEmpty() {
+		name, line = line.consumeWhile(labelChar)
+		line = line.consumeWhitespace()
+	}
+	if name.isEmpty() {
+		a.addError(line, "macro requires a name")
+		return errParse
+	}
+
+	key := strings.ToLower(name.str)
+	if _, ok := pseudoOps[key]; ok || a.instSet.GetInstructions(name.str) != nil {
+		a.addError(name, "macro name '%s' is reserved", name.str)
+		return errParse
+	}
+	if _, ok := a.macros[key]; ok {
+		a.addError(name, "macro '%s' defined more than once", name.str)
+		return errParse
+	}
+
+	m := &macro{name: name.str, def: def}
+	for _, p := range a.splitFields(line) {
+		if !p.startsWith(identifierStartChar) || p.scanWhile(labelChar) != len(p.str) {
+			a.addError(p, "invalid macro parameter '%s'", p.str)
+			return errParse
+		}
+		m.params = append(m.params, strings.ToLower(p.str))
+	}
+
+	a.defining = m
+	return nil
+}
+
+// Collect a line of a macro body. The definition ends at ".endm".
+func (a *assembler) collectMacroLine(line fstring) error {
+	word, _ := directiveWord(line)
+	switch strings.ToLower(word.str) {
+	case ".endm", ".endmacro", "endm":
+		a.macros[strings.ToLower(a.defining.name)] = a.defining
+		a.logLine(line, "endm=%s", a.defining.name)
+		a.defining = nil
+	case ".macro", "macro":
+		a.addError(word, "macro definitions may not be nested")
+		return errParse
+	default:
+		a.defining.body = append(a.defining.body, line)
+	}
+	return nil
+}
+
+// Expand a macro invocation. The arguments are the comma-separated fields
+// following the macro name.
+func (a *assembler) expandMacro(m *macro, invoke, args fstring) error {
+	a.logLine(invoke, "expand=%s", m.name)
+
+	parent := invoke.exp
+	depth := 1
+	if parent != nil {
+		depth = parent.depth + 1
+	}
+	if depth > maxMacroDepth {
+		a.addError(invoke, "macro '%s' nested more than %d levels deep", m.name, maxMacroDepth)
+		return errParse
+	}
+
+	values := a.splitFields(args.consumeWhitespace())
+	if len(values) != len(m.params) {
+		a.addError(invoke, "macro '%s' expects %d argument(s), got %d", m.name, len(m.params), len(values))
+		return errParse
+	}
+
+	a.expansions++
+	id := fmt.Sprintf("%d", a.expansions)
+	exp := &expansion{macro: m, invoke: invoke, parent: parent, depth: depth}
+
+	// As in a file, a line with a syntax error is skipped.
+	failed := false
+	for _, body := range m.body {
+		text, err := a.substitute(m, body, values, id)
+		if err != nil {
+			failed = true
+			continue
+		}
+		line := fstring{body.fileIndex, body.row, 0, text, text, exp}
+		if err := a.parseLine(line.stripTrailingComment()); err != nil {
+			if err != errParse {
+				return err
+			}
+			failed = true
+		}
+	}
+	if failed {
+		return errParse
+	}
+	return nil
+}
+
+// Replace macro parameters, \@ and local labels in one line of a macro
+// body.
+func (a *assembler) substitute(m *macro, line fstring, values []fstring, id string) (string, error) {
+	var b strings.Builder
+	s := line.str
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			b.WriteByte(c)
+
+		case c == '\'' && i+2 < len(s) && s[i+2] == '\'':
+			b.WriteString(s[i : i+3])
+			i += 2
+			continue
+		case stringQuote(c):
+			quote = c
+			b.WriteByte(c)
+
+		case comment(c):
+			b.WriteString(s[i:])
+			return b.String(), nil
+
+		case c == '\\' && i+1 < len(s) && s[i+1] == '@':
+			b.WriteString(id)
+			i++
+
+		case c == '\\':
+			n := 0
+			for i+1+n < len(s) && labelChar(s[i+1+n]) {
+				n++
+			}
+			name := strings.ToLower(s[i+1 : i+1+n])
+			found := false
+			for j, p := range m.params {
+				if p == name {
+					b.WriteString(values[j].str)
+					found = true
+					break
+				}
+			}
+			if !found {
+				a.addError(line.consume(i), "unknown macro parameter '\\%s'", s[i+1:i+1+n])
+				return "", errParse
+			}
+			i += n
+
+		case c == '@' && (i == 0 || !identifierChar(s[i-1])):
+			n := 0
+			for i+1+n < len(s) && identifierChar(s[i+1+n]) && s[i+1+n] != ':' {
+				n++
+			}
+			b.WriteString(s[i : i+1+n])
+			if n > 0 {
+				b.WriteString("_" + id)
+			}
+			i += n
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// Describe the chain of macro invocations that produced a line, for use in
+// error messages.
+func (a *assembler) expansionString(l fstring) string {
+	var s string
+	for _, n := range a.expansionNotes(l) {
+		s += "\n    " + n
+	}
+	return s
+}
+
+// Describe each macro invocation or .repeat block that produced a line,
+// innermost first.
+func (a *assembler) expansionNotes(l fstring) []string {
+	var notes []string
+	for e := l.exp; e != nil; e = e.parent {
+		file := a.files[e.invoke.fileIndex]
+		if e.macro.name == ".repeat" {
+			notes = append(notes, fmt.Sprintf("in .repeat iteration %d at '%s' line %d", e.iteration, file, e.invoke.row))
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("in macro '%s' invoked from '%s' line %d", e.macro.name, file, e.invoke.row))
+	}
+	return notes
+}
+
+// Parse a ".repeat count[, index]" block. The count must be computable
+// from constants and symbols defined before it.
+func (a *assembler) parseRepeat(line, label fstring, param any) error {
+	a.logLine(line, "repeat=")
+
+	fields := a.splitFields(line)
+	if len(fields) < 1 || len(fields) > 2 {
+		a.addError(line, "repeat requires a count and an optional index symbol")
+		return errParse
+	}
+
+	e, _, err := a.exprParser.parse(fields[0], a.scopeLabel, allowParentheses)
+	if err != nil {
+		a.addExprErrors()
+		return err
+	}
+	if !e.eval(-1, a.constants, a.labels) {
+		a.addError(fields[0], "unable to evaluate repeat count '%s'", fields[0].str)
+		return errParse
+	}
+	if e.value < 0 || e.value > maxRepeatCount {
+		a.addError(fields[0], "repeat count %d is outside 0..%d", e.value, maxRepeatCount)
+		return errParse
+	}
+
+	r := &repeat{block: &macro{name: ".repeat", def: line}, count: e.value}
+	if len(fields) == 2 {
+		f := fields[1]
+		if !f.startsWith(identifierStartChar) || f.scanWhile(labelChar) != len(f.str) {
+			a.addError(f, "invalid repeat index symbol '%s'", f.str)
+			return errParse
+		}
+		r.index = f.str
+	}
+
+	// A label on the .repeat line marks the first expanded line.
+	if !label.isEmpty() {
+		if err := a.storeLabel(label); err != nil {
+			return err
+		}
+	}
+
+	a.repeating = r
+	return nil
+}
+
+// Collect a line of a .repeat body. The body ends at the ".endr" matching
+// the ".repeat", at which point it is expanded.
+func (a *assembler) collectRepeatLine(line fstring) error {
+	r := a.repeating
+	word, _ := directiveWord(line)
+	switch strings.ToLower(word.str) {
+	case ".repeat", ".rept":
+		r.depth++
+	case ".endr", ".endrepeat":
+		if r.depth == 0 {
+			a.repeating = nil
+			a.logLine(line, "endr")
+			return a.expandRepeat(r)
+		}
+		r.depth--
+	}
+	r.block.body = append(r.block.body, line)
+	return nil
+}
+
+// Expand a .repeat block once for each iteration.
+func (a *assembler) expandRepeat(r *repeat) error {
+	invoke := r.block.def
+	parent := invoke.exp
+	depth := 1
+	if parent != nil {
+		depth = parent.depth + 1
+	}
+	if depth > maxMacroDepth {
+		a.addError(invoke, ".repeat nested more than %d levels deep", maxMacroDepth)
+		return errParse
+	}
+
+	failed := false
+	for i := 0; i < r.count; i++ {
+		a.expansions++
+		id := fmt.Sprintf("%d", a.expansions)
+		exp := &expansion{macro: r.block, invoke: invoke, parent: parent, depth: depth, iteration: i}
+
+		for _, body := range r.block.body {
+			text, err := a.substitute(r.block, body, nil, id)
+			if err != nil {
+				failed = true
+				continue
+			}
+			if r.index != "" {
+				text = replaceSymbol(text, r.index, fmt.Sprintf("%d", i))
+			}
+			line := fstring{body.fileIndex, body.row, 0, text, text, exp}
+			if err := a.parseLine(line.stripTrailingComment()); err != nil {
+				if err != errParse {
+					return err
+				}
+				failed = true
+			}
+		}
+	}
+	if failed {
+		return errParse
+	}
+	return nil
+}
+
+// Replace each whole-word occurrence of a symbol outside strings,
+// character literals and comments.
+func replaceSymbol(s, name, value string) string {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' && i+2 < len(s) && s[i+2] == '\'':
+			b.WriteString(s[i : i+3])
+			i += 2
+			continue
+		case stringQuote(c):
+			quote = c
+		case comment(c):
+			b.WriteString(s[i:])
+			return b.String()
+		case strings.HasPrefix(s[i:], name) && (i == 0 || !labelChar(s[i-1])) &&
+			(i+len(name) == len(s) || !labelChar(s[i+len(name)])):
+			b.WriteString(value)
+			i += len(name) - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// Report an ".endr" that has no matching ".repeat".
+func (a *assembler) parseEndRepeat(line, label fstring, param any) error {
+	a.addError(line, ".endr without .repeat")
+	return errParse
+}
+
+// Report an ".endm" that has no matching ".macro".
+func (a *assembler) parseEndMacro(line, label fstring, param any) error {
+	a.addError(line, ".endm without .macro")
+	return errParse
+}
@@ -0,0 +1,416 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Sections of a relocatable object, in the order they appear in the file.
+const (
+	SectionText = iota // code
+	SectionData        // initialized data
+	SectionBSS         // uninitialized data, which takes no space in the file
+)
+
+// SectionNames holds the names of the object sections.
+var SectionNames = []string{".text", ".data", ".bss"}
+
+// SectionAbsolute is the section of a symbol whose value is not an address
+// in any section, such as a constant.
+const SectionAbsolute = -1
+
+// While an object is assembled, each section is given its own 64K address
+// space by tagging addresses with the section number above bit 16.
+// External symbols are tagged the same way, after the sections. A 16-bit
+// operand whose value carries a tag needs a relocation.
+const sectionShift = 16
+
+func sectionBase(section int) int {
+	return (section + 1) << sectionShift
+}
+
+func externBase(extern int) int {
+	return (len(SectionNames) + 1 + extern) << sectionShift
+}
+
+const (
+	objectSignature    = "CO1\x00"
+	objectVersionMajor = 1
+	objectVersionMinor = 0
+)
+
+// An Object is a relocatable object file produced by assembling a source
+// file with the Relocatable option. Its sections are assembled at address 0 and
+// placed in memory by the linker, which also resolves external symbols and
+// applies the relocations.
+type Object struct {
+	Sections    []Section // one per entry in SectionNames
+	Symbols     []Symbol  // global symbols defined by the object
+	Externs     []string  // symbols used by the object but defined elsewhere
+	Relocations []Relocation
+	Files       []string     // source files
+	Lines       []ObjectLine // source lines of each section's code
+}
+
+// A Section holds the contents of one object section.
+type Section struct {
+	Name string
+	Size int    // size in bytes
+	Data []byte // contents, or nil for .bss
+}
+
+// A Symbol is a global symbol defined by an object.
+type Symbol struct {
+	Name    string
+	Section int    // section index, or SectionAbsolute
+	Value   uint16 // offset within the section, or the value itself
+}
+
+// A Relocation records a 16-bit operand or data word that must be adjusted
+// once the linker knows where its target is placed.
+type Relocation struct {
+	Section int    // section containing the word
+	Offset  uint16 // offset of the word within the section
+	Extern  bool   // true if Target is an index into Externs
+	Target  int    // section index or extern index
+	Addend  uint16 // offset added to the target address
+}
+
+// An ObjectLine maps an offset within a section to a source line.
+type ObjectLine struct {
+	Section   int
+	Offset    uint16
+	FileIndex int
+	Line      int
+}
+
+// A section segment switches the section that code is assembled into.
+type section struct {
+	addr  int
+	index int
+	line  fstring
+}
+
+func (s *section) address() int {
+	return s.addr
+}
+
+// Parse a ".text", ".data" or ".bss" pseudo-op. The param holds the section
+// index.
+func (a *assembler) parseSection(line, label fstring, param any) error {
+	a.logLine(line, "section=")
+
+	if !a.object {
+		a.addError(line, "sections may only be used when assembling an object file")
+		return errParse
+	}
+	a.segments = append(a.segments, &section{addr: -1, index: param.(int), line: line})
+	return nil
+}
+
+// Parse a ".global" or ".extern" pseudo-op, which takes a list of symbol
+// names. The param is true for ".extern".
+func (a *assembler) parseLinkage(line, label fstring, param any) error {
+	a.logLine(line, "linkage=")
+
+	if !a.object {
+		a.addError(line, "symbol linkage may only be declared when assembling an object file")
+		return errParse
+	}
+
+	for _, f := range a.splitFields(line) {
+		if !f.startsWith(identifierStartChar) || f.scanWhile(labelChar) != len(f.str) {
+			a.addError(f, "invalid symbol name '%s'", f.str)
+			return errParse
+		}
+		if !param.(bool) {
+			a.globals = append(a.globals, f)
+			continue
+		}
+		if _, ok := a.constants[f.str]; ok {
+			a.addError(f, "extern '%s' is already defined", f.str)
+			return errParse
+		}
+		a.constants[f.str] = &expr{op: opNumber, value: externBase(len(a.externs)), address: true, bytes: 2, evaluated: true}
+		a.externs = append(a.externs, f)
+		a.symbolDefs[f.str] = f
+	}
+	return nil
+}
+
+// Return true if a value is tagged with a section or extern, and so needs
+// relocating.
+func relocatable(v int) bool {
+	return v>>sectionShift != 0
+}
+
+// Record a relocation for a 16-bit word at 'offset' in 'sec' holding the
+// value 'v'. Returns false if the value can't be relocated.
+func (a *assembler) relocate(sec, offset, v int) bool {
+	tag := v >> sectionShift
+	r := Relocation{Section: sec, Offset: uint16(offset), Addend: uint16(v)}
+	switch {
+	case tag >= 1 && tag <= len(SectionNames):
+		r.Target = tag - 1
+	case tag > len(SectionNames) && tag <= len(SectionNames)+len(a.externs):
+		r.Extern, r.Target = true, tag-len(SectionNames)-1
+	default:
+		return false
+	}
+	a.relocs = append(a.relocs, r)
+	return true
+}
+
+// Check an operand or data value for relocation. Values of 'size' bytes are
+// being emitted at 'offset' in the current section.
+func (a *assembler) checkRelocation(line fstring, e *expr, sec, offset, size int) {
+	if !a.object || !e.address {
+		return
+	}
+	switch {
+	case size != 2:
+		a.addError(line, "relocatable address can't be used in a %d-byte value", size)
+	case !relocatable(e.value):
+	case !a.relocate(sec, offset, e.value):
+		a.addError(line, "expression can't be relocated")
+	}
+}
+
+// Return the section and offset of an address assembled in object mode.
+func sectionOffset(addr int) (sec int, offset uint16) {
+	return addr>>sectionShift - 1, uint16(addr)
+}
+
+// Build the object from the assembled sections, symbols and relocations.
+func (a *assembler) finishObject() error {
+	obj := &Object{Files: a.files, Relocations: a.relocs}
+
+	for i, name := range SectionNames {
+		s := Section{Name: name, Size: len(a.sectionCode[i])}
+		if i != SectionBSS {
+			s.Data = a.sectionCode[i]
+		} else if !allZero(a.sectionCode[i]) {
+			a.addError(a.sectionLine(i), "the .bss section may only reserve space")
+			return errParse
+		}
+		if s.Size > 0x10000 {
+			a.addError(a.sectionLine(i), "section %s exceeds 64K", name)
+			return errParse
+		}
+		obj.Sections = append(obj.Sections, s)
+	}
+
+	for _, e := range a.externs {
+		if _, ok := a.labels[e.str]; ok {
+			a.addError(e, "extern '%s' is defined in this file", e.str)
+			return errParse
+		}
+		obj.Externs = append(obj.Externs, e.str)
+	}
+
+	for _, g := range a.globals {
+		c, ok := a.constants[g.str]
+		if !ok || !c.evaluated {
+			a.addError(g, "global '%s' is not defined", g.str)
+			return errParse
+		}
+		sym := Symbol{Name: g.str, Section: SectionAbsolute, Value: uint16(c.value)}
+		if relocatable(c.value) {
+			sec, off := sectionOffset(c.value)
+			if sec >= len(SectionNames) {
+				a.addError(g, "global '%s' is an extern", g.str)
+				return errParse
+			}
+			sym.Section, sym.Value = sec, off
+		}
+		obj.Symbols = append(obj.Symbols, sym)
+	}
+
+	for _, l := range a.sourceLines {
+		sec, off := sectionOffset(l.Address)
+		obj.Lines = append(obj.Lines, ObjectLine{sec, off, l.FileIndex, l.Line})
+	}
+
+	a.obj = obj
+	return nil
+}
+
+// Return the bytes assembled for the address range [addr, end).
+func (a *assembler) codeRange(addr, end int) []byte {
+	code, base := a.code, a.origin
+	if a.object {
+		sec := addr>>sectionShift - 1
+		if sec < 0 || sec >= len(SectionNames) {
+			return nil
+		}
+		code, base = a.sectionCode[sec], sectionBase(sec)
+	}
+	if addr < base || end > base+len(code) || end < addr {
+		return nil
+	}
+	return code[addr-base : end-base]
+}
+
+// Return the line of the first directive selecting a section.
+func (a *assembler) sectionLine(index int) fstring {
+	for _, s := range a.segments {
+		if ss, ok := s.(*section); ok && ss.index == index {
+			return ss.line
+		}
+	}
+	return fstring{}
+}
+
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo writes the object in its binary file format. All multi-byte
+// values are little-endian and strings are zero-terminated.
+func (o *Object) WriteTo(w io.Writer) (n int64, err error) {
+	var b []byte
+	u16 := func(v int) { b = binary.LittleEndian.AppendUint16(b, uint16(v)) }
+	u32 := func(v int) { b = binary.LittleEndian.AppendUint32(b, uint32(v)) }
+	str := func(s string) { b = append(append(b, s...), 0) }
+
+	b = append(b, objectSignature...)
+	b = append(b, objectVersionMajor, objectVersionMinor)
+	u16(len(o.Sections))
+	u16(len(o.Symbols))
+	u16(len(o.Externs))
+	u32(len(o.Relocations))
+	u16(len(o.Files))
+	u32(len(o.Lines))
+
+	for _, s := range o.Sections {
+		str(s.Name)
+		u32(s.Size)
+		u32(len(s.Data))
+		b = append(b, s.Data...)
+	}
+	for _, s := range o.Symbols {
+		str(s.Name)
+		b = append(b, byte(s.Section))
+		u16(int(s.Value))
+	}
+	for _, e := range o.Externs {
+		str(e)
+	}
+	for _, r := range o.Relocations {
+		var flags byte
+		if r.Extern {
+			flags = 1
+		}
+		b = append(b, byte(r.Section), flags)
+		u16(int(r.Offset))
+		u16(r.Target)
+		u16(int(r.Addend))
+	}
+	for _, f := range o.Files {
+		str(f)
+	}
+	for _, l := range o.Lines {
+		b = append(b, byte(l.Section))
+		u16(int(l.Offset))
+		u16(l.FileIndex)
+		u32(l.Line)
+	}
+
+	nn, err := w.Write(b)
+	return int64(nn), err
+}
+
+// ReadFrom reads an object in its binary file format.
+func (o *Object) ReadFrom(r io.Reader) (n int64, err error) {
+	rr := bufio.NewReader(r)
+	read := func(size int) []byte {
+		if err != nil {
+			return make([]byte, size)
+		}
+		b := make([]byte, size)
+		var nn int
+		nn, err = io.ReadFull(rr, b)
+		n += int64(nn)
+		return b
+	}
+	u8 := func() int { return int(read(1)[0]) }
+	u16 := func() int { return int(binary.LittleEndian.Uint16(read(2))) }
+	u32 := func() int { return int(binary.LittleEndian.Uint32(read(4))) }
+	str := func() string {
+		if err != nil {
+			return ""
+		}
+		var s string
+		s, err = rr.ReadString(0)
+		n += int64(len(s))
+		return strings.TrimSuffix(s, "\x00")
+	}
+
+	h := read(6)
+	if err != nil {
+		return n, err
+	}
+	if !bytes.Equal(h[:4], []byte(objectSignature)) {
+		return n, errors.New("invalid object file format")
+	}
+	if h[4] != objectVersionMajor {
+		return n, errors.New("unsupported object file version")
+	}
+
+	sections, symbols, externs := u16(), u16(), u16()
+	relocs, files, lines := u32(), u16(), u32()
+
+	o.Sections = make([]Section, sections)
+	for i := range o.Sections {
+		s := &o.Sections[i]
+		s.Name, s.Size = str(), u32()
+		if size := u32(); size > 0 {
+			if size > 0x10000 {
+				return n, fmt.Errorf("object section %s is too large", s.Name)
+			}
+			s.Data = read(size)
+		}
+	}
+	o.Symbols = make([]Symbol, symbols)
+	for i := range o.Symbols {
+		s := &o.Symbols[i]
+		s.Name, s.Section, s.Value = str(), int(int8(u8())), uint16(u16())
+	}
+	o.Externs = make([]string, externs)
+	for i := range o.Externs {
+		o.Externs[i] = str()
+	}
+	o.Relocations = make([]Relocation, 0, min(relocs, 0x10000))
+	for i := 0; i < relocs && err == nil; i++ {
+		r := Relocation{Section: u8(), Extern: u8() != 0}
+		r.Offset, r.Target, r.Addend = uint16(u16()), u16(), uint16(u16())
+		o.Relocations = append(o.Relocations, r)
+	}
+	o.Files = make([]string, files)
+	for i := range o.Files {
+		o.Files[i] = str()
+	}
+	o.Lines = make([]ObjectLine, 0, min(lines, 0x10000))
+	for i := 0; i < lines && err == nil; i++ {
+		l := ObjectLine{Section: u8(), Offset: uint16(u16())}
+		l.FileIndex, l.Line = u16(), u32()
+		o.Lines = append(o.Lines, l)
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
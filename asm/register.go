@@ -0,0 +1,124 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"strings"
+
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// Consume a register name, R0 through R7, and return its number.
+func (l fstring) consumeRegister() (reg int, remain fstring, ok bool) {
+	if len(l.str) < 2 || (l.str[0] != 'R' && l.str[0] != 'r') || l.str[1] < '0' || l.str[1] > '7' {
+		return 0, l, false
+	}
+	if len(l.str) > 2 && labelChar(l.str[2]) {
+		return 0, l, false
+	}
+	return int(l.str[1] - '0'), l.consume(2), true
+}
+
+// Parse the register or line number operand of an instruction written in
+// native CPU1 syntax, such as "LDI R3, #$10", "ADR R1, R2" or "SETQ 2".
+// It returns the number selecting the opcode variant, or -1 if there is
+// none, and the rest of the line. For register pair instructions the
+// whole operand is parsed and returned as pair.
+//
+// Older forms that name the register in the mnemonic ("LDI3") or give the
+// operand byte directly ("ADR #$12") are still accepted.
+func (a *assembler) parseRegisterOperand(opcode fstring, insts []*cpu.Instruction, line fstring) (reg int, pair *operand, remain fstring, err error) {
+	inst := insts[0]
+	name := strings.ToUpper(opcode.str)
+	numbered := name != inst.Mnemonic // e.g. LDI3 rather than LDI
+	nativeOnly := name != inst.Name   // e.g. LDI, which has no plain form
+
+	reg, remain = -1, line
+	switch inst.Operands {
+	case cpu.RegPair:
+		x, rest, ok := line.consumeRegister()
+		if !ok {
+			return
+		}
+		rest = rest.consumeWhitespace()
+		if !rest.startsWithChar(',') {
+			a.addError(rest, "expected a second register")
+			return -1, nil, rest, errParse
+		}
+		rest = rest.consume(1).consumeWhitespace()
+		y, rest, ok := rest.consumeRegister()
+		if !ok {
+			a.addError(rest, "expected a second register")
+			return -1, nil, rest, errParse
+		}
+		rest = rest.consumeWhitespace()
+		if !rest.isEmpty() {
+			a.addError(rest, "unexpected '%s' after registers", rest.str)
+			return -1, nil, rest, errParse
+		}
+		e := &expr{op: opNumber, value: x<<4 | y, bytes: 1, evaluated: true, line: line}
+		pair = &operand{modeGuess: cpu.IMM, expr: e, forceImmediate: true}
+		return -1, pair, rest, nil
+
+	case cpu.RegOpcode:
+		r, rest, ok := line.consumeRegister()
+		switch {
+		case !ok && nativeOnly:
+			a.addError(line, "'%s' needs a register operand", opcode.str)
+			return -1, nil, line, errParse
+		case !ok:
+			return
+		case numbered:
+			a.addError(line, "'%s' already selects a register; use '%s'", opcode.str, inst.Mnemonic)
+			return -1, nil, line, errParse
+		}
+		reg, remain = r, rest.consumeWhitespace()
+
+	case cpu.LineOpcode:
+		// The line number is the whole operand of an instruction that
+		// takes no other, or else comes before a comma.
+		n, rest := line, fstring{}
+		if inst.Mode != cpu.IMP {
+			n, rest = line.consumeUntilUnquotedChar(',')
+			if rest.isEmpty() {
+				n = fstring{}
+			}
+		}
+		switch {
+		case n.isEmpty() && nativeOnly:
+			a.addError(line, "'%s' needs a line number", opcode.str)
+			return -1, nil, line, errParse
+		case n.isEmpty():
+			return
+		case numbered:
+			a.addError(line, "'%s' already selects a line; use '%s'", opcode.str, inst.Mnemonic)
+			return -1, nil, line, errParse
+		}
+
+		e, _, perr := a.exprParser.parse(n, a.scopeLabel, allowParentheses)
+		if perr != nil {
+			a.addExprErrors()
+			return -1, nil, line, perr
+		}
+		if !e.eval(-1, a.constants, a.labels) {
+			a.addError(n, "line number must use constants defined before it")
+			return -1, nil, line, errParse
+		}
+		if e.value < 0 || e.value > 7 {
+			a.addError(n, "line number must be 0-7")
+			return -1, nil, line, errParse
+		}
+		reg, remain = e.value, rest
+
+	default:
+		return
+	}
+
+	if remain.startsWithChar(',') {
+		remain = remain.consume(1).consumeWhitespace()
+	} else if !remain.isEmpty() {
+		a.addError(remain, "expected ',' after '%s'", strings.TrimSpace(line.str[:len(line.str)-len(remain.str)]))
+		return -1, nil, remain, errParse
+	}
+	return reg, nil, remain, nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// A Result holds everything the assembler learned about a program, for
+// tools that embed the assembler. Symbols are filled in even when assembly
+// fails; segments and instructions only when code was generated.
+type Result struct {
+	Assembly     *Assembly
+	SourceMap    *SourceMap
+	Symbols      []SymbolInfo  // every label and constant, sorted by name
+	Segments     []Segment     // address ranges of code, data and padding
+	Instructions []Instruction // every assembled instruction, in address order
+}
+
+// Symbol kinds
+const (
+	SymbolLabel    = "label"
+	SymbolConstant = "constant"
+	SymbolExtern   = "extern"
+)
+
+// A Position is a location in the source. Lines and columns start at 1.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+// A SymbolInfo describes a label or constant.
+type SymbolInfo struct {
+	Name       string     // local labels are qualified by their scope, as in "LOOP.next"
+	Value      int        // address or value
+	Evaluated  bool       // false if the value couldn't be computed
+	Kind       string     // SymbolLabel, SymbolConstant or SymbolExtern
+	Defined    Position   // where the symbol is defined, with an empty File if it was defined outside the source
+	References []Position // where the symbol is used
+}
+
+// Segment kinds
+const (
+	SegmentCode    = "code"
+	SegmentData    = "data"
+	SegmentPadding = "padding"
+)
+
+// A Segment is a range of addresses holding one kind of output.
+type Segment struct {
+	Kind  string // SegmentCode, SegmentData or SegmentPadding
+	Start int    // first address
+	End   int    // address just past the end
+}
+
+// An Instruction is one assembled instruction and the line it came from.
+// Instructions produced by a macro or .repeat block are placed at the line
+// that invoked it, as in the source map.
+type Instruction struct {
+	Address  int
+	Bytes    []byte
+	Mnemonic string
+	Mode     cpu.Mode
+	Operand  int // operand value, for instructions with an operand
+	Source   Position
+	Body     Position // position in the macro body, with an empty File if the instruction wasn't expanded
+	Text     string   // the line the instruction was assembled from
+}
+
+// AssembleResult assembles source code like Assemble, returning the
+// symbols, segments and instructions along with the code.
+func AssembleResult(r io.Reader, filename string, origin uint16, out io.Writer, options Option, settings ...Setting) (*Result, error) {
+	a := newAssembler(r, filename, origin, out, options, settings...)
+	return a.result()
+}
+
+// AssembleFS assembles the named file from a file system. Included files
+// are read from the same file system, and their names, like those given
+// with IncludeDir, are slash-separated paths within it.
+func AssembleFS(fsys fs.FS, name string, origin uint16, out io.Writer, options Option, settings ...Setting) (*Result, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	a := newAssembler(file, name, origin, out, options, settings...)
+	a.fsys = fsys
+	return a.result()
+}
+
+// Run the assembler and gather its results.
+func (a *assembler) result() (*Result, error) {
+	assembly, sourceMap, err := a.run()
+	res := &Result{Assembly: assembly, SourceMap: sourceMap, Symbols: a.symbols()}
+	if err == nil {
+		res.Segments = a.segmentRanges()
+		res.Instructions = a.instructions()
+	}
+	return res, err
+}
+
+// Return the position of an fstring.
+func (a *assembler) position(l fstring) Position {
+	return Position{a.files[l.fileIndex], l.row, l.column + 1}
+}
+
+// Return the position of the outermost invocation that produced a line,
+// and the line's own position if it is part of an expansion.
+func (a *assembler) expansionPosition(l fstring) (source, body Position) {
+	if l.exp == nil {
+		return a.position(l), Position{}
+	}
+	e := l.exp
+	for e.parent != nil {
+		e = e.parent
+	}
+	return a.position(e.invoke), a.position(l)
+}
+
+// Build the symbol table.
+func (a *assembler) symbols() []SymbolInfo {
+	refs := make(map[string][]Position)
+	for _, e := range a.exprParser.refs {
+		key := refKey(e)
+		refs[key] = append(refs[key], a.position(e.identifier))
+	}
+	externs := make(map[string]bool)
+	for _, e := range a.externs {
+		externs[e.str] = true
+	}
+
+	names := make(map[string]bool)
+	for name := range a.constants {
+		names[name] = true
+	}
+	for name := range a.labels {
+		names[name] = true
+	}
+
+	var syms []SymbolInfo
+	for name := range names {
+		s := SymbolInfo{Name: strings.TrimPrefix(name, "~"), Kind: SymbolConstant, References: refs[name]}
+		if e, ok := a.constants[name]; ok && e.evaluated {
+			s.Value, s.Evaluated = e.value, true
+		}
+		if seg, ok := a.labels[name]; ok {
+			s.Kind = SymbolLabel
+			if addr := a.segaddr(seg); addr != -1 {
+				s.Value, s.Evaluated = addr, true
+			}
+		}
+		if externs[name] {
+			s.Kind = SymbolExtern
+		}
+		if l, ok := a.symbolDefs[name]; ok {
+			s.Defined = a.position(l)
+		}
+		syms = append(syms, s)
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i].Name < syms[j].Name })
+	return syms
+}
+
+// Build the list of address ranges, joining neighboring segments of the
+// same kind.
+func (a *assembler) segmentRanges() []Segment {
+	var ranges []Segment
+	for i, s := range a.segments {
+		kind, size := "", 0
+		switch ss := s.(type) {
+		case *instruction:
+			kind, size = SegmentCode, int(ss.inst.Length)
+		case *data, *bytedata:
+			kind, size = SegmentData, a.segmentSize(i)
+		case *padding:
+			kind, size = SegmentPadding, ss.pad
+		case *alignment:
+			kind, size = SegmentPadding, ss.pad
+		}
+		if size == 0 {
+			continue
+		}
+
+		start := s.address()
+		if n := len(ranges); n > 0 && ranges[n-1].Kind == kind && ranges[n-1].End == start {
+			ranges[n-1].End += size
+			continue
+		}
+		ranges = append(ranges, Segment{kind, start, start + size})
+	}
+	return ranges
+}
+
+// Build the list of assembled instructions.
+func (a *assembler) instructions() []Instruction {
+	var insts []Instruction
+	for _, s := range a.segments {
+		ss, ok := s.(*instruction)
+		if !ok {
+			continue
+		}
+		inst := Instruction{
+			Address:  ss.addr,
+			Bytes:    ss.code,
+			Mnemonic: ss.inst.Mnemonic,
+			Mode:     ss.inst.Mode,
+			Text:     ss.opcode.full,
+		}
+		inst.Source, inst.Body = a.expansionPosition(ss.opcode)
+		if ss.operand.expr != nil {
+			inst.Operand = ss.operand.expr.value
+		}
+		insts = append(insts, inst)
+	}
+	sort.SliceStable(insts, func(i, j int) bool { return insts[i].Address < insts[j].Address })
+	return insts
+}
+
+// A MemFS is an in-memory file system holding source files by name, for
+// use with AssembleFS.
+type MemFS map[string]string
+
+// Open opens a file in the file system.
+func (m MemFS) Open(name string) (fs.File, error) {
+	text, ok := m[name]
+	if !ok || !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memFile{name: name, Reader: bytes.NewReader([]byte(text))}, nil
+}
+
+// A file opened from a MemFS.
+type memFile struct {
+	name string
+	*bytes.Reader
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *memFile) Close() error               { return nil }
+
+func (f *memFile) Name() string {
+	if i := strings.LastIndexByte(f.name, '/'); i >= 0 {
+		return f.name[i+1:]
+	}
+	return f.name
+}
+
+func (f *memFile) Size() int64        { return f.Reader.Size() }
+func (f *memFile) Mode() fs.FileMode  { return 0444 }
+func (f *memFile) ModTime() time.Time { return time.Time{} }
+func (f *memFile) IsDir() bool        { return false }
+func (f *memFile) Sys() any           { return nil }
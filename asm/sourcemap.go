@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"strings"
 )
 
 // A SourceMap describes the mapping between source code line numbers and
@@ -23,6 +24,7 @@ type SourceMap struct {
 	Files   []string
 	Lines   []SourceLine
 	Exports []Export
+	Labels  []Export // every label, including those not exported
 }
 
 // A SourceLine represents a mapping between a machine code address and
@@ -46,9 +48,53 @@ func NewSourceMap() *SourceMap {
 		Files:   []string{},
 		Lines:   []SourceLine{},
 		Exports: []Export{},
+		Labels:  []Export{},
 	}
 }
 
+// Labels further than this below an address aren't used to name it.
+const maxLabelOffset = 0xff
+
+// LookupLabel returns the label at an address, or else the nearest label
+// below it and the address's offset from the label. Global labels are
+// preferred to local ones at the same address.
+func (s *SourceMap) LookupLabel(addr uint16) (label string, offset int, ok bool) {
+	var best *Export
+	for _, labels := range [][]Export{s.Labels, s.Exports} {
+		for i := range labels {
+			l := &labels[i]
+			if l.Address > addr || (best != nil && l.Address < best.Address) {
+				continue
+			}
+			if best == nil || l.Address > best.Address || isLocalLabel(best.Label) && !isLocalLabel(l.Label) {
+				best = l
+			}
+		}
+	}
+	if best == nil || int(addr-best.Address) > maxLabelOffset {
+		return "", 0, false
+	}
+	return best.Label, int(addr - best.Address), true
+}
+
+// LookupName returns the address of an exported label, or else of any
+// label, with the name. Names are compared without regard to case.
+func (s *SourceMap) LookupName(name string) (addr uint16, ok bool) {
+	for _, labels := range [][]Export{s.Exports, s.Labels} {
+		for _, l := range labels {
+			if strings.EqualFold(l.Label, name) {
+				return l.Address, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Local labels are qualified by the label they follow, as in "LOOP.next".
+func isLocalLabel(name string) bool {
+	return strings.ContainsAny(name, ".@")
+}
+
 // Find searches the source map for a source code line corresponding to the
 // requested address.
 func (s *SourceMap) Find(addr int) (filename string, line int, err error) {
@@ -61,19 +107,46 @@ func (s *SourceMap) Find(addr int) (filename string, line int, err error) {
 	return "", 0, fmt.Errorf("address $%04X not found in source file", addr)
 }
 
+// FindAddress searches the source map for the first address generated by
+// a line of a source file. If the line produced no code, the next line of
+// the file that did is used instead.
+func (s *SourceMap) FindAddress(filename string, line int) (addr int, err error) {
+	found := false
+	best := SourceLine{}
+	for _, l := range s.Lines {
+		if s.Files[l.FileIndex] != filename || l.Line < line {
+			continue
+		}
+		if !found || l.Line < best.Line || (l.Line == best.Line && l.Address < best.Address) {
+			best, found = l, true
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("no code for line %d of '%s'", line, filename)
+	}
+	return best.Address, nil
+}
+
 // ClearRange clears portions of the source map that reference the
 // address range between `origin` and `origin+size`.
 func (s *SourceMap) ClearRange(origin, size int) {
 	min := uint16(origin)
 	max := uint16(origin + size)
 
-	// Filter out original exports covered by the new map's address range.
+	// Filter out original exports and labels covered by the new map's
+	// address range.
 	exports := make([]Export, 0, len(s.Exports))
 	for _, e := range s.Exports {
 		if e.Address < min || e.Address > max {
 			exports = append(exports, e)
 		}
 	}
+	labels := make([]Export, 0, len(s.Labels))
+	for _, e := range s.Labels {
+		if e.Address < min || e.Address > max {
+			labels = append(labels, e)
+		}
+	}
 
 	// Filter out original source lines covered by the new map's address
 	// range. Track only the files that remain referenced.
@@ -104,6 +177,7 @@ func (s *SourceMap) ClearRange(origin, size int) {
 	s.Files = files
 	s.Lines = lines
 	s.Exports = exports
+	s.Labels = labels
 }
 
 type bySLAddr []SourceLine
@@ -130,6 +204,10 @@ func (s *SourceMap) Merge(s2 *SourceMap) {
 	// Sort exports by address.
 	sort.Sort(byEAddr(s.Exports))
 
+	// Add labels from the new map.
+	s.Labels = append(s.Labels, s2.Labels...)
+	sort.Stable(byEAddr(s.Labels))
+
 	// Build a mapping from filename to file index.
 	fileCount := 0
 	fileMap := make(map[string]int)
@@ -172,7 +250,7 @@ func (s *SourceMap) ReadFrom(r io.Reader) (n int64, err error) {
 		return n, err
 	}
 
-	if len(b) < 16 || !bytes.Equal(b[0:4], []byte(sourceMapSignature)) {
+	if len(b) < 16 || !bytes.Equal(b[0:len(sourceMapSignature)], []byte(sourceMapSignature)) {
 		return n, errors.New("invalid source map format")
 	}
 	if b[4] != versionMajor || b[5] != versionMinor {
@@ -227,6 +305,33 @@ func (s *SourceMap) ReadFrom(r io.Reader) (n int64, err error) {
 		s.Exports[i].Address = binary.LittleEndian.Uint16(b[0:2])
 	}
 
+	// Maps written before labels were recorded end here.
+	nn, err = io.ReadFull(rr, b[:4])
+	n += int64(nn)
+	if err == io.EOF {
+		s.Labels = []Export{}
+		return n, nil
+	}
+	if err != nil {
+		return n, err
+	}
+	s.Labels = make([]Export, binary.LittleEndian.Uint32(b[0:4]))
+	for i := range s.Labels {
+		label, err := rr.ReadString(0)
+		n += int64(len(label))
+		if err != nil {
+			return n, err
+		}
+		s.Labels[i].Label = label[:len(label)-1]
+
+		nn, err = io.ReadFull(rr, b[:2])
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+		s.Labels[i].Address = binary.LittleEndian.Uint16(b[0:2])
+	}
+
 	return n, nil
 }
 
@@ -281,20 +386,22 @@ func (s *SourceMap) WriteTo(w io.Writer) (n int64, err error) {
 	}
 
 	for _, e := range s.Exports {
-		nn, err = ww.WriteString(e.Label)
+		nn, err = writeExport(ww, e)
 		n += int64(nn)
 		if err != nil {
 			return n, err
 		}
-		ww.WriteByte(0)
-		if err != nil {
-			return n, err
-		}
-		n++
+	}
 
-		var b [2]byte
-		binary.LittleEndian.PutUint16(b[:], e.Address)
-		nn, err = ww.Write(b[:])
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(len(s.Labels)))
+	nn, err = ww.Write(b[:])
+	n += int64(nn)
+	if err != nil {
+		return n, err
+	}
+	for _, e := range s.Labels {
+		nn, err = writeExport(ww, e)
 		n += int64(nn)
 		if err != nil {
 			return n, err
@@ -306,6 +413,23 @@ func (s *SourceMap) WriteTo(w io.Writer) (n int64, err error) {
 	return n, nil
 }
 
+// Write an export's label, terminated by a zero byte, and its address.
+func writeExport(w *bufio.Writer, e Export) (n int, err error) {
+	n, err = w.WriteString(e.Label)
+	if err != nil {
+		return n, err
+	}
+	if err = w.WriteByte(0); err != nil {
+		return n, err
+	}
+	n++
+
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], e.Address)
+	nn, err := w.Write(b[:])
+	return n + nn, err
+}
+
 func decodeSourceLine(r *bufio.Reader, prev SourceLine) (line SourceLine, n int, err error) {
 	da, nn, err := decode67(r)
 	n += nn
@@ -0,0 +1,261 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"strings"
+)
+
+// A TestCase is a unit test declared in assembly source with the .test
+// directive. Its expectations come from the .expect directives that follow
+// it.
+//
+//	.test   "adds two numbers", ADD2, R0=5, R1=3
+//	.expect R0=8, C=0, [RESULT]=8, CYCLES<=20, UART="OK"
+type TestCase struct {
+	Name   string
+	Target uint16     // address of the routine called by the test
+	File   string     // source file containing the .test directive
+	Line   int        // source line of the .test directive
+	Setup  []TestTerm // values stored before the routine is called
+	Expect []TestTerm // conditions checked after the routine returns
+}
+
+// A TestTerm is a single item of a .test or .expect directive, such as
+// "R0=5" or "[$2000]=$FF".
+type TestTerm struct {
+	Name    string // R0-R7, SP, PC, Q, EF, N, Z, C, I, D, V, CYCLES, UART or MEM
+	Address uint16 // memory address when Name is MEM
+	Op      string // "=", or "<=" for CYCLES
+	Value   int    // numeric value
+	Bytes   []byte // string value, for MEM and UART
+	File    string // source file containing the term
+	Line    int    // source line of the term
+	Text    string // the term as written in the source
+}
+
+// Names accepted on the left side of a test term, and the directives they
+// may appear in.
+var testTermNames = map[string]struct{ setup, expect bool }{
+	"R0": {true, true}, "R1": {true, true}, "R2": {true, true}, "R3": {true, true},
+	"R4": {true, true}, "R5": {true, true}, "R6": {true, true}, "R7": {true, true},
+	"SP": {true, true}, "Q": {true, true}, "EF": {true, true},
+	"N": {true, true}, "Z": {true, true}, "C": {true, true},
+	"I": {true, true}, "D": {true, true}, "V": {true, true},
+	"MEM":    {true, true},
+	"PC":     {false, true},
+	"CYCLES": {false, true},
+	"UART":   {false, true},
+}
+
+// A test case under construction, with expressions that may not be
+// evaluated until labels are resolved.
+type testcase struct {
+	TestCase
+	target *expr
+	setup  []*testterm
+	expect []*testterm
+}
+
+type testterm struct {
+	TestTerm
+	addr  *expr
+	value *expr
+}
+
+// Parse a .test pseudo-op: a name, a target routine, and setup terms.
+func (a *assembler) parseTest(line, label fstring, param any) error {
+	a.logLine(line, "test=")
+
+	fields := a.splitFields(line)
+	if len(fields) < 2 {
+		a.addError(line, "test requires a name and a routine to call")
+		return errParse
+	}
+
+	name := fields[0]
+	if name.startsWith(stringQuote) {
+		s, _, err := a.exprParser.parseStringLiteral(name)
+		if err != nil {
+			a.addExprErrors()
+			return err
+		}
+		name = s
+	}
+
+	target, err := a.parseTestExpr(fields[1], 0)
+	if err != nil {
+		return err
+	}
+
+	t := &testcase{target: target}
+	t.Name = name.str
+	t.File = a.files[line.fileIndex]
+	t.Line = line.row
+
+	for _, f := range fields[2:] {
+		term, err := a.parseTestTerm(f, false)
+		if err != nil {
+			return err
+		}
+		t.setup = append(t.setup, term)
+	}
+
+	a.tests = append(a.tests, t)
+	return nil
+}
+
+// Parse an .expect pseudo-op, adding conditions to the most recent test.
+func (a *assembler) parseExpect(line, label fstring, param any) error {
+	a.logLine(line, "expect=")
+
+	if len(a.tests) == 0 {
+		a.addError(line, ".expect must follow a .test directive")
+		return errParse
+	}
+	t := a.tests[len(a.tests)-1]
+
+	for _, f := range a.splitFields(line) {
+		term, err := a.parseTestTerm(f, true)
+		if err != nil {
+			return err
+		}
+		t.expect = append(t.expect, term)
+	}
+	return nil
+}
+
+// Split a line into comma-separated fields, ignoring commas inside quotes.
+func (a *assembler) splitFields(line fstring) []fstring {
+	var fields []fstring
+	remain := line
+	for !remain.isEmpty() {
+		var f fstring
+		f, remain = remain.consumeUntilUnquotedChar(',')
+		if !remain.isEmpty() {
+			remain = remain.consume(1).consumeWhitespace()
+		}
+		fields = append(fields, f.trunc(len(strings.TrimRight(f.str, " \t"))))
+	}
+	return fields
+}
+
+// Parse one "name=value" term.
+func (a *assembler) parseTestTerm(f fstring, expect bool) (*testterm, error) {
+	t := &testterm{}
+	t.File = a.files[f.fileIndex]
+	t.Line = f.row
+	t.Text = f.str
+
+	remain := f
+	if remain.startsWithChar('[') {
+		inner := remain.consume(1)
+		addr, rest := inner.consumeUntilChar(']')
+		remain = rest
+		if remain.isEmpty() {
+			a.addError(f, "memory term missing ']'")
+			return nil, errParse
+		}
+		remain = remain.consume(1)
+		e, err := a.parseTestExpr(addr, allowParentheses)
+		if err != nil {
+			return nil, err
+		}
+		t.Name, t.addr = "MEM", e
+	} else {
+		var name fstring
+		name, remain = remain.consumeWhile(labelChar)
+		t.Name = strings.ToUpper(name.str)
+	}
+
+	allowed, ok := testTermNames[t.Name]
+	switch {
+	case !ok:
+		a.addError(f, "unknown test term '%s'", t.Name)
+		return nil, errParse
+	case expect && !allowed.expect, !expect && !allowed.setup:
+		a.addError(f, "'%s' can't be used here", t.Name)
+		return nil, errParse
+	}
+
+	remain = remain.consumeWhitespace()
+	switch {
+	case remain.startsWithString("<=") && t.Name == "CYCLES":
+		t.Op, remain = "<=", remain.consume(2)
+	case remain.startsWithChar('='):
+		t.Op, remain = "=", remain.consume(1)
+	default:
+		a.addError(remain, "expected '=' in test term")
+		return nil, errParse
+	}
+
+	remain = remain.consumeWhitespace()
+	if remain.startsWith(stringQuote) && remain.str[0] == '"' {
+		s, rest, err := a.exprParser.parseStringLiteral(remain)
+		if err != nil {
+			a.addExprErrors()
+			return nil, err
+		}
+		if rest = rest.consumeWhitespace(); !rest.isEmpty() {
+			a.addError(rest, "unexpected text after string")
+			return nil, errParse
+		}
+		if t.Name != "MEM" && t.Name != "UART" {
+			a.addError(remain, "'%s' requires a numeric value", t.Name)
+			return nil, errParse
+		}
+		t.Bytes = []byte(s.str)
+		return t, nil
+	}
+
+	if t.Name == "UART" {
+		a.addError(remain, "UART requires a string value")
+		return nil, errParse
+	}
+	e, err := a.parseTestExpr(remain, allowParentheses)
+	if err != nil {
+		return nil, err
+	}
+	t.value = e
+	return t, nil
+}
+
+// Parse an expression used by a test, scheduling it for evaluation once
+// labels are known.
+func (a *assembler) parseTestExpr(line fstring, flags parseFlags) (*expr, error) {
+	e, _, err := a.exprParser.parse(line, a.scopeLabel, flags)
+	if err != nil {
+		a.addExprErrors()
+		return nil, err
+	}
+	if !e.eval(-1, a.constants, a.labels) {
+		a.pushUnevaluated(e)
+	}
+	return e, nil
+}
+
+// Copy the evaluated test expressions into the assembly's test cases.
+func (a *assembler) generateTests() error {
+	a.logSection("Generating tests")
+	for _, t := range a.tests {
+		t.Target = uint16(t.target.value)
+		for _, term := range t.setup {
+			t.Setup = append(t.Setup, term.finish())
+		}
+		for _, term := range t.expect {
+			t.Expect = append(t.Expect, term.finish())
+		}
+		a.log("%-25s Target:$%04X Setup:%d Expect:%d", t.Name, t.Target, len(t.Setup), len(t.Expect))
+	}
+	return nil
+}
+
+func (t *testterm) finish() TestTerm {
+	if t.addr != nil {
+		t.Address = uint16(t.addr.value)
+	}
+	if t.value != nil {
+		t.Value = t.value.value
+	}
+	return t.TestTerm
+}
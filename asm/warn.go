@@ -0,0 +1,287 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package asm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// Warning IDs. Each warning the assembler reports carries one of these, so
+// that it can be turned on, off or into an error with a WarningFlag.
+const (
+	WarnSignedRange  = "signed-range"  // immediate value outside -127..127 for signed arithmetic
+	WarnUnused       = "unused"        // label or constant never referenced
+	WarnFallthrough  = "fallthrough"   // code runs on into data
+	WarnStackWrite   = "stack-write"   // store into the stack page
+	WarnCallAddress  = "call-address"  // CALL to an address that isn't a label
+	WarnSameRegister = "same-register" // register pair names one register twice
+	WarnUnreachable  = "unreachable"   // unlabeled code after HALT, RET or LBR
+	WarnOrgOverlap   = "org-overlap"   // .org blocks overlap
+)
+
+// WarningIDs lists every warning ID.
+var WarningIDs = []string{
+	WarnSignedRange, WarnUnused, WarnFallthrough, WarnStackWrite,
+	WarnCallAddress, WarnSameRegister, WarnUnreachable, WarnOrgOverlap,
+}
+
+// A WarningLevel says what the assembler does with a warning.
+type WarningLevel byte
+
+// Warning levels
+const (
+	WarnOn    WarningLevel = iota // report the warning
+	WarnOff                       // ignore it
+	WarnError                     // report it as an error
+)
+
+var warningLevelNames = []string{"on", "off", "error"}
+
+func (l WarningLevel) String() string {
+	return warningLevelNames[l]
+}
+
+// Overlapping blocks can't both be loaded, so they are an error unless the
+// warning is lowered.
+var defaultWarningLevels = map[string]WarningLevel{
+	WarnOrgOverlap: WarnError,
+}
+
+// A WarningFlag sets the level of one warning, or of all of them if ID is
+// empty, such as with the -W command line option.
+type WarningFlag struct {
+	ID    string
+	Level WarningLevel
+}
+
+// ParseWarningFlag parses an "ID=level" or "level" setting, where the level
+// is on, off or error.
+func ParseWarningFlag(s string) (WarningFlag, error) {
+	var w WarningFlag
+	id, level, found := strings.Cut(s, "=")
+	if !found {
+		id, level = "", id
+	}
+
+	w.ID = strings.ToLower(strings.TrimSpace(id))
+	if w.ID == "all" {
+		w.ID = ""
+	}
+	if w.ID != "" && !knownWarning(w.ID) {
+		return w, fmt.Errorf("unknown warning '%s'", w.ID)
+	}
+
+	level = strings.ToLower(strings.TrimSpace(level))
+	for i, name := range warningLevelNames {
+		if level == name {
+			w.Level = WarningLevel(i)
+			return w, nil
+		}
+	}
+	return w, fmt.Errorf("invalid warning level '%s' (use on, off or error)", level)
+}
+
+func (w WarningFlag) apply(a *assembler) {
+	if w.ID != "" {
+		a.warnLevels[w.ID] = w.Level
+		return
+	}
+	for _, id := range WarningIDs {
+		a.warnLevels[id] = w.Level
+	}
+}
+
+func knownWarning(id string) bool {
+	for _, w := range WarningIDs {
+		if w == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Report a warning at a line, according to its level. Returns true if the
+// warning was reported as an error.
+func (a *assembler) addWarning(id string, l fstring, format string, args ...any) bool {
+	switch a.warnLevels[id] {
+	case WarnOff:
+		return false
+	case WarnError:
+		a.addErrorCode(id, l, format+" [%s]", append(args, id)...)
+		return true
+	}
+
+	w := asmerror{l, fmt.Sprintf(format, args...), id}
+	a.warnings = append(a.warnings, w)
+	if a.verbose {
+		d := a.diagnostic(w, SeverityWarning)
+		fmt.Fprintln(a.out, d.String())
+	}
+	return false
+}
+
+// Check the generated program for likely mistakes and report them as
+// warnings.
+func (a *assembler) lint() error {
+	a.logSection("Checking code")
+
+	// Segments reached by a label may be jumped to.
+	labeled := make(map[int]bool)
+	for _, seg := range a.labels {
+		labeled[seg] = true
+	}
+
+	var prev *instruction // instruction before the current segment
+	dead := false         // unreachable code has been reported
+	for i, s := range a.segments {
+		if labeled[i] {
+			dead = false
+		}
+		switch ss := s.(type) {
+		case *instruction:
+			if prev != nil && endsFlow(prev.inst) && !labeled[i] && !dead {
+				a.addWarning(WarnUnreachable, ss.opcode, "'%s' can't be reached", ss.opcode.str)
+				dead = true
+			}
+			a.lintInstruction(ss)
+			prev = ss
+
+		case *data, *bytedata, *padding:
+			if prev != nil && !endsFlow(prev.inst) && a.segmentSize(i) > 0 {
+				a.addWarning(WarnFallthrough, prev.opcode, "code after '%s' runs on into data", prev.opcode.str)
+			}
+			if a.segmentSize(i) > 0 {
+				prev = nil
+			}
+
+		case *origin, *section:
+			prev, dead = nil, false
+		}
+	}
+
+	a.lintSymbols()
+	return nil
+}
+
+// Return the number of bytes a segment produced.
+func (a *assembler) segmentSize(i int) int {
+	switch ss := a.segments[i].(type) {
+	case *data:
+		return ss.bytes()
+	case *bytedata:
+		return len(ss.b)
+	case *padding:
+		return ss.pad
+	}
+	return 0
+}
+
+// Return true if execution never continues past an instruction.
+func endsFlow(inst *cpu.Instruction) bool {
+	switch inst.Mnemonic {
+	case "HALT", "RET", "RTI", "LBR":
+		return true
+	}
+	return false
+}
+
+// Check a single instruction.
+func (a *assembler) lintInstruction(ss *instruction) {
+	inst := ss.inst
+	if ss.operand.modeGuess == cpu.IMP || ss.operand.expr == nil {
+		return
+	}
+	v := ss.operand.expr.value
+
+	switch {
+	case inst.Mode == cpu.IMM && inst.Operands == cpu.RegPair:
+		if x, y := v>>4&7, v&7; x == y {
+			a.addWarning(WarnSameRegister, ss.opcode, "'%s' uses R%d as both registers", ss.opcode.str, x)
+		}
+
+	case inst.Mode == cpu.IMM && isSignedArithmetic(inst):
+		if v < -127 || v > 127 {
+			a.addWarning(WarnSignedRange, ss.operand.expr.line, "immediate value %d is outside the signed range -127..127", v)
+		}
+
+	case inst.Mnemonic == "STI":
+		if (!a.object || !relocatable(v)) && v >= 0x100 && v <= 0x1ff {
+			a.addWarning(WarnStackWrite, ss.operand.expr.line, "store to $%04X writes to the stack page", v)
+		}
+
+	case inst.Mnemonic == "CALL":
+		if !ss.operand.expr.address {
+			a.addWarning(WarnCallAddress, ss.operand.expr.line, "CALL to $%04X, which is not a label", v&0xffff)
+		}
+	}
+}
+
+func isSignedArithmetic(inst *cpu.Instruction) bool {
+	switch inst.Mnemonic {
+	case "ADI", "ADIC", "SUBI", "SUBIC":
+		return true
+	}
+	return false
+}
+
+// Report labels and constants that are never referenced. Symbols that are
+// exported, global, external, defined on the command line or at the entry
+// point are used from outside the source, and .struct and .enum declare
+// more than most programs use.
+func (a *assembler) lintSymbols() {
+	used := make(map[string]bool)
+	for _, e := range a.exprParser.refs {
+		used[refKey(e)] = true
+	}
+	for _, e := range a.exports {
+		used[e.Label] = true
+	}
+	for _, g := range a.globals {
+		used[g.str] = true
+	}
+	for _, e := range a.externs {
+		used[e.str] = true
+	}
+
+	var names []string
+	for name := range a.constants {
+		// Symbols from macro expansions are left to the macro's author.
+		l, ok := a.symbolDefs[name]
+		if !ok || used[name] || l.exp != nil || a.declared[name] {
+			continue
+		}
+		if seg, ok := a.labels[name]; ok && !a.object && a.segaddr(seg) == a.entryAddr {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		li, lj := a.symbolDefs[names[i]], a.symbolDefs[names[j]]
+		if li.fileIndex != lj.fileIndex {
+			return li.fileIndex < lj.fileIndex
+		}
+		return li.row < lj.row
+	})
+
+	for _, name := range names {
+		kind := "constant"
+		if _, ok := a.labels[name]; ok {
+			kind = "label"
+		}
+		a.addWarning(WarnUnused, a.symbolDefs[name], "%s '%s' is never used", kind, strings.TrimPrefix(name, "~"))
+	}
+}
+
+// Return the symbol table key of an identifier expression. Local labels
+// are qualified by their scope.
+func refKey(e *expr) string {
+	key := e.identifier.str
+	if e.identifier.startsWithChar('.') || e.identifier.startsWithChar('@') {
+		key = "~" + e.scopeLabel.str + key
+	}
+	return key
+}
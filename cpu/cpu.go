@@ -37,11 +37,14 @@ type CPU struct {
 	Mem         Memory          // assigned memory
 	Cycles      uint64          // total executed CPU cycles
 	LastPC      uint16          // Previous program counter
+	EF          byte            // External flag input lines, tested by LBRE
+	Halted      bool            // Set by HALT; cleared by SetPC
 	InstSet     *InstructionSet // Instruction set used by the CPU
 	pageCrossed bool
 	deltaCycles int8
 	debugger    *Debugger
 	brkHandler  BrkHandler
+	irqSources  []IRQSource
 	storeByte   func(cpu *CPU, addr uint16, v byte)
 }
 
@@ -53,14 +56,20 @@ const (
 	vectorBRK   = 0xfffe
 )
 
+// LogPath names the file NewCPU appends its log messages to. Set it to the
+// empty string to disable logging.
+var LogPath = "CPU1.log"
+
 // NewCPU creates an emulated 6502 CPU bound to the specified memory.
 func NewCPU(arch Architecture, m Memory) *CPU {
-	LogFile, err := os.OpenFile("CPU1.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatal("Failed to open log file:", err)
+	if LogPath != "" {
+		LogFile, err := os.OpenFile(LogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			log.Fatal("Failed to open log file:", err)
+		}
+		infoLogger := log.New(LogFile, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+		infoLogger.Println("***** Entered cpu.NewCPU()")
 	}
-	infoLogger := log.New(LogFile, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	infoLogger.Println("***** Entered cpu.NewCPU()")
 
 	cpu := &CPU{
 		Arch:      arch,
@@ -73,9 +82,11 @@ func NewCPU(arch Architecture, m Memory) *CPU {
 	return cpu
 }
 
-// SetPC updates the CPU program counter to 'addr'.
+// SetPC updates the CPU program counter to 'addr'. It also restarts a
+// CPU stopped by HALT.
 func (cpu *CPU) SetPC(addr uint16) {
 	cpu.Reg.PC = addr
+	cpu.Halted = false
 }
 
 // GetInstruction returns the instruction opcode at the requested address.
@@ -92,8 +103,24 @@ func (cpu *CPU) NextAddr(addr uint16) uint16 {
 	return addr + uint16(inst.Length)
 }
 
-// Step the cpu by one instruction.
+// Step the cpu by one instruction. A halted CPU does nothing.
 func (cpu *CPU) Step() {
+	if cpu.Halted {
+		return
+	}
+
+	// Service a pending device interrupt before fetching the next
+	// instruction.
+	if !cpu.Reg.InterruptDisable && cpu.irqPending() {
+		cpu.LastPC = cpu.Reg.PC
+		cpu.irq()
+		cpu.Cycles += 7
+		if cpu.debugger != nil {
+			cpu.debugger.onUpdatePC(cpu, cpu.Reg.PC)
+		}
+		return
+	}
+
 	// Grab the next opcode at the current PC
 	//log.Printf("CPU Step. PC = x%04x\n", cpu.Reg.PC)
 	opcode := cpu.Mem.LoadByte(cpu.Reg.PC)
@@ -145,6 +172,22 @@ func (cpu *CPU) AttachBrkHandler(handler BrkHandler) {
 	cpu.brkHandler = handler
 }
 
+// AttachIRQSource attaches a device that can request maskable interrupts.
+// The CPU checks its sources before each instruction and takes the IRQ
+// vector when one is pending and interrupts are enabled.
+func (cpu *CPU) AttachIRQSource(src IRQSource) {
+	cpu.irqSources = append(cpu.irqSources, src)
+}
+
+func (cpu *CPU) irqPending() bool {
+	for _, src := range cpu.irqSources {
+		if src.IRQPending() {
+			return true
+		}
+	}
+	return false
+}
+
 // AttachDebugger attaches a debugger to the CPU. The debugger receives
 // notifications whenever the CPU executes an instruction or stores a byte
 // to memory.
@@ -374,18 +417,75 @@ func (cpu *CPU) reset() {
 	cpu.Reg.PC = cpu.Mem.LoadAddress(vectorReset)
 }
 
-// 2's Complement Add with Carry
-func (cpu *CPU) twosCompAdd(a byte, b byte) byte {
-	// x := uint32(a)
-	// y := uint32(b)
-	// carry := boolToUint32(cpu.Reg.Carry)
-	// v := x + y + carry
-	// cpu.Reg.Carry = (v >= 0x100)
-	// cpu.Reg.Overflow = (((x & 0x80) == (y & 0x80)) && ((x & 0x80) != (v & 0x80)))
-	//x := ^a
-	//cpu.updateNZ(byte(v))
-	//return byte(v)
-	return 0
+// Add two bytes and set the Carry, Overflow, Zero and Sign flags. When the
+// Decimal flag is set, both bytes are treated as packed BCD and the result
+// is decimal adjusted; Carry is set when the sum exceeds 99.
+func (cpu *CPU) add(a byte, b byte) byte {
+	x := uint32(a)
+	y := uint32(b)
+	var v uint32
+
+	switch cpu.Reg.Decimal {
+	case true:
+		lo := (x & 0x0f) + (y & 0x0f)
+		var carrylo uint32
+		if lo >= 0x0a {
+			carrylo = 0x10
+			lo -= 0x0a
+		}
+		hi := (x & 0xf0) + (y & 0xf0) + carrylo
+		if hi >= 0xa0 {
+			hi -= 0xa0
+			cpu.Reg.Carry = true
+		} else {
+			cpu.Reg.Carry = false
+		}
+		v = hi | lo
+
+	case false:
+		v = x + y
+		cpu.Reg.Carry = (v >= 0x100)
+	}
+
+	cpu.Reg.Overflow = (((x ^ y) & 0x80) == 0) && (((x ^ v) & 0x80) != 0)
+	cpu.updateNZ(byte(v))
+	return byte(v)
+}
+
+// Subtract 'b' from 'a' and set the Carry, Overflow, Zero and Sign flags.
+// As on the 6502, Carry is set when no borrow was needed (a >= b). When the
+// Decimal flag is set, both bytes are treated as packed BCD and the result
+// is decimal adjusted, wrapping below 00 to 99.
+func (cpu *CPU) subtract(a byte, b byte) byte {
+	x := uint32(a)
+	y := uint32(b)
+	var v uint32
+
+	switch cpu.Reg.Decimal {
+	case true:
+		lo := (x & 0x0f) - (y & 0x0f)
+		var borrowlo uint32
+		if int32(lo) < 0 {
+			lo += 0x0a
+			borrowlo = 0x10
+		}
+		hi := (x & 0xf0) - (y & 0xf0) - borrowlo
+		if int32(hi) < 0 {
+			hi += 0xa0
+			cpu.Reg.Carry = false
+		} else {
+			cpu.Reg.Carry = true
+		}
+		v = (hi & 0xf0) | (lo & 0x0f)
+
+	case false:
+		v = x - y
+		cpu.Reg.Carry = (x >= y)
+	}
+
+	cpu.Reg.Overflow = (((x ^ y) & 0x80) != 0) && (((x ^ v) & 0x80) != 0)
+	cpu.updateNZ(byte(v))
+	return byte(v)
 }
 
 // Add with carry (CMOS)
@@ -1049,10 +1149,7 @@ func (cpu *CPU) GetAllMemory(addr uint16) string {
 func (cpu *CPU) adi(inst *Instruction, operand []byte) {
 	v := cpu.load(inst.Mode, operand) // Get value from operand
 	r := cpu.getReg(inst.Opcode)      // Get reg # from instruction opcode
-	//rv := uint32(cpu.Reg.R[r])        // Get value from register r
-	//sum := uint32(v) + rv             // Add data value to content of register r
-	sum := cpu.twosCompAdd(cpu.Reg.R[r], v) // Add and set flags
-	cpu.Reg.R[r] = sum
+	cpu.Reg.R[r] = cpu.add(cpu.Reg.R[r], v)
 }
 
 // ADIC is redundant and not needed
@@ -1067,8 +1164,7 @@ func (cpu *CPU) adm(inst *Instruction, operand []byte) {
 	// addr := operandToAddress(operand) // Get address from operand
 	mv := cpu.load(inst.Mode, operand) // Get byte from memory
 	cv := cpu.Reg.R[r]                 // retrieve current value from register
-	sum := cpu.twosCompAdd(mv, cv)     // internal routine sets the PSR flags
-	cpu.Reg.R[r] = sum
+	cpu.Reg.R[r] = cpu.add(cv, mv)     // internal routine sets the PSR flags
 }
 
 // ADMC is redundant and not needed
@@ -1079,8 +1175,7 @@ func (cpu *CPU) adm(inst *Instruction, operand []byte) {
 func (cpu *CPU) adr(inst *Instruction, operand []byte) {
 	v := cpu.load(inst.Mode, operand)
 	x, y := cpu.getRegXY(v)
-	cpu.Reg.R[x] = cpu.Reg.R[x] + cpu.Reg.R[y]
-	cpu.updateNZ(cpu.Reg.R[x])
+	cpu.Reg.R[x] = cpu.add(cpu.Reg.R[x], cpu.Reg.R[y])
 }
 
 // ADRC is redundant and not needed
@@ -1100,13 +1195,15 @@ func (cpu *CPU) and(inst *Instruction, operand []byte) {
 func (cpu *CPU) ani(inst *Instruction, operand []byte) {
 	v := cpu.load(inst.Mode, operand) // Get value from operand
 	r := cpu.getReg(inst.Opcode)      // Get reg # from instruction opcode
-	result := v & r
+	result := cpu.Reg.R[r] & v
 	cpu.Reg.R[r] = result
 	cpu.updateNZ(cpu.Reg.R[r])
 }
 
-func (c *CPU) call(inst *Instruction, operand []byte) {
-	// TBD
+// CALL - Push the address of the next instruction and jump to the subroutine.
+func (cpu *CPU) call(inst *Instruction, operand []byte) {
+	cpu.pushAddress(cpu.Reg.PC)
+	cpu.Reg.PC = operandToAddress(operand)
 }
 
 // Compare Registers, Sets Carry flag to true if matched
@@ -1134,15 +1231,19 @@ func (cpu *CPU) ex(inst *Instruction, operand []byte) {
 	cpu.Reg.R[x] = ytemp
 	cpu.Reg.R[y] = xtemp
 }
-func (c *CPU) halt(inst *Instruction, operand []byte) {
-	// TBD
+
+// HALT - Stop the CPU clock with the PC left on the HALT instruction.
+func (cpu *CPU) halt(inst *Instruction, operand []byte) {
+	cpu.Reg.PC = cpu.LastPC
+	cpu.Halted = true
 }
 
-// Increment memory value
+// Increment Register by 1. Set N if bit 7 on. Set Z if result is 0. No carry involved.
 func (cpu *CPU) inc(inst *Instruction, operand []byte) {
-	v := cpu.load(inst.Mode, operand) + 1
+	r := cpu.getReg(inst.Opcode) // Get reg # from instruction opcode
+	v := cpu.Reg.R[r] + 1
 	cpu.updateNZ(v)
-	cpu.store(inst.Mode, operand, v)
+	cpu.Reg.R[r] = v
 }
 
 // LBR - Long Branch to memory address
@@ -1157,8 +1258,20 @@ func (cpu *CPU) lbrc(inst *Instruction, operand []byte) {
 	cpu.Reg.PC = addr
 }
 
-func (c *CPU) lbrq(inst *Instruction, operand []byte) {
-	// TBD
+// LBRE - Long Branch if the EF input line selected by the opcode is set
+func (cpu *CPU) lbre(inst *Instruction, operand []byte) {
+	n := cpu.getReg(inst.Opcode) // Get line # from instruction opcode
+	if cpu.EF&(1<<n) != 0 {
+		cpu.Reg.PC = operandToAddress(operand)
+	}
+}
+
+// LBRQ - Long Branch if the Q output line selected by the opcode is set
+func (cpu *CPU) lbrq(inst *Instruction, operand []byte) {
+	n := cpu.getReg(inst.Opcode) // Get line # from instruction opcode
+	if cpu.Reg.Q&(1<<n) != 0 {
+		cpu.Reg.PC = operandToAddress(operand)
+	}
 }
 
 // LBRZ - Long Branch if zero flag
@@ -1174,11 +1287,14 @@ func (cpu *CPU) ldi(inst *Instruction, operand []byte) {
 	v := cpu.load(inst.Mode, operand) // Get value from operand
 	r := cpu.getReg(inst.Opcode)      // Get reg # from instruction opcode
 	cpu.Reg.R[r] = v                  // Store value in register
-	fmt.Printf("Operand: %02x, Reg #: %02x, Reg Content: %02x\n", v, r, cpu.Reg.R[r])
+	//fmt.Printf("Operand: %02x, Reg #: %02x, Reg Content: %02x\n", v, r, cpu.Reg.R[r])
 }
 
-func (c *CPU) ldm(inst *Instruction, operand []byte) {
-	// TBD
+// LDM - Load Register from the memory address specified by the two-byte operand
+func (cpu *CPU) ldm(inst *Instruction, operand []byte) {
+	r := cpu.getReg(inst.Opcode) // Get reg # from instruction opcode
+	cpu.Reg.R[r] = cpu.load(inst.Mode, operand)
+	cpu.updateNZ(cpu.Reg.R[r])
 }
 
 // No-operation
@@ -1199,7 +1315,7 @@ func (cpu *CPU) or(inst *Instruction, operand []byte) {
 func (cpu *CPU) ori(inst *Instruction, operand []byte) {
 	v := cpu.load(inst.Mode, operand) // Get value from operand
 	r := cpu.getReg(inst.Opcode)      // Get reg # from instruction opcode
-	result := v | r
+	result := cpu.Reg.R[r] | v
 	cpu.Reg.R[r] = result
 	cpu.updateNZ(cpu.Reg.R[r])
 }
@@ -1222,8 +1338,16 @@ func (cpu *CPU) resetq(inst *Instruction, operand []byte) {
 	cpu.Reg.Q = bitClear(cpu.Reg.Q, r) // Clear the r bit of Q byte
 }
 
-func (c *CPU) ret(inst *Instruction, operand []byte) {
-	// TBD
+// RET - Return from subroutine by popping the PC off the stack.
+func (cpu *CPU) ret(inst *Instruction, operand []byte) {
+	cpu.Reg.PC = cpu.popAddress()
+}
+
+// RTI - Return from interrupt, restoring the status flags and then the PC
+// pushed when the interrupt was taken
+func (cpu *CPU) rti(inst *Instruction, operand []byte) {
+	cpu.Reg.RestorePS(cpu.pop())
+	cpu.Reg.PC = cpu.popAddress()
 }
 
 func (cpu *CPU) setq(inst *Instruction, operand []byte) {
@@ -1285,8 +1409,6 @@ func (cpu *CPU) spsr(inst *Instruction, operand []byte) {
 		cpu.Reg.Sign = true
 	case OverflowBit:
 		cpu.Reg.Overflow = true
-	case BreakBit:
-		cpu.Reg.Decimal = true
 	case InterruptDisableBit:
 		cpu.Reg.InterruptDisable = true
 	case DecimalBit:
@@ -1306,8 +1428,6 @@ func (cpu *CPU) cpsr(inst *Instruction, operand []byte) {
 		cpu.Reg.Sign = false
 	case OverflowBit:
 		cpu.Reg.Overflow = false
-	case BreakBit:
-		cpu.Reg.Decimal = false
 	case InterruptDisableBit:
 		cpu.Reg.InterruptDisable = false
 	case DecimalBit:
@@ -1323,8 +1443,9 @@ func (cpu *CPU) sti(inst *Instruction, operand []byte) {
 	//fmt.Printf("Address to store at: %04x, Reg #: %02x, Reg Content: %02x\n", addr, r, cpu.Reg.R[r])
 }
 
-func (c *CPU) sub(inst *Instruction, operand []byte) {
-	// TBD
+// SUB - Subtract register Y from register X, result to X. Set carry, overflow,
+// zero and neg flags. Honors the Decimal flag.
+func (cpu *CPU) sub(inst *Instruction, operand []byte) {
 	/*
 		The SBC (subtraction with carry) instruction is actually a sub‐ traction with BORROW,
 		if we use mathematically correct terminology. The symbolic operation for SBC is
@@ -1342,6 +1463,9 @@ func (c *CPU) sub(inst *Instruction, operand []byte) {
 		ensure that the carry flag is set prior to the SBC operation to be sure that true two’s complement
 		arithmetic takes place. We can set the carry flag by executing the SEC (set carry flag) instruction.
 	*/
+	v := cpu.load(inst.Mode, operand)
+	x, y := cpu.getRegXY(v)
+	cpu.Reg.R[x] = cpu.subtract(cpu.Reg.R[x], cpu.Reg.R[y])
 }
 
 // SUBC is redundant and not needed
@@ -1349,8 +1473,11 @@ func (c *CPU) sub(inst *Instruction, operand []byte) {
 // 	// TBD
 // }
 
-func (c *CPU) subi(inst *Instruction, operand []byte) {
-	// TBD
+// SUBI - Subtract immediate from register r. Honors the Decimal flag.
+func (cpu *CPU) subi(inst *Instruction, operand []byte) {
+	v := cpu.load(inst.Mode, operand) // Get value from operand
+	r := cpu.getReg(inst.Opcode)      // Get reg # from instruction opcode
+	cpu.Reg.R[r] = cpu.subtract(cpu.Reg.R[r], v)
 }
 
 // SUBIC is redundant and not needed
@@ -1358,8 +1485,12 @@ func (c *CPU) subi(inst *Instruction, operand []byte) {
 // 	// TBD
 // }
 
-func (c *CPU) subm(inst *Instruction, operand []byte) {
-	// TBD
+// SUBM - Subtract the byte at memory address from register r. Honors the
+// Decimal flag.
+func (cpu *CPU) subm(inst *Instruction, operand []byte) {
+	r := cpu.getReg(inst.Opcode)       // Get reg # from instruction opcode
+	mv := cpu.load(inst.Mode, operand) // Get byte from memory
+	cpu.Reg.R[r] = cpu.subtract(cpu.Reg.R[r], mv)
 }
 
 // SUBMC is redundant and not needed
@@ -1380,7 +1511,7 @@ func (cpu *CPU) xor(inst *Instruction, operand []byte) {
 func (cpu *CPU) xri(inst *Instruction, operand []byte) {
 	v := cpu.load(inst.Mode, operand) // Get value from operand
 	r := cpu.getReg(inst.Opcode)      // Get reg # from instruction opcode
-	result := v ^ r
+	result := cpu.Reg.R[r] ^ v
 	cpu.Reg.R[r] = result
 	cpu.updateNZ(cpu.Reg.R[r])
 }
@@ -10,6 +10,10 @@ import (
 )
 
 func loadCPU(t *testing.T, asmString string) *cpu.CPU {
+	return loadCPUMem(t, asmString, cpu.NewFlatMemory())
+}
+
+func loadCPUMem(t *testing.T, asmString string, mem cpu.Memory) *cpu.CPU {
 	b := strings.NewReader(asmString)
 	r, sm, err := asm.Assemble(b, "test.asm", 0x1000, os.Stdout, 0)
 	if err != nil {
@@ -17,7 +21,6 @@ func loadCPU(t *testing.T, asmString string) *cpu.CPU {
 		return nil
 	}
 
-	mem := cpu.NewFlatMemory()
 	cpu := cpu.NewCPU(cpu.NMOS, mem)
 	mem.StoreBytes(sm.Origin, r.Code)
 	cpu.SetPC(sm.Origin)
@@ -191,3 +194,344 @@ func TestArithmetic(t *testing.T) {
 	expectR(t, cpu, 0x12, 0)
 
 }
+
+// Test the logical immediate operations, which combine the register with
+// the operand rather than with the register number
+func TestLogicalImmediate(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDI	R3, #$F0
+	ANI	R3, #$3C
+	LDI	R4, #$0F
+	ORI	R4, #$30
+	LDI	R5, #$FF
+	XRI	R5, #$0F
+	LDI	R6, #$55
+	ANI	R6, #$00
+	`
+	cpu := runCPU(t, asm, 8)
+
+	expectPC(t, cpu, 0x1010)
+	expectR(t, cpu, 0x30, 3)
+	expectR(t, cpu, 0x3F, 4)
+	expectR(t, cpu, 0xF0, 5)
+	expectR(t, cpu, 0x00, 6)
+	if !cpu.Reg.Zero {
+		t.Error("Zero flag not set by ANI")
+	}
+}
+
+// Test loading registers from memory
+func TestLoadMemory(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDM	R2, $2000
+	LDM	R7, $2001
+	`
+	cpu := loadCPU(t, asm)
+	if cpu == nil {
+		return
+	}
+	cpu.Mem.StoreByte(0x2000, 0x42)
+	cpu.Mem.StoreByte(0x2001, 0x80)
+
+	stepCPU(cpu, 1)
+	expectR(t, cpu, 0x42, 2)
+	stepCPU(cpu, 1)
+	expectPC(t, cpu, 0x1006)
+	expectR(t, cpu, 0x80, 7)
+	if !cpu.Reg.Sign {
+		t.Error("Sign flag not set by LDM")
+	}
+}
+
+// Test INC, which increments the register in its opcode and leaves memory
+// alone
+func TestIncrement(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDI	R1, #$7F
+	INC	R1
+	LDI	R6, #$FF
+	INC	R6
+	`
+	cpu := loadCPU(t, asm)
+	if cpu == nil {
+		return
+	}
+	cpu.Mem.StoreByte(0x0000, 0x10)
+
+	stepCPU(cpu, 2)
+	expectR(t, cpu, 0x80, 1)
+	if !cpu.Reg.Sign || cpu.Reg.Zero {
+		t.Errorf("Flags incorrect after INC to $80. N=%v Z=%v", cpu.Reg.Sign, cpu.Reg.Zero)
+	}
+
+	stepCPU(cpu, 2)
+	expectPC(t, cpu, 0x1006)
+	expectCycles(t, cpu, 6)
+	expectR(t, cpu, 0x00, 6)
+	if cpu.Reg.Sign || !cpu.Reg.Zero {
+		t.Errorf("Flags incorrect after INC to $00. N=%v Z=%v", cpu.Reg.Sign, cpu.Reg.Zero)
+	}
+	expectMem(t, cpu, 0x0000, 0x10)
+}
+
+func TestRegisterSyntax(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDI	R2, #$FF
+	LDI	R5, #$10
+	INC	R2
+	DEC	R5
+	ADR	R5, R2
+	`
+	cpu := runCPU(t, asm, 5)
+
+	expectPC(t, cpu, 0x1008)
+	expectR(t, cpu, 0x00, 2)
+	expectR(t, cpu, 0x0F, 5)
+}
+
+// Test the memory-mapped keyboard
+func TestKeyboard(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDM $FF00
+	LDM $FF01
+	LDI1 #$01
+	STI1 $FF00
+	LDM $FF01
+	STI1 $FF00
+	LDM $FF00`
+
+	kb := cpu.NewKeyboard()
+	mem := cpu.NewMappedMemory(cpu.NewFlatMemory())
+	mem.Map(cpu.KeyboardStatus, 2, kb)
+	kb.Push('H', 'I')
+
+	cpu := loadCPUMem(t, asm, mem)
+	if cpu == nil {
+		return
+	}
+
+	stepCPU(cpu, 1)
+	expectR(t, cpu, 0x01, 0)
+	stepCPU(cpu, 1)
+	expectR(t, cpu, 'H', 0)
+	stepCPU(cpu, 3)
+	expectR(t, cpu, 'I', 0)
+	stepCPU(cpu, 2)
+	expectR(t, cpu, 0x00, 0)
+	if kb.Len() != 0 {
+		t.Errorf("Keyboard queue not empty. got: %d", kb.Len())
+	}
+}
+
+func TestKeyboardIRQ(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDI0 #$80
+	STI0 $FF00
+	CPSR #$04
+	NOP
+	NOP`
+
+	kb := cpu.NewKeyboard()
+	mem := cpu.NewMappedMemory(cpu.NewFlatMemory())
+	mem.Map(cpu.KeyboardStatus, 2, kb)
+	mem.StoreAddress(0xfffe, 0x2000)
+
+	cpu := loadCPUMem(t, asm, mem)
+	if cpu == nil {
+		return
+	}
+	cpu.Reg.InterruptDisable = true
+	cpu.AttachIRQSource(kb)
+
+	stepCPU(cpu, 4)
+	expectPC(t, cpu, 0x1008)
+
+	kb.Push('A')
+	stepCPU(cpu, 1)
+	expectPC(t, cpu, 0x2000)
+	expectSP(t, cpu, 0xfc)
+	expectMem(t, cpu, 0x1ff, 0x10)
+	expectMem(t, cpu, 0x1fe, 0x08)
+}
+
+// Test an IRQ handler that acknowledges the key and returns to the
+// interrupted code
+func TestKeyboardIRQReturn(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDI0 #$80
+	STI0 $FF00
+	CPSR #$04
+	NOP
+	NOP
+	.ORG $2000
+	PUSH R0
+	LDI0 #$01
+	STI0 $FF00
+	POP R0
+	RTI`
+
+	kb := cpu.NewKeyboard()
+	mem := cpu.NewMappedMemory(cpu.NewFlatMemory())
+	mem.Map(cpu.KeyboardStatus, 2, kb)
+	mem.StoreAddress(0xfffe, 0x2000)
+
+	cpu := loadCPUMem(t, asm, mem)
+	if cpu == nil {
+		return
+	}
+	cpu.Reg.InterruptDisable = true
+	cpu.AttachIRQSource(kb)
+
+	stepCPU(cpu, 4)
+	cpu.Reg.Carry = true
+	kb.Push('A')
+	stepCPU(cpu, 1)
+	expectPC(t, cpu, 0x2000)
+	if !cpu.Reg.InterruptDisable {
+		t.Error("Interrupts not disabled in handler")
+	}
+
+	cpu.Reg.Carry = false
+	stepCPU(cpu, 5)
+	expectPC(t, cpu, 0x1008)
+	expectSP(t, cpu, 0xff)
+	expectR(t, cpu, 0x80, 0)
+	if cpu.Reg.InterruptDisable || !cpu.Reg.Carry {
+		t.Errorf("Flags not restored. I=%v C=%v", cpu.Reg.InterruptDisable, cpu.Reg.Carry)
+	}
+	if kb.Len() != 0 {
+		t.Errorf("Keyboard queue not empty. got: %d", kb.Len())
+	}
+
+	// With the key acknowledged, no further interrupt is taken.
+	stepCPU(cpu, 1)
+	expectPC(t, cpu, 0x1009)
+}
+
+// Test branches on the Q output and EF input lines
+func TestLineBranches(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LBRE $2000
+	LBRQ $2000
+	SETQ0
+	LBRQ $3000`
+
+	cpu := loadCPU(t, asm)
+	if cpu == nil {
+		return
+	}
+
+	stepCPU(cpu, 2)
+	expectPC(t, cpu, 0x1006)
+	stepCPU(cpu, 2)
+	expectPC(t, cpu, 0x3000)
+
+	cpu.SetPC(0x1000)
+	cpu.EF = 0x01
+	stepCPU(cpu, 1)
+	expectPC(t, cpu, 0x2000)
+}
+
+// Test packed BCD arithmetic with the Decimal flag set
+func TestDecimal(t *testing.T) {
+	asm := `
+	.ORG $1000
+	SPSR #$08
+	LDI0 #$59
+	ADI0 #$01
+	LDI1 #$45
+	LDI2 #$55
+	ADR #$12
+	SUBI #$01
+	LDI3 #$00
+	LDI4 #$01
+	SUB #$34
+	CPSR #$08
+	LDI5 #$09
+	LDI6 #$01
+	ADR #$56`
+
+	cpu := loadCPU(t, asm)
+	if cpu == nil {
+		return
+	}
+
+	stepCPU(cpu, 3)
+	expectR(t, cpu, 0x60, 0)
+	stepCPU(cpu, 3)
+	expectR(t, cpu, 0x00, 1)
+	if !cpu.Reg.Carry || !cpu.Reg.Zero {
+		t.Errorf("BCD add 45+55 should set carry and zero")
+	}
+	stepCPU(cpu, 1)
+	expectR(t, cpu, 0x59, 0)
+	if !cpu.Reg.Carry {
+		t.Errorf("BCD subtract without borrow should set carry")
+	}
+	stepCPU(cpu, 3)
+	expectR(t, cpu, 0x99, 3)
+	if cpu.Reg.Carry {
+		t.Errorf("BCD subtract with borrow should clear carry")
+	}
+	stepCPU(cpu, 4)
+	expectR(t, cpu, 0x0a, 5)
+}
+
+// Test that HALT stops the CPU on the HALT instruction
+func TestHalt(t *testing.T) {
+	asm := `
+	.ORG $1000
+	LDI0 #$01
+	HALT
+	LDI0 #$02`
+
+	cpu := runCPU(t, asm, 4)
+	if cpu == nil {
+		return
+	}
+
+	if !cpu.Halted {
+		t.Errorf("CPU not halted")
+	}
+	expectPC(t, cpu, 0x1002)
+	expectR(t, cpu, 0x01, 0)
+
+	cpu.SetPC(0x1003)
+	stepCPU(cpu, 1)
+	expectR(t, cpu, 0x02, 0)
+}
+
+// Test subroutine calls
+func TestCallRet(t *testing.T) {
+	asm := `
+	.ORG $1000
+	CALL SUB
+	LDI1 #$02
+	HALT
+SUB	LDI0 #$01
+	RET`
+
+	cpu := runCPU(t, asm, 2)
+	if cpu == nil {
+		return
+	}
+
+	expectPC(t, cpu, 0x1008)
+	expectSP(t, cpu, 0xfd)
+	expectMem(t, cpu, 0x1ff, 0x10)
+	expectMem(t, cpu, 0x1fe, 0x03)
+
+	stepCPU(cpu, 2)
+	expectPC(t, cpu, 0x1005)
+	expectSP(t, cpu, 0xff)
+	expectR(t, cpu, 0x01, 0)
+	expectR(t, cpu, 0x02, 1)
+}
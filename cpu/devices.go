@@ -0,0 +1,101 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package cpu
+
+// A Device is a peripheral whose registers appear in the CPU's address
+// space. Addresses passed to a device are relative to the start of the
+// range it was mapped at.
+type Device interface {
+	// LoadByte returns the value of the device register at offset 'reg'.
+	// Loads must not have side effects, since the host reads device
+	// registers when dumping or disassembling memory.
+	LoadByte(reg uint16) byte
+
+	// StoreByte writes a value to the device register at offset 'reg'.
+	StoreByte(reg uint16, v byte)
+}
+
+// An IRQSource is implemented by devices that can request a maskable
+// interrupt. The request is level-triggered: it stays asserted until the
+// program services the device.
+type IRQSource interface {
+	IRQPending() bool
+}
+
+type deviceMapping struct {
+	start, end uint16 // inclusive address range
+	dev        Device
+}
+
+// MappedMemory wraps a Memory and routes accesses within mapped address
+// ranges to devices. All other accesses go to the wrapped memory.
+type MappedMemory struct {
+	Memory
+	devices []deviceMapping
+}
+
+// NewMappedMemory creates a memory that forwards unmapped accesses to 'm'.
+func NewMappedMemory(m Memory) *MappedMemory {
+	return &MappedMemory{Memory: m}
+}
+
+// Map attaches a device to 'size' consecutive addresses starting at 'addr'.
+func (m *MappedMemory) Map(addr uint16, size int, dev Device) {
+	m.devices = append(m.devices, deviceMapping{addr, addr + uint16(size-1), dev})
+}
+
+func (m *MappedMemory) lookup(addr uint16) (Device, uint16) {
+	for _, d := range m.devices {
+		if addr >= d.start && addr <= d.end {
+			return d.dev, addr - d.start
+		}
+	}
+	return nil, 0
+}
+
+// LoadByte loads a single byte from the address and returns it.
+func (m *MappedMemory) LoadByte(addr uint16) byte {
+	if dev, reg := m.lookup(addr); dev != nil {
+		return dev.LoadByte(reg)
+	}
+	return m.Memory.LoadByte(addr)
+}
+
+// LoadBytes loads multiple bytes from the address and stores them into
+// the buffer 'b'.
+func (m *MappedMemory) LoadBytes(addr uint16, b []byte) {
+	m.Memory.LoadBytes(addr, b)
+	for i := range b {
+		if dev, reg := m.lookup(addr + uint16(i)); dev != nil {
+			b[i] = dev.LoadByte(reg)
+		}
+	}
+}
+
+// LoadAddress loads a 16-bit address value from the requested address and
+// returns it.
+func (m *MappedMemory) LoadAddress(addr uint16) uint16 {
+	return uint16(m.LoadByte(addr)) | uint16(m.LoadByte(addr+1))<<8
+}
+
+// StoreByte stores a byte to the requested address.
+func (m *MappedMemory) StoreByte(addr uint16, v byte) {
+	if dev, reg := m.lookup(addr); dev != nil {
+		dev.StoreByte(reg, v)
+		return
+	}
+	m.Memory.StoreByte(addr, v)
+}
+
+// StoreBytes stores multiple bytes to the requested address.
+func (m *MappedMemory) StoreBytes(addr uint16, b []byte) {
+	for i, v := range b {
+		m.StoreByte(addr+uint16(i), v)
+	}
+}
+
+// StoreAddress stores a 16-bit address 'v' to the requested address.
+func (m *MappedMemory) StoreAddress(addr uint16, v uint16) {
+	m.StoreByte(addr, byte(v))
+	m.StoreByte(addr+1, byte(v>>8))
+}
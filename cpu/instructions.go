@@ -40,6 +40,7 @@ const (
 	symINC
 	symLBR
 	symLBRC
+	symLBRE
 	symLBRQ
 	symLBRZ
 	symLDI0
@@ -79,6 +80,7 @@ const (
 	symRESETQ6
 	symRESETQ7
 	symRET
+	symRTI
 	symSETQ0
 	symSETQ1
 	symSETQ2
@@ -144,6 +146,7 @@ var impl = []opcodeImpl{
 	{symINC, "INC", [2]instfunc{(*CPU).inc, (*CPU).inc}},
 	{symLBR, "LBR", [2]instfunc{(*CPU).lbr, (*CPU).lbr}},
 	{symLBRC, "LBRC", [2]instfunc{(*CPU).lbrc, (*CPU).lbrc}},
+	{symLBRE, "LBRE", [2]instfunc{(*CPU).lbre, (*CPU).lbre}},
 	{symLBRZ, "LBRZ", [2]instfunc{(*CPU).lbrz, (*CPU).lbrz}},
 	{symLBRQ, "LBRQ", [2]instfunc{(*CPU).lbrq, (*CPU).lbrq}},
 	{symLDI0, "LDI0", [2]instfunc{(*CPU).ldi, (*CPU).ldi}},
@@ -183,6 +186,7 @@ var impl = []opcodeImpl{
 	{symRESETQ6, "RESETQ6", [2]instfunc{(*CPU).resetq, (*CPU).resetq}},
 	{symRESETQ7, "RESETQ7", [2]instfunc{(*CPU).resetq, (*CPU).resetq}},
 	{symRET, "RET", [2]instfunc{(*CPU).ret, (*CPU).ret}},
+	{symRTI, "RTI", [2]instfunc{(*CPU).rti, (*CPU).rti}},
 	{symSETQ0, "SETQ0", [2]instfunc{(*CPU).setq, (*CPU).setq}},
 	{symSETQ1, "SETQ1", [2]instfunc{(*CPU).setq, (*CPU).setq}},
 	{symSETQ2, "SETQ2", [2]instfunc{(*CPU).setq, (*CPU).setq}},
@@ -234,6 +238,51 @@ const (
 	ACC             // Accumulator (no operand)
 )
 
+// Operands describes how an instruction encodes register or line number
+// operands.
+type Operands byte
+
+// Register operand encodings
+const (
+	NoRegister Operands = iota // no register operand
+	RegOpcode                  // register number in the opcode's low 3 bits
+	LineOpcode                 // Q or EF line number in the opcode's low 3 bits
+	RegPair                    // two registers in the operand byte, as XRRRXRRR
+)
+
+// Register operand encodings of each native mnemonic.
+var mnemonicOperands = map[string]Operands{
+	"ADI":    RegOpcode,
+	"ADM":    RegOpcode,
+	"ANI":    RegOpcode,
+	"DEC":    RegOpcode,
+	"INC":    RegOpcode,
+	"LDI":    RegOpcode,
+	"LDM":    RegOpcode,
+	"ORI":    RegOpcode,
+	"POP":    RegOpcode,
+	"PUSH":   RegOpcode,
+	"SHL":    RegOpcode,
+	"SHLC":   RegOpcode,
+	"SHR":    RegOpcode,
+	"SHRC":   RegOpcode,
+	"STI":    RegOpcode,
+	"SUBI":   RegOpcode,
+	"SUBM":   RegOpcode,
+	"XRI":    RegOpcode,
+	"LBRE":   LineOpcode,
+	"LBRQ":   LineOpcode,
+	"RESETQ": LineOpcode,
+	"SETQ":   LineOpcode,
+	"ADR":    RegPair,
+	"AND":    RegPair,
+	"CMP":    RegPair,
+	"EX":     RegPair,
+	"OR":     RegPair,
+	"SUB":    RegPair,
+	"XOR":    RegPair,
+}
+
 // Opcode data for an (opcode, mode) pair
 type opcodeData struct {
 	sym      opsym // internal opcode symbol
@@ -308,6 +357,15 @@ var data = []opcodeData{
 
 	{symLBRC, ABS, 0x1a, 3, 4, 0, false},
 
+	{symLBRE, ABS, 0x98, 3, 4, 0, false},
+	{symLBRE, ABS, 0x99, 3, 4, 0, false},
+	{symLBRE, ABS, 0x9a, 3, 4, 0, false},
+	{symLBRE, ABS, 0x9b, 3, 4, 0, false},
+	{symLBRE, ABS, 0x9c, 3, 4, 0, false},
+	{symLBRE, ABS, 0x9d, 3, 4, 0, false},
+	{symLBRE, ABS, 0x9e, 3, 4, 0, false},
+	{symLBRE, ABS, 0x9f, 3, 4, 0, false},
+
 	{symLBRQ, ABS, 0xb0, 3, 4, 0, false},
 	{symLBRQ, ABS, 0xb1, 3, 4, 0, false},
 	{symLBRQ, ABS, 0xb2, 3, 4, 0, false},
@@ -379,6 +437,8 @@ var data = []opcodeData{
 
 	{symRET, IMP, 0x03, 1, 1, 6, false},
 
+	{symRTI, IMP, 0x1f, 1, 1, 6, false},
+
 	{symSETQ0, IMP, 0x38, 1, 1, 0, false},
 	{symSETQ1, IMP, 0x39, 1, 1, 0, false},
 	{symSETQ2, IMP, 0x3a, 1, 1, 0, false},
@@ -490,17 +550,8 @@ var unusedData = []unused{
 	{0x1c, IMP, 1, 1},
 	{0x1d, IMP, 1, 1},
 	{0x1e, IMP, 1, 1},
-	{0x1f, IMP, 1, 1},
 	{0x81, IMP, 1, 1},
 	{0x83, IMP, 1, 1},
-	{0x98, IMP, 1, 1},
-	{0x99, IMP, 1, 1},
-	{0x9a, IMP, 1, 1},
-	{0x9b, IMP, 1, 1},
-	{0x9c, IMP, 1, 1},
-	{0x9d, IMP, 1, 1},
-	{0x9e, IMP, 1, 1},
-	{0x9f, IMP, 1, 1},
 	{0xa0, IMP, 1, 1},
 	{0xa1, IMP, 1, 1},
 	{0xa2, IMP, 1, 1},
@@ -556,6 +607,8 @@ var unusedData = []unused{
 // cost.
 type Instruction struct {
 	Name     string   // all-caps name of the instruction
+	Mnemonic string   // native mnemonic, without any register number
+	Operands Operands // how register or line operands are encoded
 	Mode     Mode     // addressing mode
 	Opcode   byte     // hexadecimal opcode value
 	Length   byte     // combined size of opcode and operand, in bytes
@@ -577,8 +630,8 @@ func (s *InstructionSet) Lookup(opcode byte) *Instruction {
 	return &s.instructions[opcode]
 }
 
-// GetInstructions returns all CPU instructions whose name matches the
-// provided string.
+// GetInstructions returns all CPU instructions whose name or native
+// mnemonic matches the provided string.
 func (s *InstructionSet) GetInstructions(name string) []*Instruction {
 	return s.variants[strings.ToUpper(name)]
 }
@@ -610,6 +663,7 @@ func newInstructionSet(arch Architecture) *InstructionSet {
 		// an unused instruction for it.
 		if d.cmos && arch != CMOS {
 			inst.Name = unusedName
+			inst.Mnemonic = unusedName
 			inst.Mode = d.mode
 			inst.Opcode = d.opcode
 			inst.Length = d.length
@@ -625,6 +679,8 @@ func newInstructionSet(arch Architecture) *InstructionSet {
 		}
 
 		inst.Name = impl.name
+		inst.Mnemonic = strings.TrimRight(impl.name, "01234567")
+		inst.Operands = mnemonicOperands[inst.Mnemonic]
 		inst.Mode = d.mode
 		inst.Opcode = d.opcode
 		inst.Length = d.length
@@ -633,6 +689,9 @@ func newInstructionSet(arch Architecture) *InstructionSet {
 		inst.fn = impl.fn[arch]
 
 		set.variants[inst.Name] = append(set.variants[inst.Name], inst)
+		if inst.Mnemonic != inst.Name {
+			set.variants[inst.Mnemonic] = append(set.variants[inst.Mnemonic], inst)
+		}
 	}
 
 	// Add unused opcodes to the instruction set. This information is useful
@@ -641,6 +700,7 @@ func newInstructionSet(arch Architecture) *InstructionSet {
 	for _, u := range unusedData {
 		inst := &set.instructions[u.opcode]
 		inst.Name = unusedName
+		inst.Mnemonic = unusedName
 		inst.Mode = u.mode
 		inst.Opcode = u.opcode
 		inst.Length = u.length
@@ -0,0 +1,122 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package cpu
+
+import "sync"
+
+// Default keyboard register addresses.
+const (
+	KeyboardStatus = 0xff00 // status/control register
+	KeyboardData   = 0xff01 // key at the head of the queue
+)
+
+// Keyboard status register bits.
+const (
+	KeyReady     = 1 << 0 // read: queue holds a key; write 1: discard head key
+	KeyOverflow  = 1 << 1 // read: keys were dropped; write 1: clear
+	KeyIRQEnable = 1 << 7 // read/write: request an IRQ while a key is ready
+)
+
+// KeyboardQueueSize is the number of keys the keyboard buffers before
+// dropping input.
+const KeyboardQueueSize = 16
+
+// A Keyboard is a memory-mapped input device holding a FIFO of key codes.
+// It occupies two registers:
+//
+//	+0 status  bit 0 key ready, bit 1 overflow, bit 7 IRQ enable
+//	+1 data    key code at the head of the queue (0 when empty)
+//
+// Reading the data register does not consume the key. A program
+// acknowledges a key by writing a 1 to the ready bit of the status
+// register, which advances the queue. Keys may be pushed from any
+// goroutine.
+type Keyboard struct {
+	mu        sync.Mutex
+	queue     []byte
+	overflow  bool
+	irqEnable bool
+}
+
+// NewKeyboard creates a keyboard with an empty queue.
+func NewKeyboard() *Keyboard {
+	return &Keyboard{}
+}
+
+// Push adds key codes to the end of the queue. Keys that don't fit are
+// dropped and the overflow bit is set.
+func (k *Keyboard) Push(keys ...byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range keys {
+		if len(k.queue) >= KeyboardQueueSize {
+			k.overflow = true
+			continue
+		}
+		k.queue = append(k.queue, key)
+	}
+}
+
+// Clear empties the queue and resets the status register.
+func (k *Keyboard) Clear() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.queue, k.overflow, k.irqEnable = nil, false, false
+}
+
+// Len returns the number of keys waiting in the queue.
+func (k *Keyboard) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.queue)
+}
+
+// LoadByte returns the value of a keyboard register.
+func (k *Keyboard) LoadByte(reg uint16) byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch reg {
+	case 0:
+		var s byte
+		if len(k.queue) > 0 {
+			s |= KeyReady
+		}
+		if k.overflow {
+			s |= KeyOverflow
+		}
+		if k.irqEnable {
+			s |= KeyIRQEnable
+		}
+		return s
+	case 1:
+		if len(k.queue) > 0 {
+			return k.queue[0]
+		}
+	}
+	return 0
+}
+
+// StoreByte writes a keyboard register. Only the status register is
+// writable.
+func (k *Keyboard) StoreByte(reg uint16, v byte) {
+	if reg != 0 {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if v&KeyReady != 0 && len(k.queue) > 0 {
+		k.queue = k.queue[1:]
+	}
+	if v&KeyOverflow != 0 {
+		k.overflow = false
+	}
+	k.irqEnable = v&KeyIRQEnable != 0
+}
+
+// IRQPending returns true while interrupts are enabled and a key is
+// waiting to be read.
+func (k *Keyboard) IRQPending() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.irqEnable && len(k.queue) > 0
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package cpu
+
+import (
+	"io"
+	"sync"
+)
+
+// Default UART register addresses.
+const (
+	UARTData   = 0xff04 // write: transmit a byte
+	UARTStatus = 0xff05 // read: transmitter status
+)
+
+// UART status register bits.
+const (
+	UARTTxReady = 1 << 0 // read: transmitter can accept a byte
+)
+
+// A UART is a memory-mapped serial output device. It occupies two
+// registers:
+//
+//	+0 data    writing a byte transmits it
+//	+1 status  bit 0 transmitter ready (always set)
+//
+// Transmitted bytes are written to the UART's writer as they arrive.
+type UART struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewUART creates a UART that transmits to 'w'. A nil writer discards
+// output.
+func NewUART(w io.Writer) *UART {
+	return &UART{w: w}
+}
+
+// SetWriter changes the destination of transmitted bytes.
+func (u *UART) SetWriter(w io.Writer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.w = w
+}
+
+// LoadByte returns the value of a UART register.
+func (u *UART) LoadByte(reg uint16) byte {
+	if reg == 1 {
+		return UARTTxReady
+	}
+	return 0
+}
+
+// StoreByte writes a UART register. Only the data register is writable.
+func (u *UART) StoreByte(reg uint16, v byte) {
+	if reg != 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.w != nil {
+		u.w.Write([]byte{v})
+	}
+}
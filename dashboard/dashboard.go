@@ -15,6 +15,7 @@ import (
 	"bytes"
 	"image/color"
 	"os"
+	"path/filepath"
 
 	//"log"
 	"time"
@@ -187,17 +188,29 @@ func New(cpu *cpu.CPU, host *host.Host) (w fyne.Window, o *bytes.Buffer) {
 
 	mainContainer = container.NewVBox(
 		settingsContainer,
+		newFrontPanel(),
 		middleContainer,
 		statusContainer,
 	)
 
 	w.SetContent(mainContainer)
+
+	// Keys typed while no widget has focus go to the emulated keyboard.
+	w.Canvas().SetOnTypedRune(typedRune)
+	w.Canvas().SetOnTypedKey(typedKey)
+
 	consoleBuffer.Write([]byte("********************************************************************************\n" +
 		"******************************** CPU1 Simulator ********************************\n" +
 		"********************************************************************************\n"))
 	consoleContainer.Refresh()
 	UpdateAll()
 
+	// Refresh the display whenever a watched source file is reloaded.
+	host.SetReloadHandler(func(filename string) {
+		SetStatus("Reloaded " + filepath.Base(filename))
+		UpdateAll()
+	})
+
 	return w, &consoleBuffer
 }
 
@@ -324,6 +337,29 @@ func submit() {
 
 //=========================================== End Button Callbacks ========================
 
+// Keyboard callbacks. Printable characters arrive as runes; control keys
+// arrive as key events and are translated to ASCII control codes.
+func typedRune(r rune) {
+	if r < 0x80 {
+		h.Keyboard().Push(byte(r))
+	}
+}
+
+func typedKey(ev *fyne.KeyEvent) {
+	switch ev.Name {
+	case fyne.KeyReturn, fyne.KeyEnter:
+		h.Keyboard().Push('\r')
+	case fyne.KeyBackspace:
+		h.Keyboard().Push(0x08)
+	case fyne.KeyTab:
+		h.Keyboard().Push('\t')
+	case fyne.KeyEscape:
+		h.Keyboard().Push(0x1b)
+	case fyne.KeyDelete:
+		h.Keyboard().Push(0x7f)
+	}
+}
+
 // Utilities
 func UpdateTime() {
 	formatted := time.Now().Format("Time: 15:05:01")
@@ -0,0 +1,252 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+//
+// The front panel shows the CPU's eight Q output lines as LEDs and drives
+// its eight EF input lines from toggle switches. In Altair mode the panel
+// adds address and data switches with Examine, Deposit and Single Step
+// buttons, so short programs can be toggled straight into memory.
+
+package dashboard
+
+import (
+	"fmt"
+	"image/color"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/widget"
+)
+
+var (
+	ledOn          = color.RGBA{R: 255, G: 40, B: 40, A: 255}
+	ledOff         = color.RGBA{R: 70, G: 20, B: 20, A: 255}
+	frontPanelRate = 50 * time.Millisecond
+)
+
+// A frontPanel holds the panel widgets and the state they display. The
+// ticker goroutine and the widget callbacks both use it, so mu guards
+// every field after it, along with the CPU's Q and EF lines.
+type frontPanel struct {
+	mu           sync.Mutex
+	qLEDs        [8]*canvas.Circle
+	efSwitches   [8]*widget.Check
+	addrLEDs     [16]*canvas.Circle
+	dataLEDs     [8]*canvas.Circle
+	addrSwitches [16]*widget.Check
+	dataSwitches [8]*widget.Check
+	addr         uint16 // the address being examined in Altair mode
+	lastQ        int    // the Q lines last shown, or -1
+	altairMode   *widget.Check
+	altairBox    *fyne.Container
+}
+
+// newFrontPanel builds the front panel widgets and starts a goroutine that
+// keeps the LEDs current while the CPU runs.
+func newFrontPanel() *fyne.Container {
+	p := &frontPanel{lastQ: -1}
+	ledSize := fyne.NewSize(14, 14)
+
+	// Q output LEDs and EF input switches, most significant line first.
+	qRow := container.NewHBox(panelLabel("Q "))
+	efRow := container.NewHBox(panelLabel("EF"))
+	for i := 7; i >= 0; i-- {
+		n := i
+		p.qLEDs[n] = canvas.NewCircle(ledOff)
+		qRow.Add(container.NewVBox(
+			container.NewCenter(container.NewGridWrap(ledSize, p.qLEDs[n])),
+			panelLabel(fmt.Sprintf("%d", n)),
+		))
+		p.efSwitches[n] = widget.NewCheck(fmt.Sprintf("%d", n), func(on bool) {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if on {
+				c.EF |= 1 << n
+			} else {
+				c.EF &^= 1 << n
+			}
+		})
+		efRow.Add(p.efSwitches[n])
+	}
+
+	// Altair-style address and data entry.
+	addrLEDRow := container.NewHBox(panelLabel("A "))
+	addrRow := container.NewHBox(panelLabel("A "))
+	for i := 15; i >= 0; i-- {
+		p.addrLEDs[i] = canvas.NewCircle(ledOff)
+		addrLEDRow.Add(container.NewGridWrap(ledSize, p.addrLEDs[i]))
+		p.addrSwitches[i] = widget.NewCheck("", nil)
+		addrRow.Add(p.addrSwitches[i])
+	}
+	dataLEDRow := container.NewHBox(panelLabel("D "))
+	dataRow := container.NewHBox(panelLabel("D "))
+	for i := 7; i >= 0; i-- {
+		p.dataLEDs[i] = canvas.NewCircle(ledOff)
+		dataLEDRow.Add(container.NewGridWrap(ledSize, p.dataLEDs[i]))
+		p.dataSwitches[i] = widget.NewCheck("", nil)
+		dataRow.Add(p.dataSwitches[i])
+	}
+	p.altairBox = container.NewVBox(
+		addrLEDRow,
+		addrRow,
+		dataLEDRow,
+		dataRow,
+		container.NewHBox(
+			widget.NewButton("Examine", p.examine),
+			widget.NewButton("Examine Next", p.examineNext),
+			widget.NewButton("Deposit", p.deposit),
+			widget.NewButton("Deposit Next", p.depositNext),
+			widget.NewButton("Single Step", p.singleStep),
+		),
+	)
+	p.altairBox.Hide()
+
+	p.altairMode = widget.NewCheck("Altair mode", func(on bool) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if on {
+			p.addr = c.Reg.PC
+			p.altairBox.Show()
+		} else {
+			p.altairBox.Hide()
+		}
+		p.refresh()
+	})
+
+	box := container.NewVBox(
+		container.NewHBox(qRow, widget.NewSeparator(), efRow, widget.NewSeparator(), p.altairMode),
+		p.altairBox,
+	)
+
+	go func() {
+		for range time.Tick(frontPanelRate) {
+			p.update()
+		}
+	}()
+
+	return box
+}
+
+func panelLabel(s string) *widget.Label {
+	l := widget.NewLabel(s)
+	l.TextStyle.Monospace = true
+	return l
+}
+
+func setLED(led *canvas.Circle, on bool) {
+	fill := color.Color(ledOff)
+	if on {
+		fill = ledOn
+	}
+	if led.FillColor != fill {
+		led.FillColor = fill
+		led.Refresh()
+	}
+}
+
+// Refresh the panel LEDs from the CPU state. It is called periodically,
+// so it only redraws LEDs whose state changed.
+func (p *frontPanel) update() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refresh()
+}
+
+// Refresh the LEDs. The caller holds the lock.
+func (p *frontPanel) refresh() {
+	if q := int(c.Reg.Q); q != p.lastQ {
+		for i, led := range p.qLEDs {
+			setLED(led, q&(1<<i) != 0)
+		}
+		p.lastQ = q
+	}
+
+	if p.altairMode.Checked {
+		for i, led := range p.addrLEDs {
+			setLED(led, p.addr&(1<<i) != 0)
+		}
+		d := c.Mem.LoadByte(p.addr)
+		for i, led := range p.dataLEDs {
+			setLED(led, d&(1<<i) != 0)
+		}
+	}
+}
+
+func (p *frontPanel) addrSwitchValue() uint16 {
+	var v uint16
+	for i, s := range p.addrSwitches {
+		if s.Checked {
+			v |= 1 << i
+		}
+	}
+	return v
+}
+
+func (p *frontPanel) dataSwitchValue() byte {
+	var v byte
+	for i, s := range p.dataSwitches {
+		if s.Checked {
+			v |= 1 << i
+		}
+	}
+	return v
+}
+
+// Examine loads the address switches into the panel address and the
+// program counter, and displays the byte stored there.
+func (p *frontPanel) examine() {
+	p.mu.Lock()
+	p.examineAt(p.addrSwitchValue())
+	p.mu.Unlock()
+	UpdateAll()
+}
+
+func (p *frontPanel) examineNext() {
+	p.mu.Lock()
+	p.examineAt(p.addr + 1)
+	p.mu.Unlock()
+	UpdateAll()
+}
+
+// Move the panel address and program counter. The caller holds the lock.
+func (p *frontPanel) examineAt(addr uint16) {
+	p.addr = addr
+	c.SetPC(addr)
+	SetStatus(fmt.Sprintf("Examine $%04X: $%02X", addr, c.Mem.LoadByte(addr)))
+	p.refresh()
+}
+
+// Deposit stores the data switches at the panel address.
+func (p *frontPanel) deposit() {
+	p.mu.Lock()
+	p.depositAt(p.addr)
+	p.mu.Unlock()
+	UpdateAll()
+}
+
+func (p *frontPanel) depositNext() {
+	p.mu.Lock()
+	c.SetPC(p.addr + 1)
+	p.depositAt(p.addr + 1)
+	p.mu.Unlock()
+	UpdateAll()
+}
+
+// Store the data switches and move the panel address there. The caller
+// holds the lock.
+func (p *frontPanel) depositAt(addr uint16) {
+	p.addr = addr
+	c.Mem.StoreByte(addr, p.dataSwitchValue())
+	SetStatus(fmt.Sprintf("Deposit $%04X: $%02X", addr, c.Mem.LoadByte(addr)))
+	p.refresh()
+}
+
+func (p *frontPanel) singleStep() {
+	h.ProcessGUICmd("step in")
+	p.mu.Lock()
+	p.addr = c.Reg.PC
+	p.refresh()
+	p.mu.Unlock()
+	UpdateAll()
+}
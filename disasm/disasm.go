@@ -55,20 +55,37 @@ const (
 	ShowRegisters
 	ShowCycles
 	ShowAnnotations
+	ShowLabels
 
-	ShowBasic = ShowAddress | ShowCode | ShowInstruction | ShowAnnotations
+	ShowBasic = ShowAddress | ShowCode | ShowInstruction | ShowAnnotations | ShowLabels
 	ShowFull  = ShowAddress | ShowCode | ShowInstruction | ShowRegisters | ShowCycles
 )
 
+// A SymbolResolver looks up the labels of addresses, so that disassembly
+// can show them in place of numbers. An asm.SourceMap is one.
+type SymbolResolver interface {
+	// LookupLabel returns the label at an address, or else a nearby label
+	// below it and the address's offset from the label.
+	LookupLabel(addr uint16) (label string, offset int, ok bool)
+}
+
 // Disassemble the machine code at memory address addr. Return a string
 // representing the disassembled instruction and the address of the next
-// instruction.
-func Disassemble(c *cpu.CPU, addr uint16, flags Flags, anno string, theme *Theme) (line string, next uint16) {
+// instruction. If syms isn't nil, address operands are shown as labels,
+// and with ShowLabels a label at addr is shown on a line of its own before
+// the instruction.
+func Disassemble(c *cpu.CPU, addr uint16, flags Flags, anno string, theme *Theme, syms SymbolResolver) (line string, next uint16) {
 	opcode := c.Mem.LoadByte(addr)
 	inst := c.InstSet.Lookup(opcode)
 	next = addr + uint16(inst.Length)
 	line = ""
 
+	if (flags&ShowLabels) != 0 && syms != nil {
+		if label, offset, ok := syms.LookupLabel(addr); ok && offset == 0 {
+			line += label + ":\n"
+		}
+	}
+
 	if (flags & ShowAddress) != 0 {
 		//line += fmt.Sprintf("%s%04X%s- ", theme.Addr, addr, theme.Reset)
 		line += fmt.Sprintf("%04X- ", addr)
@@ -95,11 +112,11 @@ func Disassemble(c *cpu.CPU, addr uint16, flags Flags, anno string, theme *Theme
 
 		// Return string composed of CPU instruction and operand.
 		//line += fmt.Sprintf("%s%s   %s"+modeFormat[inst.Mode]+"%s", theme.Inst, inst.Name, theme.Operand, hexString(operand), theme.Reset)
-		line += fmt.Sprintf("%s   "+modeFormat[inst.Mode], inst.Name, hexString(operand))
+		ops := operandString(inst, operand, symbolName(inst, operand, syms))
+		line += fmt.Sprintf("%-6s %s", inst.Mnemonic, ops)
 
 		// Pad to next column using uncolorized version of the operand.
-		dummy := fmt.Sprintf(modeFormat[inst.Mode], hexString(operand))
-		line += strings.Repeat(" ", 9-len(dummy))
+		line += strings.Repeat(" ", max(0, 10-len(ops)))
 	}
 
 	if (flags & ShowRegisters) != 0 {
@@ -122,6 +139,66 @@ func Disassemble(c *cpu.CPU, addr uint16, flags Flags, anno string, theme *Theme
 	return line, next
 }
 
+// Return the label naming an instruction's address operand, or an empty
+// string if there is none. Branch and CALL targets are only named by a
+// label at the target itself; other addresses may be an offset from one,
+// as in "TABLE+3".
+func symbolName(inst *cpu.Instruction, operand []byte, syms SymbolResolver) string {
+	if syms == nil || inst.Mode != cpu.ABS || !encodable(inst, operand) {
+		return ""
+	}
+	label, offset, ok := syms.LookupLabel(uint16(operand[0]) | uint16(operand[1])<<8)
+	switch {
+	case !ok:
+		return ""
+	case offset == 0:
+		return label
+	case flowOf(inst) != flowNext:
+		return ""
+	default:
+		return fmt.Sprintf("%s+%d", label, offset)
+	}
+}
+
+// Format an instruction's operand in native CPU1 syntax, naming the
+// register or line number that the opcode or operand byte selects, so that
+// the output can be assembled again. A name, if given, replaces an
+// absolute address.
+func operandString(inst *cpu.Instruction, operand []byte, name string) string {
+	s := ""
+	if name != "" && inst.Mode == cpu.ABS {
+		s = name
+	} else if inst.Length > 1 {
+		s = fmt.Sprintf(modeFormat[inst.Mode], hexString(operand[:inst.Length-1]))
+	}
+	if inst.Mode == cpu.REL {
+		s = fmt.Sprintf(modeFormat[inst.Mode], hexString(operand))
+	}
+
+	var prefix string
+	switch inst.Operands {
+	case cpu.RegOpcode:
+		prefix = fmt.Sprintf("R%d", inst.Opcode&7)
+	case cpu.LineOpcode:
+		prefix = fmt.Sprintf("%d", inst.Opcode&7)
+	case cpu.RegPair:
+		// Bits 3 and 7 of the operand byte are unused. If they are set,
+		// the byte can only be shown as it is.
+		if v := operand[0]; v&0x88 == 0 {
+			return fmt.Sprintf("R%d, R%d", v>>4, v&7)
+		}
+	}
+
+	switch {
+	case prefix == "":
+		return s
+	case s == "":
+		return prefix
+	default:
+		return prefix + ", " + s
+	}
+}
+
 // GetCyclesString returns a string describing the number of elapsed
 // CPU cycles.
 func GetCyclesString(c *cpu.CPU, theme *Theme) string {
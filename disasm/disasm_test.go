@@ -0,0 +1,247 @@
+package disasm_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"riddick.net/cpu1-simulator/asm"
+	"riddick.net/cpu1-simulator/cpu"
+	"riddick.net/cpu1-simulator/disasm"
+)
+
+// Export the code in memory, reassemble it and check that the same bytes
+// come back. Returns the exported source.
+func roundTrip(t *testing.T, c *cpu.CPU, start uint16, code []byte, names, comments map[uint16]string) string {
+	c.Mem.StoreBytes(start, code)
+	var src bytes.Buffer
+	err := disasm.Export(&src, c, start, start+uint16(len(code))-1, names, comments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assembly, _, err := asm.Assemble(strings.NewReader(src.String()), "export.asm", start, io.Discard, 0)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, src.String())
+	}
+	if !bytes.Equal(assembly.Code, code) {
+		t.Fatalf("reassembled code differs\ngot: % X\nexp: % X\n%s", assembly.Code, code, src.String())
+	}
+	return src.String()
+}
+
+func TestExportAllOpcodes(t *testing.T) {
+	// Every opcode, followed by operand bytes that set the unused bits of
+	// register pairs and make some absolute operands point into the code.
+	var code []byte
+	for op := 0; op < 256; op++ {
+		code = append(code, byte(op), byte(op)^0x5A, 0x10)
+	}
+	c := cpu.NewCPU(cpu.NMOS, cpu.NewFlatMemory())
+	roundTrip(t, c, 0x1000, code, nil, nil)
+}
+
+func TestExportLabels(t *testing.T) {
+	src := "\t.org $1000\n" +
+		"START\tLDI R1, #$05\n" +
+		"\tCALL SUB\n" +
+		"\tLDM R2, $2000\n" +
+		".loop\tLBRZ .loop\n" +
+		"\tHALT\n" +
+		"\t.db $FF, $FE\n" +
+		"SUB\tRET\n"
+	assembly, _, err := asm.Assemble(strings.NewReader(src), "test.asm", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cpu.NewCPU(cpu.NMOS, cpu.NewFlatMemory())
+	names := map[uint16]string{0x1000: "START", 0x2000: "DATA"}
+	comments := map[uint16]string{0x1002: "call the subroutine"}
+	out := roundTrip(t, c, 0x1000, assembly.Code, names, comments)
+
+	expect := []string{
+		"DATA\t= $2000",
+		"START:",
+		"CALL   SUB100E",
+		"; call the subroutine",
+		"LDM    R2, DATA",
+		"L1008:",
+		"LBRZ   L1008",
+		".db    $FF, $FE",
+		"SUB100E:",
+	}
+	for _, e := range expect {
+		if !strings.Contains(out, e) {
+			t.Errorf("export is missing %q\n%s", e, out)
+		}
+	}
+
+	// A generated label that is already a supplied name gets a suffix.
+	names[0x2000] = "SUB100E"
+	out = roundTrip(t, c, 0x1000, assembly.Code, names, nil)
+	for _, e := range []string{"SUB100E\t= $2000", "LDM    R2, SUB100E\n", "CALL   SUB100E_1", "SUB100E_1:"} {
+		if !strings.Contains(out, e) {
+			t.Errorf("export is missing %q\n%s", e, out)
+		}
+	}
+}
+
+func TestFlow(t *testing.T) {
+	src := "\t.org $1000\n" +
+		"START\tLDI R1, #$03\n" +
+		".loop\tCALL SUB\n" +
+		"\tDEC R1\n" +
+		"\tLBRZ .done\n" +
+		"\tLBR .loop\n" +
+		".done\tHALT\n" +
+		"TABLE\t.db $FF, $FE, $01\n" +
+		"SUB\tRET\n"
+	assembly, _, err := asm.Assemble(strings.NewReader(src), "test.asm", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cpu.NewCPU(cpu.NMOS, cpu.NewFlatMemory())
+	c.Mem.StoreBytes(0x1000, assembly.Code)
+
+	f := disasm.Analyze(c, []uint16{0x1000}, map[uint16]string{0x1000: "START"})
+	if len(f.Subroutines) != 2 {
+		t.Fatalf("got %d subroutines, exp 2", len(f.Subroutines))
+	}
+	main, sub := f.Subroutines[0], f.Subroutines[1]
+	if main.Name != "START" || sub.Name != "SUB1010" {
+		t.Errorf("got subroutines %s and %s, exp START and SUB1010", main.Name, sub.Name)
+	}
+	if len(main.Calls) != 1 || main.Calls[0] != 0x1010 {
+		t.Errorf("START calls %v, exp [$1010]", main.Calls)
+	}
+
+	blocks := []struct {
+		start uint16
+		end   int
+		succs []uint16
+	}{
+		{0x1000, 0x1002, []uint16{0x1002}},
+		{0x1002, 0x1009, []uint16{0x100C, 0x1009}},
+		{0x1009, 0x100C, []uint16{0x1002}},
+		{0x100C, 0x100D, nil},
+	}
+	if len(main.Blocks) != len(blocks) {
+		t.Fatalf("got %d blocks, exp %d", len(main.Blocks), len(blocks))
+	}
+	for i, exp := range blocks {
+		b := main.Blocks[i]
+		if b.Start != exp.start || b.End != exp.end || fmt.Sprint(b.Succs) != fmt.Sprint(exp.succs) {
+			t.Errorf("block %d: got $%04X-$%04X -> %v, exp $%04X-$%04X -> %v",
+				i, b.Start, b.End, b.Succs, exp.start, exp.end, exp.succs)
+		}
+	}
+
+	for addr := uint16(0x1000); addr < 0x1011; addr++ {
+		data := addr >= 0x100D && addr < 0x1010
+		if f.IsCode(addr) == data {
+			t.Errorf("$%04X: got code %v, exp %v", addr, f.IsCode(addr), !data)
+		}
+	}
+
+	var dot bytes.Buffer
+	if err := f.WriteDot(&dot, c, main); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{
+		"digraph \"START\" {",
+		"\"1002\" -> \"100C\" [label=\"taken\"];",
+		"\"1002\" -> \"1009\";",
+		"\"1002\" -> \"call_SUB1010\" [style=dashed];",
+	} {
+		if !strings.Contains(dot.String(), e) {
+			t.Errorf("graph is missing %q\n%s", e, dot.String())
+		}
+	}
+}
+
+func TestSymbolicDisassembly(t *testing.T) {
+	src := "\t.org $1000\n" +
+		"START\tLDM R1, TABLE+3\n" +
+		".loop\tCALL SUB\n" +
+		"\tLBR .loop+1\n" +
+		"SUB\tRET\n" +
+		"TABLE\t.db 1, 2, 3, 4\n"
+	assembly, sm, err := asm.Assemble(strings.NewReader(src), "test.asm", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cpu.NewCPU(cpu.NMOS, cpu.NewFlatMemory())
+	c.Mem.StoreBytes(0x1000, assembly.Code)
+
+	cases := []struct {
+		addr uint16
+		exp  string
+	}{
+		{0x1000, "START:\nLDM    R1, TABLE+3"},
+		{0x1003, "START.loop:\nCALL   SUB"},
+		{0x1006, "LBR    $1004"},
+		{0x1009, "SUB:\nRET"},
+	}
+	for _, c2 := range cases {
+		line, _ := disasm.Disassemble(c, c2.addr, disasm.ShowInstruction|disasm.ShowLabels, "", nil, sm)
+		if got := strings.TrimRight(line, " "); got != c2.exp {
+			t.Errorf("$%04X: got %q, exp %q", c2.addr, got, c2.exp)
+		}
+	}
+
+	line, _ := disasm.Disassemble(c, 0x1000, disasm.ShowInstruction, "", nil, nil)
+	if got := strings.TrimRight(line, " "); got != "LDM    R1, $100D" {
+		t.Errorf("without symbols: got %q", got)
+	}
+}
+
+func TestHTML(t *testing.T) {
+	src := "\t.org $1000\n" +
+		"START\tLDI R1, #$03\n" +
+		"; Count down\n" +
+		".loop\tCALL SUB\n" +
+		"\tLBR .loop\n" +
+		"SUB\tRET\n"
+	assembly, sm, err := asm.Assemble(strings.NewReader(src), "test.asm", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cpu.NewCPU(cpu.NMOS, cpu.NewFlatMemory())
+	c.Mem.StoreBytes(0x1000, assembly.Code)
+	c.Mem.StoreByte(0x1009, 0xff) // not an opcode
+
+	lines := strings.Split(strings.TrimSuffix(src, "\n"), "\n")
+	opts := &disasm.HTMLOptions{
+		Symbols:     sm,
+		Annotations: map[uint16]string{0x1002: "a <call>"},
+		Find:        sm.Find,
+		Lines:       func(string) ([]string, error) { return lines, nil },
+		Listing:     true,
+		Theme:       &disasm.Theme{Addr: "\x1b[90m", Inst: "\x1b[1;96m", Reset: "\x1b[0m"},
+	}
+	var page bytes.Buffer
+	if err := disasm.WriteHTML(&page, c, 0x1000, 0x1009, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []string{
+		"<title>Disassembly of $1000-$1009</title>",
+		".addr { color: #7f7f7f; }",
+		".inst { font-weight: bold; color: #00ffff; }",
+		"<tr id=\"a1009\"><td class=\"addr\">1009</td><td class=\"code\">FF</td><td class=\"inst\">.db</td><td class=\"operand\">$FF</td>",
+		"<tr id=\"a1002\">",
+		"<a href=\"#a1008\">SUB</a>",
+		"<a href=\"#a1002\">START.loop</a>",
+		"; a &lt;call&gt;",
+		"<span class=\"lineno\">   3</span>  ; Count down",
+		"<tr class=\"label\"><td colspan=\"5\">SUB:</td></tr>",
+		"<li><a href=\"#a1000\">START</a>",
+	} {
+		if !strings.Contains(page.String(), e) {
+			t.Errorf("page is missing %q\n%s", e, page.String())
+		}
+	}
+}
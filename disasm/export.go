@@ -0,0 +1,191 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// Most bytes written on one .db line.
+const exportBytesPerLine = 8
+
+// A line of exported code: an instruction, or a run of bytes that don't
+// decode to one.
+type exportLine struct {
+	addr  int
+	inst  *cpu.Instruction // nil for data bytes
+	bytes []byte
+}
+
+// Export writes the code between the start and end addresses, inclusive,
+// as CPU1 assembly source that reassembles to the same bytes. Each CALL or
+// branch target within the range gets a generated label, with a suffix if
+// the name is already taken. The names map supplies labels to use instead,
+// and addresses named outside the range are defined as constants. The comments map supplies text to write after
+// the line at an address. Bytes that don't decode to a valid instruction
+// are written with .db.
+func Export(w io.Writer, c *cpu.CPU, start, end uint16, names, comments map[uint16]string) error {
+	if end < start {
+		return fmt.Errorf("end address $%04X is before start address $%04X", end, start)
+	}
+	lines := decodeRange(c, int(start), int(end)+1)
+
+	// Label the start of every line that has a name or is the target of a
+	// CALL or branch.
+	bounds := make(map[int]bool)
+	for _, l := range lines {
+		bounds[l.addr] = true
+	}
+	labels := make(map[int]string)
+	for _, l := range lines {
+		if name, ok := names[uint16(l.addr)]; ok {
+			labels[l.addr] = name
+		}
+	}
+
+	// A generated label that is already one of the supplied names gets a
+	// suffix, so that each name still means a single address.
+	used := make(map[string]bool)
+	for _, name := range names {
+		used[name] = true
+	}
+	generate := func(format string, target int) string {
+		name := fmt.Sprintf(format, target)
+		for i := 1; used[name]; i++ {
+			name = fmt.Sprintf(format+"_%d", target, i)
+		}
+		used[name] = true
+		return name
+	}
+	for _, l := range lines {
+		target, ok := operandAddress(l)
+		if !ok || !bounds[target] || labels[target] != "" {
+			continue
+		}
+		switch {
+		case l.inst.Mnemonic == "CALL":
+			labels[target] = generate("SUB%04X", target)
+		case strings.HasPrefix(l.inst.Mnemonic, "LBR"):
+			labels[target] = generate("L%04X", target)
+		}
+	}
+
+	// Other named addresses used by the code become constants.
+	constants := make(map[int]string)
+	for _, l := range lines {
+		target, ok := operandAddress(l)
+		if !ok || labels[target] != "" {
+			continue
+		}
+		if name, ok := names[uint16(target)]; ok {
+			constants[target] = name
+		}
+	}
+
+	ww := bufio.NewWriter(w)
+	fmt.Fprintf(ww, "; Disassembled from $%04X-$%04X\n\n", start, end)
+	if len(constants) > 0 {
+		var addrs []int
+		for addr := range constants {
+			addrs = append(addrs, addr)
+		}
+		sort.Ints(addrs)
+		for _, addr := range addrs {
+			fmt.Fprintf(ww, "%s\t= $%04X\n", constants[addr], addr)
+		}
+		fmt.Fprintln(ww)
+	}
+	fmt.Fprintf(ww, "\t.org $%04X\n", start)
+
+	for _, l := range lines {
+		if label, ok := labels[l.addr]; ok {
+			fmt.Fprintf(ww, "\n%s:\n", label)
+		}
+
+		var text string
+		if l.inst == nil {
+			var vals []string
+			for _, b := range l.bytes {
+				vals = append(vals, fmt.Sprintf("$%02X", b))
+			}
+			text = fmt.Sprintf("%-6s %s", ".db", strings.Join(vals, ", "))
+		} else {
+			name := ""
+			if target, ok := operandAddress(l); ok {
+				name = labels[target]
+				if name == "" {
+					name = constants[target]
+				}
+			}
+			text = fmt.Sprintf("%-6s %s", l.inst.Mnemonic, operandString(l.inst, l.bytes[1:], name))
+		}
+		text = strings.TrimRight(text, " ")
+
+		if comment, ok := comments[uint16(l.addr)]; ok {
+			text = fmt.Sprintf("%-24s ; %s", text, comment)
+		}
+		fmt.Fprintf(ww, "\t%s\n", text)
+	}
+	return ww.Flush()
+}
+
+// Split the bytes from start up to end into instructions and runs of data
+// bytes.
+func decodeRange(c *cpu.CPU, start, end int) []exportLine {
+	var lines []exportLine
+	for addr := start; addr < end; {
+		inst := c.InstSet.Lookup(c.Mem.LoadByte(uint16(addr)))
+		if addr+int(inst.Length) <= end && inst.Length > 0 {
+			b := make([]byte, inst.Length)
+			c.Mem.LoadBytes(uint16(addr), b)
+			if encodable(inst, b[1:]) {
+				lines = append(lines, exportLine{addr, inst, b})
+				addr += len(b)
+				continue
+			}
+		}
+
+		// Add the byte to a run of data bytes.
+		b := c.Mem.LoadByte(uint16(addr))
+		if n := len(lines); n > 0 && lines[n-1].inst == nil && len(lines[n-1].bytes) < exportBytesPerLine {
+			lines[n-1].bytes = append(lines[n-1].bytes, b)
+		} else {
+			lines = append(lines, exportLine{addr: addr, bytes: []byte{b}})
+		}
+		addr++
+	}
+	return lines
+}
+
+// Return true if an instruction can be written as source that assembles to
+// the same bytes.
+func encodable(inst *cpu.Instruction, operand []byte) bool {
+	switch {
+	case !validOpcode(inst):
+		return false
+	case inst.Operands == cpu.RegPair:
+		// Unused bits in the operand byte can't be expressed in source.
+		return operand[0]&0x88 == 0
+	default:
+		return true
+	}
+}
+
+// Return true if an opcode decodes to an instruction of the CPU.
+func validOpcode(inst *cpu.Instruction) bool {
+	return inst.Name != "" && inst.Name != "???" && inst.Length > 0
+}
+
+// Return the address an instruction's absolute operand refers to.
+func operandAddress(l exportLine) (int, bool) {
+	if l.inst == nil || l.inst.Mode != cpu.ABS {
+		return 0, false
+	}
+	return int(l.bytes[1]) | int(l.bytes[2])<<8, true
+}
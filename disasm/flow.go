@@ -0,0 +1,389 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// A Block is a basic block: a run of instructions that is only entered at
+// its first instruction and only left after its last.
+type Block struct {
+	Start uint16   // address of the first instruction
+	End   int      // address just past the last instruction
+	Insts []uint16 // address of each instruction
+	Succs []uint16 // blocks that may run next
+	Taken int      // index in Succs of a branch target, or -1
+	Calls []uint16 // subroutines called by the block
+}
+
+// A Subroutine is the code reached from an entry point or a CALL target
+// without following calls.
+type Subroutine struct {
+	Entry  uint16
+	Name   string
+	Blocks []*Block // in address order
+	Calls  []uint16 // entry points of the subroutines it calls
+	Bad    []uint16 // addresses it reaches that don't hold a valid instruction
+	called bool     // true if some CALL targets the entry
+	seen   map[uint16]bool
+}
+
+// A Flow is the control flow recovered from a program by following the
+// code from its entry points. Bytes never reached as code are data.
+type Flow struct {
+	Blocks      map[uint16]*Block // blocks by start address
+	Subroutines []*Subroutine     // in address order
+	Bad         []uint16          // addresses reached that don't hold a valid instruction
+	insts       map[uint16]*cpu.Instruction
+	bad         map[uint16]bool
+	entries     map[uint16]bool
+	names       map[uint16]string
+}
+
+// How an instruction passes control to the next one.
+type flowKind byte
+
+const (
+	flowNext   flowKind = iota // continue with the next instruction
+	flowCall                   // call a subroutine, then continue
+	flowJump                   // always branch
+	flowBranch                 // branch or continue
+	flowStop                   // return or halt
+)
+
+func flowOf(inst *cpu.Instruction) flowKind {
+	switch {
+	case inst.Mnemonic == "CALL":
+		return flowCall
+	case inst.Mnemonic == "LBR":
+		return flowJump
+	case strings.HasPrefix(inst.Mnemonic, "LBR"):
+		return flowBranch
+	case inst.Mnemonic == "RET" || inst.Mnemonic == "RTI" || inst.Mnemonic == "HALT":
+		return flowStop
+	default:
+		return flowNext
+	}
+}
+
+// Analyze follows the code reachable from the entry points through every
+// branch and CALL, and splits it into basic blocks and subroutines. Each
+// entry point and CALL target starts a subroutine, named from the names
+// map if it has a name there.
+func Analyze(c *cpu.CPU, entries []uint16, names map[uint16]string) *Flow {
+	f := &Flow{
+		Blocks:  make(map[uint16]*Block),
+		insts:   make(map[uint16]*cpu.Instruction),
+		bad:     make(map[uint16]bool),
+		entries: make(map[uint16]bool),
+		names:   names,
+	}
+
+	// Decode every instruction that can be reached, noting the addresses
+	// where blocks must start.
+	leaders := make(map[uint16]bool)
+	calls := make(map[uint16]bool)
+	work := append([]uint16(nil), entries...)
+	for _, e := range entries {
+		leaders[e] = true
+	}
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		if _, ok := f.insts[addr]; ok || f.bad[addr] {
+			continue
+		}
+
+		inst := c.InstSet.Lookup(c.Mem.LoadByte(addr))
+		operand := make([]byte, max(int(inst.Length)-1, 0))
+		c.Mem.LoadBytes(addr+1, operand)
+		if int(addr)+int(inst.Length) > 0x10000 || inst.Length == 0 || !encodable(inst, operand) {
+			f.bad[addr] = true
+			continue
+		}
+		f.insts[addr] = inst
+
+		next := addr + uint16(inst.Length)
+		kind := flowOf(inst)
+		if kind == flowCall || kind == flowJump || kind == flowBranch {
+			target := uint16(operand[0]) | uint16(operand[1])<<8
+			leaders[target] = true
+			if kind == flowCall {
+				calls[target] = true
+			}
+			work = append(work, target)
+		}
+		if kind == flowBranch {
+			leaders[next] = true
+		}
+		if kind != flowJump && kind != flowStop {
+			work = append(work, next)
+		}
+	}
+	for addr := range f.bad {
+		f.Bad = append(f.Bad, addr)
+	}
+	sortAddrs(f.Bad)
+
+	// Split the instructions into blocks.
+	var addrs []uint16
+	for addr := range f.insts {
+		addrs = append(addrs, addr)
+	}
+	sortAddrs(addrs)
+	var b *Block
+	for _, addr := range addrs {
+		if b == nil || leaders[addr] || b.End != int(addr) {
+			b = &Block{Start: addr, Taken: -1}
+			f.Blocks[addr] = b
+		}
+		inst := f.insts[addr]
+		b.Insts = append(b.Insts, addr)
+		b.End = int(addr) + int(inst.Length)
+
+		kind := flowOf(inst)
+		target := c.Mem.LoadAddress(addr + 1)
+		if kind == flowCall {
+			b.Calls = appendAddr(b.Calls, target)
+		}
+		if kind == flowJump || kind == flowBranch {
+			b.Taken = len(b.Succs)
+			b.Succs = append(b.Succs, target)
+		}
+		switch {
+		case kind == flowJump || kind == flowStop:
+			b = nil
+		case kind == flowBranch || leaders[uint16(b.End)]:
+			if _, ok := f.insts[uint16(b.End)]; ok && b.End < 0x10000 {
+				b.Succs = append(b.Succs, uint16(b.End))
+			}
+			b = nil
+		}
+	}
+
+	// Gather the blocks of each subroutine.
+	for _, e := range entries {
+		f.entries[e] = true
+	}
+	for e := range calls {
+		f.entries[e] = true
+	}
+	for e := range f.entries {
+		s := &Subroutine{Entry: e, Name: f.Name(e), called: calls[e], seen: make(map[uint16]bool)}
+		f.walk(s, e)
+		sort.Slice(s.Blocks, func(i, j int) bool { return s.Blocks[i].Start < s.Blocks[j].Start })
+		sortAddrs(s.Calls)
+		sortAddrs(s.Bad)
+		f.Subroutines = append(f.Subroutines, s)
+	}
+	sort.Slice(f.Subroutines, func(i, j int) bool { return f.Subroutines[i].Entry < f.Subroutines[j].Entry })
+	return f
+}
+
+// Add the block at an address, and the blocks reachable from it, to a
+// subroutine.
+func (f *Flow) walk(s *Subroutine, addr uint16) {
+	if s.seen[addr] {
+		return
+	}
+	s.seen[addr] = true
+	b, ok := f.Blocks[addr]
+	if !ok {
+		if f.bad[addr] {
+			s.Bad = appendAddr(s.Bad, addr)
+		}
+		return
+	}
+	s.Blocks = append(s.Blocks, b)
+	for _, c := range b.Calls {
+		s.Calls = appendAddr(s.Calls, c)
+	}
+	for _, succ := range b.Succs {
+		f.walk(s, succ)
+	}
+	if f.fallsIntoBad(b) {
+		s.Bad = appendAddr(s.Bad, uint16(b.End))
+	}
+}
+
+// Return true if a block continues into bytes that aren't a valid
+// instruction.
+func (f *Flow) fallsIntoBad(b *Block) bool {
+	kind := flowOf(f.insts[b.Insts[len(b.Insts)-1]])
+	return kind != flowJump && kind != flowStop && f.bad[uint16(b.End)]
+}
+
+// IsCode returns true if the byte at an address belongs to an instruction
+// reached from an entry point.
+func (f *Flow) IsCode(addr uint16) bool {
+	for a := int(addr); a >= 0 && a > int(addr)-3; a-- {
+		if inst, ok := f.insts[uint16(a)]; ok && a+int(inst.Length) > int(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Name returns the name of a block or subroutine address. Addresses
+// without a name in the names map get a generated one.
+func (f *Flow) Name(addr uint16) string {
+	if name, ok := f.names[addr]; ok {
+		return name
+	}
+	if f.entries[addr] {
+		return fmt.Sprintf("SUB%04X", addr)
+	}
+	return fmt.Sprintf("L%04X", addr)
+}
+
+// WriteListing writes each subroutine's blocks with their instructions,
+// followed by the ranges of data lying between the blocks.
+func (f *Flow) WriteListing(w io.Writer, c *cpu.CPU) error {
+	ww := bufio.NewWriter(w)
+	for _, s := range f.Subroutines {
+		kind := "Entry"
+		if s.called {
+			kind = "Subroutine"
+		}
+		fmt.Fprintf(ww, "%s %s ($%04X): %d block(s)", kind, s.Name, s.Entry, len(s.Blocks))
+		if len(s.Calls) > 0 {
+			fmt.Fprintf(ww, ", calls %s", f.nameList(s.Calls))
+		}
+		fmt.Fprintln(ww)
+
+		for _, b := range s.Blocks {
+			fmt.Fprintf(ww, "  Block $%04X-$%04X", b.Start, b.End-1)
+			if len(b.Succs) > 0 {
+				fmt.Fprintf(ww, " -> %s", f.nameList(b.Succs))
+			}
+			fmt.Fprintln(ww)
+			for _, addr := range b.Insts {
+				line, _ := Disassemble(c, addr, ShowAddress|ShowCode|ShowInstruction, "", nil, nil)
+				fmt.Fprintf(ww, "    %s\n", strings.TrimRight(line, " "))
+			}
+		}
+		for _, addr := range s.Bad {
+			fmt.Fprintf(ww, "  Invalid instruction at $%04X\n", addr)
+		}
+		fmt.Fprintln(ww)
+	}
+
+	if data := f.dataRanges(); len(data) > 0 {
+		fmt.Fprintln(ww, "Data:")
+		for _, r := range data {
+			fmt.Fprintf(ww, "  $%04X-$%04X (%d bytes)\n", r[0], r[1]-1, r[1]-r[0])
+		}
+	}
+	return ww.Flush()
+}
+
+// Return the ranges of bytes that lie between blocks and aren't code.
+func (f *Flow) dataRanges() [][2]int {
+	var starts []uint16
+	for addr := range f.Blocks {
+		starts = append(starts, addr)
+	}
+	sortAddrs(starts)
+
+	var ranges [][2]int
+	for i := 1; i < len(starts); i++ {
+		prevEnd := f.Blocks[starts[i-1]].End
+		if prevEnd < int(starts[i]) {
+			ranges = append(ranges, [2]int{prevEnd, int(starts[i])})
+		}
+	}
+	return ranges
+}
+
+// WriteDot writes the control flow graph of a subroutine in Graphviz dot
+// format. Each node is a block, listing its instructions; solid edges lead
+// to the blocks that may run next, and dashed edges to called subroutines.
+func (f *Flow) WriteDot(w io.Writer, c *cpu.CPU, s *Subroutine) error {
+	ww := bufio.NewWriter(w)
+	fmt.Fprintf(ww, "digraph %s {\n", dotQuote(s.Name))
+	fmt.Fprintln(ww, "\tnode [shape=box, fontname=\"monospace\"];")
+
+	inSub := make(map[uint16]bool)
+	for _, b := range s.Blocks {
+		inSub[b.Start] = true
+	}
+	for _, b := range s.Blocks {
+		label := f.Name(b.Start) + ":\\l"
+		for _, addr := range b.Insts {
+			line, _ := Disassemble(c, addr, ShowAddress|ShowInstruction, "", nil, nil)
+			label += dotEscape(strings.TrimRight(line, " ")) + "\\l"
+		}
+		fmt.Fprintf(ww, "\t%s [label=\"%s\"];\n", dotNode(b.Start), label)
+	}
+	for _, addr := range s.Bad {
+		fmt.Fprintf(ww, "\t%s [label=\"invalid instruction\\n$%04X\", color=red];\n", dotNode(addr), addr)
+	}
+
+	for _, b := range s.Blocks {
+		for i, succ := range b.Succs {
+			attrs := ""
+			if i == b.Taken && len(b.Succs) > 1 {
+				attrs = " [label=\"taken\"]"
+			}
+			fmt.Fprintf(ww, "\t%s -> %s%s;\n", dotNode(b.Start), dotNode(succ), attrs)
+		}
+		if f.fallsIntoBad(b) {
+			fmt.Fprintf(ww, "\t%s -> %s;\n", dotNode(b.Start), dotNode(uint16(b.End)))
+		}
+		for _, callee := range b.Calls {
+			node := "call_" + f.Name(callee)
+			fmt.Fprintf(ww, "\t%s [label=%s, shape=ellipse];\n", dotQuote(node), dotQuote(f.Name(callee)))
+			fmt.Fprintf(ww, "\t%s -> %s [style=dashed];\n", dotNode(b.Start), dotQuote(node))
+		}
+	}
+	fmt.Fprintln(ww, "}")
+	return ww.Flush()
+}
+
+func (f *Flow) nameList(addrs []uint16) string {
+	var names []string
+	for _, addr := range addrs {
+		names = append(names, f.Name(addr))
+	}
+	return strings.Join(names, ", ")
+}
+
+func dotNode(addr uint16) string {
+	return fmt.Sprintf("\"%04X\"", addr)
+}
+
+func dotQuote(s string) string {
+	return "\"" + dotEscape(s) + "\""
+}
+
+func dotEscape(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	return strings.ReplaceAll(s, "\"", "\\\"")
+}
+
+func sortAddrs(addrs []uint16) {
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+}
+
+func appendAddr(addrs []uint16, addr uint16) []uint16 {
+	if containsAddr(addrs, addr) {
+		return addrs
+	}
+	return append(addrs, addr)
+}
+
+func containsAddr(addrs []uint16, addr uint16) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// HTMLOptions control the page written by WriteHTML.
+type HTMLOptions struct {
+	Title       string
+	Symbols     SymbolResolver    // names addresses, if not nil
+	Annotations map[uint16]string // shown as comments
+
+	// Find returns the source file and line that generated the code at an
+	// address, and Lines returns the lines of a source file. Without them
+	// the page has no source column.
+	Find  func(addr int) (filename string, line int, err error)
+	Lines func(filename string) ([]string, error)
+
+	// Listing shows every source line, including comments and other lines
+	// that generate no code, as the list command does.
+	Listing bool
+
+	// Theme colors the page the way it colors the terminal. Without one,
+	// the text isn't colored.
+	Theme *Theme
+}
+
+// The page's layout. It looks like the terminal, with text colored by the
+// theme's escape codes; each color class is named after the Theme field
+// that colors the same part of the terminal output.
+const htmlStyle = `body { font-family: sans-serif; margin: 2em; background: #1e1e1e; color: #c0c0c0; }
+table { border-collapse: collapse; font-family: monospace; }
+td { padding: 0 1em 0 0; white-space: pre; vertical-align: top; }
+tr:target { background: #404020; }
+a { color: inherit; text-decoration: none; }
+a:hover { text-decoration: underline; }
+.label td { font-weight: bold; padding-top: 0.5em; }
+.source { border-left: 1px solid #505050; padding-left: 1em; }
+.lineno { color: #7f7f7f; }
+.index { columns: 3; font-family: monospace; }
+`
+
+// CSS colors of the ANSI foreground color codes, as xterm shows them.
+var ansiColors = map[string]string{
+	"30": "#000000", "31": "#cd0000", "32": "#00cd00", "33": "#cdcd00",
+	"34": "#0000ee", "35": "#cd00cd", "36": "#00cdcd", "37": "#e5e5e5",
+	"90": "#7f7f7f", "91": "#ff0000", "92": "#00ff00", "93": "#ffff00",
+	"94": "#5c5cff", "95": "#ff00ff", "96": "#00ffff", "97": "#ffffff",
+}
+
+// Return the style rules that color the page as a theme colors the
+// terminal.
+func themeStyle(theme *Theme) string {
+	if theme == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, class := range []struct{ name, code string }{
+		{"addr", theme.Addr},
+		{"code", theme.Code},
+		{"inst", theme.Inst},
+		{"operand", theme.Operand},
+		{"annotation", theme.Annotation},
+	} {
+		if rule := ansiStyle(class.code); rule != "" {
+			fmt.Fprintf(&b, ".%s { %s }\n", class.name, rule)
+		}
+	}
+	return b.String()
+}
+
+// Convert an ANSI escape sequence, such as "\x1b[1;32m", to CSS
+// declarations.
+func ansiStyle(code string) string {
+	params, ok := strings.CutPrefix(code, "\x1b[")
+	if params, ok = strings.CutSuffix(params, "m"); !ok {
+		return ""
+	}
+	var decls []string
+	for _, p := range strings.Split(params, ";") {
+		if color, ok := ansiColors[p]; ok {
+			decls = append(decls, "color: "+color+";")
+		} else if p == "1" {
+			decls = append(decls, "font-weight: bold;")
+		}
+	}
+	return strings.Join(decls, " ")
+}
+
+// WriteHTML writes the code between the start and end addresses, inclusive,
+// as a standalone HTML page. Each line shows the address, bytes and
+// instruction, with a link from every address operand to the line at that
+// address, and the source line that generated it when the options can find
+// one. A list of the labels in the code follows.
+func WriteHTML(w io.Writer, c *cpu.CPU, start, end uint16, opts *HTMLOptions) error {
+	type row struct {
+		addr uint16
+		inst *cpu.Instruction
+		code []byte
+	}
+	var rows []row
+	inRange := make(map[uint16]bool)
+	for addr := int(start); addr <= int(end); {
+		inst := c.InstSet.Lookup(c.Mem.LoadByte(uint16(addr)))
+		n := int(inst.Length)
+		if !validOpcode(inst) {
+			n = 1
+		}
+		if addr+n > int(end)+1 {
+			n = int(end) + 1 - addr
+		}
+		code := make([]byte, n)
+		c.Mem.LoadBytes(uint16(addr), code)
+		rows = append(rows, row{uint16(addr), inst, code})
+		inRange[uint16(addr)] = true
+		addr += n
+	}
+
+	title := opts.Title
+	if title == "" {
+		title = fmt.Sprintf("Disassembly of $%04X-$%04X", start, end)
+	}
+	source := opts.Find != nil && opts.Lines != nil
+
+	ww := bufio.NewWriter(w)
+	fmt.Fprintln(ww, "<!DOCTYPE html>")
+	fmt.Fprintln(ww, "<html>\n<head>\n<meta charset=\"utf-8\">")
+	fmt.Fprintf(ww, "<title>%s</title>\n", html.EscapeString(title))
+	fmt.Fprintf(ww, "<style>\n%s%s</style>\n</head>\n<body>\n", htmlStyle, themeStyle(opts.Theme))
+	fmt.Fprintf(ww, "<h1>%s</h1>\n<table>\n", html.EscapeString(title))
+
+	labels := make(map[string]uint16)
+	last := make(map[string]int) // last source line shown from each file
+	for _, r := range rows {
+		// Show the source line for the code, and with Listing, the lines
+		// before it that generated no code.
+		var srcFile string
+		var srcLines []string
+		var srcLine int
+		if source {
+			if fn, li, err := opts.Find(int(r.addr)); err == nil {
+				if lines, err := opts.Lines(fn); err == nil && li >= 1 && li <= len(lines) {
+					srcFile, srcLines, srcLine = fn, lines, li
+				}
+			}
+		}
+		if opts.Listing && srcLines != nil {
+			from, ok := last[srcFile]
+			if !ok || from >= srcLine {
+				from = srcLine - 1
+			}
+			for i := from + 1; i < srcLine; i++ {
+				fmt.Fprintf(ww, "<tr><td colspan=\"5\"></td>%s</tr>\n", sourceCell(srcFile, i, srcLines[i-1]))
+			}
+			last[srcFile] = srcLine
+		}
+
+		if opts.Symbols != nil {
+			if label, offset, ok := opts.Symbols.LookupLabel(r.addr); ok && offset == 0 {
+				labels[label] = r.addr
+				fmt.Fprintf(ww, "<tr class=\"label\"><td colspan=\"5\">%s:</td></tr>\n", html.EscapeString(label))
+			}
+		}
+
+		fmt.Fprintf(ww, "<tr id=\"a%04X\"><td class=\"addr\">%04X</td><td class=\"code\">%s</td>", r.addr, r.addr, codeString(r.code))
+		if len(r.code) < int(r.inst.Length) || !encodable(r.inst, r.code[1:]) {
+			// Bytes that aren't a whole, valid instruction are shown as
+			// data, as Export writes them.
+			var vals []string
+			for _, b := range r.code {
+				vals = append(vals, fmt.Sprintf("$%02X", b))
+			}
+			fmt.Fprintf(ww, "<td class=\"inst\">.db</td><td class=\"operand\">%s</td>", strings.Join(vals, ", "))
+		} else {
+			operand := r.code[1:]
+			if r.inst.Mode == cpu.REL {
+				braddr := int(r.addr) + int(r.inst.Length) + byteToInt(operand[0])
+				operand = []byte{byte(braddr), byte(braddr >> 8)}
+			}
+			ops := html.EscapeString(operandString(r.inst, operand, symbolName(r.inst, operand, opts.Symbols)))
+			if r.inst.Mode == cpu.ABS {
+				if target := uint16(operand[0]) | uint16(operand[1])<<8; inRange[target] {
+					ops = fmt.Sprintf("<a href=\"#a%04X\">%s</a>", target, ops)
+				}
+			}
+			fmt.Fprintf(ww, "<td class=\"inst\">%s</td><td class=\"operand\">%s</td>", html.EscapeString(r.inst.Mnemonic), ops)
+		}
+		anno := ""
+		if a, ok := opts.Annotations[r.addr]; ok {
+			anno = "; " + html.EscapeString(a)
+		}
+		fmt.Fprintf(ww, "<td class=\"annotation\">%s</td>", anno)
+		if srcLines != nil {
+			fmt.Fprint(ww, sourceCell(srcFile, srcLine, srcLines[srcLine-1]))
+		} else if source {
+			fmt.Fprint(ww, "<td class=\"source\"></td>")
+		}
+		fmt.Fprintln(ww, "</tr>")
+	}
+	fmt.Fprintln(ww, "</table>")
+
+	if len(labels) > 0 {
+		var names []string
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(ww, "<h2>Symbols</h2>\n<ul class=\"index\">")
+		for _, name := range names {
+			fmt.Fprintf(ww, "<li><a href=\"#a%04X\">%s</a> <span class=\"addr\">$%04X</span></li>\n",
+				labels[name], html.EscapeString(name), labels[name])
+		}
+		fmt.Fprintln(ww, "</ul>")
+	}
+
+	fmt.Fprintln(ww, "</body>\n</html>")
+	return ww.Flush()
+}
+
+// Return a table cell showing a line of source, numbered and titled with
+// its file.
+func sourceCell(filename string, line int, text string) string {
+	text = strings.ReplaceAll(text, "\t", "    ")
+	return fmt.Sprintf("<td class=\"source\" title=\"%s\"><span class=\"lineno\">%4d</span>  %s</td>",
+		html.EscapeString(filename), line, html.EscapeString(text))
+}
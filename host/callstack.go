@@ -0,0 +1,170 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package host
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/beevik/cmd"
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// Most mismatched returns remembered for the backtrace.
+const maxMismatches = 8
+
+// A frame is a subroutine call or interrupt that hasn't returned yet.
+type frame struct {
+	interrupt bool   // entered by an interrupt rather than a CALL
+	site      uint16 // address of the CALL, or of the instruction interrupted
+	target    uint16 // address of the subroutine or interrupt handler
+	ret       uint16 // return address
+	sp        byte   // SP before the return address was pushed
+}
+
+// A callStack shadows the CPU's stack, recording each CALL and interrupt
+// and matching them to the RETs and RTIs that end them.
+type callStack struct {
+	frames     []frame  // innermost last
+	mismatches []string // descriptions of returns that didn't match a frame
+}
+
+// Forget every frame, as when the program is restarted.
+func (s *callStack) reset() {
+	s.frames = s.frames[:0]
+	s.mismatches = s.mismatches[:0]
+}
+
+// Forget the frames whose return addresses are no longer on the stack once
+// SP has risen to level. Level may exceed $FF when a program pops more than
+// it pushed.
+func (s *callStack) discard(level int) {
+	s.frames = s.frames[:s.depth(level)]
+}
+
+// Return the number of frames still on the stack when SP is at level.
+func (s *callStack) depth(level int) int {
+	n := len(s.frames)
+	for n > 0 && int(s.frames[n-1].sp) <= level {
+		n--
+	}
+	return n
+}
+
+// Update the call stack after the CPU has stepped from pc with the stack
+// pointer at sp. The instruction at pc may not have run if the CPU took an
+// interrupt instead.
+func (s *callStack) update(c *cpu.CPU, pc uint16, sp byte, inst *cpu.Instruction) {
+	// A new frame replaces any whose return address had already been
+	// popped from the stack.
+	switch {
+	case c.Reg.SP == sp-3:
+		s.discard(int(sp))
+		// Interrupts push the return address and the status flags.
+		s.frames = append(s.frames, frame{interrupt: true, site: pc, target: c.Reg.PC, ret: pc, sp: sp})
+
+	case inst.Mnemonic == "CALL" && c.Reg.SP == sp-2:
+		s.discard(int(sp))
+		s.frames = append(s.frames, frame{site: pc, target: c.Reg.PC, ret: pc + uint16(inst.Length), sp: sp})
+
+	case inst.Mnemonic == "RET" && c.Reg.SP == sp+2:
+		s.unwind(inst, pc, int(sp)+2, c.Reg.PC)
+
+	case inst.Mnemonic == "RTI" && c.Reg.SP == sp+3:
+		s.unwind(inst, pc, int(sp)+3, c.Reg.PC)
+	}
+}
+
+// Remove the frames whose return addresses were popped by a RET or RTI at
+// pc that returned to addr, leaving SP at level. A return that doesn't end
+// exactly the innermost frame, as when a program changes SP itself, or that
+// ends a CALL with RTI or an interrupt with RET, is remembered as a
+// mismatch.
+func (s *callStack) unwind(inst *cpu.Instruction, pc uint16, level int, addr uint16) {
+	n := s.depth(level)
+	popped := s.frames[n:]
+
+	var problem string
+	switch {
+	case len(popped) == 0:
+		problem = "matches no CALL or interrupt"
+	case len(popped) > 1:
+		problem = fmt.Sprintf("discarded %d frames", len(popped))
+	case popped[0].interrupt && inst.Mnemonic != "RTI":
+		problem = fmt.Sprintf("but the interrupt at $%04X needs RTI", popped[0].site)
+	case !popped[0].interrupt && inst.Mnemonic != "RET":
+		problem = fmt.Sprintf("but the CALL at $%04X needs RET", popped[0].site)
+	case popped[0].ret != addr || int(popped[0].sp) != level:
+		problem = fmt.Sprintf("but the CALL at $%04X returns to $%04X", popped[0].site, popped[0].ret)
+		if popped[0].interrupt {
+			problem = fmt.Sprintf("but the interrupt at $%04X returns to $%04X", popped[0].site, popped[0].ret)
+		}
+	}
+	if problem != "" {
+		m := fmt.Sprintf("%s at $%04X returned to $%04X with SP=$%02X, %s", inst.Mnemonic, pc, addr, byte(level), problem)
+		if len(s.mismatches) == maxMismatches {
+			s.mismatches = s.mismatches[1:]
+		}
+		s.mismatches = append(s.mismatches, m)
+	}
+	s.frames = s.frames[:n]
+}
+
+func (h *Host) cmdBacktrace(c *cmd.Command, args []string) error {
+	frames := h.calls.frames
+	location := func(n int, addr uint16) {
+		fmt.Fprintln(h, strings.TrimSpace(fmt.Sprintf("#%-2d $%04X %s", n, addr, h.symbolicAddr(addr))))
+	}
+	location(0, h.cpu.Reg.PC)
+
+	// Each frame owns the stack bytes from its return address down to the
+	// bytes of the frame inside it.
+	top := h.cpu.Reg.SP
+	for i := len(frames) - 1; i >= 0; i-- {
+		f := frames[i]
+		how := fmt.Sprintf("CALL at $%04X", f.site)
+		if f.interrupt {
+			how = fmt.Sprintf("interrupt at $%04X", f.site)
+		}
+		fmt.Fprintf(h, "    entered %s ($%04X) by %s, returns to $%04X\n",
+			h.symbolicAddr(f.target), f.target, how, f.ret)
+
+		if f.sp <= top {
+			fmt.Fprintln(h, "    return address has been popped from the stack")
+		} else {
+			var b []string
+			for sp := int(top) + 1; sp <= int(f.sp); sp++ {
+				b = append(b, fmt.Sprintf("%02X", h.cpu.Mem.LoadByte(0x100|uint16(sp))))
+			}
+			fmt.Fprintf(h, "    stack $%04X-$%04X: %s\n", 0x100|uint16(top+1), 0x100|uint16(f.sp), strings.Join(b, " "))
+			top = f.sp
+		}
+
+		location(len(frames)-i, f.site)
+	}
+	if len(frames) == 0 {
+		fmt.Fprintln(h, "No calls are active.")
+	}
+
+	if len(h.calls.mismatches) > 0 {
+		fmt.Fprintln(h, "Mismatched returns:")
+		for _, m := range h.calls.mismatches {
+			fmt.Fprintf(h, "    %s\n", m)
+		}
+	}
+	return nil
+}
+
+// Return the label for an address, with any offset, or an empty string if
+// it has none.
+func (h *Host) symbolicAddr(addr uint16) string {
+	label, offset, ok := h.sourceMap.LookupLabel(addr)
+	switch {
+	case !ok:
+		return ""
+	case offset == 0:
+		return label
+	default:
+		return fmt.Sprintf("%s+%d", label, offset)
+	}
+}
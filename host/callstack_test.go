@@ -0,0 +1,98 @@
+package host
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"riddick.net/cpu1-simulator/asm"
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// Assemble a program at $1000 with a keyboard whose IRQ handler is at
+// $2000, and track its calls while it runs.
+func loadCallStack(t *testing.T, src string) (*cpu.CPU, *cpu.Keyboard, *callStack) {
+	r, sm, err := asm.Assemble(strings.NewReader(src), "test.asm", 0x1000, io.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kb := cpu.NewKeyboard()
+	mem := cpu.NewMappedMemory(cpu.NewFlatMemory())
+	mem.Map(cpu.KeyboardStatus, 2, kb)
+	mem.StoreAddress(0xfffe, 0x2000)
+	mem.StoreBytes(sm.Origin, r.Code)
+
+	c := cpu.NewCPU(cpu.NMOS, mem)
+	c.SetPC(sm.Origin)
+	c.AttachIRQSource(kb)
+	return c, kb, &callStack{}
+}
+
+// Step the CPU as the host does, updating the call stack after each step.
+func stepCallStack(c *cpu.CPU, s *callStack, steps int) {
+	for i := 0; i < steps; i++ {
+		pc, sp := c.Reg.PC, c.Reg.SP
+		inst := c.GetInstruction(pc)
+		c.Step()
+		s.update(c, pc, sp, inst)
+	}
+}
+
+// The program enables keyboard interrupts and calls SUB, where the
+// interrupt is taken.
+const callStackProgram = `
+	.ORG $1000
+	LDI0 #$80
+	STI0 $FF00
+	CPSR #$04
+	CALL SUB
+	HALT
+SUB	NOP
+	NOP
+	%s
+	.ORG $2000
+	LDI0 #$01
+	STI0 $FF00
+	%s`
+
+func TestCallStackInterruptReturn(t *testing.T) {
+	c, kb, s := loadCallStack(t, fmt.Sprintf(callStackProgram, "RET", "RTI"))
+
+	stepCallStack(c, s, 4)
+	kb.Push('A')
+	stepCallStack(c, s, 1)
+	if len(s.frames) != 2 || !s.frames[1].interrupt || s.frames[1].target != 0x2000 {
+		t.Fatalf("frames after interrupt %+v", s.frames)
+	}
+
+	// The handler's RTI ends the interrupt frame, and SUB's RET its call.
+	stepCallStack(c, s, 3)
+	if len(s.frames) != 1 || s.frames[0].interrupt {
+		t.Errorf("frames after RTI %+v", s.frames)
+	}
+	stepCallStack(c, s, 3)
+	if len(s.frames) != 0 {
+		t.Errorf("frames after RET %+v", s.frames)
+	}
+	if c.Reg.PC != 0x100a {
+		t.Errorf("PC=$%04X, expected $100A", c.Reg.PC)
+	}
+	if len(s.mismatches) != 0 {
+		t.Errorf("unexpected mismatches %q", s.mismatches)
+	}
+}
+
+func TestCallStackMismatchedReturn(t *testing.T) {
+	// SUB returns with RTI, which pops one byte more than its CALL pushed.
+	c, _, s := loadCallStack(t, fmt.Sprintf(callStackProgram, "RTI", "RTI"))
+
+	stepCallStack(c, s, 7)
+	if len(s.frames) != 0 {
+		t.Errorf("frames after RTI %+v", s.frames)
+	}
+	if len(s.mismatches) != 1 || !strings.Contains(s.mismatches[0], "needs RET") {
+		t.Errorf("unexpected mismatches %q", s.mismatches)
+	}
+}
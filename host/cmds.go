@@ -29,8 +29,18 @@ func init() {
 		Brief: "Assemble a file from disk and save the binary to disk",
 		Description: "Run the cross-assembler on the specified file," +
 			" producing a binary file and source map file if successful." +
-			" If you want verbose output, specify true as a second parameter.",
-		Usage: "assemble file <filename> [<verbose>]",
+			" If you want verbose output, specify true as a second parameter." +
+			" Add 'listing' to also write a '.lst' listing file, 'hex' for" +
+			" an Intel HEX file, 'srec' for a Motorola S-record file or" +
+			" 'cx1' for a CPU1 executable. Add 'object' to produce a" +
+			" relocatable object ('.obj') file for the link command instead." +
+			" Symbols tested by .ifdef and .if may be defined with" +
+			" -D NAME=value. Warnings are set with -W on, off or error, for" +
+			" all of them or for one ID, as in -W unused=off. Included files" +
+			" are also searched for in each -I directory and then in the" +
+			" AsmPath setting. Add 'deps' to write a '.d' dependency file" +
+			" for make.",
+		Usage: "assemble file <filename> [<verbose>] [listing] [hex] [srec] [cx1] [object] [deps] [-D NAME=value ...] [-W [ID=]level ...] [-I dir ...]",
 		Data:  (*Host).cmdAssembleFile,
 	})
 	as.AddCommand(cmd.CommandDescriptor{
@@ -53,6 +63,19 @@ func init() {
 		Data:  (*Host).cmdAssembleMap,
 	})
 
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "backtrace",
+		Brief: "Display the call stack",
+		Description: "Display the subroutine calls and interrupts that" +
+			" have not yet returned, innermost first. Each frame shows the" +
+			" address of the call, the subroutine entered, the return address" +
+			" and the stack bytes that belong to it. Returns that don't match" +
+			" the most recent call, as when a program changes SP itself, are" +
+			" listed at the end.",
+		Usage: "backtrace",
+		Data:  (*Host).cmdBacktrace,
+	})
+
 	// Breakpoint commands
 	bp := root.AddSubtree(cmd.TreeDescriptor{Name: "breakpoint", Brief: "Breakpoint commands"})
 	bp.AddCommand(cmd.CommandDescriptor{
@@ -144,9 +167,24 @@ func init() {
 		Description: "Disassemble machine code starting at the requested" +
 			" address. The number of instruction lines to disassemble may be" +
 			" specified as an option. If no address is specified, the" +
-			" disassembly continues from where the last disassembly left off.",
-		Usage: "disassemble [<address>] [<lines>]",
-		Data:  (*Host).cmdDisassemble,
+			" disassembly continues from where the last disassembly left off." +
+			" 'disassemble export' writes the code between two addresses, inclusive," +
+			" to a source file that assembles to the same bytes. Labels are" +
+			" generated for CALL and branch targets, exported labels and" +
+			" single-word annotations name their addresses, other annotations" +
+			" become comments, and bytes that aren't valid instructions are" +
+			" written with .db. 'disassemble flow' follows the code from its" +
+			" entry points through every branch and CALL, instead of decoding" +
+			" memory in order, and lists the basic blocks of each subroutine" +
+			" and the data between them. Entry points default to the reset" +
+			" and IRQ vectors, the START label and exported labels. With 'dot', a Graphviz control flow" +
+			" graph of each subroutine is written to the directory." +
+			" 'disassemble html' writes the code between two addresses to a web" +
+			" page, with links from address operands to their targets, the" +
+			" source of each line and an index of labels.",
+		Usage: "disassemble [<address>] [<lines>] | export <start> <end> <filename> |" +
+			" flow [dot <directory>] [<entry> ...] | html <start> <end> <filename>",
+		Data: (*Host).cmdDisassemble,
 	})
 	root.AddCommand(cmd.CommandDescriptor{
 		Name:        "evaluate",
@@ -172,22 +210,60 @@ func init() {
 		Usage: "exports",
 		Data:  (*Host).cmdExports,
 	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "keys",
+		Brief: "Type keys on the emulated keyboard",
+		Description: "Queue text on the memory-mapped keyboard as if it had" +
+			" been typed. Enclose text containing spaces in double quotes." +
+			" Escape sequences such as \\r and \\n are recognized.",
+		Usage: "keys <text>",
+		Data:  (*Host).cmdKeys,
+	})
 	root.AddCommand(cmd.CommandDescriptor{
 		Name:  "list",
 		Brief: "List source code lines",
 		Description: "List the source code corresponding to the machine code" +
 			" at the specified address. A source map containing the address must" +
-			" have been previously loaded.",
-		Usage: "list <address> [<lines>]",
+			" have been previously loaded. 'list html' writes the source and code" +
+			" between two addresses to a web page, like 'disassemble html'.",
+		Usage: "list <address> [<lines>] | html <start> <end> <filename>",
 		Data:  (*Host).cmdList,
 	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "link",
+		Brief: "Link object files into a program",
+		Description: "Link relocatable object files produced by 'assemble file" +
+			" <filename> object' into a program and its source map. The" +
+			" sections of each object are placed as described by the layout" +
+			" file given with -T, or from $1000 by default. If the output file" +
+			" has a '.cx1' extension, a CPU1 executable is written; otherwise" +
+			" a raw binary.",
+		Usage: "link <output> <object> [<object> ...] [-T <layout>]",
+		Data:  (*Host).cmdLink,
+	})
+	root.AddCommand(cmd.CommandDescriptor{
+		Name:  "watch",
+		Brief: "Reassemble and reload a source file when it changes",
+		Description: "Assemble and load a source file, then watch it and every" +
+			" file it includes. Each time one of them is saved, the source is" +
+			" assembled and loaded again, and breakpoints move to the same" +
+			" source lines in the new code. Add 'start' to set the PC after each" +
+			" reload to the START label, or else the load origin. Other options" +
+			" are the same as for 'assemble file'. Type 'watch off' to stop" +
+			" watching, or 'watch' to see what is being watched.",
+		Usage: "watch [<filename> [start] [<assemble options>] | off]",
+		Data:  (*Host).cmdWatch,
+	})
 	root.AddCommand(cmd.CommandDescriptor{
 		Name:  "load",
 		Brief: "Load a binary file",
 		Description: "Load the contents of a binary file into the emulated" +
 			" system's memory. If the file has an associated source map, it" +
 			" will be loaded too. If the file contains raw binary data, you must" +
-			" specify the address where the data will be loaded.",
+			" specify the address where the data will be loaded. CPU1" +
+			" executables, Intel HEX and Motorola S-record files are" +
+			" recognized by their extension or content and loaded at the" +
+			" addresses they contain.",
 		Usage: "load <filename> [<address>]",
 		Data:  (*Host).cmdLoad,
 	})
@@ -284,13 +360,48 @@ func init() {
 	st.AddCommand(cmd.CommandDescriptor{
 		Name:  "out",
 		Brief: "Step out of the current subroutine",
-		Description: "Step the CPU until it executes an RTS or RTI" +
-			" instruction. This has the effect of stepping until the " +
-			" currently running subroutine has returned.",
+		Description: "Step the CPU until the currently running subroutine" +
+			" or interrupt handler has returned. Outside of any call, step" +
+			" until a RET or RTI instruction is executed.",
 		Usage: "step out",
 		Data:  (*Host).cmdStepOut,
 	})
 
+	// Source line step commands
+	nx := root.AddSubtree(cmd.TreeDescriptor{Name: "next", Brief: "Step the debugger by source line"})
+	nx.AddCommand(cmd.CommandDescriptor{
+		Name:  "in",
+		Brief: "Step into next source line",
+		Description: "Step the CPU until it reaches the start of a different" +
+			" source line, then display that line. If the line calls a" +
+			" subroutine with source, step into the subroutine. Subroutines" +
+			" in other source files are stepped over unless the StepIncludes" +
+			" setting is on, and a macro expansion is a single line unless" +
+			" the StepMacros setting is on. The number of lines may be" +
+			" specified as an option.",
+		Usage: "next in [<count>]",
+		Data:  (*Host).cmdNextIn,
+	})
+	nx.AddCommand(cmd.CommandDescriptor{
+		Name:  "over",
+		Brief: "Step over next source line",
+		Description: "Step the CPU until it reaches the start of a different" +
+			" source line, then display that line. Subroutines called by the" +
+			" line are run until they return. The number of lines may be" +
+			" specified as an option.",
+		Usage: "next over [<count>]",
+		Data:  (*Host).cmdNextOver,
+	})
+	nx.AddCommand(cmd.CommandDescriptor{
+		Name:  "out",
+		Brief: "Step out to the calling source line",
+		Description: "Step the CPU until the currently running subroutine" +
+			" has returned and the start of a source line is reached, then" +
+			" display that line.",
+		Usage: "next out",
+		Data:  (*Host).cmdNextOut,
+	})
+
 	// Add command shortcuts.
 	root.AddShortcut("a", "assemble file")
 	root.AddShortcut("ai", "assemble interactive")
@@ -302,6 +413,7 @@ func init() {
 	root.AddShortcut("bl", "breakpoint list")
 	root.AddShortcut("be", "breakpoint enable")
 	root.AddShortcut("bd", "breakpoint disable")
+	root.AddShortcut("bt", "backtrace")
 	root.AddShortcut("d", "disassemble")
 	root.AddShortcut("db", "databreakpoint")
 	root.AddShortcut("dbp", "databreakpoint")
@@ -315,6 +427,9 @@ func init() {
 	root.AddShortcut("m", "memory dump")
 	root.AddShortcut("mc", "memory copy")
 	root.AddShortcut("ms", "memory set")
+	root.AddShortcut("n", "next over")
+	root.AddShortcut("ni", "next in")
+	root.AddShortcut("no", "next out")
 	root.AddShortcut("r", "register")
 	root.AddShortcut("s", "step over")
 	root.AddShortcut("si", "step in")
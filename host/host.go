@@ -15,6 +15,7 @@ package host
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"hash/crc32"
@@ -24,13 +25,17 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/beevik/cmd"
 	"riddick.net/cpu1-simulator/asm"
 	"riddick.net/cpu1-simulator/cpu"
 	"riddick.net/cpu1-simulator/disasm"
+	"riddick.net/cpu1-simulator/link"
 	"riddick.net/cpu1-simulator/term"
 )
 
@@ -62,12 +67,15 @@ type Host struct {
 	theme          *disasm.Theme
 	prompt         string
 	mem            *cpu.FlatMemory
+	keyboard       *cpu.Keyboard
 	cpu            *cpu.CPU
 	debugger       *cpu.Debugger
 	lastCmd        *cmd.Command
 	lastArgs       []string
 	lastLine       string
 	state          state
+	running        atomic.Bool // state is stateRunning, for the console key reader
+	breakKey       atomic.Bool // ctrl-C typed on the console while running
 	miniAddr       uint16
 	assembly       []string
 	exprParser     *exprParser
@@ -75,6 +83,10 @@ type Host struct {
 	sourceMap      *asm.SourceMap
 	settings       *settings
 	annotations    map[uint16]string
+	calls          callStack             // subroutines and interrupts entered but not yet returned from
+	mu             sync.Mutex            // held while a command runs, so reloads wait for it
+	watch          *watch                // source being watched for changes, if any
+	onReload       func(filename string) // called after a watched source is reloaded
 }
 
 // IoState represents the state of the host's I/O subsystem. It is returned
@@ -117,7 +129,6 @@ func New() *Host {
 
 	h := &Host{
 		rawMode:     false,
-		rawTerminal: term.NewTerminal(console, ""),
 		theme:       theme,
 		exprParser:  newExprParser(),
 		sourceCode:  make(map[string][]string),
@@ -126,6 +137,11 @@ func New() *Host {
 		annotations: make(map[uint16]string),
 	}
 
+	// Route console input through a key reader so that keys typed while
+	// the CPU runs reach the emulated keyboard.
+	console.Reader = newKeyReader(h, os.Stdin)
+	h.rawTerminal = term.NewTerminal(console, "")
+
 	// Set up raw terminal callbacks.
 	h.rawTerminal.AutoCompleteCallback = h.autocomplete
 	h.rawTerminal.HistoryTestCallback = h.historyTest
@@ -133,9 +149,15 @@ func New() *Host {
 	// Initialize host state.
 	h.setState(stateProcessingCommands)
 
-	// Create the emulated CPU and memory.
+	// Create the emulated CPU and memory, with the keyboard and UART
+	// mapped into the I/O page. UART output goes to the console.
 	h.mem = cpu.NewFlatMemory()
-	h.cpu = cpu.NewCPU(cpu.NMOS, h.mem)
+	h.keyboard = cpu.NewKeyboard()
+	mem := cpu.NewMappedMemory(h.mem)
+	mem.Map(cpu.KeyboardStatus, 2, h.keyboard)
+	mem.Map(cpu.UARTData, 2, cpu.NewUART(h))
+	h.cpu = cpu.NewCPU(cpu.NMOS, mem)
+	h.cpu.AttachIRQSource(h.keyboard)
 
 	// Create a CPU debugger and attach it to the CPU.
 	h.debugger = cpu.NewDebugger(h)
@@ -155,6 +177,9 @@ func (h *Host) Cleanup() {
 // Reset CPU
 func (h *Host) Reset() {
 	h.cpu.Reg.Init()
+	h.cpu.Halted = false
+	h.keyboard.Clear()
+	h.calls.reset()
 }
 
 func (h *Host) enableRawMode() {
@@ -330,6 +355,8 @@ func (h *Host) RestoreIoState(state *IoState) {
 
 // Process command from GUI
 func (h *Host) ProcessGUICmd(line string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	err = h.processCommand(line)
 }
 
@@ -337,6 +364,12 @@ func (h *Host) ProcessGUICmd(line string) {
 // to a writer. If the commands are interactive, a prompt is displayed while
 // the host waits for the the next command to be entered.
 func (h *Host) RunCommands(interactive bool) {
+	h.runCommands(interactive, true)
+}
+
+// Run commands, holding the command lock while each runs unless the caller
+// already holds it.
+func (h *Host) runCommands(interactive, lock bool) {
 	//infoLogger.Println("***** RunCommands().")
 	if interactive {
 		fmt.Fprintln(h)
@@ -356,6 +389,9 @@ func (h *Host) RunCommands(interactive bool) {
 			break
 		}
 
+		if lock {
+			h.mu.Lock()
+		}
 		switch h.state {
 		case stateProcessingCommands:
 			err = h.processCommand(line)
@@ -364,6 +400,9 @@ func (h *Host) RunCommands(interactive bool) {
 		default:
 			panic("invalid state")
 		}
+		if lock {
+			h.mu.Unlock()
+		}
 
 		if err != nil {
 			break
@@ -375,6 +414,10 @@ func (h *Host) RunCommands(interactive bool) {
 
 func (h *Host) setState(s state) {
 	h.state = s
+	h.running.Store(s == stateRunning)
+	if s == stateRunning {
+		h.breakKey.Store(false)
+	}
 	switch h.state {
 	case stateMiniAssembler:
 		h.prompt = term.Cyan + "! " + term.Reset
@@ -452,6 +495,9 @@ func (h *Host) assembleInline() error {
 	fmt.Fprintln(h, "Assembling inline code...")
 	s := strings.Join(h.assembly, "\n")
 	a, _, err := asm.Assemble(strings.NewReader(s), "inline", h.miniAddr, h, 0)
+	for _, w := range a.Warnings {
+		fmt.Fprintln(h, w)
+	}
 
 	if err != nil {
 		for _, e := range a.Errors {
@@ -470,7 +516,7 @@ func (h *Host) assembleInline() error {
 	h.sourceMap.ClearRange(int(h.miniAddr), len(a.Code))
 
 	for addr, end := int(h.miniAddr), int(h.miniAddr)+len(a.Code); addr < end; {
-		d, next := disasm.Disassemble(h.cpu, uint16(addr), disasm.ShowBasic, "", h.theme)
+		d, next := disasm.Disassemble(h.cpu, uint16(addr), disasm.ShowBasic, "", h.theme, h.symbols())
 		fmt.Fprintln(h, d)
 		if next < uint16(addr) {
 			break
@@ -487,6 +533,7 @@ func (h *Host) Break() {
 	switch h.state {
 	case stateRunning:
 		h.state = stateInterrupted
+		h.running.Store(false)
 
 	case stateProcessingCommands:
 		fmt.Fprintln(h, "Type 'quit' to exit the application.")
@@ -517,8 +564,17 @@ func (h *Host) readLine(interactive bool) (string, error) {
 	return "", io.EOF
 }
 
+// Return the resolver used to show addresses as labels in disassembly, or
+// nil if the SymbolicDisasm setting is off.
+func (h *Host) symbols() disasm.SymbolResolver {
+	if !h.settings.SymbolicDisasm {
+		return nil
+	}
+	return h.sourceMap
+}
+
 func (h *Host) displayPC() {
-	d, _ := disasm.Disassemble(h.cpu, h.cpu.Reg.PC, disasm.ShowFull, "", h.theme)
+	d, _ := disasm.Disassemble(h.cpu, h.cpu.Reg.PC, disasm.ShowFull, "", h.theme, h.symbols())
 	fmt.Fprintln(h, d)
 }
 
@@ -561,24 +617,82 @@ func (h *Host) cmdAssembleFile(c *cmd.Command, args []string) error {
 		path += ".asm"
 	}
 
-	var options asm.Option
-	if len(args) > 1 {
-		verbose, err := stringToBool(args[1])
+	options, settings, ok := h.parseAssembleArgs(c, args[1:])
+	if !ok {
+		return nil
+	}
+
+	err := asm.AssembleFile(path, options, h, settings...)
+	if err != nil {
+		fmt.Fprintf(h, "Failed to assemble (%v).\n", err)
+	}
+
+	return nil
+}
+
+// Parse the options following the file name of an assemble command. The
+// AsmPath setting is added to any -I directories. Returns false after
+// reporting a bad argument.
+func (h *Host) parseAssembleArgs(c *cmd.Command, args []string) (options asm.Option, settings []asm.Setting, ok bool) {
+	for i := 0; i < len(args); i++ {
+		if flag := args[i]; strings.HasPrefix(flag, "-D") || strings.HasPrefix(flag, "-W") || strings.HasPrefix(flag, "-I") {
+			s := flag[2:]
+			if s == "" && i+1 < len(args) {
+				i++
+				s = args[i]
+			}
+			var setting asm.Setting
+			var err error
+			switch {
+			case strings.HasPrefix(flag, "-D"):
+				setting, err = asm.ParseDefine(s)
+			case strings.HasPrefix(flag, "-W"):
+				setting, err = asm.ParseWarningFlag(s)
+			default:
+				setting = asm.IncludeDir(s)
+			}
+			if err != nil {
+				fmt.Fprintf(h, "%v\n", err)
+				return 0, nil, false
+			}
+			settings = append(settings, setting)
+			continue
+		}
+		switch strings.ToLower(args[i]) {
+		case "listing":
+			options |= asm.Listing
+			continue
+		case "hex":
+			options |= asm.IntelHex
+			continue
+		case "srec":
+			options |= asm.SRecord
+			continue
+		case "cx1":
+			options |= asm.WriteExecutable
+			continue
+		case "object":
+			options |= asm.Relocatable
+			continue
+		case "deps":
+			options |= asm.Dependencies
+			continue
+		}
+
+		verbose, err := stringToBool(args[i])
 		if err != nil {
 			c.DisplayUsage(h)
-			return nil
+			return 0, nil, false
 		}
 		if verbose {
 			options |= asm.Verbose
 		}
 	}
 
-	err := asm.AssembleFile(path, options, h)
-	if err != nil {
-		fmt.Fprintf(h, "Failed to assemble (%v).\n", err)
-	}
-
-	return nil
+	// Directories in the AsmPath setting are searched after any given
+	// with -I.
+	settings = append(settings, asm.SplitIncludePath(h.settings.AsmPath)...)
+	return options, settings, true
 }
 
 func (h *Host) cmdAssembleInteractive(c *cmd.Command, args []string) error {
@@ -891,6 +1005,14 @@ func (h *Host) cmdDisassemble(c *cmd.Command, args []string) error {
 	if len(args) == 0 {
 		args = []string{"$"}
 	}
+	switch args[0] {
+	case "export":
+		return h.exportDisassembly(c, args[1:])
+	case "flow":
+		return h.analyzeFlow(c, args[1:])
+	case "html":
+		return h.writeHTML(c, args[1:], false)
+	}
 
 	addr, err := h.parseAddr(args[0], h.settings.NextDisasmAddr)
 	if err != nil {
@@ -909,7 +1031,7 @@ func (h *Host) cmdDisassemble(c *cmd.Command, args []string) error {
 	}
 
 	for i := 0; i < count; i++ {
-		d, next := disasm.Disassemble(h.cpu, addr, disasm.ShowBasic, h.annotations[addr], h.theme)
+		d, next := disasm.Disassemble(h.cpu, addr, disasm.ShowBasic, h.annotations[addr], h.theme, h.symbols())
 		fmt.Fprintln(h, d)
 		addr = next
 	}
@@ -919,6 +1041,220 @@ func (h *Host) cmdDisassemble(c *cmd.Command, args []string) error {
 	return nil
 }
 
+// Write the code in an address range to a source file that can be
+// assembled again.
+func (h *Host) exportDisassembly(c *cmd.Command, args []string) error {
+	if len(args) < 3 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	start, err := h.parseAddr(args[0], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	end, err := h.parseAddr(args[1], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	if end < start {
+		fmt.Fprintln(h, "End address must be greater than start address.")
+		return nil
+	}
+
+	names, comments := h.addressNames()
+	filename := args[2]
+	if filepath.Ext(filename) == "" {
+		filename += ".asm"
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	defer file.Close()
+
+	if err := disasm.Export(file, h.cpu, start, end, names, comments); err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	fmt.Fprintf(h, "Exported $%04X..$%04X to '%s'.\n", start, end, filepath.Base(filename))
+	return nil
+}
+
+// Write the code in an address range to an HTML page, with its source when
+// it is known. A listing shows every source line, as the list command does.
+func (h *Host) writeHTML(c *cmd.Command, args []string, listing bool) error {
+	if len(args) < 3 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	start, err := h.parseAddr(args[0], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	end, err := h.parseAddr(args[1], 0)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	if end < start {
+		fmt.Fprintln(h, "End address must be greater than start address.")
+		return nil
+	}
+	if listing && len(h.sourceMap.Lines) == 0 {
+		fmt.Fprintln(h, "No source code is loaded.")
+		return nil
+	}
+
+	opts := &disasm.HTMLOptions{
+		Symbols:     h.symbols(),
+		Annotations: h.annotations,
+		Find:        h.sourceMap.Find,
+		Lines:       h.getSourceLines,
+		Listing:     listing,
+		Theme:       h.theme,
+	}
+	if listing {
+		opts.Title = fmt.Sprintf("Listing of $%04X-$%04X", start, end)
+	}
+
+	filename := args[2]
+	if filepath.Ext(filename) == "" {
+		filename += ".html"
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	defer file.Close()
+
+	if err := disasm.WriteHTML(file, h.cpu, start, end, opts); err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	fmt.Fprintf(h, "Wrote $%04X..$%04X to '%s'.\n", start, end, filepath.Base(filename))
+	return nil
+}
+
+// Follow the code from its entry points and show its basic blocks,
+// optionally writing a control flow graph of each subroutine. Without
+// entry points, the code is followed from the reset vector and the
+// exported labels, or else from the PC.
+func (h *Host) analyzeFlow(c *cmd.Command, args []string) error {
+	dir := ""
+	if len(args) >= 1 && args[0] == "dot" {
+		if len(args) < 2 {
+			c.DisplayUsage(h)
+			return nil
+		}
+		dir, args = args[1], args[2:]
+	}
+
+	var entries []uint16
+	for _, arg := range args {
+		addr, err := h.parseAddr(arg, 0)
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+		entries = append(entries, addr)
+	}
+	if len(entries) == 0 {
+		if reset := h.cpu.Mem.LoadAddress(0xfffc); reset != 0 {
+			entries = append(entries, reset)
+		}
+		if irq := h.cpu.Mem.LoadAddress(0xfffe); irq != 0 {
+			entries = append(entries, irq)
+		}
+		if start, ok := h.sourceMap.LookupName("START"); ok {
+			entries = append(entries, start)
+		}
+		for _, e := range h.sourceMap.Exports {
+			entries = append(entries, e.Address)
+		}
+		if len(entries) == 0 {
+			entries = append(entries, h.cpu.Reg.PC)
+		}
+	}
+
+	names, _ := h.addressNames()
+	flow := disasm.Analyze(h.cpu, entries, names)
+	flow.WriteListing(h, h.cpu)
+
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return nil
+	}
+	for _, s := range flow.Subroutines {
+		file, err := os.Create(filepath.Join(dir, s.Name+".dot"))
+		if err == nil {
+			err = flow.WriteDot(file, h.cpu, s)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(h, "%v\n", err)
+			return nil
+		}
+	}
+	fmt.Fprintf(h, "Wrote %d graph(s) to '%s'.\n", len(flow.Subroutines), dir)
+	return nil
+}
+
+// Return names for addresses, for disassembly that is to be read as
+// source. Exported labels name addresses, as do annotations that are a
+// single identifier. Other annotations are returned as comments.
+func (h *Host) addressNames() (names, comments map[uint16]string) {
+	names = make(map[uint16]string)
+	used := make(map[string]bool)
+	for _, e := range h.sourceMap.Exports {
+		if _, ok := names[e.Address]; !ok && !used[e.Label] {
+			names[e.Address] = e.Label
+			used[e.Label] = true
+		}
+	}
+	comments = make(map[uint16]string)
+	for addr, anno := range h.annotations {
+		if _, ok := names[addr]; !ok && !used[anno] && h.isLabelName(anno) {
+			names[addr] = anno
+			used[anno] = true
+		} else {
+			comments[addr] = anno
+		}
+	}
+	return names, comments
+}
+
+// Return true if a string can be used as a label in assembly source.
+func (h *Host) isLabelName(s string) bool {
+	if s == "" || len(h.cpu.InstSet.GetInstructions(s)) > 0 {
+		return false
+	}
+	switch strings.ToUpper(s) {
+	case "R0", "R1", "R2", "R3", "R4", "R5", "R6", "R7", "SP", "PC":
+		return false
+	}
+	for i, ch := range s {
+		switch {
+		case ch == '_', ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z':
+		case ch >= '0' && ch <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func (h *Host) cmdExports(c *cmd.Command, args []string) error {
 	if len(h.sourceMap.Exports) == 0 {
 		fmt.Fprintln(h, "No active exports.")
@@ -963,7 +1299,7 @@ func (h *Host) cmdExecute(c *cmd.Command, args []string) error {
 	defer file.Close()
 
 	ioState := h.EnableProcessedMode(file, os.Stdout)
-	h.RunCommands(false)
+	h.runCommands(false, false)
 	h.RestoreIoState(ioState)
 
 	return nil
@@ -989,6 +1325,9 @@ func (h *Host) cmdList(c *cmd.Command, args []string) error {
 	if len(args) == 0 {
 		args = []string{"$"}
 	}
+	if args[0] == "html" {
+		return h.writeHTML(c, args[1:], true)
+	}
 
 	// Parse the address.
 	addr, err := h.parseAddr(args[0], h.settings.NextSourceAddr)
@@ -1083,6 +1422,39 @@ func (h *Host) cmdList(c *cmd.Command, args []string) error {
 	return nil
 }
 
+func (h *Host) cmdLink(c *cmd.Command, args []string) error {
+	var files []string
+	var layout string
+	for i := 0; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "-T") {
+			layout = strings.TrimPrefix(args[i], "-T")
+			if layout == "" && i+1 < len(args) {
+				i++
+				layout = args[i]
+			}
+			continue
+		}
+		files = append(files, args[i])
+	}
+	if len(files) < 2 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	objs := files[1:]
+	for i, f := range objs {
+		if filepath.Ext(f) == "" {
+			objs[i] = f + ".obj"
+		}
+	}
+
+	err := link.LinkFiles(files[0], objs, layout, h)
+	if err != nil {
+		fmt.Fprintf(h, "Failed to link (%v).\n", err)
+	}
+	return nil
+}
+
 func (h *Host) cmdLoad(c *cmd.Command, args []string) error {
 	if len(args) < 1 {
 		c.DisplayUsage(h)
@@ -1102,6 +1474,7 @@ func (h *Host) cmdLoad(c *cmd.Command, args []string) error {
 	}
 
 	_, err := h.load(filename, loadAddr)
+	h.calls.reset()
 	return err
 }
 
@@ -1271,6 +1644,7 @@ func (h *Host) cmdRegister(c *cmd.Command, args []string) error {
 		case "SP":
 			v = 0x0100 | (v & 0xff)
 			h.cpu.Reg.SP, sz = byte(v), 2
+			h.calls.discard(int(h.cpu.Reg.SP))
 		case ".":
 			key = "pc"
 			fallthrough
@@ -1306,13 +1680,19 @@ func (h *Host) cmdRun(c *cmd.Command, args []string) error {
 			return nil
 		}
 		h.cpu.SetPC(pc)
+		h.calls.reset()
 	}
 
 	fmt.Fprintf(h, "Running from $%04X. Press ctrl-C to break.\n", h.cpu.Reg.PC)
 
-	h.state = stateRunning
+	h.setState(stateRunning)
 	for step := 0; h.state == stateRunning; step++ {
 		h.step()
+		if h.cpu.Halted {
+			fmt.Fprintf(h, "CPU halted.\n")
+			h.displayPC()
+			break
+		}
 		h.breakCheck(step)
 	}
 
@@ -1326,6 +1706,13 @@ func (h *Host) cmdRun(c *cmd.Command, args []string) error {
 }
 
 func (h *Host) breakCheck(step int) {
+	// Ctrl-C typed on the console is seen by the key reader's goroutine,
+	// which leaves it here for the goroutine running the CPU.
+	if h.breakKey.Swap(false) {
+		h.Break()
+		return
+	}
+
 	// To prevent performance degradation, only test for ctrl-C once every 128
 	// CPU steps.
 	if (step & 127) == 127 {
@@ -1501,6 +1888,14 @@ func (h *Host) load(binFilename string, addr int) (origin uint16, err error) {
 		return 0, nil
 	}
 
+	// Executables, HEX and S-record files carry their own load addresses.
+	if strings.EqualFold(ext, ".cx1") || asm.IsExecutable(a.Code) {
+		return h.loadExecutable(binFilename, a.Code)
+	}
+	if format := asm.DetectFormat(binFilename, a.Code); format != asm.FormatRaw {
+		return h.loadImage(binFilename, bytes.NewReader(a.Code), format)
+	}
+
 	// Try loading a source map file if it exists.
 	mapFilename := binFilename[:len(binFilename)-len(ext)] + ".map"
 	mapFile, err := os.Open(mapFilename)
@@ -1515,11 +1910,7 @@ func (h *Host) load(binFilename string, addr int) (origin uint16, err error) {
 		} else {
 			if crc32.ChecksumIEEE(a.Code) == sourceMap.CRC {
 				fmt.Fprintf(h, "Loaded source map from '%s'.\n", filepath.Base(mapFilename))
-				if len(h.sourceMap.Files) == 0 {
-					h.sourceMap = sourceMap
-				} else {
-					h.sourceMap.Merge(sourceMap)
-				}
+				h.mergeSourceMap(sourceMap)
 			} else {
 				fmt.Fprintf(h, "Source map CRC doesn't match for '%s'.\n", filepath.Base(binFilename))
 				sourceMap = nil
@@ -1549,34 +1940,143 @@ func (h *Host) load(binFilename string, addr int) (origin uint16, err error) {
 	return origin, nil
 }
 
+// Load a CPU1 executable, storing each segment at its address. Symbols in
+// the executable are added to the source map, and a matching source map
+// file is loaded if there is one.
+func (h *Host) loadExecutable(filename string, b []byte) (origin uint16, err error) {
+	exe := &asm.Executable{}
+	_, err = exe.ReadFrom(bytes.NewReader(b))
+	if err != nil {
+		fmt.Fprintf(h, "Failed to load '%s': %v\n", filepath.Base(filename), err)
+		return 0, nil
+	}
+
+	ext := filepath.Ext(filename)
+	mapFilename := filename[:len(filename)-len(ext)] + ".map"
+	if mapFile, err := os.Open(mapFilename); err == nil {
+		defer mapFile.Close()
+		sourceMap := asm.NewSourceMap()
+		_, err = sourceMap.ReadFrom(mapFile)
+		_, code := exe.Flatten()
+		switch {
+		case err != nil:
+			fmt.Fprintf(h, "Failed to read source map '%s': %v\n", filepath.Base(mapFilename), err)
+		case crc32.ChecksumIEEE(code) != sourceMap.CRC:
+			fmt.Fprintf(h, "Source map CRC doesn't match for '%s'.\n", filepath.Base(filename))
+		default:
+			fmt.Fprintf(h, "Loaded source map from '%s'.\n", filepath.Base(mapFilename))
+			h.mergeSourceMap(sourceMap)
+		}
+	}
+	h.replaceExports(exe)
+
+	for _, s := range exe.Segments {
+		h.cpu.Mem.StoreBytes(s.Address, s.Data)
+		fmt.Fprintf(h, "Loaded '%s' to $%04X..$%04X.\n", filepath.Base(filename), s.Address, int(s.Address)+len(s.Data)-1)
+	}
+	fmt.Fprintf(h, "Entry point is $%04X.\n", exe.Entry)
+
+	h.settings.NextDisasmAddr = exe.Entry
+	return exe.Entry, nil
+}
+
+// Replace the exports covered by an executable's segments, or named by its
+// symbols, with the executable's symbols, so that loading it again doesn't
+// list them twice.
+func (h *Host) replaceExports(exe *asm.Executable) {
+	replaced := func(e asm.Export) bool {
+		for _, s := range exe.Segments {
+			if int(e.Address) >= int(s.Address) && int(e.Address) < int(s.Address)+len(s.Data) {
+				return true
+			}
+		}
+		for _, s := range exe.Symbols {
+			if strings.EqualFold(e.Label, s.Label) {
+				return true
+			}
+		}
+		return false
+	}
+
+	exports := make([]asm.Export, 0, len(h.sourceMap.Exports)+len(exe.Symbols))
+	for _, e := range h.sourceMap.Exports {
+		if !replaced(e) {
+			exports = append(exports, e)
+		}
+	}
+	exports = append(exports, exe.Symbols...)
+	sort.SliceStable(exports, func(i, j int) bool {
+		return exports[i].Address < exports[j].Address
+	})
+	h.sourceMap.Exports = exports
+}
+
+// Add a source map to the host's source map.
+func (h *Host) mergeSourceMap(sourceMap *asm.SourceMap) {
+	// The source files may have changed since they were last read.
+	for _, f := range sourceMap.Files {
+		delete(h.sourceCode, f)
+	}
+	if len(h.sourceMap.Files) == 0 {
+		h.sourceMap = sourceMap
+	} else {
+		h.sourceMap.Merge(sourceMap)
+	}
+}
+
+// Load an Intel HEX or S-record file, storing each block of data at its
+// address. The entry point, if the file has one, becomes the origin.
+func (h *Host) loadImage(filename string, r io.Reader, format string) (origin uint16, err error) {
+	img, err := asm.ReadImage(r, format)
+	if err != nil {
+		if errs, ok := err.(asm.RecordErrors); ok {
+			for _, e := range errs {
+				fmt.Fprintf(h, "%s: %v\n", filepath.Base(filename), e)
+			}
+		} else {
+			fmt.Fprintf(h, "%v\n", err)
+		}
+		fmt.Fprintf(h, "Failed to load '%s'.\n", filepath.Base(filename))
+		return 0, nil
+	}
+	if len(img.Blocks) == 0 {
+		fmt.Fprintf(h, "File '%s' contains no data.\n", filepath.Base(filename))
+		return 0, nil
+	}
+
+	for _, b := range img.Blocks {
+		h.cpu.Mem.StoreBytes(b.Address, b.Data)
+		fmt.Fprintf(h, "Loaded '%s' to $%04X..$%04X.\n", filepath.Base(filename), b.Address, int(b.Address)+len(b.Data)-1)
+	}
+
+	origin = img.Blocks[0].Address
+	if img.Entry >= 0 {
+		origin = uint16(img.Entry)
+		fmt.Fprintf(h, "Entry point is $%04X.\n", origin)
+	}
+	h.settings.NextDisasmAddr = origin
+	return origin, nil
+}
+
 func (h *Host) step() {
+	pc, sp := h.cpu.Reg.PC, h.cpu.Reg.SP
+	inst := h.cpu.GetInstruction(pc)
 	h.cpu.Step()
+	h.calls.update(h.cpu, pc, sp, inst)
 }
 
 func (h *Host) stepOver() {
 	cpu := h.cpu
 
 	inst := cpu.GetInstruction(cpu.Reg.PC)
-	next := cpu.Reg.PC + uint16(inst.Length)
-	cpu.Step()
-
-	// If a JSR was just stepped, keep stepping until the return address
-	// is hit or a corresponding RTS is stepped.
-	if inst.Name == "JSR" {
-		count := 1
-	loop:
-		for step := 0; h.state == stateRunning && cpu.Reg.PC != next; step++ {
-			inst := cpu.GetInstruction(cpu.Reg.PC)
-			cpu.Step()
-			switch inst.Name {
-			case "JSR":
-				count++
-			case "RTS":
-				count--
-				if count == 0 {
-					break loop
-				}
-			}
+	depth := len(h.calls.frames)
+	h.step()
+
+	// If a CALL was just stepped, keep stepping until the subroutine
+	// returns.
+	if inst.Mnemonic == "CALL" {
+		for step := 0; h.state == stateRunning && !cpu.Halted && len(h.calls.frames) > depth; step++ {
+			h.step()
 			h.breakCheck(step)
 		}
 	}
@@ -1585,10 +2085,13 @@ func (h *Host) stepOver() {
 func (h *Host) stepOut() {
 	cpu := h.cpu
 
-	for step := 0; h.state == stateRunning; step++ {
+	// Step until the current subroutine or interrupt handler returns.
+	// Outside of any known call, stop after the first RET or RTI.
+	depth := len(h.calls.frames)
+	for step := 0; h.state == stateRunning && !cpu.Halted; step++ {
 		inst := cpu.GetInstruction(cpu.Reg.PC)
-		cpu.Step()
-		if inst.Name == "RTS" || inst.Name == "RTI" {
+		h.step()
+		if len(h.calls.frames) < depth || (depth == 0 && (inst.Mnemonic == "RET" || inst.Mnemonic == "RTI")) {
 			break
 		}
 		h.breakCheck(step)
@@ -1725,10 +2228,8 @@ func (h *Host) resolveIdentifier(s string) (int64, error) {
 		return int64(h.cpu.Reg.PC), nil
 	}
 
-	for _, e := range h.sourceMap.Exports {
-		if strings.ToLower(e.Label) == s {
-			return int64(e.Address), nil
-		}
+	if addr, ok := h.sourceMap.LookupName(s); ok {
+		return int64(addr), nil
 	}
 
 	return 0, fmt.Errorf("identifier '%s' not found", s)
@@ -1754,7 +2255,7 @@ func (h *Host) OnDataBreakpoint(cpu *cpu.CPU, b *cpu.DataBreakpoint) {
 	h.setState(stateBreakpoint)
 
 	if cpu.LastPC != cpu.Reg.PC {
-		d, _ := disasm.Disassemble(h.cpu, cpu.LastPC, disasm.ShowFull, "", h.theme)
+		d, _ := disasm.Disassemble(h.cpu, cpu.LastPC, disasm.ShowFull, "", h.theme, h.symbols())
 		fmt.Fprintln(h, d)
 	}
 
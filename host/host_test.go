@@ -0,0 +1,45 @@
+package host
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"riddick.net/cpu1-simulator/asm"
+)
+
+func TestLoadExecutableExports(t *testing.T) {
+	h := New()
+	h.EnableProcessedMode(strings.NewReader(""), io.Discard)
+	h.sourceMap.Exports = []asm.Export{{Label: "OLD", Address: 0x0201}, {Label: "KEEP", Address: 0x3000}}
+
+	exe := &asm.Executable{
+		Entry:    0x0200,
+		Segments: []asm.Block{{Address: 0x0200, Flags: asm.SegmentRAM | asm.SegmentExec, Data: []byte{0x00, 0x00, 0x01}}},
+		Symbols:  []asm.Export{{Label: "START", Address: 0x0200}, {Label: "BUF", Address: 0x0900}},
+	}
+	var b bytes.Buffer
+	if _, err := exe.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading twice must not list the symbols twice, and exports in the
+	// loaded range are replaced.
+	filename := filepath.Join(t.TempDir(), "prog.cx1")
+	for i := 0; i < 2; i++ {
+		if _, err := h.loadExecutable(filename, b.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []asm.Export{{Label: "START", Address: 0x0200}, {Label: "BUF", Address: 0x0900}, {Label: "KEEP", Address: 0x3000}}
+	if len(h.sourceMap.Exports) != len(expect) {
+		t.Fatalf("exports %+v, expected %+v", h.sourceMap.Exports, expect)
+	}
+	for i, e := range expect {
+		if h.sourceMap.Exports[i] != e {
+			t.Errorf("export %d: got %+v, expected %+v", i, h.sourceMap.Exports[i], e)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package host
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/beevik/cmd"
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// Keyboard returns the emulated keyboard device, so that front ends such as
+// the dashboard can feed it key events.
+func (h *Host) Keyboard() *cpu.Keyboard {
+	return h.keyboard
+}
+
+// typeKeys delivers keys typed on the console to the emulated keyboard.
+// Ctrl-C is not delivered; it breaks into the debugger as usual, once the
+// CPU's next step checks for it.
+func (h *Host) typeKeys(b []byte) {
+	const CtrlC = 3
+	for _, c := range b {
+		if c == CtrlC {
+			h.breakKey.Store(true)
+			continue
+		}
+		h.keyboard.Push(c)
+	}
+}
+
+func (h *Host) cmdKeys(c *cmd.Command, args []string) error {
+	if len(args) < 1 {
+		c.DisplayUsage(h)
+		return nil
+	}
+
+	text := strings.Join(args, " ")
+	if s, err := strconv.Unquote(`"` + text + `"`); err == nil {
+		text = s
+	}
+
+	h.keyboard.Push([]byte(text)...)
+	fmt.Fprintf(h, "%d key(s) queued, %d waiting.\n", len(text), h.keyboard.Len())
+	return nil
+}
+
+// A keyReader sits between the console and the raw terminal. Input is read
+// by a background goroutine. While the CPU is running, keystrokes go to the
+// emulated keyboard; otherwise they are handed to the terminal's line
+// editor.
+type keyReader struct {
+	h    *Host
+	r    io.Reader
+	once sync.Once
+	ch   chan keyInput
+	buf  []byte
+	err  error
+}
+
+type keyInput struct {
+	b   []byte
+	err error
+}
+
+func newKeyReader(h *Host, r io.Reader) *keyReader {
+	return &keyReader{h: h, r: r, ch: make(chan keyInput, 16)}
+}
+
+// Read returns console input that was typed while the CPU was stopped.
+func (k *keyReader) Read(p []byte) (int, error) {
+	k.once.Do(func() { go k.pump() })
+
+	if len(k.buf) == 0 {
+		if k.err != nil {
+			return 0, k.err
+		}
+		in := <-k.ch
+		if in.err != nil {
+			k.err = in.err
+			return 0, in.err
+		}
+		k.buf = in.b
+	}
+
+	n := copy(p, k.buf)
+	k.buf = k.buf[n:]
+	return n, nil
+}
+
+func (k *keyReader) pump() {
+	var buf [64]byte
+	for {
+		n, err := k.r.Read(buf[:])
+		if n > 0 {
+			if k.h.running.Load() {
+				k.h.typeKeys(buf[:n])
+			} else {
+				k.ch <- keyInput{b: append([]byte(nil), buf[:n]...)}
+			}
+		}
+		if err != nil {
+			k.ch <- keyInput{err: err}
+			return
+		}
+	}
+}
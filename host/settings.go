@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"reflect"
 	"strings"
 
@@ -17,25 +18,33 @@ import (
 type settings struct {
 	HexMode         bool   `doc:"hexadecimal input mode"`
 	CompactMode     bool   `doc:"compact disassembly output"`
+	SymbolicDisasm  bool   `doc:"show labels in disassembly"`
 	MemDumpBytes    int    `doc:"default number of memory bytes to dump"`
 	DisasmLines     int    `doc:"default number of lines to disassemble"`
 	SourceLines     int    `doc:"default number of source lines to display"`
 	MaxStepLines    int    `doc:"max lines to disassemble when stepping"`
+	StepMacros      bool   `doc:"step through macro expansions by instruction"`
+	StepIncludes    bool   `doc:"step into subroutines in other source files"`
 	NextDisasmAddr  uint16 `doc:"address of next disassembly"`
 	NextSourceAddr  uint16 `doc:"address of next source line display"`
 	NextMemDumpAddr uint16 `doc:"address of next memory dump"`
+	AsmPath         string `doc:"directories searched for assembler includes"`
 }
 
 func newSettings() *settings {
 	return &settings{
 		HexMode:         false,
 		CompactMode:     false,
+		SymbolicDisasm:  true,
 		MemDumpBytes:    64,
 		DisasmLines:     10,
 		SourceLines:     10,
 		MaxStepLines:    20,
+		StepMacros:      false,
+		StepIncludes:    false,
 		NextDisasmAddr:  0,
 		NextMemDumpAddr: 0,
+		AsmPath:         os.Getenv("ASMPATH"),
 	}
 }
 
@@ -0,0 +1,180 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package host
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/beevik/cmd"
+)
+
+// How a source line step treats subroutine calls.
+type lineStep int
+
+const (
+	lineStepIn   lineStep = iota // enter subroutines that have source
+	lineStepOver                 // run subroutines to their return
+	lineStepOut                  // run until the current subroutine returns
+)
+
+func (h *Host) cmdNextIn(c *cmd.Command, args []string) error {
+	return h.stepLines(args, lineStepIn)
+}
+
+func (h *Host) cmdNextOver(c *cmd.Command, args []string) error {
+	return h.stepLines(args, lineStepOver)
+}
+
+func (h *Host) cmdNextOut(c *cmd.Command, args []string) error {
+	return h.stepLines(nil, lineStepOut)
+}
+
+// Step the CPU by a number of source lines, given by the first argument,
+// displaying the source line reached after each.
+func (h *Host) stepLines(args []string, how lineStep) error {
+	if len(h.sourceMap.Lines) == 0 {
+		fmt.Fprintln(h, "No source map is loaded.")
+		return nil
+	}
+
+	count := 1
+	if len(args) > 0 {
+		n, err := h.parseExpr(args[0])
+		if err == nil {
+			count = int(n)
+		}
+	}
+
+	if count == 0 {
+		h.displaySourceLine()
+	} else {
+		h.setState(stateRunning)
+		for i := count - 1; i >= 0 && h.state == stateRunning; i-- {
+			h.stepLine(how)
+			switch {
+			case h.cpu.Halted:
+				fmt.Fprintln(h, "CPU halted.")
+				i = 0
+			case i == h.settings.MaxStepLines:
+				fmt.Fprintln(h, "...")
+			case i < h.settings.MaxStepLines:
+				h.displaySourceLine()
+			}
+		}
+	}
+
+	h.setState(stateProcessingCommands)
+	h.settings.NextDisasmAddr = h.cpu.Reg.PC
+	return nil
+}
+
+// Step the CPU until the PC reaches the start of a different source line,
+// or of any line once the current subroutine has returned. Calls to code
+// without source, calls into other files unless the StepIncludes setting
+// is on, and interrupts are run until they return.
+func (h *Host) stepLine(how lineStep) {
+	cpu := h.cpu
+
+	// Stops are allowed at or below this call depth.
+	depth := len(h.calls.frames)
+	returned := how != lineStepOut
+
+	// A loop within the starting line doesn't end the step.
+	start, startDepth := h.lineContaining(cpu.Reg.PC), depth
+
+	for step := 0; h.state == stateRunning && !cpu.Halted; step++ {
+		inst := cpu.GetInstruction(cpu.Reg.PC)
+		h.step()
+		n := len(h.calls.frames)
+
+		switch {
+		case !returned:
+			if n < depth || (depth == 0 && (inst.Mnemonic == "RET" || inst.Mnemonic == "RTI")) {
+				returned, depth = true, n
+			}
+
+		case n == depth+1 && how == lineStepIn && h.entersSource(&h.calls.frames[depth]):
+			depth = n
+		}
+
+		if returned && n <= depth {
+			_, _, ok := h.lineStart(cpu.Reg.PC)
+			if ok && (how == lineStepOut || n != startDepth || int(cpu.Reg.PC) != start) {
+				return
+			}
+		}
+		h.breakCheck(step)
+	}
+}
+
+// Report whether a source line step should stop inside the frame just
+// entered.
+func (h *Host) entersSource(f *frame) bool {
+	if f.interrupt {
+		return false
+	}
+	file, _, ok := h.lineStart(f.target)
+	if !ok {
+		return false
+	}
+	if site, _, err := h.sourceMap.Find(int(f.site)); err == nil && site != file {
+		return h.settings.StepIncludes
+	}
+	return true
+}
+
+// Return the source file and line that start at an address. Unless the
+// StepMacros setting is on, only the first instruction of a macro
+// expansion starts its line, so that the whole expansion is one step.
+func (h *Host) lineStart(addr uint16) (filename string, line int, ok bool) {
+	lines := h.sourceMap.Lines
+	i := sort.Search(len(lines), func(i int) bool {
+		return lines[i].Address >= int(addr)
+	})
+	if i == len(lines) || lines[i].Address != int(addr) {
+		return "", 0, false
+	}
+	l := lines[i]
+	if !h.settings.StepMacros && i > 0 && lines[i-1].FileIndex == l.FileIndex && lines[i-1].Line == l.Line {
+		return "", 0, false
+	}
+	return h.sourceMap.Files[l.FileIndex], l.Line, true
+}
+
+// Return the address where the source line holding an address starts, as
+// lineStart decides where lines start, or -1 if it has no source line.
+func (h *Host) lineContaining(addr uint16) int {
+	lines := h.sourceMap.Lines
+	i := sort.Search(len(lines), func(i int) bool {
+		return lines[i].Address > int(addr)
+	}) - 1
+	for i > 0 && !h.settings.StepMacros && lines[i-1].FileIndex == lines[i].FileIndex && lines[i-1].Line == lines[i].Line {
+		i--
+	}
+	if i < 0 {
+		return -1
+	}
+	return lines[i].Address
+}
+
+// Display the source line at the PC, as the list command does, or else
+// the disassembled instruction.
+func (h *Host) displaySourceLine() {
+	pc := h.cpu.Reg.PC
+	fn, li, err := h.sourceMap.Find(int(pc))
+	if err != nil {
+		h.displayPC()
+		return
+	}
+	lines, err := h.getSourceLines(fn)
+	if err != nil || li < 1 || li > len(lines) {
+		h.displayPC()
+		return
+	}
+
+	var buf [3]byte
+	cn := h.cpu.NextAddr(pc) - pc
+	h.cpu.Mem.LoadBytes(pc, buf[:cn])
+	fmt.Fprintf(h, "%04X- %-8s\t%s\n", pc, codeString(buf[:cn]), lines[li-1])
+}
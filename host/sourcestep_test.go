@@ -0,0 +1,149 @@
+package host
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const stepMain = `	.org $1000
+	.macro COUNTDOWN
+@loop	DEC R0
+	LBRZ @done
+	LBR @loop
+@done	LDI R5, #5
+	.endm
+START	LDI R0, #3
+	CALL SUB
+	COUNTDOWN
+	LDI R1, #1
+	LDI R2, #2
+	HALT
+	.include lib.asm
+	.org $2000
+IRQ	LDI R4, #$01
+	STI R4, $FF00
+	RTI
+`
+
+const stepLib = `SUB	LDI R3, #3
+	RET
+`
+
+// Assemble and load the stepping program, with the PC at START.
+func loadStepProgram(t *testing.T) *Host {
+	dir := t.TempDir()
+	for name, src := range map[string]string{"main.asm": stepMain, "lib.asm": stepLib} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := New()
+	h.EnableProcessedMode(strings.NewReader(""), io.Discard)
+	h.ProcessGUICmd("assemble file " + filepath.Join(dir, "main.asm"))
+	h.ProcessGUICmd("load " + filepath.Join(dir, "main.bin"))
+	start, ok := h.sourceMap.LookupName("START")
+	if !ok {
+		t.Fatal("program not loaded")
+	}
+	h.cpu.SetPC(start)
+	h.cpu.Mem.StoreAddress(0xfffe, 0x2000)
+	return h
+}
+
+// Check that the PC is at the start of a source line.
+func expectLine(t *testing.T, h *Host, file string, line int) {
+	t.Helper()
+	f, l, err := h.sourceMap.Find(int(h.cpu.Reg.PC))
+	if err != nil || filepath.Base(f) != file || l != line {
+		t.Fatalf("PC $%04X is at %s:%d (%v), expected %s:%d", h.cpu.Reg.PC, filepath.Base(f), l, err, file, line)
+	}
+}
+
+func TestNextOver(t *testing.T) {
+	h := loadStepProgram(t)
+
+	h.stepLines(nil, lineStepOver)
+	expectLine(t, h, "main.asm", 9)
+	h.stepLines(nil, lineStepOver)
+	expectLine(t, h, "main.asm", 10)
+	if h.cpu.Reg.R[3] != 3 {
+		t.Errorf("SUB didn't run, R3=$%02X", h.cpu.Reg.R[3])
+	}
+
+	// The macro's loop goes back to the start of its line, which doesn't
+	// end the step.
+	h.stepLines(nil, lineStepOver)
+	expectLine(t, h, "main.asm", 11)
+	if h.cpu.Reg.R[0] != 0 {
+		t.Errorf("loop didn't finish, R0=$%02X", h.cpu.Reg.R[0])
+	}
+
+	h.stepLines([]string{"2"}, lineStepOver)
+	expectLine(t, h, "main.asm", 13)
+}
+
+func TestNextMacros(t *testing.T) {
+	h := loadStepProgram(t)
+	h.settings.StepMacros = true
+	h.stepLines([]string{"2"}, lineStepOver)
+	expectLine(t, h, "main.asm", 10)
+
+	// Each instruction of the expansion is a stop, though all of them
+	// belong to the invoking line.
+	pc := h.cpu.Reg.PC
+	h.stepLines(nil, lineStepOver)
+	expectLine(t, h, "main.asm", 10)
+	if h.cpu.Reg.PC != pc+1 {
+		t.Errorf("PC $%04X, expected $%04X", h.cpu.Reg.PC, pc+1)
+	}
+}
+
+func TestNextIn(t *testing.T) {
+	// SUB is in an included file, so it is run through.
+	h := loadStepProgram(t)
+	h.stepLines([]string{"2"}, lineStepIn)
+	expectLine(t, h, "main.asm", 10)
+
+	h = loadStepProgram(t)
+	h.settings.StepIncludes = true
+	h.stepLines([]string{"2"}, lineStepIn)
+	expectLine(t, h, "lib.asm", 1)
+	h.stepLines(nil, lineStepIn)
+	expectLine(t, h, "lib.asm", 2)
+}
+
+func TestNextOut(t *testing.T) {
+	h := loadStepProgram(t)
+	h.settings.StepIncludes = true
+	h.stepLines([]string{"2"}, lineStepIn)
+	expectLine(t, h, "lib.asm", 1)
+
+	h.stepLines(nil, lineStepOut)
+	expectLine(t, h, "main.asm", 10)
+	if len(h.calls.frames) != 0 {
+		t.Errorf("%d frames left after returning", len(h.calls.frames))
+	}
+}
+
+func TestNextInterrupt(t *testing.T) {
+	h := loadStepProgram(t)
+	h.stepLines([]string{"3"}, lineStepOver)
+	expectLine(t, h, "main.asm", 11)
+
+	// The interrupt is taken at the start of the step, and its handler is
+	// run through.
+	h.cpu.Mem.StoreByte(0xff00, 0x80)
+	h.cpu.Reg.InterruptDisable = false
+	h.keyboard.Push('A')
+	h.stepLines(nil, lineStepIn)
+	expectLine(t, h, "main.asm", 12)
+	if h.cpu.Reg.R[4] != 1 || h.cpu.Reg.R[1] != 1 {
+		t.Errorf("R4=$%02X R1=$%02X, expected the handler and line 11 to run", h.cpu.Reg.R[4], h.cpu.Reg.R[1])
+	}
+	if len(h.calls.frames) != 0 {
+		t.Errorf("%d frames left after the interrupt", len(h.calls.frames))
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package host
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/beevik/cmd"
+	"riddick.net/cpu1-simulator/asm"
+)
+
+// Editors often write a file in several steps, so a reload waits for
+// changes to settle.
+const watchDelay = 200 * time.Millisecond
+
+// A watch reassembles and reloads a source file whenever it or a file it
+// includes changes.
+type watch struct {
+	path     string // the source file
+	start    bool   // set the PC to START, or the origin, after each reload
+	options  asm.Option
+	settings []asm.Setting
+	watcher  fileWatcher
+	dirs     map[string]bool // directories being watched
+
+	// The watcher reports changes on its own goroutine, while reloads
+	// replace the files being watched.
+	mu    sync.Mutex
+	files map[string]bool // absolute paths of the source and its includes
+	timer *time.Timer     // delays the reload after a change
+}
+
+// A fileWatcher reports changes to the files in a set of directories.
+type fileWatcher interface {
+	Add(dir string) error
+	Close() error
+}
+
+// SetReloadHandler sets a function called each time a watched source file
+// is reassembled and reloaded.
+func (h *Host) SetReloadHandler(fn func(filename string)) {
+	h.onReload = fn
+}
+
+func (h *Host) cmdWatch(c *cmd.Command, args []string) error {
+	if len(args) < 1 {
+		if h.watch == nil {
+			fmt.Fprintln(h, "Not watching any source file.")
+		} else {
+			h.watch.mu.Lock()
+			n := len(h.watch.files)
+			h.watch.mu.Unlock()
+			fmt.Fprintf(h, "Watching '%s' and %d included file(s).\n", filepath.Base(h.watch.path), n-1)
+		}
+		return nil
+	}
+
+	if args[0] == "off" {
+		if h.watch == nil {
+			fmt.Fprintln(h, "Not watching any source file.")
+			return nil
+		}
+		fmt.Fprintf(h, "Stopped watching '%s'.\n", filepath.Base(h.watch.path))
+		h.stopWatch()
+		return nil
+	}
+
+	path := args[0]
+	if filepath.Ext(path) == "" {
+		path += ".asm"
+	}
+
+	start := false
+	var rest []string
+	for _, arg := range args[1:] {
+		if arg == "start" {
+			start = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	options, settings, ok := h.parseAssembleArgs(c, rest)
+	if !ok {
+		return nil
+	}
+	if options&asm.Relocatable != 0 {
+		fmt.Fprintln(h, "Object files can't be loaded; link them first.")
+		return nil
+	}
+
+	h.stopWatch()
+	w := &watch{
+		path:     path,
+		start:    start,
+		options:  options,
+		settings: settings,
+		files:    make(map[string]bool),
+		dirs:     make(map[string]bool),
+	}
+	watcher, err := h.startWatcher(w)
+	if err != nil {
+		fmt.Fprintf(h, "Unable to watch files (%v).\n", err)
+		return nil
+	}
+	w.watcher = watcher
+	h.watch = w
+
+	h.reload(w)
+	fmt.Fprintf(h, "Watching '%s'. Type 'watch off' to stop.\n", filepath.Base(path))
+	return nil
+}
+
+// Stop watching the current source file.
+func (h *Host) stopWatch() {
+	if h.watch != nil {
+		h.watch.watcher.Close()
+		h.watch = nil
+	}
+}
+
+// Note a change to a file in a watched directory. A reload waits for any
+// command in progress, such as a run, to finish.
+func (h *Host) fileChanged(w *watch, name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.files[absPath(name)] {
+		return
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timer = time.AfterFunc(watchDelay, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.watch == w {
+			h.reload(w)
+		}
+	})
+}
+
+// Reassemble and reload a watched source file. Breakpoints in the old code
+// move to the same source lines in the new code.
+func (h *Host) reload(w *watch) {
+	// Note the source line of each breakpoint before the code moves.
+	type mark struct {
+		addr     uint16
+		disabled bool
+		file     string
+		line     int
+	}
+	var marks []mark
+	for _, b := range h.debugger.GetBreakpoints() {
+		if file, line, err := h.sourceMap.Find(int(b.Address)); err == nil {
+			marks = append(marks, mark{b.Address, b.Disabled, file, line})
+		}
+	}
+
+	assembly, err := asm.BuildFile(w.path, w.options, h, w.settings...)
+	var includes []string
+	if assembly != nil {
+		includes = assembly.Includes
+	}
+	w.update(h, includes)
+	if err != nil {
+		fmt.Fprintf(h, "Failed to assemble (%v).\n", err)
+		return
+	}
+
+	ext := filepath.Ext(w.path)
+	origin, err := h.load(w.path[:len(w.path)-len(ext)]+".bin", -1)
+	if err != nil {
+		fmt.Fprintf(h, "%v\n", err)
+		return
+	}
+
+	for _, m := range marks {
+		h.debugger.RemoveBreakpoint(m.addr)
+	}
+	for _, m := range marks {
+		addr, err := h.sourceMap.FindAddress(m.file, m.line)
+		if err != nil {
+			fmt.Fprintf(h, "Breakpoint at $%04X removed: %v.\n", m.addr, err)
+			continue
+		}
+		b := h.debugger.AddBreakpoint(uint16(addr))
+		b.Disabled = m.disabled
+		if uint16(addr) != m.addr {
+			fmt.Fprintf(h, "Breakpoint at $%04X moved to $%04X.\n", m.addr, addr)
+		}
+	}
+
+	if w.start {
+		pc := int64(origin)
+		if addr, err := h.resolveIdentifier("START"); err == nil {
+			pc = addr
+		}
+		h.cpu.SetPC(uint16(pc))
+		h.settings.NextDisasmAddr = uint16(pc)
+	}
+
+	fmt.Fprintf(h, "Reloaded '%s' at %s.\n", filepath.Base(w.path), time.Now().Format("15:04:05"))
+	if h.onReload != nil {
+		h.onReload(w.path)
+	}
+}
+
+// Watch the source file and the files it includes. Directories are
+// watched rather than files, since many editors save by replacing a file.
+func (w *watch) update(h *Host, includes []string) {
+	files := make(map[string]bool)
+	for _, f := range append([]string{w.path}, includes...) {
+		abs := absPath(f)
+		files[abs] = true
+		dir := filepath.Dir(abs)
+		if w.dirs[dir] {
+			continue
+		}
+		if err := w.watcher.Add(dir); err != nil {
+			fmt.Fprintf(h, "Unable to watch '%s' (%v).\n", dir, err)
+			continue
+		}
+		w.dirs[dir] = true
+	}
+
+	w.mu.Lock()
+	w.files = files
+	w.mu.Unlock()
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+//go:build !js
+
+package host
+
+import (
+	"fmt"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Start watching for changes to files, passing each one to fileChanged
+// until the watcher is closed.
+func (h *Host) startWatcher(w *watch) (fileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					h.fileChanged(w, ev.Name)
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(h, "Watch error: %v\n", err)
+			}
+		}
+	}()
+	return watcher, nil
+}
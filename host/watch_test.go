@@ -0,0 +1,75 @@
+package host
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A nullWatcher accepts directories without watching them, so tests can
+// drive reloads themselves.
+type nullWatcher struct{}
+
+func (nullWatcher) Add(dir string) error { return nil }
+func (nullWatcher) Close() error         { return nil }
+
+func newWatch(t *testing.T, src string) (*Host, *watch) {
+	path := filepath.Join(t.TempDir(), "prog.asm")
+	if err := os.WriteFile(path, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	h := New()
+	h.EnableProcessedMode(strings.NewReader(""), io.Discard)
+	w := &watch{path: path, watcher: nullWatcher{}, dirs: make(map[string]bool)}
+	h.watch = w
+	h.reload(w)
+	return h, w
+}
+
+func TestReloadBreakpoints(t *testing.T) {
+	h, w := newWatch(t, "\t.org $1000\nSTART\tNOP\n\tNOP\nLOOP\tNOP\n\tLBR LOOP\n\tHALT\n")
+	h.debugger.AddBreakpoint(0x1002)
+	h.debugger.AddBreakpoint(0x1003).Disabled = true
+	h.debugger.AddBreakpoint(0x1006)
+
+	// Growing line 2 by a byte moves the code of every later line. Line 6
+	// is removed along with its HALT.
+	src := "\t.org $1000\nSTART\tLDI R0, #1\n\tNOP\nLOOP\tNOP\n\tLBR LOOP\n"
+	if err := os.WriteFile(w.path, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	h.reload(w)
+
+	bps := h.debugger.GetBreakpoints()
+	if len(bps) != 2 {
+		t.Fatalf("got %d breakpoints, expected 2", len(bps))
+	}
+	if b := h.debugger.GetBreakpoint(0x1003); b == nil || b.Disabled {
+		t.Errorf("breakpoint on line 4 not moved to $1003: %+v", b)
+	}
+	if b := h.debugger.GetBreakpoint(0x1004); b == nil || !b.Disabled {
+		t.Errorf("disabled breakpoint on line 5 not moved to $1004: %+v", b)
+	}
+}
+
+func TestWatchFilesRace(t *testing.T) {
+	h, w := newWatch(t, "\t.org $1000\n\tHALT\n")
+
+	// Events for other files may arrive while a reload replaces the
+	// watched files. Run with -race to check them.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			h.fileChanged(w, filepath.Join(filepath.Dir(w.path), "prog.bin"))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		w.update(h, nil)
+	}
+	wg.Wait()
+}
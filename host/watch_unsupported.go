@@ -0,0 +1,11 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+//go:build js
+
+package host
+
+import "errors"
+
+func (h *Host) startWatcher(w *watch) (fileWatcher, error) {
+	return nil, errors.New("file watching is not supported on this platform")
+}
@@ -0,0 +1,410 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+// Package link combines relocatable object files produced by the assembler
+// into a single program. Each object's sections are placed in memory
+// according to a layout, global symbols are matched with the externs that
+// use them, and relocations are applied to the code.
+package link
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"riddick.net/cpu1-simulator/asm"
+)
+
+// defaultText is the address of the .text section when the layout doesn't
+// give one. It matches the assembler's default origin.
+const defaultText = 0x1000
+
+// A Layout describes where the sections of a linked program are placed in
+// memory. The sections of all objects are gathered together, so the .text
+// sections of every object follow each other, then the .data sections, and
+// so on.
+type Layout struct {
+	Address []int  // address of each section, or -1 to follow the previous section
+	Entry   string // entry point symbol, or "" for the start of .text
+}
+
+// DefaultLayout returns a layout placing .text at $1000, with .data and
+// .bss following it.
+func DefaultLayout() *Layout {
+	l := &Layout{Address: make([]int, len(asm.SectionNames))}
+	for i := range l.Address {
+		l.Address[i] = -1
+	}
+	l.Address[asm.SectionText] = defaultText
+	return l
+}
+
+// ParseLayout reads a layout description. Each line holds a section name
+// followed by its address, or "entry" followed by a symbol name. Addresses
+// may be decimal or hexadecimal with a '$' or '0x' prefix. Text following
+// a '#' or ';' is a comment. For example:
+//
+//	text  $0200
+//	data  $0800
+//	bss   $0900
+//	entry START
+func ParseLayout(r io.Reader) (*Layout, error) {
+	l := DefaultLayout()
+
+	scanner := bufio.NewScanner(r)
+	for row := 1; scanner.Scan(); row++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("layout line %d: expected a name and a value", row)
+		}
+
+		name := strings.ToLower(fields[0])
+		if name == "entry" {
+			l.Entry = fields[1]
+			continue
+		}
+		sec := sectionIndex(name)
+		if sec < 0 {
+			return nil, fmt.Errorf("layout line %d: unknown section '%s'", row, fields[0])
+		}
+		addr, err := parseAddress(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("layout line %d: %v", row, err)
+		}
+		l.Address[sec] = addr
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ReadLayout reads a layout description from a file.
+func ReadLayout(path string) (*Layout, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseLayout(f)
+}
+
+// Return the index of a section name, given with or without its leading
+// '.', or -1 if there is no such section.
+func sectionIndex(name string) int {
+	for i, s := range asm.SectionNames {
+		if name == s || "."+name == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func parseAddress(s string) (int, error) {
+	v, base := s, 10
+	switch {
+	case strings.HasPrefix(s, "$"):
+		v, base = s[1:], 16
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		v, base = s[2:], 16
+	}
+	n, err := strconv.ParseUint(v, base, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address '%s'", s)
+	}
+	return int(n), nil
+}
+
+// Errors is a list of problems found while linking, such as undefined or
+// duplicate symbols.
+type Errors []string
+
+func (e Errors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// A symbol is a global symbol and the object that defines it.
+type symbol struct {
+	addr int
+	obj  int
+}
+
+// Link combines objects into a program placed according to a layout. The
+// names identify each object in error messages. It returns the linked
+// program and its source map, whose exports hold the global symbols. If
+// anything fails to link, the error is an Errors list.
+func Link(objs []*asm.Object, names []string, layout *Layout) (*asm.Assembly, *asm.SourceMap, error) {
+	if layout == nil {
+		layout = DefaultLayout()
+	}
+	var errs Errors
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	// Place each object's sections. bases[i][s] is the address of
+	// section s of object i.
+	bases := make([][]int, len(objs))
+	for i := range bases {
+		bases[i] = make([]int, len(asm.SectionNames))
+	}
+	starts := make([]int, len(asm.SectionNames))
+	ends := make([]int, len(asm.SectionNames))
+	addr := defaultText
+	for s := range asm.SectionNames {
+		if s < len(layout.Address) && layout.Address[s] >= 0 {
+			addr = layout.Address[s]
+		}
+		starts[s] = addr
+		for i, o := range objs {
+			if s >= len(o.Sections) {
+				continue
+			}
+			bases[i][s] = addr
+			addr += o.Sections[s].Size
+		}
+		ends[s] = addr
+		if addr > 0x10000 {
+			fail("section %s at $%04X extends beyond $FFFF", asm.SectionNames[s], starts[s])
+		}
+	}
+	for s := range asm.SectionNames {
+		for t := s + 1; t < len(asm.SectionNames); t++ {
+			if starts[s] < ends[t] && starts[t] < ends[s] {
+				fail("section %s overlaps section %s", asm.SectionNames[s], asm.SectionNames[t])
+			}
+		}
+	}
+
+	// Gather the global symbols.
+	symbols := make(map[string]symbol)
+	for i, o := range objs {
+		for _, sym := range o.Symbols {
+			v := int(sym.Value)
+			if sym.Section != asm.SectionAbsolute {
+				v += bases[i][sym.Section]
+			}
+			if prev, ok := symbols[sym.Name]; ok {
+				fail("symbol '%s' is defined in both '%s' and '%s'", sym.Name, names[prev.obj], names[i])
+				continue
+			}
+			symbols[sym.Name] = symbol{addr: v, obj: i}
+		}
+	}
+
+	// Copy the section contents and apply the relocations.
+	undefined := make(map[string]bool)
+	data := make([][][]byte, len(objs))
+	for i, o := range objs {
+		data[i] = make([][]byte, len(o.Sections))
+		for s, sec := range o.Sections {
+			data[i][s] = append([]byte(nil), sec.Data...)
+		}
+
+		for _, r := range o.Relocations {
+			var target int
+			switch {
+			case r.Extern && r.Target < len(o.Externs):
+				name := o.Externs[r.Target]
+				sym, ok := symbols[name]
+				if !ok {
+					if !undefined[names[i]+"\x00"+name] {
+						undefined[names[i]+"\x00"+name] = true
+						fail("undefined symbol '%s' used in '%s'", name, names[i])
+					}
+					continue
+				}
+				target = sym.addr
+			case !r.Extern && r.Target < len(o.Sections):
+				target = bases[i][r.Target]
+			default:
+				fail("invalid relocation target in '%s'", names[i])
+				continue
+			}
+			if r.Section >= len(data[i]) || int(r.Offset)+2 > len(data[i][r.Section]) {
+				fail("invalid relocation offset in '%s'", names[i])
+				continue
+			}
+			v := uint16(target + int(r.Addend))
+			b := data[i][r.Section][r.Offset:]
+			b[0], b[1] = byte(v), byte(v>>8)
+		}
+	}
+
+	entry := starts[asm.SectionText]
+	if layout.Entry != "" {
+		sym, ok := symbols[layout.Entry]
+		if !ok {
+			fail("entry symbol '%s' is not defined", layout.Entry)
+		}
+		entry = sym.addr
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, errs
+	}
+
+	// The .text and .data sections each become one block of code. The
+	// .bss section takes no space in the program.
+	flags := []byte{asm.SegmentRAM | asm.SegmentExec, asm.SegmentRAM}
+	var blocks []asm.Block
+	for s := range flags {
+		var b []byte
+		for i := range objs {
+			if s < len(data[i]) {
+				b = append(b, data[i][s]...)
+			}
+		}
+		if len(b) > 0 {
+			blocks = append(blocks, asm.Block{Address: uint16(starts[s]), Flags: flags[s], Data: b})
+		}
+	}
+
+	exe := &asm.Executable{Entry: uint16(entry), Segments: blocks}
+	origin, code := exe.Flatten()
+	if code == nil {
+		origin = uint16(starts[asm.SectionText])
+	}
+	assembly := &asm.Assembly{Origin: origin, Code: code, Blocks: blocks, Entry: uint16(entry)}
+
+	// Merge the objects' source lines, renumbering their files.
+	sourceMap := asm.NewSourceMap()
+	sourceMap.Origin = origin
+	sourceMap.Size = uint32(len(code))
+	sourceMap.CRC = crc32.ChecksumIEEE(code)
+	for i, o := range objs {
+		fileBase := len(sourceMap.Files)
+		sourceMap.Files = append(sourceMap.Files, o.Files...)
+		for _, l := range o.Lines {
+			if l.Section < 0 || l.Section >= len(asm.SectionNames) {
+				continue
+			}
+			sourceMap.Lines = append(sourceMap.Lines, asm.SourceLine{
+				Address:   bases[i][l.Section] + int(l.Offset),
+				FileIndex: fileBase + l.FileIndex,
+				Line:      l.Line,
+			})
+		}
+	}
+	sort.SliceStable(sourceMap.Lines, func(i, j int) bool {
+		return sourceMap.Lines[i].Address < sourceMap.Lines[j].Address
+	})
+
+	for i, o := range objs {
+		for _, sym := range o.Symbols {
+			if sym.Section != asm.SectionAbsolute {
+				sourceMap.Exports = append(sourceMap.Exports, asm.Export{
+					Label:   sym.Name,
+					Address: uint16(bases[i][sym.Section] + int(sym.Value)),
+				})
+			}
+		}
+	}
+	sort.SliceStable(sourceMap.Exports, func(i, j int) bool {
+		return sourceMap.Exports[i].Address < sourceMap.Exports[j].Address
+	})
+
+	return assembly, sourceMap, nil
+}
+
+// ReadObject reads a relocatable object file.
+func ReadObject(path string) (*asm.Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	obj := &asm.Object{}
+	if _, err := obj.ReadFrom(bufio.NewReader(f)); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return obj, nil
+}
+
+// LinkFiles links object files into the output file, using the layout file
+// if one is given. If the output has a ".cx1" extension, it is written as
+// a CPU1 executable; otherwise it is written as a raw binary. A source map
+// is written next to the output with a ".map" extension.
+func LinkFiles(output string, objFiles []string, layoutFile string, out io.Writer) error {
+	if len(objFiles) == 0 {
+		return errors.New("no object files to link")
+	}
+
+	layout := DefaultLayout()
+	if layoutFile != "" {
+		var err error
+		if layout, err = ReadLayout(layoutFile); err != nil {
+			return err
+		}
+	}
+
+	objs := make([]*asm.Object, len(objFiles))
+	names := make([]string, len(objFiles))
+	for i, path := range objFiles {
+		obj, err := ReadObject(path)
+		if err != nil {
+			return err
+		}
+		objs[i], names[i] = obj, filepath.Base(path)
+	}
+
+	assembly, sourceMap, err := Link(objs, names, layout)
+	if err != nil {
+		var errs Errors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				fmt.Fprintln(out, e)
+			}
+			return errors.New("link error")
+		}
+		return err
+	}
+
+	ext := filepath.Ext(output)
+	if ext == "" {
+		output += ".bin"
+		ext = ".bin"
+	}
+	mapPath := output[:len(output)-len(ext)] + ".map"
+
+	var w io.WriterTo = assembly
+	if strings.ToLower(ext) == ".cx1" {
+		w = assembly.Executable(sourceMap.Exports)
+	}
+	if err := writeFile(output, w); err != nil {
+		return err
+	}
+	if err := writeFile(mapPath, sourceMap); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Linked %d object(s) to produce '%s' and '%s'.\n",
+		len(objs), filepath.Base(output), filepath.Base(mapPath))
+	return nil
+}
+
+func writeFile(path string, w io.WriterTo) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
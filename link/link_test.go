@@ -0,0 +1,285 @@
+package link_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"riddick.net/cpu1-simulator/asm"
+	"riddick.net/cpu1-simulator/link"
+)
+
+// The main module calls PRINT in the library and keeps a table in .data
+// that refers to both modules.
+const mainSource = `
+	.global START
+	.extern PRINT
+START	CALL PRINT
+	LBR START
+	.data
+TBL	.dw TBL+1, PRINT`
+
+// The library stores R0 in a counter that lives in its .bss section.
+const libSource = `
+	.global PRINT, COUNT
+PRINT	STI R0, COUNT
+	RET
+	.bss
+COUNT	.pad 0, 2`
+
+const layoutSource = `
+# ROM layout
+text  $0200
+.data $800   ; sections may be named with a leading dot
+bss   0x0900
+entry START
+`
+
+func assembleObject(t *testing.T, name, src string) *asm.Object {
+	assembly, _, err := asm.Assemble(strings.NewReader(src), name, 0x1000, io.Discard, asm.Relocatable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assembly.Object
+}
+
+func parseLayout(t *testing.T, src string) *link.Layout {
+	l, err := link.ParseLayout(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestParseLayout(t *testing.T) {
+	l := link.DefaultLayout()
+	if len(l.Address) != len(asm.SectionNames) || l.Address[asm.SectionText] != 0x1000 ||
+		l.Address[asm.SectionData] != -1 || l.Address[asm.SectionBSS] != -1 || l.Entry != "" {
+		t.Errorf("default layout incorrect: %+v", l)
+	}
+
+	l = parseLayout(t, layoutSource)
+	if l.Address[asm.SectionText] != 0x0200 || l.Address[asm.SectionData] != 0x0800 ||
+		l.Address[asm.SectionBSS] != 0x0900 || l.Entry != "START" {
+		t.Errorf("layout incorrect: %+v", l)
+	}
+
+	// Sections left out follow the previous one.
+	l = parseLayout(t, "data $2000\n")
+	if l.Address[asm.SectionText] != 0x1000 || l.Address[asm.SectionData] != 0x2000 || l.Address[asm.SectionBSS] != -1 {
+		t.Errorf("partial layout incorrect: %+v", l)
+	}
+
+	errs := []struct {
+		src, err string
+	}{
+		{"text\n", "layout line 1: expected a name and a value"},
+		{"\ntext $0200 $0300\n", "layout line 2: expected a name and a value"},
+		{"rodata $0200\n", "layout line 1: unknown section 'rodata'"},
+		{"text $10000\n", "layout line 1: invalid address '$10000'"},
+		{"text START\n", "layout line 1: invalid address 'START'"},
+	}
+	for _, e := range errs {
+		_, err := link.ParseLayout(strings.NewReader(e.src))
+		if err == nil || err.Error() != e.err {
+			t.Errorf("%q: got error %v, expected %q", e.src, err, e.err)
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	objs := []*asm.Object{assembleObject(t, "main.asm", mainSource), assembleObject(t, "lib.asm", libSource)}
+	assembly, sourceMap, err := link.Link(objs, []string{"main.obj", "lib.obj"}, parseLayout(t, layoutSource))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assembly.Entry != 0x0200 {
+		t.Errorf("entry $%04X, expected $0200", assembly.Entry)
+	}
+
+	// Each object's sections follow the same section of the objects
+	// before it, and every relocated address points into the placed
+	// sections.
+	blocks := []asm.Block{
+		{Address: 0x0200, Flags: asm.SegmentRAM | asm.SegmentExec, Data: []byte{
+			0x02, 0x06, 0x02, // CALL PRINT
+			0x18, 0x00, 0x02, // LBR START
+			0xe8, 0x00, 0x09, // STI R0, COUNT
+			0x03, // RET
+		}},
+		{Address: 0x0800, Flags: asm.SegmentRAM, Data: []byte{
+			0x01, 0x08, // TBL+1
+			0x06, 0x02, // PRINT
+		}},
+	}
+	if len(assembly.Blocks) != len(blocks) {
+		t.Fatalf("got %d blocks, expected %d", len(assembly.Blocks), len(blocks))
+	}
+	for i, b := range blocks {
+		got := assembly.Blocks[i]
+		if got.Address != b.Address || got.Flags != b.Flags || !bytes.Equal(got.Data, b.Data) {
+			t.Errorf("block %d: got $%04X %02X % X, expected $%04X %02X % X",
+				i, got.Address, got.Flags, got.Data, b.Address, b.Flags, b.Data)
+		}
+	}
+	if assembly.Origin != 0x0200 || len(assembly.Code) != 0x0604 {
+		t.Errorf("code at $%04X is %d bytes, expected $0200 and %d", assembly.Origin, len(assembly.Code), 0x0604)
+	}
+
+	exports := []asm.Export{{Label: "START", Address: 0x0200}, {Label: "PRINT", Address: 0x0206}, {Label: "COUNT", Address: 0x0900}}
+	if len(sourceMap.Exports) != len(exports) {
+		t.Fatalf("exports incorrect: %+v", sourceMap.Exports)
+	}
+	for i, e := range exports {
+		if sourceMap.Exports[i] != e {
+			t.Errorf("export %d: got %+v, expected %+v", i, sourceMap.Exports[i], e)
+		}
+	}
+
+	file, line, err := sourceMap.Find(0x0206)
+	if err != nil || file != "lib.asm" || line != 3 {
+		t.Errorf("$0206 maps to %s:%d (%v), expected lib.asm:3", file, line, err)
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	main := assembleObject(t, "main.asm", mainSource)
+	lib := assembleObject(t, "lib.asm", libSource)
+
+	tests := []struct {
+		objs   []*asm.Object
+		names  []string
+		layout string
+		errs   []string
+	}{
+		{
+			[]*asm.Object{main}, []string{"main.obj"}, "",
+			[]string{"undefined symbol 'PRINT' used in 'main.obj'"},
+		},
+		{
+			[]*asm.Object{main, lib, lib}, []string{"main.obj", "a.obj", "b.obj"}, "",
+			[]string{
+				"symbol 'PRINT' is defined in both 'a.obj' and 'b.obj'",
+				"symbol 'COUNT' is defined in both 'a.obj' and 'b.obj'",
+			},
+		},
+		{
+			[]*asm.Object{main, lib}, []string{"main.obj", "lib.obj"}, "entry MISSING",
+			[]string{"entry symbol 'MISSING' is not defined"},
+		},
+		{
+			[]*asm.Object{main, lib}, []string{"main.obj", "lib.obj"}, "text $0200\ndata $0204",
+			[]string{
+				"section .text overlaps section .data",
+				"section .text overlaps section .bss",
+			},
+		},
+		{
+			[]*asm.Object{main, lib}, []string{"main.obj", "lib.obj"}, "text $FFFC",
+			[]string{
+				"section .text at $FFFC extends beyond $FFFF",
+				"section .data at $10006 extends beyond $FFFF",
+				"section .bss at $1000A extends beyond $FFFF",
+			},
+		},
+	}
+	for _, tt := range tests {
+		_, _, err := link.Link(tt.objs, tt.names, parseLayout(t, tt.layout))
+		var errs link.Errors
+		if !errors.As(err, &errs) {
+			t.Errorf("%v: got %v, expected link errors", tt.names, err)
+			continue
+		}
+		if strings.Join(errs, "\n") != strings.Join(tt.errs, "\n") {
+			t.Errorf("%v: got errors\n%s\nexpected\n%s", tt.names, errs, strings.Join(tt.errs, "\n"))
+		}
+	}
+}
+
+func TestLinkFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, w io.WriterTo) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.WriteTo(f); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	objFiles := []string{
+		write("main.obj", assembleObject(t, "main.asm", mainSource)),
+		write("lib.obj", assembleObject(t, "lib.asm", libSource)),
+	}
+	layoutFile := filepath.Join(dir, "rom.ld")
+	if err := os.WriteFile(layoutFile, []byte(layoutSource), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := link.LinkFiles(filepath.Join(dir, "rom.cx1"), objFiles, layoutFile, &out); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	if out.String() != "Linked 2 object(s) to produce 'rom.cx1' and 'rom.map'.\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	f, err := os.Open(filepath.Join(dir, "rom.cx1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe := &asm.Executable{}
+	_, err = exe.ReadFrom(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe.Entry != 0x0200 || len(exe.Segments) != 2 || exe.Segments[0].Address != 0x0200 ||
+		exe.Segments[1].Address != 0x0800 || len(exe.Symbols) != 3 {
+		t.Errorf("executable incorrect: entry $%04X, %d segments, %d symbols", exe.Entry, len(exe.Segments), len(exe.Symbols))
+	}
+
+	f, err = os.Open(filepath.Join(dir, "rom.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourceMap := asm.NewSourceMap()
+	_, err = sourceMap.ReadFrom(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := sourceMap.LookupName("PRINT"); !ok || addr != 0x0206 {
+		t.Errorf("map has PRINT at $%04X (%v), expected $0206", addr, ok)
+	}
+
+	// Without an extension, the program is written as a raw binary.
+	out.Reset()
+	if err := link.LinkFiles(filepath.Join(dir, "rom"), objFiles, layoutFile, &out); err != nil {
+		t.Fatal(err)
+	}
+	code, err := os.ReadFile(filepath.Join(dir, "rom.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 0x0604 || code[0] != 0x02 || !bytes.Equal(code[0x0600:], []byte{0x01, 0x08, 0x06, 0x02}) {
+		t.Errorf("binary incorrect: %d bytes", len(code))
+	}
+
+	// Link errors are written to the output.
+	out.Reset()
+	err = link.LinkFiles(filepath.Join(dir, "bad.bin"), objFiles[:1], "", &out)
+	if err == nil || !strings.Contains(out.String(), "undefined symbol 'PRINT'") {
+		t.Errorf("got %v and output %q, expected a link error", err, out.String())
+	}
+}
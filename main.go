@@ -8,6 +8,7 @@ import (
 
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"riddick.net/cpu1-simulator/asm"
@@ -24,6 +25,16 @@ const (
 
 var (
 	assemble   string
+	defines    defineFlags
+	warnings   warningFlags
+	includes   includeFlags
+	deps       bool
+	diagFormat string
+	listing    bool
+	intelHex   bool
+	sRecord    bool
+	executable bool
+	object     bool
 	gui        bool
 	logFile    *os.File
 	err        error
@@ -34,26 +45,44 @@ var (
 )
 
 func init() {
-	logFile, err = os.OpenFile("CPU1.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatal("Failed to open log file:", err)
-	}
-	infoLogger.Println("***** host.settings.init()")
-
 	// Initialize the startup parameters to be parsed in command line
 	flag.StringVar(&assemble, "a", "", "assemble file")
+	flag.BoolVar(&listing, "l", false, "also write a listing (.lst) when assembling")
+	flag.BoolVar(&intelHex, "hex", false, "also write an Intel HEX file (.hex) when assembling")
+	flag.BoolVar(&sRecord, "srec", false, "also write a Motorola S-record file (.s19) when assembling")
+	flag.BoolVar(&executable, "cx1", false, "also write a CPU1 executable (.cx1) when assembling")
+	flag.BoolVar(&object, "c", false, "assemble to a relocatable object (.obj) for the linker")
+	flag.Var(&defines, "D", "define `NAME=value` when assembling (repeatable)")
+	flag.StringVar(&diagFormat, "diagnostics", "text", "report assembler errors and warnings as `text` or json")
+	flag.Var(&includes, "I", "search `dir` for included files when assembling (repeatable)")
+	flag.BoolVar(&deps, "M", false, "also write a Makefile dependency file (.d) when assembling")
+	flag.Var(&warnings, "W", "set warnings to on, off or error, or one with `[ID=]level` (repeatable)")
 	flag.BoolVar(&gui, "g", false, "Activate GUI")
 	flag.CommandLine.Usage = func() {
-		fmt.Println("Usage: go6502 [script] ..\nOptions:")
+		fmt.Println("Usage: go6502 [script] ..\n       go6502 run [options] prog.asm|prog.bin\n       go6502 test [options] prog.asm\n       go6502 link [options] a.obj b.obj ...\nOptions:")
 		flag.PrintDefaults()
 	}
 }
 
 func main() {
+	// The run, test and link subcommands work headless, without the
+	// log file, the host or the dashboard.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run":
+			os.Exit(runMain(os.Args[2:]))
+		case "test":
+			os.Exit(testMain(os.Args[2:]))
+		case "link":
+			os.Exit(linkMain(os.Args[2:]))
+		}
+	}
+
 	logFile, err = os.OpenFile("CPU1.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatal("Failed to open log file:", err)
 	}
+	infoLogger.SetOutput(logFile)
 
 	infoLogger.Println("***** Entered main()")
 
@@ -73,9 +102,47 @@ func main() {
 
 	// Initiate assembly from the command line if requested.
 	if assemble != "" {
-		err := asm.AssembleFile(assemble, 0, os.Stdout)
+		var options asm.Option
+		if listing {
+			options |= asm.Listing
+		}
+		if intelHex {
+			options |= asm.IntelHex
+		}
+		if sRecord {
+			options |= asm.SRecord
+		}
+		if executable {
+			options |= asm.WriteExecutable
+		}
+		if object {
+			options |= asm.Relocatable
+		}
+		if deps {
+			options |= asm.Dependencies
+		}
+		switch diagFormat {
+		case "text":
+		case "json":
+			options |= asm.DiagnosticsJSON
+		default:
+			exitOnError(fmt.Errorf("unknown diagnostics format '%s'", diagFormat))
+		}
+		var settings []asm.Setting
+		for _, d := range defines {
+			settings = append(settings, d)
+		}
+		for _, w := range warnings {
+			settings = append(settings, w)
+		}
+		for _, dir := range includes {
+			settings = append(settings, dir)
+		}
+		settings = append(settings, asm.SplitIncludePath(os.Getenv("ASMPATH"))...)
+		err := asm.AssembleFile(assemble, options, os.Stdout, settings...)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to assemble (%v).\n", err)
+			os.Exit(1)
 		}
 		os.Exit(0)
 	}
@@ -122,6 +189,65 @@ func main() {
 	h.RunCommands(true)
 }
 
+// defineFlags collects repeated -D arguments.
+type defineFlags []asm.Define
+
+func (d *defineFlags) String() string {
+	s := make([]string, len(*d))
+	for i, v := range *d {
+		s[i] = fmt.Sprintf("%s=%d", v.Name, v.Value)
+	}
+	return strings.Join(s, ",")
+}
+
+func (d *defineFlags) Set(v string) error {
+	def, err := asm.ParseDefine(v)
+	if err != nil {
+		return err
+	}
+	*d = append(*d, def)
+	return nil
+}
+
+// warningFlags collects repeated -W arguments.
+type warningFlags []asm.WarningFlag
+
+func (w *warningFlags) String() string {
+	s := make([]string, len(*w))
+	for i, v := range *w {
+		s[i] = v.Level.String()
+		if v.ID != "" {
+			s[i] = v.ID + "=" + s[i]
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (w *warningFlags) Set(v string) error {
+	wf, err := asm.ParseWarningFlag(v)
+	if err != nil {
+		return err
+	}
+	*w = append(*w, wf)
+	return nil
+}
+
+// includeFlags collects repeated -I arguments.
+type includeFlags []asm.IncludeDir
+
+func (d *includeFlags) String() string {
+	s := make([]string, len(*d))
+	for i, v := range *d {
+		s[i] = string(v)
+	}
+	return strings.Join(s, string(os.PathListSeparator))
+}
+
+func (d *includeFlags) Set(v string) error {
+	*d = append(*d, asm.IncludeDir(v))
+	return nil
+}
+
 func handleInterrupt(h *host.Host, c chan os.Signal) {
 	for {
 		<-c
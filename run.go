@@ -0,0 +1,198 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"riddick.net/cpu1-simulator/cpu"
+	"riddick.net/cpu1-simulator/link"
+	"riddick.net/cpu1-simulator/runner"
+)
+
+// memFlags collects repeated -mem arguments.
+type memFlags []runner.MemRange
+
+func (m *memFlags) String() string {
+	s := make([]string, len(*m))
+	for i, r := range *m {
+		s[i] = fmt.Sprintf("$%04X:%d", r.Address, r.Length)
+	}
+	return strings.Join(s, ",")
+}
+
+func (m *memFlags) Set(v string) error {
+	r, err := runner.ParseMemRange(v)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, r)
+	return nil
+}
+
+// runMain implements the "run" subcommand, which executes a program without
+// the interactive host or the dashboard and reports the final CPU state. It
+// returns the process exit code.
+func runMain(args []string) int {
+	// Batch runs must leave no trace on disk.
+	cpu.LogPath = ""
+
+	var config runner.Config
+	var mem memFlags
+	var dump string
+
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.StringVar(&config.Entry, "entry", "", "entry `address` or label (default: program entry)")
+	fs.Uint64Var(&config.MaxCycles, "max-cycles", 0, "stop after `N` cycles (0: no limit)")
+	fs.DurationVar(&config.Timeout, "timeout", 0, "stop after this `duration` (0: no limit)")
+	fs.StringVar(&dump, "dump", "text", "result `format`: text or json")
+	fs.Var(&mem, "mem", "report memory `addr:len` (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cpu1-simulator run [options] prog.asm|prog.bin\nOptions:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "Exit codes: 0 halt, 1 error, 2 max cycles, 3 timeout, 4 fault\n")
+	}
+
+	files, ok := parseArgs(fs, args)
+	if !ok {
+		return runner.ExitError
+	}
+	config.Memory = mem
+
+	write := (*runner.Result).WriteText
+	switch dump {
+	case "text":
+	case "json":
+		write = (*runner.Result).WriteJSON
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown dump format '%s'.\n", dump)
+		return runner.ExitError
+	}
+
+	var result *runner.Result
+	switch len(files) {
+	case 1:
+		p, err := runner.LoadProgram(files[0])
+		if err != nil {
+			result = runner.Error(err)
+		} else {
+			result = runner.Run(p, config)
+		}
+	default:
+		fs.Usage()
+		result = runner.Error(errors.New("run requires exactly one program file"))
+	}
+
+	write(result, os.Stdout)
+	return result.Code
+}
+
+// testMain implements the "test" subcommand, which runs the unit tests
+// declared with .test and .expect in an assembly source file. It returns
+// the process exit code.
+func testMain(args []string) int {
+	cpu.LogPath = ""
+
+	var config runner.Config
+	var junit string
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Uint64Var(&config.MaxCycles, "max-cycles", 0, "fail a test after `N` cycles (default 1000000)")
+	fs.DurationVar(&config.Timeout, "timeout", 0, "fail a test after this `duration` (0: no limit)")
+	fs.StringVar(&junit, "junit", "", "also write results as JUnit XML to `file`")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cpu1-simulator test [options] prog.asm\nOptions:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "Exit codes: 0 all passed, 1 error, 5 test failures\n")
+	}
+
+	files, ok := parseArgs(fs, args)
+	if !ok {
+		return runner.ExitError
+	}
+	if len(files) != 1 {
+		fs.Usage()
+		return runner.ExitError
+	}
+
+	p, err := runner.LoadProgram(files[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return runner.ExitError
+	}
+	if len(p.Tests) == 0 {
+		fmt.Fprintf(os.Stderr, "No tests found in '%s'.\n", files[0])
+		return runner.ExitError
+	}
+
+	results := runner.RunTests(p, config)
+	failed := runner.WriteTestReport(os.Stdout, results)
+
+	if junit != "" {
+		f, err := os.Create(junit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return runner.ExitError
+		}
+		defer f.Close()
+		name := strings.TrimSuffix(filepath.Base(files[0]), filepath.Ext(files[0]))
+		if err := runner.WriteJUnit(f, name, results); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return runner.ExitError
+		}
+	}
+
+	if failed > 0 {
+		return runner.ExitTestFailed
+	}
+	return 0
+}
+
+// linkMain implements the "link" subcommand, which links relocatable object
+// files into a program. It returns the process exit code.
+func linkMain(args []string) int {
+	var output, layout string
+
+	fs := flag.NewFlagSet("link", flag.ContinueOnError)
+	fs.StringVar(&output, "o", "a.bin", "output `file` (.bin or .cx1)")
+	fs.StringVar(&layout, "T", "", "memory layout `file`")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: cpu1-simulator link [options] a.obj b.obj ...\nOptions:\n")
+		fs.PrintDefaults()
+	}
+
+	files, ok := parseArgs(fs, args)
+	if !ok {
+		return runner.ExitError
+	}
+	if len(files) == 0 {
+		fs.Usage()
+		return runner.ExitError
+	}
+
+	if err := link.LinkFiles(output, files, layout, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to link (%v).\n", err)
+		return runner.ExitError
+	}
+	return 0
+}
+
+// parseArgs parses a subcommand's options, allowing them to appear before
+// or after file names. It returns the file names.
+func parseArgs(fs *flag.FlagSet, args []string) (files []string, ok bool) {
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, false
+		}
+		if fs.NArg() == 0 {
+			return files, true
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
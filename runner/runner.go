@@ -0,0 +1,360 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+// Package runner executes CPU1 programs without the interactive host or the
+// dashboard. It is used by the "run" subcommand to grade programs in batch.
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"riddick.net/cpu1-simulator/asm"
+	"riddick.net/cpu1-simulator/cpu"
+	"riddick.net/cpu1-simulator/disasm"
+)
+
+// Exit status codes, one per way a run can end.
+const (
+	ExitHalt      = 0 // program executed HALT
+	ExitError     = 1 // assembly, load or usage error
+	ExitMaxCycles = 2 // cycle limit reached
+	ExitTimeout   = 3 // time limit reached
+	ExitFault     = 4 // undefined opcode executed
+)
+
+var statusNames = map[int]string{
+	ExitHalt:      "halt",
+	ExitError:     "error",
+	ExitMaxCycles: "max-cycles",
+	ExitTimeout:   "timeout",
+	ExitFault:     "fault",
+}
+
+// defaultOrigin is used for binaries that have no source map.
+const defaultOrigin = 0x1000
+
+// A MemRange selects bytes of memory to include in the result.
+type MemRange struct {
+	Address uint16
+	Length  int
+}
+
+// ParseMemRange parses a memory range of the form "addr:len". Both values
+// may be decimal or hexadecimal with a '$' or "0x" prefix.
+func ParseMemRange(s string) (MemRange, error) {
+	a, l, ok := strings.Cut(s, ":")
+	if !ok {
+		return MemRange{}, fmt.Errorf("memory range '%s' must be addr:len", s)
+	}
+	addr, err := parseNumber(a)
+	if err != nil || addr > 0xffff {
+		return MemRange{}, fmt.Errorf("invalid memory address '%s'", a)
+	}
+	length, err := parseNumber(l)
+	if err != nil || length < 1 || addr+length > 0x10000 {
+		return MemRange{}, fmt.Errorf("invalid memory length '%s'", l)
+	}
+	return MemRange{uint16(addr), length}, nil
+}
+
+// Config controls how a program is run.
+type Config struct {
+	Entry     string        // entry address or label; empty uses the program entry
+	MaxCycles uint64        // stop after this many cycles; 0 for no limit
+	Timeout   time.Duration // stop after this much time; 0 for no limit
+	Memory    []MemRange    // memory ranges to report
+}
+
+// Flags holds the processor status flags.
+type Flags struct {
+	N bool `json:"n"`
+	Z bool `json:"z"`
+	C bool `json:"c"`
+	I bool `json:"i"`
+	D bool `json:"d"`
+	V bool `json:"v"`
+}
+
+// MemDump holds the contents of one reported memory range.
+type MemDump struct {
+	Address uint16 `json:"address"`
+	Bytes   string `json:"bytes"` // hexadecimal, two digits per byte
+}
+
+// Result describes the final state of a run.
+type Result struct {
+	Status string    `json:"status"`
+	Code   int       `json:"code"`
+	Error  string    `json:"error,omitempty"`
+	R      [8]byte   `json:"r"`
+	SP     byte      `json:"sp"`
+	PC     uint16    `json:"pc"`
+	Flags  Flags     `json:"flags"`
+	Q      byte      `json:"q"`
+	EF     byte      `json:"ef"`
+	Cycles uint64    `json:"cycles"`
+	UART   string    `json:"uart,omitempty"`
+	Memory []MemDump `json:"memory,omitempty"`
+
+	reg cpu.Registers
+}
+
+// A Program is machine code ready to be loaded into memory.
+type Program struct {
+	Blocks    []asm.Block // machine code, each block loaded at its own address
+	Entry     uint16      // default entry point
+	Exports   []asm.Export
+	Tests     []asm.TestCase // unit tests, when assembled from source
+	SourceMap *asm.SourceMap // nil for binaries without a map file
+}
+
+// LoadProgram reads a program from a file. Files with a .bin extension are
+// loaded as machine code, along with a matching .map file if present, .cx1
+// files as CPU1 executables, and Intel HEX and S-record files as memory
+// images. Other files are assembled in memory, without writing any output
+// files, searching the directories in the ASMPATH environment variable for
+// included files.
+func LoadProgram(filename string) (*Program, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	file := bytes.NewReader(content)
+
+	ext := filepath.Ext(filename)
+	if strings.EqualFold(ext, ".cx1") {
+		exe := &asm.Executable{}
+		if _, err := exe.ReadFrom(file); err != nil {
+			return nil, err
+		}
+		return &Program{Blocks: exe.Segments, Entry: exe.Entry, Exports: exe.Symbols}, nil
+	}
+	if format := asm.DetectFormat(filename, content); format != asm.FormatRaw {
+		return loadImage(filename, file, format)
+	}
+	if !strings.EqualFold(ext, ".bin") {
+		assembly, sourceMap, err := asm.Assemble(file, filename, defaultOrigin, io.Discard, 0, asm.SplitIncludePath(os.Getenv("ASMPATH"))...)
+		if err != nil {
+			if len(assembly.Errors) > 0 {
+				return nil, fmt.Errorf("%s", strings.Join(assembly.Errors, "\n"))
+			}
+			return nil, err
+		}
+		return &Program{assembly.Image().Blocks, assembly.Entry, sourceMap.Exports, assembly.Tests, sourceMap}, nil
+	}
+
+	a := &asm.Assembly{}
+	if _, err := a.ReadFrom(file); err != nil {
+		return nil, err
+	}
+	p := &Program{Blocks: []asm.Block{{Address: defaultOrigin, Data: a.Code}}, Entry: defaultOrigin}
+
+	mapFile, err := os.Open(filename[:len(filename)-len(ext)] + ".map")
+	if err == nil {
+		defer mapFile.Close()
+		sourceMap := asm.NewSourceMap()
+		if _, err := sourceMap.ReadFrom(mapFile); err != nil {
+			return nil, err
+		}
+		p.Blocks[0].Address, p.Exports, p.SourceMap = sourceMap.Origin, sourceMap.Exports, sourceMap
+		p.Entry = sourceMap.Origin
+	}
+	return p, nil
+}
+
+// loadImage reads an Intel HEX or S-record file. The program runs from the
+// file's entry point, or else from the start of its first record.
+func loadImage(filename string, r io.Reader, format string) (*Program, error) {
+	img, err := asm.ReadImage(r, format)
+	if err != nil {
+		if errs, ok := err.(asm.RecordErrors); ok {
+			msgs := make([]string, len(errs))
+			for i, e := range errs {
+				msgs[i] = fmt.Sprintf("%s: %v", filepath.Base(filename), e)
+			}
+			return nil, fmt.Errorf("%s", strings.Join(msgs, "\n"))
+		}
+		return nil, err
+	}
+	if len(img.Blocks) == 0 {
+		return nil, fmt.Errorf("file '%s' contains no data", filepath.Base(filename))
+	}
+
+	p := &Program{Blocks: img.Blocks, Entry: img.Blocks[0].Address}
+	if img.Entry >= 0 {
+		p.Entry = uint16(img.Entry)
+	}
+	return p, nil
+}
+
+// newCPU creates a CPU with the program loaded and the standard devices
+// mapped. UART output is collected in 'uart'. Only the program's blocks are
+// stored, so the gaps between them, and the devices mapped there, are left
+// alone.
+func (p *Program) newCPU(uart *bytes.Buffer) *cpu.CPU {
+	mem := cpu.NewMappedMemory(cpu.NewFlatMemory())
+	mem.Map(cpu.KeyboardStatus, 2, cpu.NewKeyboard())
+	mem.Map(cpu.UARTData, 2, cpu.NewUART(uart))
+	c := cpu.NewCPU(cpu.NMOS, mem)
+	for _, b := range p.Blocks {
+		mem.StoreBytes(b.Address, b.Data)
+	}
+	return c
+}
+
+// Run loads a program into a fresh CPU and executes it until it halts,
+// faults or reaches a limit.
+func Run(p *Program, config Config) *Result {
+	var uart bytes.Buffer
+	c := p.newCPU(&uart)
+
+	entry := p.Entry
+	if config.Entry != "" {
+		addr, err := p.resolve(config.Entry)
+		if err != nil {
+			return Error(err)
+		}
+		entry = addr
+	}
+	c.SetPC(entry)
+
+	code, msg := execute(c, config)
+
+	r := &Result{
+		Status: statusNames[code],
+		Code:   code,
+		Error:  msg,
+		R:      c.Reg.R,
+		SP:     c.Reg.SP,
+		PC:     c.Reg.PC,
+		Q:      c.Reg.Q,
+		EF:     c.EF,
+		Cycles: c.Cycles,
+		UART:   uart.String(),
+		Flags: Flags{
+			N: c.Reg.Sign,
+			Z: c.Reg.Zero,
+			C: c.Reg.Carry,
+			I: c.Reg.InterruptDisable,
+			D: c.Reg.Decimal,
+			V: c.Reg.Overflow,
+		},
+		reg: c.Reg,
+	}
+	for _, m := range config.Memory {
+		b := make([]byte, m.Length)
+		c.Mem.LoadBytes(m.Address, b)
+		r.Memory = append(r.Memory, MemDump{m.Address, fmt.Sprintf("%X", b)})
+	}
+	return r
+}
+
+func execute(c *cpu.CPU, config Config) (code int, msg string) {
+	return executeUntil(c, config, -1)
+}
+
+// executeUntil runs the CPU until it halts, faults, reaches a limit or
+// arrives at address 'stop'. Pass -1 to run without a stop address.
+func executeUntil(c *cpu.CPU, config Config, stop int) (code int, msg string) {
+	var deadline time.Time
+	if config.Timeout > 0 {
+		deadline = time.Now().Add(config.Timeout)
+	}
+
+	for step := 0; ; step++ {
+		if c.Halted || int(c.Reg.PC) == stop {
+			return ExitHalt, ""
+		}
+		if config.MaxCycles > 0 && c.Cycles >= config.MaxCycles {
+			return ExitMaxCycles, fmt.Sprintf("cycle limit of %d reached", config.MaxCycles)
+		}
+
+		// Only check the clock once every 1024 steps, since it is
+		// comparatively slow.
+		if !deadline.IsZero() && (step&1023) == 0 && time.Now().After(deadline) {
+			return ExitTimeout, fmt.Sprintf("time limit of %v reached", config.Timeout)
+		}
+
+		inst := c.GetInstruction(c.Reg.PC)
+		if inst.Name == "???" {
+			return ExitFault, fmt.Sprintf("undefined opcode $%02X at $%04X", inst.Opcode, c.Reg.PC)
+		}
+		c.Step()
+	}
+}
+
+// resolve converts a label or a numeric address to an address. Labels that
+// aren't exported can only be found in the program's source map.
+func (p *Program) resolve(s string) (uint16, error) {
+	if p.SourceMap != nil {
+		if addr, ok := p.SourceMap.LookupName(s); ok {
+			return addr, nil
+		}
+	}
+	for _, e := range p.Exports {
+		if strings.EqualFold(e.Label, s) {
+			return e.Address, nil
+		}
+	}
+	v, err := parseNumber(s)
+	if err != nil || v > 0xffff {
+		return 0, fmt.Errorf("entry '%s' is not a label or address", s)
+	}
+	return uint16(v), nil
+}
+
+func parseNumber(s string) (int, error) {
+	base := 10
+	switch {
+	case strings.HasPrefix(s, "$"):
+		s, base = s[1:], 16
+	case strings.HasPrefix(s, "0x"):
+		s, base = s[2:], 16
+	}
+	v, err := strconv.ParseUint(s, base, 32)
+	return int(v), err
+}
+
+// Error returns a Result describing a failure that prevented the program
+// from running.
+func Error(err error) *Result {
+	return &Result{Status: statusNames[ExitError], Code: ExitError, Error: err.Error()}
+}
+
+// WriteJSON writes the result as a JSON object.
+func (r *Result) WriteJSON(w io.Writer) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// WriteText writes the result in the same format the host uses to display
+// registers and memory.
+func (r *Result) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "Status: %s (%d)\n", r.Status, r.Code)
+	if r.Error != "" {
+		fmt.Fprintf(w, "%s\n", r.Error)
+	}
+	if r.Code == ExitError {
+		return nil
+	}
+	fmt.Fprintf(w, "%s C=%d\n", disasm.GetRegisterString(&r.reg), r.Cycles)
+	fmt.Fprintf(w, "Q=%08b EF=%08b\n", r.Q, r.EF)
+	if r.UART != "" {
+		fmt.Fprintf(w, "UART: %q\n", r.UART)
+	}
+	for _, m := range r.Memory {
+		fmt.Fprintf(w, "$%04X: %s\n", m.Address, m.Bytes)
+	}
+	return nil
+}
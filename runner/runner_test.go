@@ -0,0 +1,370 @@
+package runner_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"riddick.net/cpu1-simulator/asm"
+	"riddick.net/cpu1-simulator/runner"
+)
+
+// Write a source file to a temporary directory and load it as a program.
+func loadSource(t *testing.T, name, src string) *runner.Program {
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	p, err := runner.LoadProgram(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestBlocks(t *testing.T) {
+	// The gap between the blocks covers the UART, which must not receive
+	// the bytes of a zero-filled image.
+	src := "\t.org $0200\n" +
+		"START\tLDI R0, #$41\n" +
+		"\tSTI R0, $FF04\n" +
+		"\tHALT\n" +
+		"\t.org $FFFC\n" +
+		"\t.dw START\n"
+	p := loadSource(t, "gap.asm", src)
+	if len(p.Blocks) != 2 {
+		t.Fatalf("got %d blocks, expected 2", len(p.Blocks))
+	}
+
+	r := runner.Run(p, runner.Config{})
+	if r.Code != runner.ExitHalt {
+		t.Fatalf("status %s: %s", r.Status, r.Error)
+	}
+	if r.UART != "A" {
+		t.Errorf("UART output %q, expected %q", r.UART, "A")
+	}
+}
+
+func TestEntryLabel(t *testing.T) {
+	// START isn't exported, so it is found through the source map.
+	src := "\t.org $1000\n" +
+		"\tLDI R1, #$01\n" +
+		"\tHALT\n" +
+		"START\tLDI R1, #$02\n" +
+		"\tHALT\n"
+	p := loadSource(t, "entry.asm", src)
+
+	r := runner.Run(p, runner.Config{Entry: "START"})
+	if r.Code != runner.ExitHalt {
+		t.Fatalf("status %s: %s", r.Status, r.Error)
+	}
+	if r.R[1] != 2 {
+		t.Errorf("R1=$%02X, expected $02", r.R[1])
+	}
+
+	r = runner.Run(p, runner.Config{Entry: "$1000"})
+	if r.R[1] != 1 {
+		t.Errorf("R1=$%02X, expected $01", r.R[1])
+	}
+
+	r = runner.Run(p, runner.Config{Entry: "MISSING"})
+	if r.Code != runner.ExitError {
+		t.Errorf("unknown entry gave status %s", r.Status)
+	}
+}
+
+func TestTestHalts(t *testing.T) {
+	src := "\t.org $1000\n" +
+		"\t.test \"halts\", ADD1, R1=7\n" +
+		"\t.expect R1=8\n" +
+		"ADD1\tADI R1, #$01\n" +
+		"\tHALT\n"
+	p := loadSource(t, "halts.asm", src)
+
+	results := runner.RunTests(p, runner.Config{})
+	if len(results) != 1 {
+		t.Fatalf("got %d results, expected 1", len(results))
+	}
+	r := results[0]
+	if r.Passed {
+		t.Fatal("routine that halted passed")
+	}
+	if len(r.Failures) != 1 || !strings.Contains(r.Failures[0], "halted instead of returning") {
+		t.Errorf("unexpected failures %q", r.Failures)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		config runner.Config
+		code   int
+		status string
+	}{
+		{"halt", "\tHALT\n", runner.Config{}, runner.ExitHalt, "halt"},
+		{"error", "\tHALT\n", runner.Config{Entry: "MISSING"}, runner.ExitError, "error"},
+		{"max-cycles", "LOOP\tLBR LOOP\n", runner.Config{MaxCycles: 100}, runner.ExitMaxCycles, "max-cycles"},
+		{"timeout", "LOOP\tLBR LOOP\n", runner.Config{Timeout: time.Millisecond}, runner.ExitTimeout, "timeout"},
+		{"fault", "\tNOP\n\t.db $06\n", runner.Config{}, runner.ExitFault, "fault"},
+	}
+	for _, tt := range tests {
+		p := loadSource(t, tt.name+".asm", "\t.org $1000\n"+tt.src)
+		r := runner.Run(p, tt.config)
+		if r.Code != tt.code || r.Status != tt.status {
+			t.Errorf("%s: got %s (%d), expected %s (%d)", tt.name, r.Status, r.Code, tt.status, tt.code)
+		}
+		if (r.Error == "") != (tt.code == runner.ExitHalt) {
+			t.Errorf("%s: unexpected error %q", tt.name, r.Error)
+		}
+	}
+
+	filename := filepath.Join(t.TempDir(), "bad.asm")
+	if err := os.WriteFile(filename, []byte("\tBOGUS R0\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.LoadProgram(filename); err == nil {
+		t.Error("program with an unknown opcode loaded")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	src := "\t.org $1000\n" +
+		"\tLDI R0, #$41\n" +
+		"\tSTI R0, $FF04\n" +
+		"\tSTI R0, $2000\n" +
+		"\tHALT\n"
+	p := loadSource(t, "json.asm", src)
+	mem, err := runner.ParseMemRange("$2000:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := runner.Run(p, runner.Config{Memory: []runner.MemRange{mem}})
+
+	var buf bytes.Buffer
+	if err := r.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for k := range fields {
+		got = append(got, k)
+	}
+	sort.Strings(got)
+	expect := []string{"code", "cycles", "ef", "flags", "memory", "pc", "q", "r", "sp", "status", "uart"}
+	if strings.Join(got, " ") != strings.Join(expect, " ") {
+		t.Errorf("fields %v, expected %v", got, expect)
+	}
+
+	var flags map[string]bool
+	if err := json.Unmarshal(fields["flags"], &flags); err != nil || len(flags) != 6 {
+		t.Errorf("flags %s", fields["flags"])
+	}
+	if string(fields["uart"]) != `"A"` {
+		t.Errorf("uart %s, expected \"A\"", fields["uart"])
+	}
+	if string(fields["pc"]) != "4104" {
+		t.Errorf("pc %s, expected 4104", fields["pc"])
+	}
+
+	// Errors carry a message and omit the empty output fields.
+	buf.Reset()
+	if err := runner.Error(os.ErrNotExist).WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	fields = nil
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["error"]; !ok {
+		t.Error("error result has no error field")
+	}
+	if _, ok := fields["uart"]; ok {
+		t.Error("error result has a uart field")
+	}
+}
+
+func TestMemRanges(t *testing.T) {
+	tests := []struct {
+		s      string
+		expect runner.MemRange
+		ok     bool
+	}{
+		{"$2000:4", runner.MemRange{Address: 0x2000, Length: 4}, true},
+		{"0x10:16", runner.MemRange{Address: 0x10, Length: 16}, true},
+		{"4096:$10", runner.MemRange{Address: 0x1000, Length: 16}, true},
+		{"$FFFF:1", runner.MemRange{Address: 0xffff, Length: 1}, true},
+		{"$FFFF:2", runner.MemRange{}, false},
+		{"$2000:0", runner.MemRange{}, false},
+		{"$10000:1", runner.MemRange{}, false},
+		{"$2000", runner.MemRange{}, false},
+		{"ZZ:1", runner.MemRange{}, false},
+	}
+	for _, tt := range tests {
+		m, err := runner.ParseMemRange(tt.s)
+		if (err == nil) != tt.ok || m != tt.expect {
+			t.Errorf("%s: got %+v, %v", tt.s, m, err)
+		}
+	}
+
+	src := "\t.org $1000\n" +
+		"\tLDI R0, #$AB\n" +
+		"\tSTI R0, $2001\n" +
+		"\tHALT\n"
+	p := loadSource(t, "mem.asm", src)
+	r := runner.Run(p, runner.Config{Memory: []runner.MemRange{{Address: 0x2000, Length: 3}, {Address: 0x1000, Length: 2}}})
+	expect := []runner.MemDump{{Address: 0x2000, Bytes: "00AB00"}, {Address: 0x1000, Bytes: "E0AB"}}
+	if len(r.Memory) != len(expect) || r.Memory[0] != expect[0] || r.Memory[1] != expect[1] {
+		t.Errorf("memory %+v, expected %+v", r.Memory, expect)
+	}
+}
+
+// A program with one passing, one failing and one endless test.
+const testProgram = "\t.org $1000\n" +
+	"\t.test \"passes\", ADD1, R1=7\n" +
+	"\t.expect R1=8\n" +
+	"\t.test \"fails\", ADD1, R1=1\n" +
+	"\t.expect R1=3\n" +
+	"\t.test \"loops\", LOOP\n" +
+	"\t.expect R1=0\n" +
+	"ADD1\tADI R1, #$01\n" +
+	"\tRET\n" +
+	"LOOP\tLBR LOOP\n"
+
+func TestRunTests(t *testing.T) {
+	p := loadSource(t, "tests.asm", testProgram)
+	results := runner.RunTests(p, runner.Config{MaxCycles: 1000})
+	if len(results) != 3 {
+		t.Fatalf("got %d results, expected 3", len(results))
+	}
+
+	if r := results[0]; r.Name != "passes" || !r.Passed || len(r.Failures) != 0 {
+		t.Errorf("passing test: %+v", r)
+	}
+	if r := results[1]; r.Passed || len(r.Failures) != 1 || !strings.Contains(r.Failures[0], "R1: expected $03, got $02") {
+		t.Errorf("failing test: %+v", r)
+	}
+	if r := results[2]; r.Passed || len(r.Failures) != 1 || !strings.Contains(r.Failures[0], "cycle limit of 1000 reached") {
+		t.Errorf("endless test: %+v", r)
+	}
+
+	if results[0].Line != 2 || results[1].Line != 4 {
+		t.Errorf("test lines %d and %d, expected 2 and 4", results[0].Line, results[1].Line)
+	}
+
+	var buf bytes.Buffer
+	if failed := runner.WriteTestReport(&buf, results); failed != 2 {
+		t.Errorf("report counted %d failures, expected 2", failed)
+	}
+	if !strings.Contains(buf.String(), "3 test(s), 1 passed, 2 failed.") {
+		t.Errorf("report summary missing:\n%s", buf.String())
+	}
+}
+
+func TestJUnit(t *testing.T) {
+	p := loadSource(t, "tests.asm", testProgram)
+	results := runner.RunTests(p, runner.Config{MaxCycles: 1000})
+
+	var buf bytes.Buffer
+	if err := runner.WriteJUnit(&buf, "tests", results); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), xml.Header) {
+		t.Error("report has no XML header")
+	}
+
+	var doc struct {
+		XMLName xml.Name `xml:"testsuites"`
+		Suites  []struct {
+			Name     string `xml:"name,attr"`
+			Tests    int    `xml:"tests,attr"`
+			Failures int    `xml:"failures,attr"`
+			Time     string `xml:"time,attr"`
+			Cases    []struct {
+				Name      string `xml:"name,attr"`
+				ClassName string `xml:"classname,attr"`
+				File      string `xml:"file,attr"`
+				Line      int    `xml:"line,attr"`
+				Failure   *struct {
+					Message string `xml:"message,attr"`
+					Text    string `xml:",chardata"`
+				} `xml:"failure"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Suites) != 1 {
+		t.Fatalf("got %d suites, expected 1", len(doc.Suites))
+	}
+	s := doc.Suites[0]
+	if s.Name != "tests" || s.Tests != 3 || s.Failures != 2 || s.Time == "" {
+		t.Errorf("suite name=%q tests=%d failures=%d time=%q", s.Name, s.Tests, s.Failures, s.Time)
+	}
+	if len(s.Cases) != 3 {
+		t.Fatalf("got %d cases, expected 3", len(s.Cases))
+	}
+	for i, name := range []string{"passes", "fails", "loops"} {
+		c := s.Cases[i]
+		if c.Name != name || c.ClassName != "tests" || filepath.Base(c.File) != "tests.asm" || c.Line != 2*i+2 {
+			t.Errorf("case %d: %+v", i, c)
+		}
+		if (c.Failure == nil) != (i == 0) {
+			t.Errorf("case %s: unexpected failure %+v", name, c.Failure)
+		}
+	}
+	if f := s.Cases[1].Failure; f != nil && (f.Message != results[1].Failures[0] || !strings.Contains(f.Text, f.Message)) {
+		t.Errorf("failure message %q, text %q", f.Message, f.Text)
+	}
+}
+
+func TestImages(t *testing.T) {
+	// The same program as TestBlocks, with its reset vector as a second
+	// record and an entry point given by the file.
+	img := &asm.Image{
+		Blocks: []asm.Block{
+			{Address: 0x0200, Data: []byte{0xe0, 0x41, 0xe8, 0x04, 0xff, 0x01}},
+			{Address: 0xfffc, Data: []byte{0x00, 0x02}},
+		},
+		Entry: 0x0200,
+	}
+	var hex, srec bytes.Buffer
+	if err := asm.WriteIntelHex(&hex, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := asm.WriteSRecord(&srec, img, "gap"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string]string{"gap.hex": hex.String(), "gap.s19": srec.String()} {
+		p := loadSource(t, name, content)
+		if len(p.Blocks) != 2 || p.Entry != 0x0200 {
+			t.Errorf("%s: got %d blocks with entry $%04X", name, len(p.Blocks), p.Entry)
+			continue
+		}
+		r := runner.Run(p, runner.Config{})
+		if r.Code != runner.ExitHalt || r.UART != "A" {
+			t.Errorf("%s: status %s, UART output %q", name, r.Status, r.UART)
+		}
+	}
+
+	// A bad checksum is reported by line rather than assembled as source.
+	filename := filepath.Join(t.TempDir(), "bad.hex")
+	if err := os.WriteFile(filename, []byte(":0100000000FE\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err := runner.LoadProgram(filename)
+	if err == nil || !strings.HasPrefix(err.Error(), "bad.hex: line 1: ") {
+		t.Errorf("got error %v, expected a record error", err)
+	}
+}
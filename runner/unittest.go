@@ -0,0 +1,280 @@
+// Copyright 2024 Christopher J. Riddick, covered by BSD 3-clause license included in this repo
+
+package runner
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"riddick.net/cpu1-simulator/asm"
+	"riddick.net/cpu1-simulator/cpu"
+)
+
+// ExitTestFailed is the exit code reported when one or more unit tests
+// fail.
+const ExitTestFailed = 5
+
+// sentinelReturn is the return address pushed before a test calls its
+// routine. Arriving there means the routine returned.
+const sentinelReturn = 0xffff
+
+// defaultTestCycles limits each test when no cycle limit is configured, so
+// a routine that never returns fails instead of hanging the run.
+const defaultTestCycles = 1000000
+
+// A TestResult records the outcome of one unit test.
+type TestResult struct {
+	Name     string
+	File     string
+	Line     int
+	Passed   bool
+	Failures []string // one message per failed expectation
+	Cycles   uint64   // cycles used by the routine under test
+	Duration time.Duration
+}
+
+// RunTests runs each of the program's unit tests in a fresh CPU.
+func RunTests(p *Program, config Config) []TestResult {
+	if config.MaxCycles == 0 {
+		config.MaxCycles = defaultTestCycles
+	}
+	results := make([]TestResult, 0, len(p.Tests))
+	for _, t := range p.Tests {
+		results = append(results, p.runTest(t, config))
+	}
+	return results
+}
+
+func (p *Program) runTest(t asm.TestCase, config Config) TestResult {
+	start := time.Now()
+	r := TestResult{Name: t.Name, File: t.File, Line: t.Line}
+
+	var uart bytes.Buffer
+	c := p.newCPU(&uart)
+	for _, term := range t.Setup {
+		setTerm(c, term)
+	}
+
+	// Call the routine with a return address the runner can recognize.
+	push := func(v byte) {
+		c.Mem.StoreByte(0x100|uint16(c.Reg.SP), v)
+		c.Reg.SP--
+	}
+	push(byte(sentinelReturn >> 8))
+	push(byte(sentinelReturn & 0xff))
+	c.SetPC(t.Target)
+
+	code, msg := executeUntil(c, config, sentinelReturn)
+	r.Cycles = c.Cycles
+	r.Duration = time.Since(start)
+
+	if code == ExitHalt && c.Reg.PC != sentinelReturn {
+		msg = "routine halted instead of returning"
+	}
+	if msg != "" {
+		r.Failures = append(r.Failures, fmt.Sprintf("%s%s", p.location(c.Reg.PC), msg))
+		return r
+	}
+
+	for _, term := range t.Expect {
+		if err := checkTerm(c, term, uart.String()); err != "" {
+			r.Failures = append(r.Failures, fmt.Sprintf("%s:%d: %s", filepath.Base(term.File), term.Line, err))
+		}
+	}
+	r.Passed = len(r.Failures) == 0
+	return r
+}
+
+// location returns the source location of an address, formatted as a
+// message prefix, or an empty string if it is unknown.
+func (p *Program) location(addr uint16) string {
+	if p.SourceMap == nil {
+		return ""
+	}
+	file, line, err := p.SourceMap.Find(int(addr))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d: ", filepath.Base(file), line)
+}
+
+func flagOf(c *cpu.CPU, name string) *bool {
+	switch name {
+	case "N":
+		return &c.Reg.Sign
+	case "Z":
+		return &c.Reg.Zero
+	case "C":
+		return &c.Reg.Carry
+	case "I":
+		return &c.Reg.InterruptDisable
+	case "D":
+		return &c.Reg.Decimal
+	case "V":
+		return &c.Reg.Overflow
+	}
+	return nil
+}
+
+func byteOf(c *cpu.CPU, name string) *byte {
+	switch name {
+	case "SP":
+		return &c.Reg.SP
+	case "Q":
+		return &c.Reg.Q
+	case "EF":
+		return &c.EF
+	}
+	if len(name) == 2 && name[0] == 'R' && name[1] >= '0' && name[1] <= '7' {
+		return &c.Reg.R[name[1]-'0']
+	}
+	return nil
+}
+
+// setTerm applies a .test setup term to the CPU.
+func setTerm(c *cpu.CPU, t asm.TestTerm) {
+	switch {
+	case t.Name == "MEM" && t.Bytes != nil:
+		c.Mem.StoreBytes(t.Address, t.Bytes)
+	case t.Name == "MEM":
+		c.Mem.StoreByte(t.Address, byte(t.Value))
+	case flagOf(c, t.Name) != nil:
+		*flagOf(c, t.Name) = t.Value != 0
+	case byteOf(c, t.Name) != nil:
+		*byteOf(c, t.Name) = byte(t.Value)
+	}
+}
+
+// checkTerm tests an .expect term against the CPU state. It returns a
+// description of the mismatch, or an empty string if the term holds.
+func checkTerm(c *cpu.CPU, t asm.TestTerm, uart string) string {
+	switch {
+	case t.Name == "MEM" && t.Bytes != nil:
+		got := make([]byte, len(t.Bytes))
+		c.Mem.LoadBytes(t.Address, got)
+		if !bytes.Equal(got, t.Bytes) {
+			return fmt.Sprintf("[$%04X]: expected %q, got %q", t.Address, t.Bytes, got)
+		}
+	case t.Name == "MEM":
+		if got := c.Mem.LoadByte(t.Address); got != byte(t.Value) {
+			return fmt.Sprintf("[$%04X]: expected $%02X, got $%02X", t.Address, byte(t.Value), got)
+		}
+	case t.Name == "PC":
+		if c.Reg.PC != uint16(t.Value) {
+			return fmt.Sprintf("PC: expected $%04X, got $%04X", uint16(t.Value), c.Reg.PC)
+		}
+	case t.Name == "CYCLES" && t.Op == "<=":
+		if c.Cycles > uint64(t.Value) {
+			return fmt.Sprintf("CYCLES: expected at most %d, got %d", t.Value, c.Cycles)
+		}
+	case t.Name == "CYCLES":
+		if c.Cycles != uint64(t.Value) {
+			return fmt.Sprintf("CYCLES: expected %d, got %d", t.Value, c.Cycles)
+		}
+	case t.Name == "UART":
+		if uart != string(t.Bytes) {
+			return fmt.Sprintf("UART: expected %q, got %q", t.Bytes, uart)
+		}
+	case flagOf(c, t.Name) != nil:
+		want, got := t.Value != 0, *flagOf(c, t.Name)
+		if got != want {
+			return fmt.Sprintf("%s: expected %d, got %d", t.Name, boolToInt(want), boolToInt(got))
+		}
+	case byteOf(c, t.Name) != nil:
+		if got := *byteOf(c, t.Name); got != byte(t.Value) {
+			return fmt.Sprintf("%s: expected $%02X, got $%02X", t.Name, byte(t.Value), got)
+		}
+	}
+	return ""
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteTestReport writes a human-readable summary of test results. It
+// returns the number of failed tests.
+func WriteTestReport(w io.Writer, results []TestResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.Passed {
+			fmt.Fprintf(w, "PASS  %s (%d cycles)\n", r.Name, r.Cycles)
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "FAIL  %s (%s:%d)\n", r.Name, filepath.Base(r.File), r.Line)
+		for _, f := range r.Failures {
+			fmt.Fprintf(w, "      %s\n", f)
+		}
+	}
+	fmt.Fprintf(w, "%d test(s), %d passed, %d failed.\n", len(results), len(results)-failed, failed)
+	return failed
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr"`
+	Line      int           `xml:"line,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes test results as JUnit XML, using 'suite' as the test
+// suite name.
+func WriteJUnit(w io.Writer, suite string, results []TestResult) error {
+	s := junitSuite{Name: suite, Tests: len(results)}
+	var total time.Duration
+	for _, r := range results {
+		total += r.Duration
+		tc := junitCase{
+			Name:      r.Name,
+			ClassName: suite,
+			File:      r.File,
+			Line:      r.Line,
+			Time:      fmt.Sprintf("%.3f", r.Duration.Seconds()),
+		}
+		if !r.Passed {
+			s.Failures++
+			var text bytes.Buffer
+			for _, f := range r.Failures {
+				fmt.Fprintln(&text, f)
+			}
+			tc.Failure = &junitFailure{Message: r.Failures[0], Text: text.String()}
+		}
+		s.Cases = append(s.Cases, tc)
+	}
+	s.Time = fmt.Sprintf("%.3f", total.Seconds())
+
+	b, err := xml.MarshalIndent(junitSuites{Suites: []junitSuite{s}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", xml.Header, b)
+	return err
+}